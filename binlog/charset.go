@@ -0,0 +1,90 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"github.com/pingcap/parser/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
+)
+
+// charsetEncodings MySQL charsets which can convert into UTF-8
+var charsetEncodings = map[string]encoding.Encoding{
+	"latin1":   charmap.Windows1252, // MySQL latin1 is cp1252
+	"latin2":   charmap.ISO8859_2,
+	"latin5":   charmap.ISO8859_9,
+	"latin7":   charmap.ISO8859_13,
+	"greek":    charmap.ISO8859_7,
+	"hebrew":   charmap.ISO8859_8,
+	"cp1250":   charmap.Windows1250,
+	"cp1251":   charmap.Windows1251,
+	"cp1256":   charmap.Windows1256,
+	"cp1257":   charmap.Windows1257,
+	"cp850":    charmap.CodePage850,
+	"cp852":    charmap.CodePage852,
+	"cp866":    charmap.CodePage866,
+	"koi8r":    charmap.KOI8R,
+	"koi8u":    charmap.KOI8U,
+	"macroman": charmap.Macintosh,
+	"gb2312":   simplifiedchinese.GBK, // GBK is superset of GB2312
+	"gbk":      simplifiedchinese.GBK,
+	"gb18030":  simplifiedchinese.GB18030,
+	"big5":     traditionalchinese.Big5,
+	"sjis":     japanese.ShiftJIS,
+	"cp932":    japanese.ShiftJIS,
+	"ujis":     japanese.EUCJP,
+	"eucjpms":  japanese.EUCJP,
+	"euckr":    korean.EUCKR,
+	"ucs2":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16":    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"utf16le":  unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf32":    utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM),
+}
+
+// decodeCharset convert bytes in MySQL charset into UTF-8 string.
+// false if charset can't convert or bytes are not valid in charset, unknown and binary charset are checked as UTF-8.
+func decodeCharset(cs string, b []byte) (string, bool) {
+	enc, ok := charsetEncodings[cs]
+	if !ok {
+		return string(b), utf8.Valid(b)
+	}
+	s, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", false
+	}
+	// invalid bytes decoded as U+FFFD can't encode back
+	r, err := enc.NewEncoder().Bytes(s)
+	if err != nil || !bytes.Equal(r, b) {
+		return "", false
+	}
+	return string(s), true
+}
+
+// CollationCharset charset name of collation id, empty if unknown
+func CollationCharset(id uint64) string {
+	cs, _, err := charset.GetCharsetInfoByID(int(id))
+	if err != nil {
+		return ""
+	}
+	return cs
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+func TestTableCharsets(t *testing.T) {
+	sql := "CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL,\n" +
+		"  `a` varchar(10) CHARACTER SET gbk COLLATE gbk_bin DEFAULT NULL,\n" +
+		"  `b` varchar(10) DEFAULT NULL,\n" +
+		"  `c` varbinary(10) DEFAULT NULL,\n" +
+		"  `d` text CHARACTER SET utf8mb3,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_bin;"
+	stmts, err := ParseCreateTables("test", sql, "utf8mb4")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := NewTable(stmts[0])
+	if table.Charset != "latin1" {
+		t.Errorf("table charset want latin1, got %s", table.Charset)
+	}
+	for i, cs := range []string{"", "gbk", "latin1", "binary", "utf8mb3"} {
+		if got := table.Columns[i].Charset; got != cs {
+			t.Errorf("column %s charset want %s, got %s", table.Columns[i].Name, cs, got)
+		}
+	}
+}
+
+func TestCharsetValues(t *testing.T) {
+	cases := []struct {
+		charset, sqlType string
+		tp               byte
+		raw              interface{}
+		sql, native      string
+	}{
+		// 中文, 誠 second byte is 0x5C
+		{"gbk", "varchar(10)", mysql.MYSQL_TYPE_VARCHAR, "\xd6\xd0\xce\xc4\xd5\x5c", `"中文誠"`, "中文誠"},
+		{"latin1", "varchar(10)", mysql.MYSQL_TYPE_VARCHAR, "caf\xe9", `"café"`, "café"},
+		{"gbk", "varchar(10)", mysql.MYSQL_TYPE_VARCHAR, "\x81", `_gbk X'81'`, "\x81"},
+		{"utf8mb4", "varchar(10)", mysql.MYSQL_TYPE_VARCHAR, `a'\`, `"a\'\\"`, `a'\`},
+		{"binary", "varbinary(10)", mysql.MYSQL_TYPE_VARCHAR, "\xff\x00", `X'ff00'`, "\xff\x00"},
+		{"", "", mysql.MYSQL_TYPE_VARCHAR, "\xff", `X'ff'`, "\xff"},
+		{"gbk", "text", mysql.MYSQL_TYPE_BLOB, []byte("\xd6\xd0"), `"中"`, "中"},
+		{"", "text", mysql.MYSQL_TYPE_BLOB, []byte("abc"), `"abc"`, "abc"},
+	}
+	for _, c := range cases {
+		v := Value{Column: "c", Type: c.tp, SQLType: c.sqlType, Charset: c.charset, Raw: c.raw}
+		if got := v.SQL(false); got != c.sql {
+			t.Errorf("%s %q SQL want %s, got %s", c.charset, c.raw, c.sql, got)
+		}
+		n, _ := v.Native()
+		if got, _ := n.(string); got != c.native {
+			t.Errorf("%s %q Native want %q, got %q", c.charset, c.raw, c.native, n)
+		}
+	}
+
+	// BLOB keep hex, JSON of GBK text in UTF-8
+	blob := Value{Type: mysql.MYSQL_TYPE_BLOB, SQLType: "blob", Charset: "binary", Raw: []byte("abc")}
+	if got := blob.SQL(false); got != "X'616263'" {
+		t.Errorf("blob want X'616263', got %s", got)
+	}
+	buf, _ := json.Marshal(Value{Type: mysql.MYSQL_TYPE_STRING, Charset: "gbk", Raw: "\xd6\xd0"})
+	if string(buf) != `"中"` {
+		t.Errorf("gbk JSON want \"中\", got %s", buf)
+	}
+	if cs := CollationCharset(28); cs != "gbk" {
+		t.Errorf("collation 28 want gbk, got %s", cs)
+	}
+}
@@ -1,4 +1,4 @@
-package event
+package binlog
 
 import (
 	"bufio"
@@ -57,7 +57,7 @@ func parseEncryptHeader(binlog string, keys []KeyRing) (enc EncryptHeader, err e
 	if _, err := io.ReadFull(fd, bufFileHeader); err != nil {
 		return enc, err
 	}
-	if !CheckBinlogFileEncrypt(bufFileHeader) {
+	if !CheckFileEncrypt(bufFileHeader) {
 		return enc, fmt.Errorf("file not encrypted")
 	}
 
@@ -244,8 +244,8 @@ func decryptAESCTR(stream cipher.Stream, src []byte) []byte {
 	return dst
 }
 
-// DecryptBinlog decrypt binlog file with keyring
-func DecryptBinlog(orgBinlog, keyring string) error {
+// Decrypt write decrypted binlog file into w with keyring
+func Decrypt(w io.Writer, orgBinlog, keyring string) error {
 	stream, err := initAESCTRStream(orgBinlog, keyring)
 	if err != nil {
 		return err
@@ -257,7 +257,7 @@ func DecryptBinlog(orgBinlog, keyring string) error {
 	}
 	defer ofd.Close()
 	r := bufio.NewReader(ofd)
-	w := bufio.NewWriter(os.Stdout)
+	bw := bufio.NewWriter(w)
 
 	var offset int64
 	for {
@@ -274,7 +274,7 @@ func DecryptBinlog(orgBinlog, keyring string) error {
 		if offset <= EncryptFileHeaderOffset {
 			continue
 		}
-		w.Write(decryptAESCTR(stream, data[:n]))
+		bw.Write(decryptAESCTR(stream, data[:n]))
 	}
-	return w.Flush()
+	return bw.Flush()
 }
@@ -0,0 +1,16 @@
+package binlog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseKeyRing(t *testing.T) {
+	keys, err := parseKeyRing("../test/keyring")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	for _, key := range keys {
+		fmt.Println(string(key.KeyID), string(key.UserID))
+	}
+}
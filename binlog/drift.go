@@ -0,0 +1,117 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pingcap/parser/types"
+)
+
+// Drift columns of TABLE_MAP_EVENT not match table schema, schema is older or newer than binlog
+type Drift struct {
+	Table         string        `json:"table"`
+	TableID       uint64        `json:"table_id"`
+	BinlogColumns int           `json:"binlog_columns"`
+	SchemaColumns int           `json:"schema_columns"`
+	Columns       []ColumnDrift `json:"columns,omitempty"`
+}
+
+// ColumnDrift column with different type, signedness or name in binlog and schema
+type ColumnDrift struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`                  // column name in schema
+	BinlogName string `json:"binlog_name,omitempty"` // only with binlog_row_metadata=FULL
+	SchemaType string `json:"schema_type"`
+	BinlogType string `json:"binlog_type"`
+}
+
+// CheckTableMap compare columns of TABLE_MAP_EVENT with table schema, nil if table is nil or columns match.
+// Column types are compared by binlog storage type, eg. VARCHAR(10) and VARCHAR(20) are the same,
+// signedness and names are compared only if binlog_row_metadata recorded them.
+func CheckTableMap(table *Table, tm *replication.TableMapEvent) *Drift {
+	if table == nil {
+		return nil
+	}
+	d := &Drift{
+		Table:         table.String(),
+		TableID:       tm.TableID,
+		BinlogColumns: int(tm.ColumnCount),
+		SchemaColumns: len(table.Columns),
+	}
+	names := tm.ColumnNameString()
+	unsigned := tm.UnsignedMap()
+	for i := 0; i < d.BinlogColumns && i < d.SchemaColumns; i++ {
+		col := table.Columns[i]
+		var meta uint16
+		if i < len(tm.ColumnMeta) {
+			meta = tm.ColumnMeta[i]
+		}
+		binlogType := binlogTypeClass(tm.ColumnType[i], meta)
+		drift := col.tp != 0 && schemaTypeClass(col.tp) != binlogType
+		if _, ok := unsigned[i]; ok && unsigned[i] != col.Unsigned {
+			drift = true
+		}
+		c := ColumnDrift{Index: i, Name: col.Name, SchemaType: col.Type, BinlogType: types.TypeToStr(binlogType, "")}
+		if i < len(names) && names[i] != "" {
+			c.BinlogName = names[i]
+			drift = drift || !strings.EqualFold(names[i], col.Name)
+		}
+		if unsigned[i] {
+			c.BinlogType += " unsigned"
+		}
+		if drift {
+			d.Columns = append(d.Columns, c)
+		}
+	}
+	if d.BinlogColumns == d.SchemaColumns && len(d.Columns) == 0 {
+		return nil
+	}
+	return d
+}
+
+// schemaTypeClass binlog storage type of schema column type
+func schemaTypeClass(tp byte) byte {
+	switch tp {
+	case mysql.MYSQL_TYPE_VAR_STRING:
+		return mysql.MYSQL_TYPE_VARCHAR
+	case mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
+		return mysql.MYSQL_TYPE_BLOB
+	case mysql.MYSQL_TYPE_DECIMAL:
+		return mysql.MYSQL_TYPE_NEWDECIMAL
+	}
+	return tp
+}
+
+// binlogTypeClass binlog column type with temporal types of different versions merged,
+// real type of ENUM, SET is kept in metadata of MYSQL_TYPE_STRING
+func binlogTypeClass(tp byte, meta uint16) byte {
+	switch tp {
+	case mysql.MYSQL_TYPE_TIMESTAMP2:
+		return mysql.MYSQL_TYPE_TIMESTAMP
+	case mysql.MYSQL_TYPE_DATETIME2:
+		return mysql.MYSQL_TYPE_DATETIME
+	case mysql.MYSQL_TYPE_TIME2:
+		return mysql.MYSQL_TYPE_TIME
+	case mysql.MYSQL_TYPE_NEWDATE:
+		return mysql.MYSQL_TYPE_DATE
+	case mysql.MYSQL_TYPE_STRING:
+		if real := byte(meta >> 8); real == mysql.MYSQL_TYPE_ENUM || real == mysql.MYSQL_TYPE_SET {
+			return real
+		}
+	}
+	return schemaTypeClass(tp)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestCheckTableMap(t *testing.T) {
+	sql := "CREATE TABLE `t` (`id` int unsigned, `name` varchar(10), `status` enum('a','b'), `ctime` datetime, `body` text)"
+	stmts, err := ParseCreateTables("test", sql, "utf8mb4")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := NewTable(stmts[0])
+	tableMap := func() *replication.TableMapEvent {
+		return &replication.TableMapEvent{
+			TableID:     1,
+			ColumnCount: 5,
+			ColumnType: []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_STRING,
+				mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_BLOB},
+			ColumnMeta: []uint16{0, 40, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, 0, 2},
+		}
+	}
+
+	if d := CheckTableMap(table, tableMap()); d != nil {
+		t.Errorf("same schema got drift: %+v", d)
+	}
+	if d := CheckTableMap(nil, tableMap()); d != nil {
+		t.Errorf("no schema got drift: %+v", d)
+	}
+
+	// column added after schema dumped
+	tm := tableMap()
+	tm.ColumnCount = 6
+	tm.ColumnType = append(tm.ColumnType, mysql.MYSQL_TYPE_LONG)
+	tm.ColumnMeta = append(tm.ColumnMeta, 0)
+	if d := CheckTableMap(table, tm); d == nil || d.BinlogColumns != 6 || d.SchemaColumns != 5 || len(d.Columns) != 0 {
+		t.Errorf("column count drift: %+v", d)
+	}
+
+	// enum changed to char, signed id and renamed column from binlog_row_metadata=FULL
+	tm = tableMap()
+	tm.ColumnMeta[2] = uint16(mysql.MYSQL_TYPE_STRING)<<8 | 40
+	tm.SignednessBitmap = []byte{0}
+	tm.ColumnName = [][]byte{[]byte("id"), []byte("title"), []byte("status"), []byte("ctime"), []byte("BODY")}
+	d := CheckTableMap(table, tm)
+	if d == nil || len(d.Columns) != 3 {
+		t.Fatalf("column drift: %+v", d)
+	}
+	if c := d.Columns[0]; c.Name != "id" || c.SchemaType != "int(11) unsigned" || c.BinlogType != "int" {
+		t.Errorf("signedness drift: %+v", c)
+	}
+	if c := d.Columns[1]; c.Name != "name" || c.BinlogName != "title" {
+		t.Errorf("name drift: %+v", c)
+	}
+	if c := d.Columns[2]; c.Name != "status" || c.BinlogType != "char" {
+		t.Errorf("type drift: %+v", c)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// ErrStop return by handler to stop Run without error
+var ErrStop = errors.New("binlog: stop")
+
+// Row actions of RowEvent, transaction actions of TransactionEvent
+const (
+	Insert = "insert"
+	Update = "update"
+	Delete = "delete"
+
+	Begin    = "begin"
+	Commit   = "commit"
+	Rollback = "rollback"
+)
+
+// Header common info of events
+type Header struct {
+	EventType string // binlog event type, eg. WriteRowsEventV2, QueryEvent
+	Timestamp uint32
+	ServerID  uint32
+	LogFile   string // empty for binlog files without ROTATE_EVENT
+	LogPos    uint32 // end position of the event
+	GTID      string // uuid:gno of current transaction
+	ThreadID  uint32 // thread id of current transaction
+}
+
+// Row one row image, Before is nil for insert, After is nil for delete
+type Row struct {
+	Before []Value
+	After  []Value
+}
+
+// RowEvent rows of one WRITE_ROWS, UPDATE_ROWS or DELETE_ROWS event
+type RowEvent struct {
+	Header
+	Action  string // Insert, Update or Delete
+	Table   *Table // Columns empty if table not found in schema
+	Columns []string
+	Rows    []Row
+}
+
+// QueryEvent statements in QUERY_EVENT, DDL or statement format DML
+type QueryEvent struct {
+	Header
+	Schema string // default database
+	Query  string
+}
+
+// TransactionEvent BEGIN, COMMIT, ROLLBACK of transaction, Xid is 0 if commit without XID_EVENT
+type TransactionEvent struct {
+	Header
+	Action string // Begin, Commit or Rollback
+	Xid    uint64
+}
+
+// Handler typed events receiver, returning an error stops Run, ErrStop stops Run without error
+type Handler interface {
+	OnRow(ctx context.Context, e *RowEvent) error
+	OnQuery(ctx context.Context, e *QueryEvent) error
+	OnTransaction(ctx context.Context, e *TransactionEvent) error
+}
+
+// EventHandler optional Handler interface, receive every raw event before filters and typed handlers
+type EventHandler interface {
+	OnEvent(ctx context.Context, e *replication.BinlogEvent) error
+}
+
+// NopHandler Handler ignore all events, embed it to implement part of Handler
+type NopHandler struct{}
+
+// OnRow implements Handler
+func (NopHandler) OnRow(context.Context, *RowEvent) error { return nil }
+
+// OnQuery implements Handler
+func (NopHandler) OnQuery(context.Context, *QueryEvent) error { return nil }
+
+// OnTransaction implements Handler
+func (NopHandler) OnTransaction(context.Context, *TransactionEvent) error { return nil }
@@ -0,0 +1,161 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"os"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+)
+
+// https://dev.mysql.com/doc/internals/en/binary-log-structure-and-contents.html
+
+const (
+	FileHeaderLength  = 4  // binlog file magic header 0XFE bin
+	EventHeaderLength = 19 // event header length
+)
+
+// CheckFileHeader check file is binary log
+func CheckFileHeader(buf []byte) bool {
+	// 0xFE62696E not encrypted
+	// 0xFD62696E encrypted
+	return bytes.Equal(buf, []byte{0xfe, 'b', 'i', 'n'}) || bytes.Equal(buf, []byte{0xfd, 'b', 'i', 'n'})
+}
+
+// CheckFileEncrypt check file is encrypted
+func CheckFileEncrypt(buf []byte) bool {
+	return bytes.Equal(buf, []byte{0xfd, 'b', 'i', 'n'})
+}
+
+// File binary log file reader, encrypted file decrypted with keyring
+type File struct {
+	fd     *os.File
+	stream cipher.Stream
+	parser *replication.BinlogParser
+}
+
+// OpenFile open binary log file, "-" for stdin
+func OpenFile(name, keyring string) (*File, error) {
+	var fd *os.File
+	var err error
+	switch name {
+	case "-":
+		fd = os.Stdin
+	default:
+		fd, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &File{fd: fd, parser: replication.NewBinlogParser()}
+	f.parser.SetUseDecimal(true)               // support Decimal type
+	f.parser.SetUseFloatWithTrailingZero(true) // keep 1.0 in JSON as double
+	f.parser.SetRowsEventDecodeFunc(decodeRowsEvent)
+	if err = f.checkHeader(name, keyring); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) checkHeader(name, keyring string) error {
+	bufFileHeader := make([]byte, FileHeaderLength)
+	if _, err := io.ReadFull(f.fd, bufFileHeader); err != nil {
+		return errors.Trace(err)
+	}
+	if !CheckFileHeader(bufFileHeader) {
+		return errors.Errorf("invalid file type, not binlog")
+	}
+	if !CheckFileEncrypt(bufFileHeader) {
+		return nil
+	}
+
+	stream, err := initAESCTRStream(name, keyring)
+	if err != nil {
+		return err
+	}
+	f.fd.Seek(EncryptFileHeaderOffset, 0)
+	if _, err := io.ReadFull(f.fd, bufFileHeader); err != nil {
+		return errors.Trace(err)
+	}
+	if !CheckFileHeader(decryptAESCTR(stream, bufFileHeader)) {
+		return errors.Errorf("invalid file type, not binlog")
+	}
+	f.stream = stream
+	return nil
+}
+
+// Next read next event, io.EOF at the end of file
+func (f *File) Next() (*replication.BinlogEvent, error) {
+	return NextEvent(f.parser, f.fd, f.stream)
+}
+
+// Close close the file
+func (f *File) Close() error {
+	return f.fd.Close()
+}
+
+// NextEvent read one event from r, decrypt with stream if not nil
+func NextEvent(p *replication.BinlogParser, r io.Reader, stream cipher.Stream) (*replication.BinlogEvent, error) {
+	var err error
+	var head *replication.EventHeader
+	var event *replication.BinlogEvent
+
+	bufHead := make([]byte, EventHeaderLength)
+	if _, err = io.ReadFull(r, bufHead); err != nil {
+		return event, err
+	}
+	if stream != nil {
+		bufHead = decryptAESCTR(stream, bufHead)
+	}
+
+	head, err = ParseEventHeader(bufHead)
+	if err != nil {
+		return event, errors.Trace(err)
+	}
+
+	eventLength := head.EventSize - replication.EventHeaderSize
+	bufBody := make([]byte, eventLength)
+	if n, err := io.ReadFull(r, bufBody); err != nil {
+		err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, head.EventSize, replication.EventHeaderSize, n)
+		return event, err
+	}
+	if stream != nil {
+		bufBody = decryptAESCTR(stream, bufBody)
+	}
+
+	var rawData []byte
+	rawData = append(rawData, bufHead...)
+	rawData = append(rawData, bufBody...)
+	return p.Parse(rawData)
+}
+
+// ParseEventHeader parser event header, in go-mysql it's internal func, make it public
+func ParseEventHeader(buf []byte) (*replication.EventHeader, error) {
+	head := new(replication.EventHeader)
+	err := head.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if head.EventSize <= uint32(replication.EventHeaderSize) {
+		err = errors.Errorf("invalid event header, event size is %d, too small", head.EventSize)
+		return nil, err
+	}
+	return head, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RegexpFilterPrefix table filter use regular expression instead of LIKE pattern, eg. re:^db\.tb_[0-9]+$
+const RegexpFilterPrefix = "re:"
+
+// filterRegexps compiled regular expression cache, key: filter with case flag
+var filterRegexps sync.Map
+
+// SplitTableName split `db`.`tb` or db.tb into database and table name
+func SplitTableName(table string) (string, string) {
+	if strings.HasPrefix(table, "`") {
+		tup := strings.SplitN(strings.Trim(table, "`"), "`.`", 2)
+		if len(tup) == 2 {
+			return tup[0], tup[1]
+		}
+	}
+	table = strings.Replace(table, "`", "", -1)
+	tup := strings.SplitN(table, ".", 2)
+	if len(tup) < 2 {
+		return "", tup[0]
+	}
+	return tup[0], tup[1]
+}
+
+// CheckTableFilter check table filter format, LIKE pattern db.tb or re: prefixed regular expression
+func CheckTableFilter(filter string) error {
+	if strings.HasPrefix(filter, RegexpFilterPrefix) {
+		_, err := filterRegexp(filter, false)
+		return err
+	}
+	if !strings.Contains(filter, ".") {
+		return fmt.Errorf("'%s' format should be db.tb", filter)
+	}
+	return nil
+}
+
+// TableFilterMatch check if table match filter, replicate-wild-do-table semantics.
+// `%` matches any number of characters, `_` matches exactly one character, `\` escape the next character.
+// Filter with `re:` prefix will be used as regular expression match against db.tb.
+// Database and table names compare case insensitive if insensitive, as lower_case_table_names 1, 2 of MySQL.
+// Invalid filters match nothing, check them with CheckTableFilter first.
+func TableFilterMatch(table, filter string, insensitive bool) bool {
+	database, name := SplitTableName(table)
+	if database == "" || name == "" {
+		return false
+	}
+
+	if strings.HasPrefix(filter, RegexpFilterPrefix) {
+		re, err := filterRegexp(filter, insensitive)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(database + "." + name)
+	}
+
+	sep := strings.SplitN(filter, ".", 2)
+	if len(sep) < 2 {
+		return false
+	}
+
+	// 当 -schema 指定的文件中只有 CREATE TABLE 忘了写 USE db 的时候，database 为 %
+	dbMatch := database == "%" || likeMatch(database, sep[0], insensitive)
+	return dbMatch && likeMatch(name, sep[1], insensitive)
+}
+
+// TableFiltersMatch check if table match any of filters
+func TableFiltersMatch(table string, filters []string, insensitive bool) bool {
+	for _, filter := range filters {
+		if TableFilterMatch(table, filter, insensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterRegexp(filter string, insensitive bool) (*regexp.Regexp, error) {
+	expr := strings.TrimPrefix(filter, RegexpFilterPrefix)
+	if insensitive {
+		expr = "(?i)" + expr
+	}
+	if re, ok := filterRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	filterRegexps.Store(expr, re)
+	return re, nil
+}
+
+// likeMatch SQL LIKE pattern match with `%`, `_` wildcard and `\` escape
+func likeMatch(str, pattern string, insensitive bool) bool {
+	if insensitive {
+		str = strings.ToLower(str)
+		pattern = strings.ToLower(pattern)
+	}
+	s := []rune(str)
+	p := []rune(pattern)
+
+	// backtrack to last `%` when mismatch
+	var si, pi int
+	starP, starS := -1, -1
+	for si < len(s) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '%':
+				starP, starS = pi, si
+				pi++
+				continue
+			case '_':
+				si++
+				pi++
+				continue
+			case '\\':
+				if pi+1 < len(p) && p[pi+1] == s[si] {
+					si++
+					pi += 2
+					continue
+				}
+				if pi+1 == len(p) && s[si] == '\\' {
+					si++
+					pi++
+					continue
+				}
+			default:
+				if p[pi] == s[si] {
+					si++
+					pi++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		si = starS
+		pi = starP + 1
+	}
+	for pi < len(p) && p[pi] == '%' {
+		pi++
+	}
+	return pi == len(p)
+}
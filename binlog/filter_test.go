@@ -0,0 +1,74 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"testing"
+)
+
+func TestTableFilterMatch(t *testing.T) {
+	cases := []struct {
+		table       string
+		filter      string
+		insensitive bool
+		match       bool
+	}{
+		{"`db`.`tb`", "db.%", false, true},
+		{"`db`.`tb`", "db.tb%", false, true},
+		{"`db`.`tb`", "db%.tb%", false, true},
+		{"`db`.`tb`", "db%.%", false, true},
+		{"db.tb", "db.%", false, true},
+		{"db.tb", "%.tb", false, true},
+		{"db.tb", "db.t_", false, true},
+		{"db.tb", "db.t__", false, false},
+		{"db.tb1", "db.%b_", false, true},
+		{"shard_01.order_0001", "shard\\_%.order\\_%", false, true},
+		{"shard01.order_0001", "shard\\_%.order\\_%", false, false},
+		{"db.tb%x", "db.tb\\%x", false, true},
+		{"db.tbyx", "db.tb\\%x", false, false},
+		{"db.a_b_c", "db.%_c", false, true},
+		{"db.abc", "db.a%c%", false, true},
+		{"db.abd", "db.a%c", false, false},
+		{"DB.TB", "db.tb", false, false},
+		{"DB.TB", "db.tb", true, true},
+		{"DB.TB", "db.t%", true, true},
+		{"db.tb", "re:^db\\.tb$", false, true},
+		{"db.order_0001", "re:^db\\.order_[0-9]{4}$", false, true},
+		{"db.order_x", "re:^db\\.order_[0-9]{4}$", false, false},
+		{"DB.ORDER_0001", "re:^db\\.order_[0-9]{4}$", false, false},
+		{"DB.ORDER_0001", "re:^db\\.order_[0-9]{4}$", true, true},
+		{"`%`.`tb`", "db.tb", false, true},
+		{"", "db.%", false, false},
+		{"tb", "%.%", false, false},
+	}
+	for _, c := range cases {
+		if got := TableFilterMatch(c.table, c.filter, c.insensitive); got != c.match {
+			t.Errorf("TableFilterMatch(%q, %q) insensitive=%v, want %v, got %v",
+				c.table, c.filter, c.insensitive, c.match, got)
+		}
+	}
+}
+
+func TestCheckTableFilter(t *testing.T) {
+	for _, filter := range []string{"db.tb", "db.%", "re:^db\\..*"} {
+		if err := CheckTableFilter(filter); err != nil {
+			t.Errorf("CheckTableFilter(%q) got error: %s", filter, err.Error())
+		}
+	}
+	for _, filter := range []string{"tb", "re:(db"} {
+		if err := CheckTableFilter(filter); err == nil {
+			t.Errorf("CheckTableFilter(%q) should return error", filter)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// JSON binary value types, see mysql-server sql-common/json_binary.h
+const (
+	jsonbSmallObject byte = 0x00
+	jsonbLargeObject byte = 0x01
+	jsonbSmallArray  byte = 0x02
+	jsonbLargeArray  byte = 0x03
+	jsonbLiteral     byte = 0x04
+	jsonbInt16       byte = 0x05
+	jsonbUint16      byte = 0x06
+	jsonbInt32       byte = 0x07
+	jsonbUint32      byte = 0x08
+	jsonbInt64       byte = 0x09
+	jsonbUint64      byte = 0x0a
+	jsonbDouble      byte = 0x0b
+	jsonbString      byte = 0x0c
+	jsonbOpaque      byte = 0x0f
+)
+
+// decodeRowsEvent go-mysql RowsEventDecodeFunc, decode rows as go-mysql does, then decode JSON columns again.
+// go-mysql marshal DECIMAL inside JSON by decimal.Decimal, which is a quoted string unless the global
+// decimal.MarshalJSONWithoutQuotes is set, here DECIMAL is kept as JSON number without touching the global.
+func decodeRowsEvent(e *replication.RowsEvent, data []byte) error {
+	pos, err := e.DecodeHeader(data)
+	if err != nil {
+		return err
+	}
+	if err = e.DecodeData(pos, data); err != nil {
+		return err
+	}
+	for _, tp := range e.Table.ColumnType {
+		if tp == mysql.MYSQL_TYPE_JSON {
+			return jsonRows(e, data[pos:])
+		}
+	}
+	return nil
+}
+
+// jsonRows replace JSON values of decoded rows by decoding row images again
+func jsonRows(e *replication.RowsEvent, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode JSON of table %s.%s: %v", e.Table.Schema, e.Table.Table, r)
+		}
+	}()
+	// RowsEvent.Type() only knows WRITE, UPDATE, DELETE, two images with unknown type is PARTIAL_UPDATE_ROWS_EVENT
+	partial := e.ColumnBitmap2 != nil && e.Type() == replication.EnumRowsEventTypeUnknown
+	pos := 0
+	for i, row := range e.Rows {
+		bitmap, after := e.ColumnBitmap1, false
+		if e.ColumnBitmap2 != nil && i%2 == 1 {
+			bitmap, after = e.ColumnBitmap2, true
+		}
+		n, err := jsonImage(e, data[pos:], bitmap, row, partial && after)
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+// jsonImage decode JSON columns of one row image, return bytes of the image
+func jsonImage(e *replication.RowsEvent, data []byte, bitmap []byte, row []interface{}, partial bool) (int, error) {
+	pos := 0
+	var partialBits []byte
+	if partial {
+		options, _, n := mysql.LengthEncodedInt(data)
+		pos += n
+		if replication.EnumBinlogRowValueOptions(options)&replication.EnumBinlogRowValueOptionsPartialJsonUpdates != 0 {
+			size := (int(e.Table.JsonColumnCount()) + 7) / 8
+			partialBits = data[pos : pos+size]
+			pos += size
+		}
+	}
+
+	present := 0
+	for i := 0; i < int(e.ColumnCount); i++ {
+		if bitSet(bitmap, i) {
+			present++
+		}
+	}
+	nullBits := data[pos : pos+(present+7)/8]
+	pos += len(nullBits)
+
+	jsonIndex, nullIndex := 0, 0
+	for i := 0; i < int(e.ColumnCount); i++ {
+		tp, meta := e.Table.ColumnType[i], e.Table.ColumnMeta[i]
+		// partial bits have a bit for every JSON column, present or not
+		isPartial := false
+		if tp == mysql.MYSQL_TYPE_JSON && partialBits != nil {
+			isPartial = bitSet(partialBits, jsonIndex)
+			jsonIndex++
+		}
+		if !bitSet(bitmap, i) {
+			continue
+		}
+		nullIndex++
+		if bitSet(nullBits, nullIndex-1) {
+			continue
+		}
+		if tp != mysql.MYSQL_TYPE_JSON {
+			n, err := columnSize(data[pos:], tp, meta)
+			if err != nil {
+				return 0, err
+			}
+			pos += n
+			continue
+		}
+
+		length := int(mysql.FixedLengthInt(data[pos : pos+int(meta)]))
+		doc := data[pos+int(meta) : pos+int(meta)+length]
+		pos += int(meta) + length
+		// go-mysql keep empty document as empty value
+		if length == 0 {
+			continue
+		}
+		var err error
+		if isPartial {
+			row[i], err = jsonDiff(doc)
+		} else {
+			row[i], err = jsonBinary(doc)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+// jsonDiff first diff of partial JSON update, as go-mysql decodes
+func jsonDiff(data []byte) (*replication.JsonDiff, error) {
+	diff := &replication.JsonDiff{Op: replication.JsonDiffOperation(data[0])}
+	if diff.Op > replication.JsonDiffOperationRemove {
+		return nil, replication.ErrCorruptedJSONDiff
+	}
+	data = data[1:]
+	length, _, n := mysql.LengthEncodedInt(data)
+	diff.Path = string(data[n : n+int(length)])
+	data = data[n+int(length):]
+	if diff.Op == replication.JsonDiffOperationRemove {
+		return diff, nil
+	}
+	length, _, n = mysql.LengthEncodedInt(data)
+	value, err := jsonBinary(data[n : n+int(length)])
+	if err != nil {
+		return nil, fmt.Errorf("cannot read json diff for field %q: %w", diff.Path, err)
+	}
+	diff.Value = value
+	return diff, nil
+}
+
+// jsonBinary JSON text of MySQL JSON binary document, DECIMAL as number, DOUBLE keeps trailing zero as go-mysql
+func jsonBinary(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("empty JSON document")
+	}
+	v, err := jsonValue(data[0], data[1:])
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(v)
+	return string(buf), err
+}
+
+func jsonValue(tp byte, data []byte) (interface{}, error) {
+	switch tp {
+	case jsonbSmallObject, jsonbLargeObject, jsonbSmallArray, jsonbLargeArray:
+		return jsonContainer(tp, data)
+	case jsonbLiteral:
+		switch data[0] {
+		case 0x00:
+			return nil, nil
+		case 0x01:
+			return true, nil
+		case 0x02:
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid JSON literal %d", data[0])
+	case jsonbInt16:
+		return int16(binary.LittleEndian.Uint16(data)), nil
+	case jsonbUint16:
+		return binary.LittleEndian.Uint16(data), nil
+	case jsonbInt32:
+		return int32(binary.LittleEndian.Uint32(data)), nil
+	case jsonbUint32:
+		return binary.LittleEndian.Uint32(data), nil
+	case jsonbInt64:
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case jsonbUint64:
+		return binary.LittleEndian.Uint64(data), nil
+	case jsonbDouble:
+		return replication.FloatWithTrailingZero(math.Float64frombits(binary.LittleEndian.Uint64(data))), nil
+	case jsonbString:
+		length, n := jsonVariableLength(data)
+		return string(data[n : n+length]), nil
+	case jsonbOpaque:
+		return jsonOpaque(data)
+	}
+	return nil, fmt.Errorf("invalid JSON type %d", tp)
+}
+
+// jsonContainer object or array, small format uses 2 bytes count, size and offsets, large uses 4 bytes
+func jsonContainer(tp byte, data []byte) (interface{}, error) {
+	small := tp == jsonbSmallObject || tp == jsonbSmallArray
+	object := tp == jsonbSmallObject || tp == jsonbLargeObject
+	offsetSize := 4
+	if small {
+		offsetSize = 2
+	}
+	number := func(b []byte) int {
+		if small {
+			return int(binary.LittleEndian.Uint16(b))
+		}
+		return int(binary.LittleEndian.Uint32(b))
+	}
+	count := number(data)
+	if size := number(data[offsetSize:]); size > len(data) {
+		return nil, fmt.Errorf("JSON container size %d > data length %d", size, len(data))
+	}
+
+	keyEntrySize, valueEntrySize := 2+offsetSize, 1+offsetSize
+	keys := make([]string, count)
+	if object {
+		for i := 0; i < count; i++ {
+			entry := 2*offsetSize + keyEntrySize*i
+			offset := number(data[entry:])
+			length := int(binary.LittleEndian.Uint16(data[entry+offsetSize:]))
+			keys[i] = string(data[offset : offset+length])
+		}
+	}
+	values := make([]interface{}, count)
+	for i := 0; i < count; i++ {
+		entry := 2*offsetSize + valueEntrySize*i
+		if object {
+			entry += keyEntrySize * count
+		}
+		valueType := data[entry]
+		var err error
+		// literal, 16 bits integers and 32 bits integers of large container are inlined in value entry
+		inline := valueType == jsonbLiteral || valueType == jsonbInt16 || valueType == jsonbUint16 ||
+			(!small && (valueType == jsonbInt32 || valueType == jsonbUint32))
+		if inline {
+			values[i], err = jsonValue(valueType, data[entry+1:entry+valueEntrySize])
+		} else {
+			values[i], err = jsonValue(valueType, data[number(data[entry+1:]):])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !object {
+		return values, nil
+	}
+	m := make(map[string]interface{}, count)
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	return m, nil
+}
+
+// jsonOpaque MySQL typed value in JSON, DECIMAL as json.Number, temporal types as string like go-mysql
+func jsonOpaque(data []byte) (interface{}, error) {
+	tp := data[0]
+	length, n := jsonVariableLength(data[1:])
+	data = data[1+n : 1+n+length]
+	switch tp {
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		s, _, err := decimalBinary(data[2:], int(data[0]), int(data[1]))
+		return json.Number(s), err
+	case mysql.MYSQL_TYPE_TIME:
+		v := int64(binary.LittleEndian.Uint64(data))
+		if v == 0 {
+			return "00:00:00", nil
+		}
+		sign := ""
+		if v < 0 {
+			sign, v = "-", -v
+		}
+		hms := v >> 24
+		return fmt.Sprintf("%s%02d:%02d:%02d.%06d", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6), v%(1<<24)), nil
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIMESTAMP:
+		v := int64(binary.LittleEndian.Uint64(data))
+		if v == 0 {
+			return "0000-00-00 00:00:00", nil
+		}
+		if v < 0 {
+			v = -v
+		}
+		ymdhms := v >> 24
+		ymd, hms := ymdhms>>17, ymdhms%(1<<17)
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", (ymd>>5)/13, (ymd>>5)%13, ymd%(1<<5),
+			hms>>12, (hms>>6)%(1<<6), hms%(1<<6), v%(1<<24)), nil
+	}
+	return string(data), nil
+}
+
+// jsonVariableLength length of string and opaque data, 7 bits each byte with the highest bit as continue flag
+func jsonVariableLength(data []byte) (int, int) {
+	length := 0
+	for i := 0; i < 5 && i < len(data); i++ {
+		length |= int(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return length, i + 1
+		}
+	}
+	panic("invalid JSON variable length")
+}
+
+// decimalDigitsBytes bytes to store 0 ~ 9 decimal digits
+var decimalDigitsBytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// decimalSize bytes of DECIMAL(precision, scale) in binary format
+func decimalSize(precision, scale int) int {
+	intg := precision - scale
+	return intg/9*4 + decimalDigitsBytes[intg%9] + scale/9*4 + decimalDigitsBytes[scale%9]
+}
+
+// decimalBinary exact string of DECIMAL in binary format, groups of 9 digits in 4 bytes big-endian,
+// the highest bit inverted as sign, negative value has all bits inverted
+func decimalBinary(data []byte, precision, scale int) (string, int, error) {
+	size := decimalSize(precision, scale)
+	if len(data) < size {
+		return "", 0, fmt.Errorf("decimal(%d,%d) needs %d bytes, got %d", precision, scale, size, len(data))
+	}
+	buf := make([]byte, size)
+	copy(buf, data)
+	negative := buf[0]&0x80 == 0
+	buf[0] ^= 0x80
+	if negative {
+		for i := range buf {
+			buf[i] ^= 0xff
+		}
+	}
+
+	pos := 0
+	group := func(digits int) uint32 {
+		var v uint32
+		for _, b := range buf[pos : pos+decimalDigitsBytes[digits]] {
+			v = v<<8 | uint32(b)
+		}
+		pos += decimalDigitsBytes[digits]
+		return v
+	}
+	var intPart, fracPart strings.Builder
+	intg := precision - scale
+	if d := intg % 9; d > 0 {
+		fmt.Fprintf(&intPart, "%d", group(d))
+	}
+	for i := 0; i < intg/9; i++ {
+		fmt.Fprintf(&intPart, "%09d", group(9))
+	}
+	for i := 0; i < scale/9; i++ {
+		fmt.Fprintf(&fracPart, "%09d", group(9))
+	}
+	if d := scale % 9; d > 0 {
+		fmt.Fprintf(&fracPart, "%0*d", d, group(d))
+	}
+
+	s := strings.TrimLeft(intPart.String(), "0")
+	if s == "" {
+		s = "0"
+	}
+	if scale > 0 {
+		s += "." + fracPart.String()
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s, size, nil
+}
+
+// columnSize bytes of a non-NULL column value in row image
+func columnSize(data []byte, tp byte, meta uint16) (int, error) {
+	length := int(meta)
+	// STRING keeps real type and max length in meta, see go-mysql RowsEvent.decodeValue
+	if tp == mysql.MYSQL_TYPE_STRING && meta >= 256 {
+		b0, b1 := byte(meta>>8), byte(meta&0xff)
+		if b0&0x30 != 0x30 {
+			length = int(uint16(b1) | uint16((b0&0x30)^0x30)<<4)
+			tp = b0 | 0x30
+		} else {
+			length = int(b1)
+			tp = b0
+		}
+	}
+	fsp := int(meta+1) / 2
+	switch tp {
+	case mysql.MYSQL_TYPE_NULL:
+		return 0, nil
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_YEAR:
+		return 1, nil
+	case mysql.MYSQL_TYPE_SHORT:
+		return 2, nil
+	case mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_TIME:
+		return 3, nil
+	case mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_TIMESTAMP:
+		return 4, nil
+	case mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_DATETIME:
+		return 8, nil
+	case mysql.MYSQL_TYPE_TIMESTAMP2:
+		return 4 + fsp, nil
+	case mysql.MYSQL_TYPE_DATETIME2:
+		return 5 + fsp, nil
+	case mysql.MYSQL_TYPE_TIME2:
+		return 3 + fsp, nil
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		return decimalSize(int(meta>>8), int(meta&0xff)), nil
+	case mysql.MYSQL_TYPE_BIT:
+		return (int(meta>>8)*8 + int(meta&0xff) + 7) / 8, nil
+	case mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET:
+		return int(meta & 0xff), nil
+	case mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_GEOMETRY, mysql.MYSQL_TYPE_VECTOR, mysql.MYSQL_TYPE_JSON:
+		return int(meta) + int(mysql.FixedLengthInt(data[:meta])), nil
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING:
+		if length < 256 {
+			return 1 + int(data[0]), nil
+		}
+		return 2 + int(binary.LittleEndian.Uint16(data)), nil
+	}
+	return 0, fmt.Errorf("unsupport type %d in binlog", tp)
+}
+
+// bitSet bit i of little-endian bitmap
+func bitSet(bitmap []byte, i int) bool {
+	return bitmap[i>>3]&(1<<(uint(i)&7)) != 0
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// JSONB documents, {"price": 2.50, "qty": 1.0}, [-12.345], [true, -2], "abc"
+var (
+	docObject = []byte{0x00, 2, 0, 40, 0, 18, 0, 3, 0, 21, 0, 5, 0, 0x0b, 26, 0, 0x0f, 34, 0,
+		'q', 't', 'y', 'p', 'r', 'i', 'c', 'e',
+		0, 0, 0, 0, 0, 0, 0xf0, 0x3f,
+		mysql.MYSQL_TYPE_NEWDECIMAL, 4, 3, 2, 0x82, 0x32}
+	docDecimal = []byte{0x02, 1, 0, 14, 0, 0x0f, 7, 0, mysql.MYSQL_TYPE_NEWDECIMAL, 5, 5, 3, 0x73, 0xfe, 0xa6}
+	docInline  = []byte{0x02, 2, 0, 10, 0, 0x04, 1, 0, 0x05, 0xfe, 0xff}
+	docString  = []byte{0x0c, 3, 'a', 'b', 'c'}
+)
+
+// TestJSONBinary DECIMAL inside JSON document is a number without changing any global
+func TestJSONBinary(t *testing.T) {
+	cases := []struct {
+		doc  []byte
+		want string
+	}{
+		{docObject, `{"price":2.50,"qty":1.0}`},
+		{docDecimal, `[-12.345]`},
+		{docInline, `[true,-2]`},
+		{docString, `"abc"`},
+	}
+	for _, c := range cases {
+		got, err := jsonBinary(c.doc)
+		if err != nil {
+			t.Errorf("%s error: %s", c.want, err.Error())
+			continue
+		}
+		if got != c.want {
+			t.Errorf("want %s, got %s", c.want, got)
+		}
+	}
+
+	if _, err := jsonBinary(docObject[:20]); err == nil {
+		t.Error("truncated document should fail")
+	}
+}
+
+// TestDecodeRowsEventModes file and replication stream decode the same event into the same row values
+func TestDecodeRowsEventModes(t *testing.T) {
+	fde, err := formatDescriptionEvent()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// id INT, amount DECIMAL(10,2), name VARCHAR(20), doc JSON
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0, 4,
+		mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_JSON,
+		5, 10, 2, 80, 0, 4, 0}
+	writeRows := []byte{1, 0, 0, 0, 0, 0, 1, 0, 2, 0, 4, 0x0f}
+	writeRows = append(writeRows, 0x00, 1, 0, 0, 0, 0x80, 0, 0, 0x7b, 0x2d, 3, 'a', 'b', 'c')
+	writeRows = append(append(writeRows, binary.LittleEndian.AppendUint32(nil, uint32(len(docObject)))...), docObject...)
+	writeRows = append(writeRows, 0x02, 2, 0, 0, 0, 0)
+	writeRows = append(append(writeRows, binary.LittleEndian.AppendUint32(nil, uint32(len(docDecimal)))...), docDecimal...)
+	events := [][]byte{
+		fde,
+		testEventBytes(replication.TABLE_MAP_EVENT, tableMap),
+		testEventBytes(replication.WRITE_ROWS_EVENTv2, writeRows),
+	}
+
+	// replication stream, parser configured as BinlogSyncer does
+	cfg := (&Parser{opts: Options{Location: time.UTC}}).syncerConfig()
+	stream := replication.NewBinlogParser()
+	stream.SetUseDecimal(cfg.UseDecimal)
+	stream.SetUseFloatWithTrailingZero(cfg.UseFloatWithTrailingZero)
+	stream.SetRowsEventDecodeFunc(cfg.RowsEventDecodeFunc)
+	stream.SetParseTime(cfg.ParseTime)
+	stream.SetTimestampStringLocation(cfg.TimestampStringLocation)
+	var streamRows string
+	for _, data := range events {
+		e, err := stream.Parse(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if rows, ok := e.Event.(*replication.RowsEvent); ok {
+			streamRows = fmt.Sprint(rows.Rows)
+		}
+	}
+
+	// binary log file
+	name := filepath.Join(t.TempDir(), "binlog.000001")
+	content := []byte{0xfe, 'b', 'i', 'n'}
+	for _, data := range events {
+		content = append(content, data...)
+	}
+	if err = os.WriteFile(name, content, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := OpenFile(name, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	var fileRows string
+	for {
+		e, err := f.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if rows, ok := e.Event.(*replication.RowsEvent); ok {
+			fileRows = fmt.Sprint(rows.Rows)
+		}
+	}
+
+	want := `[[1 123.45 abc {"price":2.50,"qty":1.0}] [2 <nil>  [-12.345]]]`
+	if fileRows != want {
+		t.Errorf("file want %s, got %s", want, fileRows)
+	}
+	if streamRows != fileRows {
+		t.Errorf("stream want %s, got %s", fileRows, streamRows)
+	}
+}
+
+// formatDescriptionEvent FORMAT_DESCRIPTION_EVENT of test binlog, CRC32 checksum enabled
+func formatDescriptionEvent() ([]byte, error) {
+	fd, err := os.Open("../test/binlog.000002")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	head := make([]byte, FileHeaderLength+replication.EventHeaderSize)
+	if _, err = io.ReadFull(fd, head); err != nil {
+		return nil, err
+	}
+	fde := make([]byte, binary.LittleEndian.Uint32(head[FileHeaderLength+9:]))
+	copy(fde, head[FileHeaderLength:])
+	if _, err = io.ReadFull(fd, fde[replication.EventHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return fde, nil
+}
+
+func testEventBytes(tp replication.EventType, body []byte) []byte {
+	size := replication.EventHeaderSize + len(body) + replication.BinlogChecksumLength
+	b := binary.LittleEndian.AppendUint32(nil, 0) // timestamp
+	b = append(b, byte(tp))
+	b = binary.LittleEndian.AppendUint32(b, 1) // server id
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = binary.LittleEndian.AppendUint32(b, 0) // log pos
+	b = binary.LittleEndian.AppendUint16(b, 0) // flags
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"time"
+
+	pingcap "github.com/pingcap/parser/mysql"
+)
+
+// Options Parser options, binlog files are parsed if Files not empty, otherwise replicate from Master
+type Options struct {
+	Files   []string // binlog files parsed in order, "-" for stdin
+	Keyring string   // keyring file for encrypted binlog files
+
+	Master Master
+
+	Schema   string         // CREATE TABLE statements with optional USE db, column names are @N for tables not found
+	Charset  string         // charset for schema parsing and replication connection, default utf8mb4
+	Location *time.Location // TIMESTAMP columns convert into this timezone, nil keep go-mysql default
+
+	// Filters, empty or zero value means no filter.
+	// Tables, IgnoreTables only filter row events, LIKE pattern or re: prefixed regular expression.
+	Tables              []string
+	IgnoreTables        []string
+	LowerCaseTableNames bool      // table filters case insensitive
+	StartPosition       uint32    // skip events end before this position
+	StopPosition        uint32    // stop at the first event end after this position
+	StartTime           time.Time // skip events before this time
+	StopTime            time.Time // stop at the first event after this time
+}
+
+// Master replication source, replicate from File, Position or GTIDSet as a replica with ServerID
+type Master struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Flavor   string // mysql or mariadb, default mysql
+	ServerID uint32 // server id of this replica, should be unique in replication topology
+
+	File         string
+	Position     uint32
+	AutoPosition bool   // replicate with GTIDSet, File and Position will be ignored
+	GTIDSet      string // executed GTID set
+
+	ReadTimeout time.Duration // default 3s, Run returns error if no event received in ReadTimeout unless Follow
+	RetryCount  int           // max reconnect attempts
+	Follow      bool          // wait for new events forever
+}
+
+// check fill default values and validate options
+func (o *Options) check() error {
+	if o.Charset == "" {
+		o.Charset = "utf8mb4"
+	}
+	if _, ok := pingcap.Charsets[o.Charset]; !ok {
+		return fmt.Errorf("charset %s not exist", o.Charset)
+	}
+	for _, filter := range append(append([]string{}, o.Tables...), o.IgnoreTables...) {
+		if err := CheckTableFilter(filter); err != nil {
+			return err
+		}
+	}
+	if len(o.Files) > 0 {
+		return nil
+	}
+	if o.Master.Host == "" {
+		return fmt.Errorf("no binlog files or master host")
+	}
+	if o.Master.Flavor == "" {
+		o.Master.Flavor = "mysql"
+	}
+	if o.Master.ReadTimeout == 0 {
+		o.Master.ReadTimeout = 3 * time.Second
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/juju/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Parser parse binlog files or replication stream into typed events.
+// All state belongs to the Parser, parsers are independent with each other, but one Parser should Run once at a time.
+type Parser struct {
+	opts   Options
+	schema *schemaStore
+
+	file     string // current binlog file
+	pos      uint32 // end position of the latest event
+	gtid     string // GTID of current transaction
+	threadID uint32 // thread id of current transaction
+	started  bool   // StartPosition reached
+}
+
+// New create Parser with options, schema parsed here
+func New(opts Options) (*Parser, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	schema, err := newSchemaStore(opts.Schema, opts.Charset)
+	if err != nil {
+		return nil, err
+	}
+	return &Parser{opts: opts, schema: schema}, nil
+}
+
+// Position binlog file and end position of the latest event
+func (p *Parser) Position() (string, uint32) {
+	return p.file, p.pos
+}
+
+// Table table info from schema, nil if not found
+func (p *Parser) Table(database, name string) *Table {
+	return p.schema.table(database, name)
+}
+
+// Run parse events until the end of files, handler returns error or ctx done.
+// Replication stream never ends unless Master.Follow is false and no event received in Master.ReadTimeout.
+func (p *Parser) Run(ctx context.Context, h Handler) error {
+	var err error
+	if len(p.opts.Files) > 0 {
+		err = p.runFiles(ctx, h)
+	} else {
+		err = p.runStream(ctx, h)
+	}
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+func (p *Parser) runFiles(ctx context.Context, h Handler) error {
+	for _, name := range p.opts.Files {
+		f, err := OpenFile(name, p.opts.Keyring)
+		if err != nil {
+			return err
+		}
+		if p.opts.Location != nil {
+			f.parser.SetTimestampStringLocation(p.opts.Location)
+		}
+		if name != "-" {
+			p.file = filepath.Base(name)
+		}
+		err = p.runFile(ctx, f, h)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Parser) runFile(ctx context.Context, f *File, h Handler) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		event, err := f.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = p.handle(ctx, event, h); err != nil {
+			return err
+		}
+	}
+}
+
+// syncerConfig replication config, decode events as OpenFile does
+func (p *Parser) syncerConfig() replication.BinlogSyncerConfig {
+	m := p.opts.Master
+	return replication.BinlogSyncerConfig{
+		ServerID:             m.ServerID,
+		Flavor:               m.Flavor,
+		Host:                 m.Host,
+		Port:                 uint16(m.Port),
+		User:                 m.User,
+		Password:             m.Password,
+		Charset:              p.opts.Charset,
+		ReadTimeout:          m.ReadTimeout,
+		MaxReconnectAttempts: m.RetryCount,
+		SemiSyncEnabled:      false,
+
+		ParseTime:                false,           // parse mysql datetime/time as string
+		TimestampStringLocation:  p.opts.Location, // If ParseTime is false, convert TIMESTAMP into this specified timezone.
+		UseDecimal:               true,            // support Decimal type
+		UseFloatWithTrailingZero: true,            // keep 1.0 in JSON as double
+		RowsEventDecodeFunc:      decodeRowsEvent,
+	}
+}
+
+func (p *Parser) runStream(ctx context.Context, h Handler) error {
+	m := p.opts.Master
+	syncer := replication.NewBinlogSyncer(p.syncerConfig())
+	defer syncer.Close()
+
+	var streamer *replication.BinlogStreamer
+	var err error
+	if m.AutoPosition {
+		var gtid mysql.GTIDSet
+		gtid, err = mysql.ParseGTIDSet(m.Flavor, m.GTIDSet)
+		if err != nil {
+			return err
+		}
+		streamer, err = syncer.StartSyncGTID(gtid)
+	} else {
+		p.file, p.pos = m.File, m.Position
+		streamer, err = syncer.StartSync(mysql.Position{Name: m.File, Pos: m.Position})
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := p.streamEvent(ctx, streamer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Trace(err)
+		}
+		if err = p.handle(ctx, event, h); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Parser) streamEvent(ctx context.Context, streamer *replication.BinlogStreamer) (*replication.BinlogEvent, error) {
+	if p.opts.Master.Follow {
+		return streamer.GetEvent(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.opts.Master.ReadTimeout)
+	defer cancel()
+	return streamer.GetEvent(ctx)
+}
+
+// handle track position, call EventHandler, then typed handlers for events pass filters
+func (p *Parser) handle(ctx context.Context, event *replication.BinlogEvent, h Handler) error {
+	p.track(event)
+	if eh, ok := h.(EventHandler); ok {
+		if err := eh.OnEvent(ctx, event); err != nil {
+			return err
+		}
+	}
+	do, err := p.filter(event)
+	if !do {
+		return err
+	}
+	return p.dispatch(ctx, event, h)
+}
+
+// track keep position, GTID and thread id of current transaction
+func (p *Parser) track(event *replication.BinlogEvent) {
+	switch ev := event.Event.(type) {
+	case *replication.RotateEvent:
+		if name := string(ev.NextLogName); name != "" {
+			p.file, p.pos = name, uint32(ev.Position)
+		}
+		return
+	case *replication.GTIDEvent:
+		serverID, _ := uuid.FromBytes(ev.SID)
+		p.gtid = fmt.Sprintf("%s:%d", serverID, ev.GNO)
+	case *replication.QueryEvent:
+		p.threadID = ev.SlaveProxyID
+	}
+	if event.Header.LogPos > 0 {
+		p.pos = event.Header.LogPos
+	}
+}
+
+// filter check event with options filters, ErrStop if stop position or time reached
+func (p *Parser) filter(event *replication.BinlogEvent) (bool, error) {
+	o := p.opts
+	header := event.Header
+	if o.StopPosition > 0 && header.LogPos > o.StopPosition {
+		return false, ErrStop
+	}
+	if !o.StopTime.IsZero() && int64(header.Timestamp) > o.StopTime.Unix() {
+		return false, ErrStop
+	}
+	if o.StartPosition > 0 && !p.started {
+		if header.LogPos < o.StartPosition {
+			return false, nil
+		}
+		p.started = true
+	}
+	if !o.StartTime.IsZero() && int64(header.Timestamp) < o.StartTime.Unix() {
+		return false, nil
+	}
+
+	ev, ok := event.Event.(*replication.RowsEvent)
+	if !ok {
+		return true, nil
+	}
+	table := fmt.Sprintf("`%s`.`%s`", ev.Table.Schema, ev.Table.Table)
+	if len(o.Tables) > 0 && !TableFiltersMatch(table, o.Tables, o.LowerCaseTableNames) {
+		return false, nil
+	}
+	return !TableFiltersMatch(table, o.IgnoreTables, o.LowerCaseTableNames), nil
+}
+
+func (p *Parser) header(event *replication.BinlogEvent) Header {
+	return Header{
+		EventType: event.Header.EventType.String(),
+		Timestamp: event.Header.Timestamp,
+		ServerID:  event.Header.ServerID,
+		LogFile:   p.file,
+		LogPos:    event.Header.LogPos,
+		GTID:      p.gtid,
+		ThreadID:  p.threadID,
+	}
+}
+
+// dispatch convert event into typed event and call handler
+func (p *Parser) dispatch(ctx context.Context, event *replication.BinlogEvent, h Handler) error {
+	switch event.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return h.OnRow(ctx, p.rowEvent(event, Insert))
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		return h.OnRow(ctx, p.rowEvent(event, Update))
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		return h.OnRow(ctx, p.rowEvent(event, Delete))
+	case replication.XID_EVENT:
+		return h.OnTransaction(ctx, &TransactionEvent{
+			Header: p.header(event),
+			Action: Commit,
+			Xid:    event.Event.(*replication.XIDEvent).XID,
+		})
+	case replication.QUERY_EVENT:
+		ev := event.Event.(*replication.QueryEvent)
+		query := string(ev.Query)
+		switch strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(query), ";")) {
+		case "BEGIN":
+			return h.OnTransaction(ctx, &TransactionEvent{Header: p.header(event), Action: Begin})
+		case "COMMIT":
+			return h.OnTransaction(ctx, &TransactionEvent{Header: p.header(event), Action: Commit})
+		case "ROLLBACK":
+			return h.OnTransaction(ctx, &TransactionEvent{Header: p.header(event), Action: Rollback})
+		}
+		return h.OnQuery(ctx, &QueryEvent{Header: p.header(event), Schema: string(ev.Schema), Query: query})
+	}
+	return nil
+}
+
+// rowEvent typed rows, update rows event keep before, after image pairs
+func (p *Parser) rowEvent(event *replication.BinlogEvent, action string) *RowEvent {
+	ev := event.Event.(*replication.RowsEvent)
+	table := p.schema.table(string(ev.Table.Schema), string(ev.Table.Table))
+	if table == nil {
+		table = &Table{Schema: string(ev.Table.Schema), Name: string(ev.Table.Table)}
+	}
+	e := &RowEvent{
+		Header:  p.header(event),
+		Action:  action,
+		Table:   table,
+		Columns: table.ColumnNames(int(ev.ColumnCount)),
+	}
+	values := EventValues(table, ev)
+	for i := 0; i < len(values); i++ {
+		switch action {
+		case Insert:
+			e.Rows = append(e.Rows, Row{After: values[i]})
+		case Delete:
+			e.Rows = append(e.Rows, Row{Before: values[i]})
+		case Update:
+			if i+1 < len(values) {
+				e.Rows = append(e.Rows, Row{Before: values[i], After: values[i+1]})
+			}
+			i++
+		}
+	}
+	return e
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector record typed events as text
+type collector struct {
+	events []string
+	stopAt int // return ErrStop after stopAt events
+}
+
+func (c *collector) add(format string, args ...interface{}) error {
+	c.events = append(c.events, fmt.Sprintf(format, args...))
+	if c.stopAt > 0 && len(c.events) >= c.stopAt {
+		return ErrStop
+	}
+	return nil
+}
+
+func (c *collector) OnRow(_ context.Context, e *RowEvent) error {
+	native := func(values []Value) []interface{} {
+		var image []interface{}
+		for _, v := range values {
+			n, _ := v.Native()
+			image = append(image, n)
+		}
+		return image
+	}
+	var rows []string
+	for _, row := range e.Rows {
+		rows = append(rows, fmt.Sprintf("%v => %v", native(row.Before), native(row.After)))
+	}
+	return c.add("%s %s %v %s", e.Action, e.Table, e.Columns, strings.Join(rows, ", "))
+}
+
+func (c *collector) OnQuery(_ context.Context, e *QueryEvent) error {
+	return c.add("query %s %s", e.Schema, e.Query)
+}
+
+func (c *collector) OnTransaction(_ context.Context, e *TransactionEvent) error {
+	return c.add("%s %d", e.Action, e.Xid)
+}
+
+func TestParser(t *testing.T) {
+	schema, err := os.ReadFile("../test/schema.sql")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	opts := Options{
+		Files:  []string{"../test/binlog.000002"},
+		Schema: string(schema),
+		Tables: []string{"test.tb"},
+	}
+	expect := []string{
+		"insert `test`.`tb` [a b] [] => [1 abc]",
+		"insert `test`.`tb` [a b] [] => [2 ghi]",
+		"insert `test`.`tb` [a b] [] => [3 space\u00a0]",
+		"update `test`.`tb` [a b] [2 ghi] => [2 中文]",
+		"update `test`.`tb` [a b] [2 中文] => [2 'abc']",
+		"update `test`.`tb` [a b] [2 'abc'] => [2 \"abc]",
+		"delete `test`.`tb` [a b] [1 abc] => []",
+	}
+
+	// two parsers in one process run at the same time with their own options
+	var wg sync.WaitGroup
+	collectors := []*collector{{}, {}}
+	errs := make([]error, 2)
+	for i := range collectors {
+		o := opts
+		if i == 1 {
+			o.Tables = []string{"test.%"}
+			o.IgnoreTables = []string{"test.tb"}
+		}
+		p, err := New(o)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.Run(context.Background(), collectors[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var rows []string
+	for _, e := range collectors[0].events {
+		switch strings.Fields(e)[0] {
+		case Insert, Update, Delete:
+			rows = append(rows, e)
+		}
+	}
+	if strings.Join(rows, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("want:\n%q\ngot:\n%q", expect, rows)
+	}
+	for _, e := range collectors[1].events {
+		if strings.Contains(e, "`test`.`tb`") {
+			t.Errorf("test.tb should be ignored, got: %s", e)
+		}
+	}
+	if len(collectors[1].events) == 0 {
+		t.Error("parser with test.% filter got no events")
+	}
+
+	// ErrStop from handler stops without error
+	c := &collector{stopAt: 2}
+	p, _ := New(opts)
+	if err := p.Run(context.Background(), c); err != nil || len(c.events) != 2 {
+		t.Errorf("ErrStop want 2 events without error, got %d, %v", len(c.events), err)
+	}
+	if file, pos := p.Position(); file != "binlog.000002" || pos == 0 {
+		t.Errorf("position want binlog.000002, got %s:%d", file, pos)
+	}
+
+	// cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Run(ctx, &collector{}); err != context.Canceled {
+		t.Errorf("cancelled context want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestParserLocation(t *testing.T) {
+	c := &collector{}
+	p, err := New(Options{
+		Files:    []string{"../test/binlog.000002"},
+		Tables:   []string{"test.timeTest"},
+		Location: time.FixedZone("CST", 8*3600),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = p.Run(context.Background(), c); err != nil {
+		t.Fatal(err.Error())
+	}
+	// TIMESTAMP in Location, DATETIME as it is
+	expect := "insert `test`.`timeTest` [@0 @1] [] => [2016-06-02 07:55:29 2016-06-01 23:55:29]"
+	if len(c.events) == 0 || !strings.Contains(strings.Join(c.events, "\n"), expect) {
+		t.Errorf("want %s, got %q", expect, c.events)
+	}
+}
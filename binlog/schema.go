@@ -0,0 +1,266 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+
+	// pingcap/parser
+	_ "github.com/pingcap/tidb/types/parser_driver"
+)
+
+// Table column and primary key info of a table
+type Table struct {
+	Schema      string
+	Name        string
+	Columns     []Column
+	PrimaryKeys []string // primary key column names, all columns if table has no primary key
+	Charset     string   // table default charset, empty if not declared
+}
+
+// Column column info from CREATE TABLE
+type Column struct {
+	Name     string
+	Type     string // column type definition, eg. int(10) unsigned, varchar(10)
+	Unsigned bool
+	Charset  string   // charset of string column, declared on column or table default, binary for binary strings, empty if unknown
+	Elems    []string // ENUM, SET members
+
+	Generated bool // GENERATED ALWAYS AS virtual or stored column, MySQL rejects explicit value
+	Invisible bool // INVISIBLE column, eg. generated invisible primary key my_row_id
+
+	tp byte // pingcap/parser type, same numbering as binlog column type, 0 if unknown
+}
+
+// String `db`.`tb`
+func (t *Table) String() string {
+	return fmt.Sprintf("`%s`.`%s`", t.Schema, t.Name)
+}
+
+// ColumnNames column names, @N for columns beyond schema
+func (t *Table) ColumnNames(count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		if t != nil && i < len(t.Columns) {
+			names[i] = t.Columns[i].Name
+		} else {
+			names[i] = fmt.Sprintf("@%d", i)
+		}
+	}
+	return names
+}
+
+// Unsigned column i is unsigned integer
+func (t *Table) Unsigned(i int) bool {
+	return t != nil && i < len(t.Columns) && t.Columns[i].Unsigned
+}
+
+// Writable column i accepts explicit value in INSERT VALUES and UPDATE SET, true if column not in schema.
+// Invisible columns are skipped too, they are not expected by INSERT without column list and may not exist in target.
+func (t *Table) Writable(i int) bool {
+	if t == nil || i >= len(t.Columns) {
+		return true
+	}
+	return !t.Columns[i].Generated && !t.Columns[i].Invisible
+}
+
+// NewTable build Table from CREATE TABLE statement
+func NewTable(stmt *ast.CreateTableStmt) *Table {
+	t := &Table{Schema: stmt.Table.Schema.String(), Name: stmt.Table.Name.String()}
+	// charsets pingcap/parser not support are kept in comments by removeIncompatibleWords,
+	// statement text may be the original SQL, removeIncompatibleWords again to get them
+	text := removeIncompatibleWords(stmt.Text())
+	charsets := make(map[string]string)
+	for _, m := range columnCharsetComment.FindAllStringSubmatch(text, -1) {
+		charsets[m[1]] = m[2]
+	}
+	if m := tableCharsetComment.FindStringSubmatch(text); m != nil {
+		t.Charset = m[1]
+	}
+	invisible := make(map[string]bool)
+	for _, m := range columnInvisibleComment.FindAllStringSubmatch(text, -1) {
+		invisible[m[1]] = true
+	}
+	for _, col := range stmt.Cols {
+		c := Column{
+			Name:     col.Name.Name.String(),
+			Type:     col.Tp.InfoSchemaStr(),
+			Unsigned: col.Tp.Flag&mysql.UnsignedFlag > 0,
+			Charset:  col.Tp.Charset,
+			Elems:    col.Tp.Elems,
+			tp:       col.Tp.Tp,
+		}
+		if cs, ok := charsets[c.Name]; ok {
+			c.Charset = cs
+		}
+		for _, opt := range col.Options {
+			if opt.Tp == ast.ColumnOptionGenerated {
+				c.Generated = true
+			}
+		}
+		c.Invisible = invisible[c.Name]
+		if c.Charset == "" && stringType(col.Tp.Tp) {
+			c.Charset = t.Charset
+		}
+		t.Columns = append(t.Columns, c)
+	}
+	for _, con := range stmt.Constraints {
+		if con.Tp == ast.ConstraintPrimaryKey {
+			for _, key := range con.Keys {
+				t.PrimaryKeys = append(t.PrimaryKeys, key.Column.Name.String())
+			}
+		}
+	}
+	// 如果表没有主键，把表的所有列合起来当主键
+	if len(t.PrimaryKeys) == 0 {
+		for _, c := range t.Columns {
+			t.PrimaryKeys = append(t.PrimaryKeys, c.Name)
+		}
+	}
+	return t
+}
+
+// stringType column type store characters or binary strings
+func stringType(tp byte) bool {
+	switch tp {
+	case mysql.TypeVarchar, mysql.TypeString, mysql.TypeVarString, mysql.TypeEnum, mysql.TypeSet,
+		mysql.TypeTinyBlob, mysql.TypeBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+		return true
+	}
+	return false
+}
+
+// ParseCreateTables parse CREATE TABLE statements, tables without database belong to latest USE database,
+// or database if no USE statement. database "%" matches any database.
+func ParseCreateTables(database, sql, charset string) ([]*ast.CreateTableStmt, error) {
+	sql = removeIncompatibleWords(sql)
+	stmts, _, err := parser.New().Parse(sql, charset, mysql.Charsets[charset])
+	if err != nil {
+		return nil, err
+	}
+	if database == "" {
+		database = "%"
+	}
+	var tables []*ast.CreateTableStmt
+	for _, stmt := range stmts {
+		switch node := stmt.(type) {
+		case *ast.CreateTableStmt:
+			if node.Table.Schema.String() == "" {
+				node.Table.Schema = model.NewCIStr(database)
+			}
+			tables = append(tables, node)
+		case *ast.UseStmt:
+			database = node.DBName
+		}
+	}
+	return tables, nil
+}
+
+// removeIncompatibleWords remove pingcap/parser not support words from schema
+// Note: only for MySQL `SHOW CREATE TABLE` hand-writing SQL not compatible
+func removeIncompatibleWords(sql string) string {
+	// CONSTRAINT col_fk FOREIGN KEY (col) REFERENCES tb (id) ON UPDATE CASCADE
+	re := regexp.MustCompile(` ON UPDATE CASCADE`)
+	sql = re.ReplaceAllString(sql, "")
+
+	// FULLTEXT KEY col_fk (col) /*!50100 WITH PARSER `ngram` */
+	// /*!50100 PARTITION BY LIST (col)
+	re = regexp.MustCompile(`/\*!5`)
+	sql = re.ReplaceAllString(sql, "/* 5")
+
+	// `col` varchar(10) CHARACTER SET gbk COLLATE gbk_bin DEFAULT NULL
+	// keep charset of SHOW CREATE TABLE column lines in comment for NewTable, remove the others
+	re = regexp.MustCompile("(?m)^(\\s*`[^`]+` [^\\n]*?)CHARACTER SET ([a-z_0-9]+)( COLLATE [a-z_0-9]+)?\\b")
+	sql = re.ReplaceAllString(sql, "${1}/* charset ${2} */")
+	re = regexp.MustCompile(`CHARACTER SET [a-z_0-9]* `)
+	sql = re.ReplaceAllString(sql, "")
+
+	// ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3 COLLATE=utf8mb3_bin
+	re = regexp.MustCompile(`(?m)^(\).*?)DEFAULT CHARSET=([a-z_0-9]+)( COLLATE=[a-z_0-9]+)?`)
+	sql = re.ReplaceAllString(sql, "${1}/* default charset ${2} */")
+	re = regexp.MustCompile(`DEFAULT CHARSET=[a-z_0-9]*`)
+	sql = re.ReplaceAllString(sql, "")
+
+	// `my_row_id` bigint unsigned NOT NULL AUTO_INCREMENT /*!80023 INVISIBLE */
+	// pingcap/parser not support invisible column, keep it in comment for NewTable
+	re = regexp.MustCompile("(?m)^(\\s*`[^`]+` [^\\n]*?)(/\\*!80023 INVISIBLE \\*/|\\bINVISIBLE\\b)")
+	sql = re.ReplaceAllString(sql, "${1}/* invisible */")
+
+	return sql
+}
+
+// charset and invisible comments left by removeIncompatibleWords
+var (
+	columnCharsetComment   = regexp.MustCompile("(?m)^\\s*`([^`]+)` .*?/\\* charset ([a-z_0-9]+) \\*/")
+	tableCharsetComment    = regexp.MustCompile(`(?m)^\).*?/\* default charset ([a-z_0-9]+) \*/`)
+	columnInvisibleComment = regexp.MustCompile("(?m)^\\s*`([^`]+)` .*?/\\* invisible \\*/")
+)
+
+// schemaStore tables of one Parser, keyed by `db`.`tb`
+type schemaStore struct {
+	tables   map[string]*Table
+	wildcard map[string]*Table // tables declared without database, keyed by table name
+}
+
+func newSchemaStore(sql, charset string) (*schemaStore, error) {
+	s := &schemaStore{tables: make(map[string]*Table), wildcard: make(map[string]*Table)}
+	if strings.TrimSpace(sql) == "" {
+		return s, nil
+	}
+	var stmts []*ast.CreateTableStmt
+	var errs []*SchemaError
+	if IsSnapshot(sql) {
+		snapshot, err := ParseSnapshot([]byte(sql))
+		if err != nil {
+			return nil, err
+		}
+		stmts, errs = snapshot.Parse(charset)
+	} else {
+		stmts, errs = ParseSchema("", sql, charset)
+	}
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		return nil, fmt.Errorf("schema parse failed, %s", strings.Join(msgs, "; "))
+	}
+	for _, stmt := range stmts {
+		t := NewTable(stmt)
+		if t.Schema == "%" {
+			s.wildcard[t.Name] = t
+			continue
+		}
+		s.tables[t.String()] = t
+	}
+	return s, nil
+}
+
+// table lookup table by database and name, nil if not found
+func (s *schemaStore) table(database, name string) *Table {
+	if t, ok := s.tables[fmt.Sprintf("`%s`.`%s`", database, name)]; ok {
+		return t
+	}
+	if t, ok := s.wildcard[name]; ok {
+		return t
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"testing"
+)
+
+func TestTableWritable(t *testing.T) {
+	sql := "CREATE TABLE `t` (\n" +
+		"  `my_row_id` bigint unsigned NOT NULL AUTO_INCREMENT /*!80023 INVISIBLE */,\n" +
+		"  `a` varchar(10) CHARACTER SET gbk DEFAULT NULL INVISIBLE,\n" +
+		"  `b` int GENERATED ALWAYS AS ((`id` + 1)) VIRTUAL,\n" +
+		"  `c` int GENERATED ALWAYS AS ((`id` * 2)) STORED NOT NULL,\n" +
+		"  `d` int DEFAULT NULL COMMENT 'visible',\n" +
+		"  PRIMARY KEY (`my_row_id`),\n" +
+		"  KEY `idx_d` (`d`) /*!80000 INVISIBLE */\n" +
+		") ENGINE=InnoDB"
+	stmts, err := ParseCreateTables("test", sql, "utf8mb4")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := NewTable(stmts[0])
+	cases := []struct {
+		generated, invisible bool
+	}{{false, true}, {false, true}, {true, false}, {true, false}, {false, false}}
+	for i, c := range cases {
+		col := table.Columns[i]
+		if col.Generated != c.generated || col.Invisible != c.invisible {
+			t.Errorf("column %s want generated %v invisible %v, got %v %v", col.Name, c.generated, c.invisible, col.Generated, col.Invisible)
+		}
+		if table.Writable(i) != (!c.generated && !c.invisible) {
+			t.Errorf("column %s writable wrong", col.Name)
+		}
+	}
+	if table.Columns[1].Charset != "gbk" {
+		t.Errorf("invisible column charset want gbk, got %s", table.Columns[1].Charset)
+	}
+	if !table.Writable(len(table.Columns)) {
+		t.Error("column beyond schema should be writable")
+	}
+	if len(table.PrimaryKeys) != 1 || table.PrimaryKeys[0] != "my_row_id" {
+		t.Errorf("primary key want my_row_id, got %v", table.PrimaryKeys)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pingcap/parser/ast"
+)
+
+// SchemaError CREATE TABLE statement which can't parse, other tables in the same file are not affected
+type SchemaError struct {
+	Table string // `db`.`tb`, `%` as database if no USE before it
+	Err   error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("table: %s, error: %s", e.Table, e.Err.Error())
+}
+
+var (
+	useStatement         = regexp.MustCompile("(?is)^USE\\s+`?([^`;\\s]+)`?")
+	createTableStatement = regexp.MustCompile("(?is)^CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(`[^`]+`|[^\\s.(`]+)(?:\\.(`[^`]+`|[^\\s(`]+))?")
+)
+
+// ParseSchema parse CREATE TABLE statements one by one, such as mysqldump --no-data output or hand-writing SQL.
+// Tables without database belong to latest USE database, or database if no USE statement, "%" matches any database.
+// Statements other than CREATE TABLE and USE are ignored, tables can't parse are returned as SchemaError.
+// Text() of returned statements is the original SQL without removeIncompatibleWords.
+func ParseSchema(database, sql, charset string) ([]*ast.CreateTableStmt, []*SchemaError) {
+	var tables []*ast.CreateTableStmt
+	var errs []*SchemaError
+	if database == "" {
+		database = "%"
+	}
+	for _, stmt := range splitStatements(sql) {
+		if m := useStatement.FindStringSubmatch(stmt); m != nil {
+			database = m[1]
+			continue
+		}
+		m := createTableStatement.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		nodes, err := ParseCreateTables(database, stmt, charset)
+		if err != nil {
+			db, name := database, m[1]
+			if m[2] != "" {
+				db, name = strings.Trim(m[1], "`"), m[2]
+			}
+			errs = append(errs, &SchemaError{Table: fmt.Sprintf("`%s`.`%s`", db, strings.Trim(name, "`")), Err: err})
+			continue
+		}
+		for _, node := range nodes {
+			node.SetText(stmt)
+		}
+		tables = append(tables, nodes...)
+	}
+	return tables, errs
+}
+
+// splitStatements split SQL script into statements like mysql client, DELIMITER command is supported.
+// Line comments are removed, block comments are kept, /*!40101 ... */ executable comments are part of statement.
+func splitStatements(sql string) []string {
+	var stmts []string
+	var buf strings.Builder
+	delimiter := ";"
+	blank := true // nothing but whitespace and comments in buf, DELIMITER only works at statement start
+	flush := func() {
+		if stmt := strings.TrimSpace(buf.String()); !blank && stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		buf.Reset()
+		blank = true
+	}
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case blank && lineStart(sql, i) && hasPrefixFold(sql[i:], "DELIMITER") &&
+			len(sql) > i+9 && (sql[i+9] == ' ' || sql[i+9] == '\t'):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			if fields := strings.Fields(sql[i : i+end]); len(fields) > 1 {
+				delimiter = fields[1]
+			}
+			i += end
+			buf.Reset()
+		case strings.HasPrefix(sql[i:], delimiter):
+			flush()
+			i += len(delimiter)
+		case c == '\'' || c == '"' || c == '`':
+			end := quoteEnd(sql, i)
+			buf.WriteString(sql[i:end])
+			blank = false
+			i = end
+		case c == '#' || (strings.HasPrefix(sql[i:], "--") && (i+2 == len(sql) || unicode.IsSpace(rune(sql[i+2])))):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end += i + 4
+			}
+			if strings.HasPrefix(sql[i:], "/*!") {
+				blank = false
+			}
+			buf.WriteString(sql[i:end])
+			i = end
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				blank = false
+			}
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return stmts
+}
+
+// quoteEnd end index of quoted string starts at i, backslash escape and doubled quote are supported
+func quoteEnd(sql string, i int) int {
+	quote := sql[i]
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(sql)
+}
+
+func lineStart(sql string, i int) bool {
+	return i == 0 || sql[i-1] == '\n'
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// SnapshotVersion version of Snapshot format
+const SnapshotVersion = 1
+
+// Snapshot JSON schema snapshot, CREATE TABLE statement of each table
+type Snapshot struct {
+	Version       int             `json:"version"`
+	Charset       string          `json:"charset,omitempty"`
+	Source        string          `json:"source,omitempty"` // host:port of MySQL or schema file
+	ServerVersion string          `json:"server_version,omitempty"`
+	GTIDExecuted  string          `json:"gtid_executed,omitempty"`
+	Time          string          `json:"time,omitempty"` // when schema loaded, RFC 3339
+	Tables        []SnapshotTable `json:"tables"`
+}
+
+// SnapshotTable table of Snapshot
+type SnapshotTable struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+	Create   string `json:"create"`
+}
+
+// IsSnapshot schema text is JSON snapshot rather than SQL
+func IsSnapshot(schema string) bool {
+	return strings.HasPrefix(strings.TrimSpace(schema), "{")
+}
+
+// ParseSnapshot load JSON snapshot
+func ParseSnapshot(buf []byte) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, err
+	}
+	if s.Version > SnapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d not supported", s.Version)
+	}
+	return &s, nil
+}
+
+// Parse parse CREATE TABLE of each table, charset of snapshot is used if not empty
+func (s *Snapshot) Parse(charset string) ([]*ast.CreateTableStmt, []*SchemaError) {
+	if s.Charset != "" {
+		charset = s.Charset
+	}
+	var tables []*ast.CreateTableStmt
+	var errs []*SchemaError
+	for _, t := range s.Tables {
+		nodes, tableErrs := ParseSchema(t.Database, t.Create, charset)
+		if len(nodes) == 0 && len(tableErrs) == 0 {
+			tableErrs = append(tableErrs, &SchemaError{Table: fmt.Sprintf("`%s`.`%s`", t.Database, t.Name), Err: fmt.Errorf("no CREATE TABLE statement")})
+		}
+		tables = append(tables, nodes...)
+		errs = append(errs, tableErrs...)
+	}
+	return tables, errs
+}
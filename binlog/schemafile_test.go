@@ -0,0 +1,96 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	sql := "-- comment; here\n" +
+		"SELECT 'a;b', \"c\\\";d\", `e;f` # tail;\n;" +
+		"/* block; */ SELECT 1 /*!40101 ;*/;\n" +
+		"DELIMITER //\n" +
+		"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END //\n" +
+		"delimiter ;\n" +
+		"SELECT 'it''s;'"
+	want := []string{
+		"SELECT 'a;b', \"c\\\";d\", `e;f`",
+		"/* block; */ SELECT 1 /*!40101 ;*/",
+		"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END",
+		"SELECT 'it''s;'",
+	}
+	got := splitStatements(sql)
+	if len(got) != len(want) {
+		t.Fatalf("want %d statements, got %d: %q", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d want %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	buf, err := os.ReadFile("../test/mysqldump.sql")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stmts, errs := ParseSchema("", string(buf), "utf8mb4")
+	var tables []string
+	for _, stmt := range stmts {
+		tables = append(tables, NewTable(stmt).String())
+	}
+	if len(tables) != 2 || tables[0] != "`shop`.`orders`" || tables[1] != "`crm`.`user`" {
+		t.Errorf("tables want `shop`.`orders`, `crm`.`user`, got %v", tables)
+	}
+	if len(errs) != 1 || errs[0].Table != "`shop`.`embedding`" {
+		t.Errorf("errors want `shop`.`embedding`, got %v", errs)
+	}
+	orders := NewTable(stmts[0])
+	if orders.Columns[1].Charset != "gbk" || orders.Columns[2].Charset != "utf8mb4" || !orders.Columns[0].Unsigned {
+		t.Errorf("orders columns wrong: %v", orders.Columns)
+	}
+
+	// snapshot keep parsed statements, which can parse again
+	snapshot := Snapshot{Version: SnapshotVersion}
+	for _, stmt := range stmts {
+		snapshot.Tables = append(snapshot.Tables, SnapshotTable{
+			Database: stmt.Table.Schema.String(),
+			Name:     stmt.Table.Name.String(),
+			Create:   stmt.Text(),
+		})
+	}
+	snapshot.Tables = append(snapshot.Tables, SnapshotTable{Database: "crm", Name: "bad", Create: "CREATE TABLE bad (id vector(3))"})
+	buf, _ = json.Marshal(snapshot)
+	if !IsSnapshot(string(buf)) {
+		t.Fatal("snapshot not detected")
+	}
+	s, err := ParseSnapshot(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stmts, errs = s.Parse("utf8mb4")
+	if len(stmts) != 2 || len(errs) != 1 || errs[0].Table != "`crm`.`bad`" {
+		t.Errorf("snapshot want 2 tables 1 error, got %d, %v", len(stmts), errs)
+	}
+	if cs := NewTable(stmts[0]).Columns[1].Charset; cs != "gbk" {
+		t.Errorf("snapshot column charset want gbk, got %s", cs)
+	}
+	if _, err = ParseSnapshot([]byte(`{"version": 2}`)); err == nil {
+		t.Error("snapshot version 2 should fail")
+	}
+}
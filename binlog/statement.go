@@ -0,0 +1,350 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/parser/charset"
+)
+
+// status vars code of QUERY_EVENT, see libbinlogevents/include/statement_events.h
+const (
+	qFlags2                       = 0
+	qSQLMode                      = 1
+	qCatalog                      = 2
+	qAutoIncrement                = 3
+	qCharset                      = 4
+	qTimeZone                     = 5
+	qCatalogNZ                    = 6
+	qLcTimeNames                  = 7
+	qCharsetDatabase              = 8
+	qTableMapForUpdate            = 9
+	qMasterDataWritten            = 10
+	qInvoker                      = 11
+	qUpdatedDBNames               = 12
+	qMicroseconds                 = 13
+	qExplicitDefaultsForTimestamp = 16
+	qDDLLoggedWithXid             = 17
+	qDefaultCollationForUTF8MB4   = 18
+	qSQLRequirePrimaryKey         = 19
+	qDefaultTableEncryption       = 20
+	qMariadbHRNow                 = 128
+	qMariadbXid                   = 129
+)
+
+// OPTION_* bits of Flags2 which are replicated
+const (
+	OptionAutoIsNull          = 1 << 14
+	OptionNotAutocommit       = 1 << 19
+	OptionNoForeignKeyChecks  = 1 << 26
+	OptionRelaxedUniqueChecks = 1 << 27
+)
+
+// QueryStatus session context recorded in status vars of QUERY_EVENT.
+// Server only writes some of them when they are not default or used by the statement, fields not recorded are zero.
+type QueryStatus struct {
+	Flags2                 uint32
+	HasFlags2              bool
+	SQLMode                uint64
+	HasSQLMode             bool
+	AutoIncrementIncrement uint16 // 1 if not recorded
+	AutoIncrementOffset    uint16 // 1 if not recorded
+	ClientCollation        uint16 // collation ids of character_set_client, collation_connection, collation_server
+	ConnectionCollation    uint16
+	ServerCollation        uint16
+	TimeZone               string
+	LcTimeNames            uint16 // 0 is en_US
+	DatabaseCollation      uint16
+	Microseconds           uint32
+	HasMicroseconds        bool
+
+	ExplicitDefaultsForTimestamp    bool
+	HasExplicitDefaultsForTimestamp bool
+	DefaultCollationForUTF8MB4      uint16
+}
+
+// ParseQueryStatus parse status vars of QUERY_EVENT, parsing stops at unknown code like MySQL does
+func ParseQueryStatus(vars []byte) (*QueryStatus, error) {
+	s := &QueryStatus{AutoIncrementIncrement: 1, AutoIncrementOffset: 1}
+	for pos := 0; pos < len(vars); {
+		code := vars[pos]
+		pos++
+		b := vars[pos:]
+		// n bytes needed by current code
+		need := func(n int) error {
+			if len(b) < n {
+				return fmt.Errorf("status var %d truncated at %d", code, pos)
+			}
+			return nil
+		}
+		// length of 1 byte length prefixed string
+		str := func() (int, error) {
+			if err := need(1); err != nil {
+				return 0, err
+			}
+			return 1 + int(b[0]), need(1 + int(b[0]))
+		}
+		var n int
+		var err error
+		switch code {
+		case qFlags2:
+			if err = need(4); err == nil {
+				s.Flags2, s.HasFlags2, n = binary.LittleEndian.Uint32(b), true, 4
+			}
+		case qSQLMode:
+			if err = need(8); err == nil {
+				s.SQLMode, s.HasSQLMode, n = binary.LittleEndian.Uint64(b), true, 8
+			}
+		case qCatalog:
+			// length, catalog, trailing zero
+			if n, err = str(); err == nil {
+				n++
+				err = need(n)
+			}
+		case qAutoIncrement:
+			if err = need(4); err == nil {
+				s.AutoIncrementIncrement = binary.LittleEndian.Uint16(b)
+				s.AutoIncrementOffset = binary.LittleEndian.Uint16(b[2:])
+				n = 4
+			}
+		case qCharset:
+			if err = need(6); err == nil {
+				s.ClientCollation = binary.LittleEndian.Uint16(b)
+				s.ConnectionCollation = binary.LittleEndian.Uint16(b[2:])
+				s.ServerCollation = binary.LittleEndian.Uint16(b[4:])
+				n = 6
+			}
+		case qTimeZone:
+			if n, err = str(); err == nil {
+				s.TimeZone = string(b[1:n])
+			}
+		case qCatalogNZ:
+			n, err = str()
+		case qLcTimeNames:
+			if err = need(2); err == nil {
+				s.LcTimeNames, n = binary.LittleEndian.Uint16(b), 2
+			}
+		case qCharsetDatabase:
+			if err = need(2); err == nil {
+				s.DatabaseCollation, n = binary.LittleEndian.Uint16(b), 2
+			}
+		case qTableMapForUpdate, qDDLLoggedWithXid, qMariadbXid:
+			n, err = 8, need(8)
+		case qMasterDataWritten:
+			n, err = 4, need(4)
+		case qInvoker:
+			// user, host
+			if n, err = str(); err == nil {
+				b = b[n:]
+				var host int
+				host, err = str()
+				n += host
+			}
+		case qUpdatedDBNames:
+			if err = need(1); err != nil {
+				break
+			}
+			n = 1
+			// 254 means too many databases, no names
+			if count := int(b[0]); count != 254 {
+				for i := 0; i < count && err == nil; i++ {
+					end := strings.IndexByte(string(b[n:]), 0)
+					if end < 0 {
+						err = fmt.Errorf("status var %d truncated at %d", code, pos)
+					}
+					n += end + 1
+				}
+			}
+		case qMicroseconds:
+			if err = need(3); err == nil {
+				s.Microseconds = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+				s.HasMicroseconds, n = true, 3
+			}
+		case qExplicitDefaultsForTimestamp:
+			if err = need(1); err == nil {
+				s.ExplicitDefaultsForTimestamp, s.HasExplicitDefaultsForTimestamp, n = b[0] != 0, true, 1
+			}
+		case qDefaultCollationForUTF8MB4:
+			if err = need(2); err == nil {
+				s.DefaultCollationForUTF8MB4, n = binary.LittleEndian.Uint16(b), 2
+			}
+		case qSQLRequirePrimaryKey, qDefaultTableEncryption:
+			n, err = 1, need(1)
+		case qMariadbHRNow:
+			n, err = 3, need(3)
+		default:
+			return s, nil
+		}
+		if err != nil {
+			return s, err
+		}
+		pos += n
+	}
+	return s, nil
+}
+
+// ParseRand seeds of RAND_EVENT, which is written before statement using RAND()
+func ParseRand(data []byte) (uint64, uint64, error) {
+	if len(data) < 16 {
+		return 0, 0, fmt.Errorf("RAND_EVENT length %d, want 16", len(data))
+	}
+	return binary.LittleEndian.Uint64(data), binary.LittleEndian.Uint64(data[8:]), nil
+}
+
+// Item_result types of user variable
+const (
+	UserVarString  = 0
+	UserVarReal    = 1
+	UserVarInt     = 2
+	UserVarDecimal = 4
+)
+
+// UserVar user variable of USER_VAR_EVENT, which is written before statement using it
+type UserVar struct {
+	Name      string
+	IsNull    bool
+	Type      byte   // UserVarString, UserVarReal, UserVarInt, UserVarDecimal
+	Collation uint32 // collation id of string value
+	Value     []byte
+	Unsigned  bool
+}
+
+// ParseUserVar parse USER_VAR_EVENT
+func ParseUserVar(data []byte) (*UserVar, error) {
+	errTruncated := fmt.Errorf("USER_VAR_EVENT truncated")
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	pos := 4 + size
+	if len(data) < pos+1 {
+		return nil, errTruncated
+	}
+	v := &UserVar{Name: string(data[4:pos]), IsNull: data[pos] != 0}
+	pos++
+	if v.IsNull {
+		return v, nil
+	}
+	if len(data) < pos+9 {
+		return nil, errTruncated
+	}
+	v.Type = data[pos]
+	v.Collation = binary.LittleEndian.Uint32(data[pos+1:])
+	size = int(binary.LittleEndian.Uint32(data[pos+5:]))
+	pos += 9
+	if len(data) < pos+size {
+		return nil, errTruncated
+	}
+	v.Value = data[pos : pos+size]
+	pos += size
+	// flags since MySQL 5.6, 1 for unsigned
+	if pos < len(data) {
+		v.Unsigned = data[pos]&1 > 0
+	}
+	return v, nil
+}
+
+// SQL MySQL literal of value, strings are hex with charset introducer and collation like mysqlbinlog
+func (v *UserVar) SQL() string {
+	if v.IsNull {
+		return "NULL"
+	}
+	switch v.Type {
+	case UserVarReal:
+		if len(v.Value) < 8 {
+			return "NULL"
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(v.Value)), 'g', -1, 64)
+	case UserVarInt:
+		if len(v.Value) < 8 {
+			return "NULL"
+		}
+		if v.Unsigned {
+			return strconv.FormatUint(binary.LittleEndian.Uint64(v.Value), 10)
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(v.Value)), 10)
+	case UserVarDecimal:
+		if len(v.Value) < 2 {
+			return "NULL"
+		}
+		return decodeDecimal(int(v.Value[0]), int(v.Value[1]), v.Value[2:])
+	}
+	hex := fmt.Sprintf("X'%X'", v.Value)
+	cs, collation, err := charset.GetCharsetInfoByID(int(v.Collation))
+	if err != nil {
+		return hex
+	}
+	return fmt.Sprintf("_%s %s COLLATE `%s`", cs, hex, collation)
+}
+
+// decodeDecimal MySQL binary DECIMAL into string, 9 digits every 4 bytes
+func decodeDecimal(precision, scale int, b []byte) string {
+	digitsBytes := []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+	integral := precision - scale
+	size := integral/9*4 + digitsBytes[integral%9] + scale/9*4 + digitsBytes[scale%9]
+	if len(b) < size || size == 0 {
+		return "NULL"
+	}
+	buf := make([]byte, size)
+	copy(buf, b)
+	negative := buf[0]&0x80 == 0
+	buf[0] ^= 0x80
+	if negative {
+		for i := range buf {
+			buf[i] ^= 0xff
+		}
+	}
+	// read n bytes big endian, pos moves forward
+	pos := 0
+	read := func(n int) uint32 {
+		var x uint32
+		for i := 0; i < n; i++ {
+			x = x<<8 | uint32(buf[pos+i])
+		}
+		pos += n
+		return x
+	}
+
+	var s strings.Builder
+	if negative {
+		s.WriteByte('-')
+	}
+	var digits strings.Builder
+	if n := digitsBytes[integral%9]; n > 0 {
+		digits.WriteString(strconv.FormatUint(uint64(read(n)), 10))
+	}
+	for i := 0; i < integral/9; i++ {
+		digits.WriteString(fmt.Sprintf("%09d", read(4)))
+	}
+	intPart := strings.TrimLeft(digits.String(), "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+	s.WriteString(intPart)
+	if scale > 0 {
+		s.WriteByte('.')
+		for i := 0; i < scale/9; i++ {
+			s.WriteString(fmt.Sprintf("%09d", read(4)))
+		}
+		if rest := scale % 9; rest > 0 {
+			s.WriteString(fmt.Sprintf("%0*d", rest, read(digitsBytes[rest])))
+		}
+	}
+	return s.String()
+}
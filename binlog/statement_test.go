@@ -0,0 +1,103 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestParseQueryStatus(t *testing.T) {
+	vars := []byte{
+		qFlags2, 0x00, 0x00, 0x00, 0x04, // OPTION_NO_FOREIGN_KEY_CHECKS
+		qSQLMode, 0x00, 0x00, 0x20, 0x4e, 0x00, 0x00, 0x00, 0x00,
+		qCatalogNZ, 3, 's', 't', 'd',
+		qAutoIncrement, 2, 0, 1, 0,
+		qCharset, 45, 0, 45, 0, 255, 0,
+		qTimeZone, 6, '+', '0', '8', ':', '0', '0',
+		qUpdatedDBNames, 2, 'a', 0, 'b', 0,
+		qMicroseconds, 0x40, 0xe2, 0x01,
+		200, 1, 2, 3, // unknown code, stop parsing
+	}
+	s, err := ParseQueryStatus(vars)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !s.HasFlags2 || s.Flags2&OptionNoForeignKeyChecks == 0 || !s.HasSQLMode || s.SQLMode != 1310720000 {
+		t.Errorf("flags2, sql_mode wrong: %+v", s)
+	}
+	if s.AutoIncrementIncrement != 2 || s.AutoIncrementOffset != 1 {
+		t.Errorf("auto_increment wrong: %+v", s)
+	}
+	if s.ClientCollation != 45 || s.ConnectionCollation != 45 || s.ServerCollation != 255 || s.TimeZone != "+08:00" {
+		t.Errorf("charset, time_zone wrong: %+v", s)
+	}
+	if !s.HasMicroseconds || s.Microseconds != 123456 {
+		t.Errorf("microseconds wrong: %+v", s)
+	}
+
+	// defaults
+	s, err = ParseQueryStatus(nil)
+	if err != nil || s.AutoIncrementIncrement != 1 || s.AutoIncrementOffset != 1 || s.HasSQLMode {
+		t.Errorf("empty status vars: %+v, %v", s, err)
+	}
+	if _, err = ParseQueryStatus([]byte{qSQLMode, 0, 0}); err == nil {
+		t.Error("truncated sql_mode without error")
+	}
+}
+
+func TestUserVar(t *testing.T) {
+	// name length, name, is_null, type, collation, value length, value, flags
+	event := func(name string, tp byte, collation uint32, value []byte, flags byte) []byte {
+		b := binary.LittleEndian.AppendUint32(nil, uint32(len(name)))
+		b = append(b, name...)
+		b = append(b, 0, tp)
+		b = binary.LittleEndian.AppendUint32(b, collation)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(value)))
+		return append(append(b, value...), flags)
+	}
+	cases := []struct {
+		data []byte
+		sql  string
+	}{
+		{append(binary.LittleEndian.AppendUint32(nil, 1), 'a', 1), "NULL"},
+		{event("a", UserVarString, 45, []byte("abc"), 0), "_utf8mb4 X'616263' COLLATE `utf8mb4_general_ci`"},
+		{event("a", UserVarString, 9999, []byte("abc"), 0), "X'616263'"},
+		{event("a", UserVarInt, 63, binary.LittleEndian.AppendUint64(nil, math.MaxUint64), 0), "-1"},
+		{event("a", UserVarInt, 63, binary.LittleEndian.AppendUint64(nil, math.MaxUint64), 1), "18446744073709551615"},
+		{event("a", UserVarReal, 63, binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5)), 0), "1.5"},
+		{event("a", UserVarDecimal, 63, []byte{8, 4, 0x84, 0xd2, 0x16, 0x2e}, 0), "1234.5678"},
+		{event("a", UserVarDecimal, 63, []byte{8, 4, 0x7b, 0x2d, 0xe9, 0xd1}, 0), "-1234.5678"},
+	}
+	for _, c := range cases {
+		v, err := ParseUserVar(c.data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if v.Name != "a" || v.SQL() != c.sql {
+			t.Errorf("want %s, got %s = %s", c.sql, v.Name, v.SQL())
+		}
+	}
+	if _, err := ParseUserVar([]byte{5, 0, 0, 0, 'a'}); err == nil {
+		t.Error("truncated USER_VAR_EVENT without error")
+	}
+}
+
+func TestParseRand(t *testing.T) {
+	data := binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, 1), 2)
+	if seed1, seed2, err := ParseRand(data); err != nil || seed1 != 1 || seed2 != 2 {
+		t.Errorf("rand seeds: %d, %d, %v", seed1, seed2, err)
+	}
+}
@@ -0,0 +1,471 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// Value one column value of a row image with column metadata
+type Value struct {
+	Column   string      // column name, @N if table not found in schema
+	Type     byte        // binlog column type, mysql.MYSQL_TYPE_*
+	SQLType  string      // column type definition from schema, empty if table not found
+	Unsigned bool        // unsigned integer column
+	Charset  string      // column charset from schema or TABLE_MAP metadata, empty if unknown
+	Elems    []string    // ENUM, SET members from schema or TABLE_MAP metadata
+	Raw      interface{} // value decoded by go-mysql, *replication.JsonDiff for partial JSON update
+	Missing  bool        // column not in row image, binlog_row_image is MINIMAL or NOBLOB
+}
+
+// RowValues typed values of one row image, table nil if not found in schema
+func RowValues(table *Table, types []byte, row []interface{}) []Value {
+	names := table.ColumnNames(len(row))
+	values := make([]Value, len(row))
+	for i, raw := range row {
+		v := Value{Column: names[i], Raw: raw}
+		if i < len(types) {
+			v.Type = types[i]
+		}
+		if table != nil && i < len(table.Columns) {
+			col := table.Columns[i]
+			v.SQLType, v.Unsigned, v.Charset, v.Elems = col.Type, col.Unsigned, col.Charset, col.Elems
+		}
+		values[i] = v
+	}
+	return values
+}
+
+// EventValues typed values of each row image of rows event, columns not in row image are Missing
+func EventValues(table *Table, ev *replication.RowsEvent) [][]Value {
+	values := make([][]Value, len(ev.Rows))
+	for i, row := range ev.Rows {
+		values[i] = TableMapValues(table, ev.Table, row)
+		if i < len(ev.SkippedColumns) {
+			for _, col := range ev.SkippedColumns[i] {
+				if col < len(values[i]) {
+					values[i][col].Missing = true
+				}
+			}
+		}
+	}
+	return values
+}
+
+// TableMapValues typed values of one row image like RowValues, ENUM, SET columns logged as STRING get their real type.
+// Charsets and ENUM, SET members not found in table come from TABLE_MAP_EVENT optional metadata,
+// which needs binlog_row_metadata on MySQL 8.0
+func TableMapValues(table *Table, tm *replication.TableMapEvent, row []interface{}) []Value {
+	values := RowValues(table, tm.ColumnType, row)
+	for i := range values {
+		if values[i].Type == mysql.MYSQL_TYPE_STRING && i < len(tm.ColumnMeta) {
+			if tp := byte(tm.ColumnMeta[i] >> 8); tp == mysql.MYSQL_TYPE_ENUM || tp == mysql.MYSQL_TYPE_SET {
+				values[i].Type = tp
+			}
+		}
+	}
+	for i, id := range tm.CollationMap() {
+		if i < len(values) && values[i].Charset == "" {
+			values[i].Charset = CollationCharset(id)
+		}
+	}
+	elems := func(m map[int][]string) {
+		charsets := tm.EnumSetCollationMap()
+		for i, members := range m {
+			if i >= len(values) || len(values[i].Elems) > 0 {
+				continue
+			}
+			// members are in column charset, decode into a copy, go-mysql cache the slices
+			decoded := make([]string, len(members))
+			for j, member := range members {
+				decoded[j] = member
+				if s, ok := decodeCharset(CollationCharset(charsets[i]), []byte(member)); ok {
+					decoded[j] = s
+				}
+			}
+			values[i].Elems = decoded
+		}
+	}
+	elems(tm.EnumStrValueMap())
+	elems(tm.SetStrValueMap())
+	return values
+}
+
+// IsNull value is SQL NULL
+func (v Value) IsNull() bool {
+	return v.Raw == nil && !v.Missing
+}
+
+// IsPartial value is partial JSON update, SQL is an expression on the column rather than a literal
+func (v Value) IsPartial() bool {
+	_, ok := v.Raw.(*replication.JsonDiff)
+	return ok
+}
+
+// Native typed Go value: int64, uint64, float64, string, []byte or nil,
+// kind is one of number, string, binary, decimal, null
+// strings in other charset are converted into UTF-8
+func (v Value) Native() (interface{}, string) {
+	if label, ok := v.label(); ok {
+		return label, "string"
+	}
+	if b, ok := v.characters(); ok {
+		if s, ok := decodeCharset(v.Charset, b); ok {
+			return s, "string"
+		}
+	}
+	return nativeValue(v.Raw, v.Type, v.Unsigned)
+}
+
+// MarshalJSON JSON of Native value, binary as base64 string
+func (v Value) MarshalJSON() ([]byte, error) {
+	n, _ := v.Native()
+	return json.Marshal(n)
+}
+
+// CSV field of value, NULL as \N. Fields with comma, double quote or newline are double quoted.
+func (v Value) CSV() string {
+	n, kind := v.Native()
+	switch kind {
+	case "null":
+		return `\N`
+	case "number", "decimal":
+		return v.SQL(false)
+	}
+	s := fmt.Sprint(n)
+	if b, ok := n.([]byte); ok {
+		s = string(b)
+	}
+	if strings.ContainsAny(s, ",\"\r\n") {
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	return s
+}
+
+// SQL MySQL literal of value, strings in hex format if hexString
+func (v Value) SQL(hexString bool) string {
+	if v.Raw == nil {
+		return "NULL"
+	}
+	switch v.Type {
+	case mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_NULL:
+		return fmt.Sprint(v.Raw)
+	// binlog keep unsigned value as signed
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONGLONG:
+		n, _ := v.Native()
+		return fmt.Sprint(n)
+	// go-mysql format fractional seconds by column precision, TIMESTAMP in parser TimestampStringLocation
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIMESTAMP,
+		mysql.MYSQL_TYPE_NEWDATE, mysql.MYSQL_TYPE_TIMESTAMP2, mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_TIME2:
+		return fmt.Sprint("'", v.Raw, "'")
+	case mysql.MYSQL_TYPE_YEAR:
+		// '0' means year 2000
+		if fmt.Sprint(v.Raw) == "0" {
+			return "'0000'"
+		}
+		return fmt.Sprint("'", v.Raw, "'")
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING:
+		switch val := v.Raw.(type) {
+		case string, []byte:
+			b, _ := v.characters()
+			return v.stringSQL(b, hexString)
+		case int, int64, int32, int16, int8, uint64, uint32, uint16, uint8:
+			// SET ENUM, index if members unknown
+			if label, ok := v.label(); ok {
+				return fmt.Sprintf(`"%s"`, Escape(label))
+			}
+			return fmt.Sprint(val)
+		default:
+			return fmt.Sprintf(`'%s'`, fmt.Sprint(val))
+		}
+
+	// MySQL 8.0/8.4: ENUM and SET types - stored as integers in binlog
+	case mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET:
+		if label, ok := v.label(); ok {
+			return fmt.Sprintf(`"%s"`, Escape(label))
+		}
+		return fmt.Sprint(v.Raw)
+
+	case mysql.MYSQL_TYPE_JSON:
+		switch val := v.Raw.(type) {
+		case *replication.JsonDiff:
+			return jsonDiffSQL(v.Column, val)
+		case []byte:
+			return jsonSQL(string(val))
+		default:
+			return jsonSQL(fmt.Sprint(val))
+		}
+	case mysql.MYSQL_TYPE_BIT:
+		switch val := v.Raw.(type) {
+		case int64:
+			return fmt.Sprintf(`b'%b'`, uint64(val))
+		case int, uint64:
+			return fmt.Sprintf(`b'%b'`, val)
+		default:
+			return fmt.Sprintf(`'%s'`, fmt.Sprint(val))
+		}
+
+	// MySQL 8.0/8.4: GEOMETRY and Spatial types - stored as binary WKB format
+	// Supports: GEOMETRY, POINT, LINESTRING, POLYGON, MULTIPOINT,
+	//           MULTILINESTRING, MULTIPOLYGON, GEOMETRYCOLLECTION
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		return fmt.Sprintf(`ST_GeomFromWKB(X'%s')`, hex.EncodeToString(v.bytes()))
+
+	// MySQL 9.0: VECTOR type - stored as binary format
+	// Supports: VECTOR data type for AI/ML applications
+	case mysql.MYSQL_TYPE_VECTOR:
+		return fmt.Sprintf(`STRING_TO_VECTOR(X'%s')`, hex.EncodeToString(v.bytes()))
+
+	// MySQL 8.0/8.4: BLOB types - stored as binary data
+	case mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
+		if b, ok := v.characters(); ok {
+			return v.stringSQL(b, hexString)
+		}
+		return fmt.Sprintf(`X'%s'`, hex.EncodeToString(v.bytes()))
+	}
+
+	// unknown types
+	if val, ok := v.Raw.([]byte); ok {
+		return fmt.Sprintf(`X'%s'`, hex.EncodeToString(val))
+	}
+	return fmt.Sprintf(`'%s'`, fmt.Sprint(v.Raw))
+}
+
+// jsonSQL JSON document literal, CAST keep the value as JSON rather than string
+func jsonSQL(doc string) string {
+	// go-mysql decode empty document as empty value, MySQL read it as JSON null
+	if doc == "" {
+		doc = "null"
+	}
+	return fmt.Sprintf(`CAST('%s' AS JSON)`, Escape(doc))
+}
+
+// jsonDiffSQL expression of partial JSON update on column, binlog_row_value_options=PARTIAL_JSON
+func jsonDiffSQL(column string, diff *replication.JsonDiff) string {
+	column = fmt.Sprintf("`%s`", column)
+	path := fmt.Sprintf(`'%s'`, Escape(diff.Path))
+	switch diff.Op {
+	case replication.JsonDiffOperationReplace:
+		return fmt.Sprintf("JSON_REPLACE(%s, %s, %s)", column, path, jsonSQL(diff.Value))
+	case replication.JsonDiffOperationInsert:
+		// add array element at position, or object member
+		if strings.HasSuffix(diff.Path, "]") {
+			return fmt.Sprintf("JSON_ARRAY_INSERT(%s, %s, %s)", column, path, jsonSQL(diff.Value))
+		}
+		return fmt.Sprintf("JSON_SET(%s, %s, %s)", column, path, jsonSQL(diff.Value))
+	case replication.JsonDiffOperationRemove:
+		return fmt.Sprintf("JSON_REMOVE(%s, %s)", column, path)
+	}
+	return column
+}
+
+// label ENUM member or comma separated SET members of index value, false if members unknown or index out of range
+func (v Value) label() (string, bool) {
+	var n uint64
+	switch val := v.Raw.(type) {
+	case int64:
+		n = uint64(val)
+	case int:
+		n = uint64(val)
+	default:
+		return "", false
+	}
+	if len(v.Elems) == 0 {
+		return "", false
+	}
+	switch {
+	case v.Type == mysql.MYSQL_TYPE_ENUM || strings.HasPrefix(v.SQLType, "enum("):
+		// 0 is the empty string error value
+		if n == 0 {
+			return "", true
+		}
+		if n > uint64(len(v.Elems)) {
+			return "", false
+		}
+		return v.Elems[n-1], true
+	case v.Type == mysql.MYSQL_TYPE_SET || strings.HasPrefix(v.SQLType, "set("):
+		if len(v.Elems) < 64 && n>>uint(len(v.Elems)) != 0 {
+			return "", false
+		}
+		var members []string
+		for i, elem := range v.Elems {
+			if n&(1<<uint(i)) != 0 {
+				members = append(members, elem)
+			}
+		}
+		return strings.Join(members, ","), true
+	}
+	return "", false
+}
+
+// stringSQL literal of string column value. Characters are converted into UTF-8 and escaped,
+// Escape is not safe for multi byte charsets like GBK whose second byte may be 0x5C.
+// Bytes not valid in column charset keep as hex with charset introducer, eg. _gbk X'5c',
+// hex without introducer only for binary strings.
+func (v Value) stringSQL(b []byte, hexString bool) string {
+	literal := fmt.Sprintf(`X'%s'`, hex.EncodeToString(b))
+	if hexString {
+		return literal
+	}
+	if s, ok := decodeCharset(v.Charset, b); ok {
+		// strconv.Quote will escape unicode \u0100
+		return fmt.Sprintf(`"%s"`, Escape(s))
+	}
+	if v.Charset != "" && v.Charset != "binary" {
+		return fmt.Sprintf("_%s %s", v.Charset, literal)
+	}
+	return literal
+}
+
+// characters raw bytes of CHAR, VARCHAR, BINARY, VARBINARY and TEXT values, false for BLOB and other types
+func (v Value) characters() ([]byte, bool) {
+	switch v.Type {
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING:
+	case mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
+		// TEXT columns are BLOB in binlog
+		if v.Charset == "binary" || v.Charset == "" && !strings.Contains(v.SQLType, "text") {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	switch val := v.Raw.(type) {
+	case string:
+		return []byte(val), true
+	case []byte:
+		return val, true
+	}
+	return nil, false
+}
+
+// bytes raw bytes of binary value
+func (v Value) bytes() []byte {
+	if val, ok := v.Raw.([]byte); ok {
+		return val
+	}
+	return []byte(fmt.Sprint(v.Raw))
+}
+
+// Escape escape string for MySQL string literal, without quote
+func Escape(sql string) string {
+	dest := make([]byte, 0, 2*len(sql))
+	var escape byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		escape = 0
+
+		switch c {
+		case 0: /* Must be escaped for 'mysql' */
+			escape = '0'
+		case '\n': /* Must be escaped for logs */
+			escape = 'n'
+		case '\r':
+			escape = 'r'
+		case '\\':
+			escape = '\\'
+		case '\'':
+			escape = '\''
+		case '"': /* Better safe than sorry */
+			escape = '"'
+		case '\032': /* This gives problems on Win32 */
+			escape = 'Z'
+		}
+
+		if escape != 0 {
+			dest = append(dest, '\\', escape)
+		} else {
+			dest = append(dest, c)
+		}
+	}
+
+	return string(dest)
+}
+
+// integerBits storage bits of integer column types, binlog keep unsigned value as signed
+var integerBits = map[byte]uint{
+	mysql.MYSQL_TYPE_TINY:     8,
+	mysql.MYSQL_TYPE_SHORT:    16,
+	mysql.MYSQL_TYPE_INT24:    24,
+	mysql.MYSQL_TYPE_LONG:     32,
+	mysql.MYSQL_TYPE_LONGLONG: 64,
+}
+
+// integerValue signed integer value, convert into uint64 by column type
+func integerValue(v int64, tp byte, unsigned bool) interface{} {
+	if bits, ok := integerBits[tp]; ok && unsigned && v < 0 {
+		u := uint64(v)
+		if bits < 64 {
+			u &= 1<<bits - 1
+		}
+		return u
+	}
+	return v
+}
+
+// nativeValue typed value of binlog column: int64, uint64, float64, string, []byte or nil,
+// kind is one of number, string, binary, decimal, null
+func nativeValue(v interface{}, tp byte, unsigned bool) (interface{}, string) {
+	switch val := v.(type) {
+	case nil:
+		return nil, "null"
+	case int8:
+		return integerValue(int64(val), tp, unsigned), "number"
+	case int16:
+		return integerValue(int64(val), tp, unsigned), "number"
+	case int32:
+		return integerValue(int64(val), tp, unsigned), "number"
+	case int64:
+		return integerValue(val, tp, unsigned), "number"
+	case int:
+		return integerValue(int64(val), tp, unsigned), "number"
+	case uint8:
+		return uint64(val), "number"
+	case uint16:
+		return uint64(val), "number"
+	case uint32:
+		return uint64(val), "number"
+	case uint64:
+		return val, "number"
+	case float32:
+		if math.IsNaN(float64(val)) || math.IsInf(float64(val), 0) {
+			return fmt.Sprint(val), "string"
+		}
+		return float64(val), "number"
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return fmt.Sprint(val), "string"
+		}
+		return val, "number"
+	case string:
+		return val, "string"
+	case []byte:
+		if tp == mysql.MYSQL_TYPE_JSON {
+			return string(val), "string"
+		}
+		return val, "binary"
+	}
+	// decimal.Decimal keep precision as string
+	if tp == mysql.MYSQL_TYPE_NEWDECIMAL || tp == mysql.MYSQL_TYPE_DECIMAL {
+		return fmt.Sprint(v), "decimal"
+	}
+	return fmt.Sprint(v), "string"
+}
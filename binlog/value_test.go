@@ -0,0 +1,149 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binlog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/shopspring/decimal"
+)
+
+func TestValueRenderers(t *testing.T) {
+	table := &Table{Schema: "test", Name: "t", Columns: []Column{
+		{Name: "id", Type: "int(10) unsigned", Unsigned: true},
+		{Name: "name", Type: "varchar(10)"},
+		{Name: "price", Type: "decimal(10,2)"},
+		{Name: "data", Type: "blob"},
+		{Name: "memo", Type: "text"},
+	}}
+	types := []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_BLOB}
+	row := RowValues(table, types, []interface{}{int32(-2), `it's "a", b`, decimal.RequireFromString("1.25"), []byte{0, 1}, nil})
+
+	cases := []struct {
+		sql, csv, json string
+	}{
+		{"4294967294", "4294967294", "4294967294"},
+		{`"it\'s \"a\", b"`, `"it's ""a"", b"`, `"it's \"a\", b"`},
+		{"1.25", "1.25", `"1.25"`},
+		{"X'0001'", "\x00\x01", `"AAE="`},
+		{"NULL", `\N`, "null"},
+	}
+	for i, c := range cases {
+		v := row[i]
+		if v.Column != table.Columns[i].Name {
+			t.Errorf("column %d want name %s, got %s", i, table.Columns[i].Name, v.Column)
+		}
+		if got := v.SQL(false); got != c.sql {
+			t.Errorf("%s SQL want %s, got %s", v.Column, c.sql, got)
+		}
+		if got := v.CSV(); got != c.csv {
+			t.Errorf("%s CSV want %q, got %q", v.Column, c.csv, got)
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if string(buf) != c.json {
+			t.Errorf("%s JSON want %s, got %s", v.Column, c.json, buf)
+		}
+	}
+	if !row[4].IsNull() || row[0].IsNull() {
+		t.Error("IsNull wrong")
+	}
+	if got := row[1].SQL(true); got != "X'69742773202261222c2062'" {
+		t.Errorf("hex string got %s", got)
+	}
+
+	// columns beyond schema named by position
+	row = RowValues(nil, types[:1], []interface{}{int32(-1)})
+	if row[0].Column != "@0" || row[0].SQL(false) != "-1" {
+		t.Errorf("want @0 = -1, got %s = %s", row[0].Column, row[0].SQL(false))
+	}
+}
+
+// TestJSONDecimal DECIMAL inside JSON document is a number without setting by library users
+func TestJSONDecimal(t *testing.T) {
+	doc, err := jsonBinary(docObject)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v := Value{Column: "j", Type: mysql.MYSQL_TYPE_JSON, Raw: doc}
+	if want := `CAST('{\"price\":2.50,\"qty\":1.0}' AS JSON)`; v.SQL(false) != want {
+		t.Errorf("want %s, got %s", want, v.SQL(false))
+	}
+}
+
+// TestJSONValues JSON literals parse back into the same document
+func TestJSONValues(t *testing.T) {
+	docs := []string{
+		`{"a": "it's \"quoted\""}`,
+		`{"path": "C:\\dir\\file", "line": "a\nb"}`,
+		`["中文", 1.0, 2.50, null, true]`,
+		`"O'Reilly"`,
+	}
+	for _, doc := range docs {
+		for _, raw := range []interface{}{doc, []byte(doc)} {
+			v := Value{Column: "j", Type: mysql.MYSQL_TYPE_JSON, Raw: raw}
+			sql := v.SQL(false)
+			stmt, err := parser.New().ParseOneStmt("SELECT "+sql, "", "")
+			if err != nil {
+				t.Errorf("%s parse error: %s", sql, err.Error())
+				continue
+			}
+			cast, ok := stmt.(*ast.SelectStmt).Fields.Fields[0].Expr.(*ast.FuncCastExpr)
+			if !ok {
+				t.Errorf("%s is not CAST", sql)
+				continue
+			}
+			if got := cast.Expr.(ast.ValueExpr).GetString(); got != doc {
+				t.Errorf("round trip want %s, got %s", doc, got)
+			}
+		}
+	}
+	empty := Value{Type: mysql.MYSQL_TYPE_JSON, Raw: []byte{}}
+	if got := empty.SQL(false); got != "CAST('null' AS JSON)" {
+		t.Errorf("empty JSON want null, got %s", got)
+	}
+
+	diffs := []struct {
+		diff *replication.JsonDiff
+		sql  string
+	}{
+		{&replication.JsonDiff{Op: replication.JsonDiffOperationReplace, Path: "$.a", Value: `"it's"`},
+			"JSON_REPLACE(`j`, '$.a', CAST('\\\"it\\'s\\\"' AS JSON))"},
+		{&replication.JsonDiff{Op: replication.JsonDiffOperationInsert, Path: "$.b", Value: "1"},
+			"JSON_SET(`j`, '$.b', CAST('1' AS JSON))"},
+		{&replication.JsonDiff{Op: replication.JsonDiffOperationInsert, Path: "$.c[0]", Value: "[]"},
+			"JSON_ARRAY_INSERT(`j`, '$.c[0]', CAST('[]' AS JSON))"},
+		{&replication.JsonDiff{Op: replication.JsonDiffOperationRemove, Path: `$."k'ey"`},
+			"JSON_REMOVE(`j`, '$.\\\"k\\'ey\\\"')"},
+	}
+	for _, d := range diffs {
+		v := Value{Column: "j", Type: mysql.MYSQL_TYPE_JSON, Raw: d.diff}
+		if !v.IsPartial() {
+			t.Error("JsonDiff value should be partial")
+		}
+		if got := v.SQL(false); got != d.sql {
+			t.Errorf("partial JSON want %s, got %s", d.sql, got)
+		}
+		if _, err := parser.New().ParseOneStmt("UPDATE t SET j = "+d.sql, "", ""); err != nil {
+			t.Errorf("%s parse error: %s", d.sql, err.Error())
+		}
+	}
+}
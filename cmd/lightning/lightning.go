@@ -14,6 +14,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/LianjiaTech/lightning/common"
 	"github.com/LianjiaTech/lightning/event"
 	"github.com/LianjiaTech/lightning/rebuild"
@@ -26,17 +28,48 @@ func main() {
 	// load config from lightning.yaml, master.info, relay.info, command lines
 	common.ParseConfig()
 
+	r := rebuild.New(&common.Config, &common.MasterInfo, os.Stdout)
+
+	// run lua plugin with fixtures offline, no binlog, no schema from mysql
+	if len(common.Config.Rebuild.LuaTest) > 0 {
+		if !r.LuaTest() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// load table schema info from mysql or create table SQL file
-	rebuild.LoadSchemaInfo()
+	r.LoadSchemaInfo()
+
+	// export schema into SQL file, directory or JSON snapshot, no binlog parsing
+	if common.Config.MySQL.SaveSchema != "" {
+		if err := r.SaveSchema(common.Config.MySQL.SaveSchema); err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
 	// load lua script
-	rebuild.LoadLuaScript()
+	r.LoadLuaScript()
+
+	// load wasm plugin module
+	if err := r.LoadWasmModule(); err != nil {
+		common.Log.Error(err.Error())
+		os.Exit(1)
+	}
 
 	go common.SyncReplicationInfo()
 
 	// binlog parser file || stream
-	event.BinlogParser()
+	event.NewHandler(&common.Config, &common.MasterInfo, r).BinlogParser()
+
+	// plugin stopped parsing, eg. -lua-violation abort
+	if err := r.Err(); err != nil {
+		common.Log.Error(err.Error())
+		os.Exit(1)
+	}
 
 	// query stat info which need print at last
-	rebuild.LastStatus()
+	r.LastStatus()
 }
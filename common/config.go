@@ -61,6 +61,9 @@ var gConfig = GlobalConfig{
 type MySQL struct {
 	BinlogFile                   []string      `yaml:"binlog-file"`
 	SchemaFile                   string        `yaml:"schema-file"`
+	SaveSchema                   string        `yaml:"-"`               // write loaded schema into SQL file, directory or JSON snapshot then exit
+	SchemaPrefetch               int           `yaml:"schema-prefetch"` // parallel connections to load all tables from mysql at start, 0 load each table on its first TABLE_MAP_EVENT
+	DriftReport                  string        `yaml:"drift-report"`    // JSON report of tables whose schema not match TABLE_MAP_EVENT, empty for stderr
 	MasterInfo                   string        `yaml:"master-info"`
 	ReplicateFromCurrentPosition bool          `yaml:"replicate-from-current-position"`
 	SyncInterval                 string        `yaml:"sync-interval"`
@@ -94,6 +97,8 @@ type Filters struct {
 	ExcludeGTIDSet string   `yaml:"exclude-gtid-set"`
 	StartTimestamp int64    `yaml:"-"`
 	StopTimestamp  int64    `yaml:"-"`
+	// 与 MySQL lower_case_table_names 含义相同，0: 库表名大小写敏感，1, 2: 大小写不敏感
+	LowerCaseTableNames int `yaml:"lower-case-table-names"`
 }
 
 var fConfig = Filters{
@@ -108,23 +113,57 @@ var fConfig = Filters{
 
 // Rebuild rebuild plugins
 type Rebuild struct {
-	Plugin              string        `yaml:"plugin"` // Plugin name: sql, flashback, stat, lua, find
+	Plugin              string        `yaml:"plugin"` // Plugin name: sql, flashback, stat, lua, wasm, find
 	CompleteInsert      bool          `yaml:"complete-insert"`
 	ExtendedInsertCount int           `yaml:"extended-insert-count"`
 	IgnoreColumns       []string      `yaml:"ignore-columns"`
 	Replace             bool          `yaml:"replace"`
+	ForceFlashback      bool          `yaml:"force-flashback"` // generate flashback SQL for tables whose schema not match binlog
 	SleepInterval       string        `yaml:"sleep-interval"`
 	SleepDuration       time.Duration `yaml:"-"`
 	ForeachTime         bool          `yaml:"foreach-time"`
-	CurrentEventTime    string        `yaml:"-"`
 	LuaScript           string        `yaml:"lua-script"`
+	LuaScripts          []LuaScript   `yaml:"lua-scripts"` // chained after lua-script, each with its own table filters
+	LuaMode             string        `yaml:"lua-mode"`    // compat: set GoValues globals as well, typed: only pass row table to lua
+	LuaTimeout          string        `yaml:"lua-timeout"` // time budget of each lua hook call, 0s for no limit
+	LuaTimeoutDuration  time.Duration `yaml:"-"`
+	LuaMemoryLimit      int           `yaml:"lua-memory-limit"`    // MB, heap limit while lua hook running, 0 for no limit
+	LuaViolation        string        `yaml:"lua-violation"`       // budget violation policy: skip, abort, retry
+	LuaRetry            int           `yaml:"lua-retry"`           // retry times of lua-violation retry, then skip
+	LuaSandbox          bool          `yaml:"lua-sandbox"`         // remove os, io, debug, dofile, loadfile, only require lua-modules
+	LuaModules          []string      `yaml:"lua-modules"`         // modules allowed to require in lua-sandbox
+	LuaReloadInterval   string        `yaml:"lua-reload-interval"` // check lua-script file change interval, 0s only reload on SIGHUP
+	LuaReloadDuration   time.Duration `yaml:"-"`
+	LuaTest             []string      `yaml:"-"` // fixture files of -lua-test
+	WasmModule          string        `yaml:"wasm-module"`
+	WasmTimeout         string        `yaml:"wasm-timeout"` // time budget of each wasm function call, 0s for no limit
+	WasmTimeoutDuration time.Duration `yaml:"-"`
+	WasmMemoryLimit     int           `yaml:"wasm-memory-limit"` // MB, linear memory limit of wasm module, 0 for no limit
 	WithoutDBName       bool          `yaml:"without-db-name"`
+	RewriteDB           []string      `yaml:"rewrite-db"`     // replicate-rewrite-db format, from_db->to_db
+	RewriteTables       []string      `yaml:"rewrite-tables"` // db.tb->db.tb, re:regexp->replacement
+	RewriteRules        []RewriteRule `yaml:"-"`
+	RouteTables         []string      `yaml:"route-tables"`  // physical table pattern->logical table, eg. shard\_%.order\_%->shard.order
+	LogicalTable        bool          `yaml:"logical-table"` // use logical table name in output, physical table as comment
+	RouteRules          []RouteRule   `yaml:"-"`
+}
+
+// LuaScript lua plugin script with table filters, empty tables match all events
+type LuaScript struct {
+	Script string   `yaml:"script"`
+	Tables []string `yaml:"tables"` // replication_wild_do_tables format
 }
 
 var rConfig = Rebuild{
-	Plugin:        "sql",
-	SleepInterval: "0s",
-	WithoutDBName: false,
+	Plugin:            "sql",
+	SleepInterval:     "0s",
+	LuaMode:           "compat",
+	LuaTimeout:        "0s",
+	LuaViolation:      "skip",
+	LuaRetry:          3,
+	LuaReloadInterval: "0s",
+	WasmTimeout:       "0s",
+	WithoutDBName:     false,
 }
 
 // Configuration config sections
@@ -254,7 +293,10 @@ func ParseConfig() {
 	mysqlPort := flag.Int("port", 0, "mysql port")
 	mysqlPassword := flag.String("password", "", "mysql password")
 	mysqlBinlogFile := flag.String("binlog-file", "", "binlog files separate with space, eg. --binlog-file='binlog.000001 binlog.000002'")
-	mysqlSchemaFile := flag.String("schema-file", "", "schema load from file")
+	mysqlSchemaFile := flag.String("schema-file", "", "schema load from SQL file, JSON snapshot or directory of schema files")
+	mysqlSchemaPrefetch := flag.Int("schema-prefetch", 0, "load all tables schema from mysql at start with N parallel connections, 0 load each table on its first TABLE_MAP_EVENT")
+	mysqlDriftReport := flag.String("drift-report", "", "write JSON report of tables whose schema not match binlog into file, default stderr")
+	mysqlSaveSchema := flag.String("save-schema", "", "save schema loaded from -schema-file or mysql then exit, .json for JSON snapshot, directory for one file each table, others for SQL file")
 	mysqlKeyring := flag.String("keyring", "", "mysql keyring file path")
 	mysqlMasterInfo := flag.String("master-info", "", "master.info file")
 	mysqlReplicateFromCurrent := flag.Bool("replicate-from-current-position", false, "binlog dump from current `show master status`")
@@ -274,17 +316,36 @@ func ParseConfig() {
 	filterTables := flag.String("tables", "", "binlog filter tables. eg. -tables db1.tb1,db1.tb2,db2.%")
 	filterIgnoreTables := flag.String("ignore-tables", "", "binlog filter ignore tables")
 	filterEventTypes := flag.String("event-types", "", "binlog filter event types")
+	filterLowerCaseTableNames := flag.Int("lower-case-table-names", -1, "table filter case sensitivity, same as mysql lower_case_table_names")
 
 	// Rebuild section config
 	rebuildPlugin := flag.String("plugin", "", "plugin name, use --list-plugin check all supported plugins")
 	rebuildCompleteInsert := flag.Bool("complete-insert", false, "complete column info, like 'INSERT INTO tb (col) VALUES (1)'")
 	rebuildExtendedInsertCount := flag.Int("extended-insert-count", 0, "use multiple-row INSERT syntax that include several VALUES")
 	rebuildReplace := flag.Bool("replace", false, "use REPLACE INTO instead of INSERT INTO, UPDATE")
+	rebuildForceFlashback := flag.Bool("force-flashback", false, "generate flashback SQL for tables whose schema not match binlog")
 	rebuildSleepInterval := flag.String("sleep-interval", "", "execute commands repeatedly with a sleep between")
 	rebuildIgnoreColumns := flag.String("ignore-columns", "", "query rebuild ignore columns")
 	rebuildLuaScript := flag.String("lua-script", "", "lua plugin script file")
+	rebuildLuaTimeout := flag.String("lua-timeout", "", "time budget of each lua hook call, eg. 100ms")
+	rebuildLuaMemoryLimit := flag.Int("lua-memory-limit", 0, "heap limit in MB while lua hook running")
+	rebuildLuaViolation := flag.String("lua-violation", "", "lua budget violation policy: skip, abort, retry")
+	rebuildLuaRetry := flag.Int("lua-retry", -1, "retry times of -lua-violation retry")
+	rebuildLuaSandbox := flag.Bool("lua-sandbox", false, "lua sandbox, remove os, io and only allow -lua-modules")
+	rebuildLuaModules := flag.String("lua-modules", "", "modules allowed to require in -lua-sandbox, eg. lightning,mysql")
+	rebuildLuaReloadInterval := flag.String("lua-reload-interval", "", "check -lua-script file change interval, reload at transaction boundary")
+	rebuildLuaTest := flag.String("lua-test", "", "run lua plugin with fixture files offline and compare with expect output, eg. -lua-test test/lua/demo.sql.yaml")
+	rebuildLuaScripts := flag.String("lua-scripts", "", "chained lua scripts with table filters, eg. -lua-scripts 'plugin/cache.lua:db1.%,db2.tb;plugin/audit.lua'")
+	rebuildWasmModule := flag.String("wasm-module", "", "wasm plugin module file")
+	rebuildWasmTimeout := flag.String("wasm-timeout", "", "time budget of each wasm function call, eg. 100ms")
+	rebuildWasmMemoryLimit := flag.Int("wasm-memory-limit", 0, "linear memory limit in MB of wasm module")
+	rebuildLuaMode := flag.String("lua-mode", "", "lua hook arguments, compat: row table and GoValues globals, typed: row table only")
 	rebuildWithoutDBName := flag.Bool("without-db-name", false, "insert/delete/update query without database name, only table name")
 	rebuildForeachTime := flag.Bool("foreach-time", false, "add time foreach sql")
+	rebuildRewriteDB := flag.String("rewrite-db", "", "rewrite database name in output, eg. -rewrite-db 'db1->db2'")
+	rebuildRewriteTables := flag.String("rewrite-tables", "", "rewrite table name in output, eg. -rewrite-tables 'db.tb->db.tb_recover'")
+	rebuildRouteTables := flag.String("route-tables", "", "route sharding tables onto logical table, eg. -route-tables 'shard\\_%.order\\_%->shard.order'")
+	rebuildLogicalTable := flag.Bool("logical-table", false, "use logical table name of -route-tables in output")
 
 	// master.info config
 	masterHost := flag.String("master-host", "", "master.info master_host")
@@ -382,6 +443,15 @@ func ParseConfig() {
 	if *mysqlSchemaFile != "" {
 		Config.MySQL.SchemaFile = *mysqlSchemaFile
 	}
+	if *mysqlSchemaPrefetch > 0 {
+		Config.MySQL.SchemaPrefetch = *mysqlSchemaPrefetch
+	}
+	if *mysqlDriftReport != "" {
+		Config.MySQL.DriftReport = *mysqlDriftReport
+	}
+	if *mysqlSaveSchema != "" {
+		Config.MySQL.SaveSchema = *mysqlSaveSchema
+	}
 	if *mysqlKeyring != "" {
 		Config.MySQL.Keyring = *mysqlKeyring
 	}
@@ -477,20 +547,23 @@ func ParseConfig() {
 		}
 	}
 	if *filterTables != "" {
-		Config.Filters.Tables = strings.Split(*filterTables, ",")
+		Config.Filters.Tables = splitTableFilters(*filterTables)
+	}
+	if *filterLowerCaseTableNames >= 0 {
+		Config.Filters.LowerCaseTableNames = *filterLowerCaseTableNames
 	}
 	for _, t := range Config.Filters.Tables {
-		if !strings.Contains(t, ".") {
-			fmt.Println("filter -tables format should be db.tb")
+		if err := CheckTableFilter(t); err != nil {
+			fmt.Println("filter -tables", err.Error())
 			os.Exit(1)
 		}
 	}
 	if *filterIgnoreTables != "" {
-		Config.Filters.IgnoreTables = strings.Split(*filterIgnoreTables, ",")
+		Config.Filters.IgnoreTables = splitTableFilters(*filterIgnoreTables)
 	}
 	for _, t := range Config.Filters.IgnoreTables {
-		if !strings.Contains(t, ".") {
-			fmt.Println("filter -ignore-tables format should be db.tb")
+		if err := CheckTableFilter(t); err != nil {
+			fmt.Println("filter -ignore-tables", err.Error())
 			os.Exit(1)
 		}
 	}
@@ -505,7 +578,7 @@ func ParseConfig() {
 	switch Config.Rebuild.Plugin {
 	case "":
 		Config.Rebuild.Plugin = "sql"
-	case "lua", "sql", "flashback", "stat", "find", "decrypt":
+	case "lua", "wasm", "sql", "flashback", "stat", "find", "decrypt":
 	default:
 		ListPlugin()
 		os.Exit(1)
@@ -519,6 +592,9 @@ func ParseConfig() {
 	if *rebuildReplace {
 		Config.Rebuild.Replace = *rebuildReplace
 	}
+	if *rebuildForceFlashback {
+		Config.Rebuild.ForceFlashback = *rebuildForceFlashback
+	}
 	if *rebuildSleepInterval != "" {
 		_, err = time.ParseDuration(*rebuildSleepInterval)
 		if err != nil {
@@ -538,8 +614,104 @@ func ParseConfig() {
 	if len(Config.Rebuild.IgnoreColumns) > 0 {
 		Config.Rebuild.CompleteInsert = true
 	}
-	if *rebuildLuaScript != "" {
-		Config.Rebuild.LuaScript = *rebuildLuaScript
+	parseLuaScripts(*rebuildLuaScript, *rebuildLuaScripts)
+	for _, s := range Config.Rebuild.LuaScripts {
+		if s.Script == "" {
+			fmt.Println("lua-scripts script should not be empty")
+			os.Exit(1)
+		}
+		for _, t := range s.Tables {
+			if err := CheckTableFilter(t); err != nil {
+				fmt.Println("lua-scripts", s.Script, err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+	if *rebuildLuaMode != "" {
+		Config.Rebuild.LuaMode = *rebuildLuaMode
+	}
+	switch Config.Rebuild.LuaMode {
+	case "":
+		Config.Rebuild.LuaMode = "compat"
+	case "compat", "typed":
+	default:
+		fmt.Printf("lua-mode '%s' not support, use compat or typed\n", Config.Rebuild.LuaMode)
+		os.Exit(1)
+	}
+	if *rebuildLuaTimeout != "" {
+		_, err = time.ParseDuration(*rebuildLuaTimeout)
+		if err != nil {
+			Log.Warn("-lua-timeout '%s' Error: %s", *rebuildLuaTimeout, err.Error())
+		} else {
+			Config.Rebuild.LuaTimeout = *rebuildLuaTimeout
+		}
+	}
+	Config.Rebuild.LuaTimeoutDuration, err = time.ParseDuration(Config.Rebuild.LuaTimeout)
+	if err != nil {
+		Log.Warn("lua-timeout '%s' Error: %s", Config.Rebuild.LuaTimeout, err.Error())
+		Config.Rebuild.LuaTimeoutDuration = time.Duration(0 * time.Second)
+	}
+	if *rebuildLuaMemoryLimit > 0 {
+		Config.Rebuild.LuaMemoryLimit = *rebuildLuaMemoryLimit
+	}
+	if *rebuildLuaViolation != "" {
+		Config.Rebuild.LuaViolation = *rebuildLuaViolation
+	}
+	switch Config.Rebuild.LuaViolation {
+	case "":
+		Config.Rebuild.LuaViolation = "skip"
+	case "skip", "abort", "retry":
+	default:
+		fmt.Printf("lua-violation '%s' not support, use skip, abort or retry\n", Config.Rebuild.LuaViolation)
+		os.Exit(1)
+	}
+	if *rebuildLuaRetry >= 0 {
+		Config.Rebuild.LuaRetry = *rebuildLuaRetry
+	}
+	if *rebuildLuaSandbox {
+		Config.Rebuild.LuaSandbox = *rebuildLuaSandbox
+	}
+	if *rebuildLuaModules != "" {
+		Config.Rebuild.LuaModules = strings.Split(*rebuildLuaModules, ",")
+	}
+	if *rebuildLuaTest != "" {
+		Config.Rebuild.LuaTest = strings.Split(*rebuildLuaTest, ",")
+	}
+	if *rebuildLuaReloadInterval != "" {
+		_, err = time.ParseDuration(*rebuildLuaReloadInterval)
+		if err != nil {
+			Log.Warn("-lua-reload-interval '%s' Error: %s", *rebuildLuaReloadInterval, err.Error())
+		} else {
+			Config.Rebuild.LuaReloadInterval = *rebuildLuaReloadInterval
+		}
+	}
+	Config.Rebuild.LuaReloadDuration, err = time.ParseDuration(Config.Rebuild.LuaReloadInterval)
+	if err != nil {
+		Log.Warn("lua-reload-interval '%s' Error: %s", Config.Rebuild.LuaReloadInterval, err.Error())
+		Config.Rebuild.LuaReloadDuration = time.Duration(0 * time.Second)
+	}
+	if *rebuildWasmModule != "" {
+		Config.Rebuild.WasmModule = *rebuildWasmModule
+	}
+	if Config.Rebuild.Plugin == "wasm" && Config.Rebuild.WasmModule == "" {
+		fmt.Println("-plugin wasm need -wasm-module")
+		os.Exit(1)
+	}
+	if *rebuildWasmTimeout != "" {
+		_, err = time.ParseDuration(*rebuildWasmTimeout)
+		if err != nil {
+			Log.Warn("-wasm-timeout '%s' Error: %s", *rebuildWasmTimeout, err.Error())
+		} else {
+			Config.Rebuild.WasmTimeout = *rebuildWasmTimeout
+		}
+	}
+	Config.Rebuild.WasmTimeoutDuration, err = time.ParseDuration(Config.Rebuild.WasmTimeout)
+	if err != nil {
+		Log.Warn("wasm-timeout '%s' Error: %s", Config.Rebuild.WasmTimeout, err.Error())
+		Config.Rebuild.WasmTimeoutDuration = time.Duration(0 * time.Second)
+	}
+	if *rebuildWasmMemoryLimit > 0 {
+		Config.Rebuild.WasmMemoryLimit = *rebuildWasmMemoryLimit
 	}
 	if *rebuildWithoutDBName {
 		Config.Rebuild.WithoutDBName = *rebuildWithoutDBName
@@ -547,6 +719,28 @@ func ParseConfig() {
 	if *rebuildForeachTime {
 		Config.Rebuild.ForeachTime = *rebuildForeachTime
 	}
+	if *rebuildRewriteDB != "" {
+		Config.Rebuild.RewriteDB = strings.Split(*rebuildRewriteDB, ",")
+	}
+	if *rebuildRewriteTables != "" {
+		Config.Rebuild.RewriteTables = strings.Split(*rebuildRewriteTables, ",")
+	}
+	Config.Rebuild.RewriteRules, err = ParseRewriteRules(Config.Rebuild.RewriteDB, Config.Rebuild.RewriteTables)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if *rebuildRouteTables != "" {
+		Config.Rebuild.RouteTables = strings.Split(*rebuildRouteTables, ",")
+	}
+	Config.Rebuild.RouteRules, err = ParseRouteRules(Config.Rebuild.RouteTables)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	if *rebuildLogicalTable {
+		Config.Rebuild.LogicalTable = *rebuildLogicalTable
+	}
 
 	LoadMasterInfo()
 
@@ -706,18 +900,23 @@ func SyncReplicationInfo() {
 	}
 }
 
-// FlushReplicationInfo flush master.info
+// FlushReplicationInfo flush MasterInfo into master.info
 func FlushReplicationInfo() {
-	if Config.MySQL.MasterInfo == "" {
+	FlushMasterInfo(Config.MySQL.MasterInfo, &MasterInfo)
+}
+
+// FlushMasterInfo write master info into file, nothing if file is empty
+func FlushMasterInfo(file string, masterInfo *ChangeMaster) {
+	if file == "" {
 		return
 	}
-	f, err := os.OpenFile(Config.MySQL.MasterInfo, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	if err != nil {
 		Log.Error(errors.Trace(err).Error())
 		return
 	}
 	defer f.Close()
-	info, err := yaml.Marshal(MasterInfo)
+	info, err := yaml.Marshal(masterInfo)
 	if err != nil {
 		Log.Error(errors.Trace(err).Error())
 		return
@@ -757,6 +956,7 @@ func ListPlugin() {
 	fmt.Println("  flashback: generate flashback query from ROW format binlog")
 	fmt.Println("  stat: statistic ROW format binlog table update|insert|delete query count")
 	fmt.Println("  lua: self define lua scripts")
+	fmt.Println("  wasm: self define WebAssembly module")
 	fmt.Println("  find: find binlog file name by event time")
 	fmt.Println("  decrypt: decrypt binlog file using keyring")
 }
@@ -773,3 +973,26 @@ func TimeOffset(timezone string) int {
 	_, localOffset := now.Zone()
 	return destOffset - localOffset
 }
+
+// parseLuaScripts apply -lua-script and -lua-scripts. -lua-scripts replaces scripts from config file,
+// lua-script of config file as well unless -lua-script is also given
+func parseLuaScripts(script, scripts string) {
+	if script != "" {
+		Config.Rebuild.LuaScript = script
+	}
+	if scripts == "" {
+		return
+	}
+	if script == "" {
+		Config.Rebuild.LuaScript = ""
+	}
+	Config.Rebuild.LuaScripts = nil
+	for _, script := range strings.Split(scripts, ";") {
+		sep := strings.SplitN(strings.TrimSpace(script), ":", 2)
+		s := LuaScript{Script: sep[0]}
+		if len(sep) == 2 && sep[1] != "" {
+			s.Tables = splitTableFilters(sep[1])
+		}
+		Config.Rebuild.LuaScripts = append(Config.Rebuild.LuaScripts, s)
+	}
+}
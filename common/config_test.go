@@ -101,6 +101,48 @@ func TestParseConfigFile(t *testing.T) {
 	pretty.Println(Config)
 }
 
+func TestParseLuaScripts(t *testing.T) {
+	rebuildOrg := Config.Rebuild
+	defer func() { Config.Rebuild = rebuildOrg }()
+
+	cases := []struct {
+		script, scripts string
+		want            string
+		wantScripts     int
+	}{
+		// lua-script from config file only
+		{"", "", "plugin/demo.flashback.lua", 1},
+		{"plugin/demo.sql.lua", "", "plugin/demo.sql.lua", 1},
+		// -lua-scripts replaces lua-script from config file
+		{"", "plugin/cache.lua:db1.%,db2.tb;plugin/audit.lua", "", 2},
+		{"plugin/demo.sql.lua", "plugin/cache.lua:db1.%", "plugin/demo.sql.lua", 1},
+	}
+	for _, c := range cases {
+		Config.Rebuild.LuaScript = "plugin/demo.flashback.lua"
+		Config.Rebuild.LuaScripts = []LuaScript{{Script: "plugin/demo.filter.lua"}}
+		parseLuaScripts(c.script, c.scripts)
+		if Config.Rebuild.LuaScript != c.want || len(Config.Rebuild.LuaScripts) != c.wantScripts {
+			t.Errorf("-lua-script %q -lua-scripts %q want %q and %d scripts, got %q and %v",
+				c.script, c.scripts, c.want, c.wantScripts, Config.Rebuild.LuaScript, Config.Rebuild.LuaScripts)
+		}
+	}
+	if tables := Config.Rebuild.LuaScripts[0].Tables; len(tables) != 1 || tables[0] != "db1.%" {
+		t.Errorf("lua-scripts tables want [db1.%%], got %v", tables)
+	}
+
+	// comma inside regular expression
+	parseLuaScripts("", `plugin/cache.lua:re:^db\.t{1,3}$,db2.%;plugin/audit.lua:re:^db[,_]x$`)
+	if tables := Config.Rebuild.LuaScripts[0].Tables; len(tables) != 2 || tables[0] != `re:^db\.t{1,3}$` || tables[1] != "db2.%" {
+		t.Errorf("lua-scripts tables want [re:^db\\.t{1,3}$ db2.%%], got %v", tables)
+	}
+	if tables := Config.Rebuild.LuaScripts[1].Tables; len(tables) != 1 || tables[0] != `re:^db[,_]x$` {
+		t.Errorf("lua-scripts tables want [re:^db[,_]x$], got %v", tables)
+	}
+	if !TableFiltersMatch("`db`.`ttt`", Config.Rebuild.LuaScripts[0].Tables) {
+		t.Error("`db`.`ttt` should match re:^db\\.t{1,3}$")
+	}
+}
+
 func TestVersion(t *testing.T) {
 	version()
 }
@@ -0,0 +1,91 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"github.com/LianjiaTech/lightning/binlog"
+)
+
+// RegexpFilterPrefix table filter use regular expression instead of LIKE pattern, eg. re:^db\.tb_[0-9]+$
+const RegexpFilterPrefix = binlog.RegexpFilterPrefix
+
+// SplitTableName split `db`.`tb` or db.tb into database and table name
+func SplitTableName(table string) (string, string) {
+	return binlog.SplitTableName(table)
+}
+
+// splitTableFilters split comma separated -tables, -ignore-tables, -lua-scripts filters.
+// Commas inside (), [], {} are part of regular expression, eg. re:^db\.t{1,3}$, `\` escape the next character.
+func splitTableFilters(filters string) []string {
+	var res []string
+	depth, start := 0, 0
+	for i := 0; i < len(filters); i++ {
+		switch filters[i] {
+		case '\\':
+			i++
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				res = append(res, filters[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, filters[start:])
+}
+
+// CheckTableFilter check -tables, -ignore-tables filter format
+func CheckTableFilter(filter string) error {
+	return binlog.CheckTableFilter(filter)
+}
+
+// TableFilterMatch check if table match filter with Config, see Configuration.TableFilterMatch
+func TableFilterMatch(table, filter string) bool {
+	return Config.TableFilterMatch(table, filter)
+}
+
+// TableFilterMatch check if table match filter, replicate-wild-do-table semantics, see binlog.TableFilterMatch.
+// Case sensitivity follows Filters.LowerCaseTableNames like MySQL does.
+func (c *Configuration) TableFilterMatch(table, filter string) bool {
+	if err := binlog.CheckTableFilter(filter); err != nil {
+		Log.Error("TableFilterMatch, filter: '%s' error: %s", filter, err.Error())
+		return false
+	}
+	return binlog.TableFilterMatch(table, filter, c.caseInsensitive())
+}
+
+// TableFiltersMatch check if table match any of filters with Config
+func TableFiltersMatch(table string, filters []string) bool {
+	return Config.TableFiltersMatch(table, filters)
+}
+
+// TableFiltersMatch check if table match any of filters
+func (c *Configuration) TableFiltersMatch(table string, filters []string) bool {
+	return binlog.TableFiltersMatch(table, filters, c.caseInsensitive())
+}
+
+// TableFiltersMatchCase TableFiltersMatch with case sensitivity given instead of Config.Filters.LowerCaseTableNames
+func TableFiltersMatchCase(table string, filters []string, insensitive bool) bool {
+	return binlog.TableFiltersMatch(table, filters, insensitive)
+}
+
+// caseInsensitive lower_case_table_names 1, 2 库表名大小写不敏感
+func (c *Configuration) caseInsensitive() bool {
+	return c.Filters.LowerCaseTableNames != 0
+}
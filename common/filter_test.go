@@ -0,0 +1,56 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestTableFilterMatch(t *testing.T) {
+	lowerOrg := Config.Filters.LowerCaseTableNames
+	defer func() { Config.Filters.LowerCaseTableNames = lowerOrg }()
+
+	cases := []struct {
+		table  string
+		filter string
+		lower  int
+		match  bool
+	}{
+		{"DB.TB", "db.tb", 0, false},
+		{"DB.TB", "db.tb", 1, true},
+		{"DB.TB", "db.t%", 2, true},
+		{"DB.ORDER_0001", "re:^db\\.order_[0-9]{4}$", 0, false},
+		{"DB.ORDER_0001", "re:^db\\.order_[0-9]{4}$", 1, true},
+	}
+	for _, c := range cases {
+		Config.Filters.LowerCaseTableNames = c.lower
+		if got := TableFilterMatch(c.table, c.filter); got != c.match {
+			t.Errorf("TableFilterMatch(%q, %q) lower_case_table_names=%d, want %v, got %v",
+				c.table, c.filter, c.lower, c.match, got)
+		}
+	}
+}
+
+func TestCheckTableFilter(t *testing.T) {
+	for _, filter := range []string{"db.tb", "db.%", "re:^db\\..*"} {
+		if err := CheckTableFilter(filter); err != nil {
+			t.Errorf("CheckTableFilter(%q) got error: %s", filter, err.Error())
+		}
+	}
+	for _, filter := range []string{"tb", "re:(db"} {
+		if err := CheckTableFilter(filter); err == nil {
+			t.Errorf("CheckTableFilter(%q) should return error", filter)
+		}
+	}
+}
@@ -16,6 +16,8 @@ package common
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
 	"runtime"
 	"strings"
@@ -125,20 +127,31 @@ func LogIfWarn(err error, format string, v ...interface{}) {
 
 // Verbose ...
 func Verbose(format string, a ...interface{}) {
-	if Config.Global.Verbose || Config.Global.VerboseVerbose {
-		if !strings.HasSuffix(format, "\n") {
-			format += "\n"
-		}
-		fmt.Printf(format, a...)
-	}
+	Config.Verbose(os.Stdout, format, a...)
 }
 
 // VerboseVerbose ...
 func VerboseVerbose(format string, a ...interface{}) {
-	if Config.Global.VerboseVerbose {
-		if !strings.HasSuffix(format, "\n") {
-			format += "\n"
-		}
-		fmt.Printf(format, a...)
+	Config.VerboseVerbose(os.Stdout, format, a...)
+}
+
+// Verbose -verbose debug info into w
+func (c *Configuration) Verbose(w io.Writer, format string, a ...interface{}) {
+	if c.Global.Verbose || c.Global.VerboseVerbose {
+		verbosePrint(w, format, a...)
+	}
+}
+
+// VerboseVerbose -verbose-verbose debug info into w
+func (c *Configuration) VerboseVerbose(w io.Writer, format string, a ...interface{}) {
+	if c.Global.VerboseVerbose {
+		verbosePrint(w, format, a...)
+	}
+}
+
+func verbosePrint(w io.Writer, format string, a ...interface{}) {
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
 	}
+	fmt.Fprintf(w, format, a...)
 }
@@ -0,0 +1,130 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteSeparator separator between from and to in rewrite rules, same as replicate-rewrite-db
+const RewriteSeparator = "->"
+
+// RewriteRule database or table name rewrite rule
+type RewriteRule struct {
+	FromDB    string
+	FromTable string // empty for database level rule
+	ToDB      string
+	ToTable   string
+	Regexp    *regexp.Regexp // match against db.tb, ToTable is the replacement template
+}
+
+// ParseRewriteRules parse -rewrite-db, -rewrite-tables into rules, table level rules come first
+// rewrite-db format: from_db->to_db
+// rewrite-tables format: from_db.from_tb->to_db.to_tb or re:regexp->replacement, eg. re:^db\.(.*)$->db_bak.$1
+func ParseRewriteRules(databases, tables []string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	for _, rule := range tables {
+		sep := strings.Index(rule, RewriteSeparator)
+		if sep <= 0 {
+			return nil, fmt.Errorf("rewrite-tables '%s' format should be db.tb->db.tb", rule)
+		}
+		from, to := rule[:sep], rule[sep+len(RewriteSeparator):]
+		if strings.HasPrefix(from, RegexpFilterPrefix) {
+			expr := strings.TrimPrefix(from, RegexpFilterPrefix)
+			if Config.caseInsensitive() {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite-tables '%s' regexp error: %s", rule, err.Error())
+			}
+			rules = append(rules, RewriteRule{Regexp: re, ToTable: to})
+			continue
+		}
+		fromDB, fromTable := SplitTableName(from)
+		toDB, toTable := SplitTableName(to)
+		if fromDB == "" || fromTable == "" || toDB == "" || toTable == "" {
+			return nil, fmt.Errorf("rewrite-tables '%s' format should be db.tb->db.tb", rule)
+		}
+		rules = append(rules, RewriteRule{FromDB: fromDB, FromTable: fromTable, ToDB: toDB, ToTable: toTable})
+	}
+	for _, rule := range databases {
+		sep := strings.Index(rule, RewriteSeparator)
+		if sep <= 0 || sep+len(RewriteSeparator) == len(rule) {
+			return nil, fmt.Errorf("rewrite-db '%s' format should be from_db->to_db", rule)
+		}
+		rules = append(rules, RewriteRule{
+			FromDB: strings.Trim(rule[:sep], "`"),
+			ToDB:   strings.Trim(rule[sep+len(RewriteSeparator):], "`"),
+		})
+	}
+	return rules, nil
+}
+
+// RewriteTableName rewrite database and table name with Config, see Configuration.RewriteTableName
+func RewriteTableName(database, table string) (string, string) {
+	return Config.RewriteTableName(database, table)
+}
+
+// RewriteTableName rewrite database and table name with Rebuild.RewriteRules, first match win
+func (c *Configuration) RewriteTableName(database, table string) (string, string) {
+	for _, rule := range c.Rebuild.RewriteRules {
+		switch {
+		case rule.Regexp != nil:
+			name := database + "." + table
+			if !rule.Regexp.MatchString(name) {
+				continue
+			}
+			db, tb := SplitTableName(rule.Regexp.ReplaceAllString(name, rule.ToTable))
+			if db == "" {
+				return database, tb
+			}
+			return db, tb
+		case rule.FromTable != "":
+			if c.nameEqual(database, rule.FromDB) && c.nameEqual(table, rule.FromTable) {
+				return rule.ToDB, rule.ToTable
+			}
+		default:
+			if c.nameEqual(database, rule.FromDB) {
+				return rule.ToDB, table
+			}
+		}
+	}
+	return database, table
+}
+
+// RewriteDatabaseName rewrite database name with database level rules of Config
+func RewriteDatabaseName(database string) string {
+	return Config.RewriteDatabaseName(database)
+}
+
+// RewriteDatabaseName rewrite database name with database level rules
+func (c *Configuration) RewriteDatabaseName(database string) string {
+	for _, rule := range c.Rebuild.RewriteRules {
+		if rule.Regexp == nil && rule.FromTable == "" && c.nameEqual(database, rule.FromDB) {
+			return rule.ToDB
+		}
+	}
+	return database
+}
+
+// nameEqual compare database or table name with lower_case_table_names
+func (c *Configuration) nameEqual(a, b string) bool {
+	if c.caseInsensitive() {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
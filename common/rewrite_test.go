@@ -0,0 +1,68 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestRewriteTableName(t *testing.T) {
+	rulesOrg := Config.Rebuild.RewriteRules
+	defer func() { Config.Rebuild.RewriteRules = rulesOrg }()
+
+	var err error
+	Config.Rebuild.RewriteRules, err = ParseRewriteRules(
+		[]string{"db1->db2"},
+		[]string{
+			"shop.orders->shop.orders_recover_20261018",
+			`re:^shard_([0-9]+)\.order_([0-9]+)$->recover.order_${1}_$2`,
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := [][4]string{
+		// database, table, expect database, expect table
+		{"shop", "orders", "shop", "orders_recover_20261018"},
+		{"shop", "items", "shop", "items"},
+		{"db1", "tb", "db2", "tb"},
+		{"shard_01", "order_0001", "recover", "order_01_0001"},
+		{"shard_01", "item_0001", "shard_01", "item_0001"},
+	}
+	for _, c := range cases {
+		db, tb := RewriteTableName(c[0], c[1])
+		if db != c[2] || tb != c[3] {
+			t.Errorf("RewriteTableName(%s, %s) want %s.%s, got %s.%s", c[0], c[1], c[2], c[3], db, tb)
+		}
+	}
+
+	if db := RewriteDatabaseName("db1"); db != "db2" {
+		t.Errorf("RewriteDatabaseName(db1) want db2, got %s", db)
+	}
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	wrong := [][2][]string{
+		{{"db1"}, nil},
+		{{"db1->"}, nil},
+		{nil, {"tb->tb2"}},
+		{nil, {"re:(db->db.tb"}},
+	}
+	for _, w := range wrong {
+		if _, err := ParseRewriteRules(w[0], w[1]); err == nil {
+			t.Errorf("ParseRewriteRules(%v, %v) should return error", w[0], w[1])
+		}
+	}
+}
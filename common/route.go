@@ -0,0 +1,65 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteRule map physical sharding tables onto one logical table
+type RouteRule struct {
+	Pattern string // table filter format, LIKE pattern or re:regexp
+	Logical string // `db`.`tb`
+}
+
+// ParseRouteRules parse -route-tables, format: physical_pattern->logical_db.logical_tb
+// eg. shard\_%.order\_%->shard.order
+func ParseRouteRules(routes []string) ([]RouteRule, error) {
+	var rules []RouteRule
+	for _, route := range routes {
+		sep := strings.Index(route, RewriteSeparator)
+		if sep <= 0 {
+			return nil, fmt.Errorf("route-tables '%s' format should be pattern->db.tb", route)
+		}
+		pattern, logical := route[:sep], route[sep+len(RewriteSeparator):]
+		if err := CheckTableFilter(pattern); err != nil {
+			return nil, fmt.Errorf("route-tables %s", err.Error())
+		}
+		database, table := SplitTableName(logical)
+		if database == "" || table == "" {
+			return nil, fmt.Errorf("route-tables '%s' logical table format should be db.tb", route)
+		}
+		rules = append(rules, RouteRule{
+			Pattern: pattern,
+			Logical: fmt.Sprintf("`%s`.`%s`", database, table),
+		})
+	}
+	return rules, nil
+}
+
+// RouteTable get logical table name of physical table with Config, see Configuration.RouteTable
+func RouteTable(table string) string {
+	return Config.RouteTable(table)
+}
+
+// RouteTable get logical table name of physical table, return empty string if no rule match
+func (c *Configuration) RouteTable(table string) string {
+	for _, rule := range c.Rebuild.RouteRules {
+		if c.TableFilterMatch(table, rule.Pattern) {
+			return rule.Logical
+		}
+	}
+	return ""
+}
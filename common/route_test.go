@@ -0,0 +1,49 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+	rulesOrg := Config.Rebuild.RouteRules
+	defer func() { Config.Rebuild.RouteRules = rulesOrg }()
+
+	var err error
+	Config.Rebuild.RouteRules, err = ParseRouteRules([]string{
+		`shard\_%.order\_%->shard.order`,
+		`re:^log_[0-9]+\.event$->log.event`,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cases := [][2]string{
+		{"`shard_00`.`order_0000`", "`shard`.`order`"},
+		{"`shard_63`.`order_1023`", "`shard`.`order`"},
+		{"`shard_63`.`item_1023`", ""},
+		{"`log_2026`.`event`", "`log`.`event`"},
+	}
+	for _, c := range cases {
+		if logical := RouteTable(c[0]); logical != c[1] {
+			t.Errorf("RouteTable(%s) want %s, got %s", c[0], c[1], logical)
+		}
+	}
+
+	for _, route := range []string{"shard_%.order_%", "shard_%.order_%->order", "tb->shard.order"} {
+		if _, err := ParseRouteRules([]string{route}); err == nil {
+			t.Errorf("ParseRouteRules(%s) should return error", route)
+		}
+	}
+}
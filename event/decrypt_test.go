@@ -1,23 +1,12 @@
 package event
 
 import (
-	"fmt"
 	"os"
 	"testing"
 
 	"github.com/LianjiaTech/lightning/common"
 )
 
-func TestParseKeyRing(t *testing.T) {
-	keys, err := parseKeyRing(common.DevPath + "/test/keyring")
-	if err != nil {
-		t.Error(err.Error())
-	}
-	for _, key := range keys {
-		fmt.Println(string(key.KeyID), string(key.UserID))
-	}
-}
-
 func TestDecryptBinlog(t *testing.T) {
 	// stdout redirect
 	std := os.Stdout
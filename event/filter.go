@@ -25,185 +25,200 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-var FollowGTID bool
-var FollowThreadID bool
-var Ending bool
-var Starting bool
-
 // FilterThreadID ...
-func FilterThreadID(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterThreadID(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.ThreadID == 0 {
+	if h.cfg.Filters.ThreadID == 0 {
 		return true
 	}
 	var threadId uint32
 	switch event.Header.EventType {
 	case replication.QUERY_EVENT:
 		threadId = event.Event.(*replication.QueryEvent).SlaveProxyID
-		if threadId == uint32(common.Config.Filters.ThreadID) {
+		if threadId == uint32(h.cfg.Filters.ThreadID) {
 			do = true
-			FollowThreadID = do
+			h.followThreadID = do
 		} else {
-			FollowThreadID = false
+			h.followThreadID = false
 		}
 	default:
-		common.VerboseVerbose("-- [DEBUG] FilterThreadID do: %v, Table: %s", FollowThreadID, threadId)
-		return FollowThreadID
+		h.verboseVerbose("-- [DEBUG] FilterThreadID do: %v, Table: %s", h.followThreadID, threadId)
+		return h.followThreadID
 	}
-	common.VerboseVerbose("-- [DEBUG] FilterThreadID do: %v, Table: %s", do, threadId)
+	h.verboseVerbose("-- [DEBUG] FilterThreadID do: %v, Table: %s", do, threadId)
 	return do
 }
 
 // FilterTables ...
-func FilterTables(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterTables(event *replication.BinlogEvent) bool {
 	var do bool
-	if len(common.Config.Filters.Tables) == 0 {
-		do = true
+	if len(h.cfg.Filters.Tables) == 0 || !tableEvent(event) {
+		return true
 	}
-	table := rebuild.RowEventTable(event)
-	for _, filter := range common.Config.Filters.Tables {
-		if tableFilterMatch(table, filter) {
+	tables := h.eventTables(event)
+	for _, table := range tables {
+		if h.cfg.TableFiltersMatch(table, h.cfg.Filters.Tables) {
 			do = true
 			break
 		}
 	}
-	common.VerboseVerbose("-- [DEBUG] FilterTables do: %v, Table: %s", do, table)
+	h.verboseVerbose("-- [DEBUG] FilterTables do: %v, Table: %s", do, strings.Join(tables, ","))
 	return do
 }
 
 // FilterIgnoreTables ...
-func FilterIgnoreTables(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterIgnoreTables(event *replication.BinlogEvent) bool {
 	do := true
-	if len(common.Config.Filters.IgnoreTables) == 0 {
+	if len(h.cfg.Filters.IgnoreTables) == 0 || !tableEvent(event) {
 		return true
 	}
-	table := rebuild.RowEventTable(event)
-	for _, filter := range common.Config.Filters.IgnoreTables {
-		if tableFilterMatch(table, filter) {
+	tables := h.eventTables(event)
+	for _, table := range tables {
+		if h.cfg.TableFiltersMatch(table, h.cfg.Filters.IgnoreTables) {
 			do = false
 			break
 		}
 	}
-	common.VerboseVerbose("-- [DEBUG] FilterIgnoreTables do: %v, Table: %s", do, table)
+	h.verboseVerbose("-- [DEBUG] FilterIgnoreTables do: %v, Table: %s", do, strings.Join(tables, ","))
 	return do
 }
 
+// eventTables get table names from rows event or query event
+func (h *Handler) eventTables(event *replication.BinlogEvent) []string {
+	if event.Header.EventType == replication.QUERY_EVENT {
+		return h.r.QueryEventTables(event)
+	}
+	if table := rebuild.RowEventTable(event); table != "" {
+		return []string{table}
+	}
+	return nil
+}
+
+// tableEvent rows event or QUERY_EVENT other than BEGIN, COMMIT which table and event type filters work on.
+// GTID, XID, ROTATE and BEGIN, COMMIT always pass, or transaction hooks would be unpaired.
+func tableEvent(event *replication.BinlogEvent) bool {
+	if event.Header.EventType == replication.QUERY_EVENT {
+		return !rebuild.IsTransactionQuery(string(event.Event.(*replication.QueryEvent).Query))
+	}
+	return rebuild.RowEventTable(event) != ""
+}
+
 // FilterStartDatetime ...
-func FilterStartDatetime(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterStartDatetime(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.StartTimestamp == 0 {
+	if h.cfg.Filters.StartTimestamp == 0 {
 		do = true
 	}
-	if int64(event.Header.Timestamp) >= common.Config.Filters.StartTimestamp {
+	if int64(event.Header.Timestamp) >= h.cfg.Filters.StartTimestamp {
 		do = true
 	}
 	return do
 }
 
 // FilterStopDatetime ...
-func FilterStopDatetime(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterStopDatetime(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.StopTimestamp == 0 {
+	if h.cfg.Filters.StopTimestamp == 0 {
 		do = true
 		return do
 	}
-	if int64(event.Header.Timestamp) <= common.Config.Filters.StopTimestamp {
+	if int64(event.Header.Timestamp) <= h.cfg.Filters.StopTimestamp {
 		do = true
 	} else {
-		Ending = true
+		h.ending = true
 	}
 	return do
 }
 
 // FilterServerID ...
-func FilterServerID(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterServerID(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.ServerID == 0 {
+	if h.cfg.Filters.ServerID == 0 {
 		do = true
 	}
-	if event.Header.ServerID == uint32(common.Config.Filters.ServerID) {
+	if event.Header.ServerID == uint32(h.cfg.Filters.ServerID) {
 		do = true
 	}
 	return do
 }
 
 // FilterIncludeGTIDs ...
-func FilterIncludeGTIDs(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterIncludeGTIDs(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.IncludeGTIDSet == "" {
+	if h.cfg.Filters.IncludeGTIDSet == "" {
 		return true
 	}
 	switch event.Header.EventType {
 	case replication.GTID_EVENT:
-		do = InGTIDSet(event.Event.(*replication.GTIDEvent).SID, event.Event.(*replication.GTIDEvent).GNO, common.Config.Filters.IncludeGTIDSet)
-		if FollowGTID && !do {
-			Ending = true
+		do = InGTIDSet(event.Event.(*replication.GTIDEvent).SID, event.Event.(*replication.GTIDEvent).GNO, h.cfg.Filters.IncludeGTIDSet)
+		if h.followGTID && !do {
+			h.ending = true
 		}
-		FollowGTID = do
+		h.followGTID = do
 	default:
-		do = FollowGTID
+		do = h.followGTID
 	}
 	return do
 }
 
 // FilterExcludeGTIDs ...
-func FilterExcludeGTIDs(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterExcludeGTIDs(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.ExcludeGTIDSet == "" {
+	if h.cfg.Filters.ExcludeGTIDSet == "" {
 		return true
 	}
 	switch event.Header.EventType {
 	case replication.GTID_EVENT:
-		do = !InGTIDSet(event.Event.(*replication.GTIDEvent).SID, event.Event.(*replication.GTIDEvent).GNO, common.Config.Filters.ExcludeGTIDSet)
-		FollowGTID = do
+		do = !InGTIDSet(event.Event.(*replication.GTIDEvent).SID, event.Event.(*replication.GTIDEvent).GNO, h.cfg.Filters.ExcludeGTIDSet)
+		h.followGTID = do
 	default:
-		do = FollowGTID
+		do = h.followGTID
 	}
 	return do
 }
 
 // FilterStartPos ...
-func FilterStartPos(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterStartPos(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.StartPosition == 0 || Starting {
+	if h.cfg.Filters.StartPosition == 0 || h.starting {
 		do = true
 	}
-	if event.Header.LogPos >= common.Config.Filters.StartPosition {
+	if event.Header.LogPos >= h.cfg.Filters.StartPosition {
 		do = true
-		Starting = true
+		h.starting = true
 	}
 	return do
 }
 
 // FilterStopPos ...
-func FilterStopPos(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterStopPos(event *replication.BinlogEvent) bool {
 	var do bool
-	if common.Config.Filters.StopPosition == 0 {
+	if h.cfg.Filters.StopPosition == 0 {
 		do = true
 		return do
 	}
-	if event.Header.LogPos <= common.Config.Filters.StopPosition {
+	if event.Header.LogPos <= h.cfg.Filters.StopPosition {
 		do = true
 	} else {
-		Ending = true
+		h.ending = true
 	}
 	return do
 }
 
 // FilterQueryType ...
-func FilterQueryType(event *replication.BinlogEvent) bool {
+func (h *Handler) FilterQueryType(event *replication.BinlogEvent) bool {
 	var do bool
-	if len(common.Config.Filters.EventType) == 0 {
+	if len(h.cfg.Filters.EventType) == 0 || !tableEvent(event) {
 		return true
 	}
 
-	for _, t := range common.Config.Filters.EventType {
+	for _, t := range h.cfg.Filters.EventType {
 		switch event.Header.EventType {
 		case replication.WRITE_ROWS_EVENTv2, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv0:
 			if strings.ToLower(t) == "insert" {
 				do = true
 			}
-		case replication.UPDATE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv0:
+		case replication.UPDATE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv0, replication.PARTIAL_UPDATE_ROWS_EVENT:
 			if strings.ToLower(t) == "update" {
 				do = true
 			}
@@ -212,7 +227,8 @@ func FilterQueryType(event *replication.BinlogEvent) bool {
 				do = true
 			}
 		case replication.QUERY_EVENT:
-			prefix := strings.Fields(string(event.Event.(*replication.QueryEvent).Query))[0]
+			// statement format DML, eg. INSERT INTO ... matches insert
+			prefix := strings.ToLower(strings.Fields(string(event.Event.(*replication.QueryEvent).Query))[0])
 			if strings.ToLower(t) == prefix {
 				do = true
 			}
@@ -226,117 +242,76 @@ func FilterQueryType(event *replication.BinlogEvent) bool {
 }
 
 // UpdateMasterInfo ...
-func UpdateMasterInfo(event *replication.BinlogEvent) {
+func (h *Handler) UpdateMasterInfo(event *replication.BinlogEvent) {
 	switch event.Header.EventType {
 	case replication.ROTATE_EVENT:
 		nextFile := string(event.Event.(*replication.RotateEvent).NextLogName)
-		if nextFile != common.MasterInfo.MasterLogFile {
-			common.MasterInfo.MasterLogFile = nextFile
-			common.MasterInfo.MasterLogPos = 4
+		if nextFile != h.master.MasterLogFile {
+			h.master.MasterLogFile = nextFile
+			h.master.MasterLogPos = 4
 		}
 	case replication.QUERY_EVENT:
-		common.MasterInfo.MasterLogPos = int64(event.Header.LogPos)
+		h.master.MasterLogPos = int64(event.Header.LogPos)
 	case replication.XID_EVENT:
-		common.MasterInfo.MasterLogPos = int64(event.Header.LogPos)
+		h.master.MasterLogPos = int64(event.Header.LogPos)
 		executedGTIDSet := fmt.Sprint(event.Event.(*replication.XIDEvent).GSet)
 		if executedGTIDSet != "<nil>" {
-			common.MasterInfo.ExecutedGTIDSet = executedGTIDSet
+			h.master.ExecutedGTIDSet = executedGTIDSet
 		}
 	default:
 	}
 
 	// START SLAVE UNTIL MASTER_LOG_FILE = 'log_name', MASTER_LOG_POS = log_pos
-	if common.MasterInfo.MasterLogFile == common.MasterInfo.UntilLogFile &&
-		common.MasterInfo.UntilLogPos <= common.MasterInfo.MasterLogPos {
-		Ending = true
+	if h.master.MasterLogFile == h.master.UntilLogFile &&
+		h.master.UntilLogPos <= h.master.MasterLogPos {
+		h.ending = true
 	}
-	common.MasterInfo.SecondsBehindMaster = time.Now().Unix() - int64(event.Header.Timestamp)
-	if common.Config.MySQL.SyncDuration.Seconds() == 0 {
-		common.FlushReplicationInfo()
+	h.master.SecondsBehindMaster = time.Now().Unix() - int64(event.Header.Timestamp)
+	if h.cfg.MySQL.SyncDuration.Seconds() == 0 {
+		common.FlushMasterInfo(h.cfg.MySQL.MasterInfo, h.master)
 	}
 }
 
 // BinlogFilter check if event will do
-func BinlogFilter(event *replication.BinlogEvent) bool {
-	if !FilterStopPos(event) {
+func (h *Handler) BinlogFilter(event *replication.BinlogEvent) bool {
+	if !h.FilterStopPos(event) {
 		return false
 	}
-	if !FilterStartPos(event) {
+	if !h.FilterStartPos(event) {
 		return false
 	}
-	if !FilterThreadID(event) {
+	if !h.FilterThreadID(event) {
 		return false
 	}
-	if !FilterExcludeGTIDs(event) {
+	if !h.FilterExcludeGTIDs(event) {
 		return false
 	}
-	if !FilterIncludeGTIDs(event) {
+	if !h.FilterIncludeGTIDs(event) {
 		return false
 	}
-	if !FilterServerID(event) {
+	if !h.FilterServerID(event) {
 		return false
 	}
-	if !FilterStopDatetime(event) {
+	if !h.FilterStopDatetime(event) {
 		return false
 	}
-	if !FilterStartDatetime(event) {
+	if !h.FilterStartDatetime(event) {
 		return false
 	}
-	if !FilterTables(event) {
+	if !h.FilterTables(event) {
 		return false
 	}
-	if !FilterIgnoreTables(event) {
+	if !h.FilterIgnoreTables(event) {
 		return false
 	}
-	if !FilterQueryType(event) {
+	if !h.FilterQueryType(event) {
 		return false
 	}
-	return true
-}
-
-func tableFilterMatch(table, filter string) bool {
-	var match, dbMatch, tbMatch bool
-	table = strings.Replace(table, "`", "", -1)
-	schema := strings.Split(table, ".")
-	if len(schema) < 2 {
-		return match
-	}
-	sep := strings.Split(filter, ".")
-	if len(sep) < 2 {
-		common.Log.Error("tableFilterMatch, -tables: '%s' filter format error", filter)
-		return match
-	}
-
-	// 库表名大小写不敏感
-	if sep[0] == "%" {
-		dbMatch = true
-	}
-	// 当 -schema 指定的文件中只有 CREATE TABLE 忘了写 USE db 的时候，schema[0] 为 %
-	if schema[0] == "%" {
-		dbMatch = true
-	}
-	if i := strings.Index(sep[0], "%"); i > 0 {
-		if strings.HasPrefix(schema[0], sep[0][0:i]) {
-			dbMatch = true
-		}
-	}
-	if strings.ToLower(schema[0]) == strings.ToLower(sep[0]) {
-		dbMatch = true
-	}
-
-	if sep[1] == "%" {
-		tbMatch = true
-	}
-	if i := strings.Index(sep[1], "%"); i > 0 {
-		if strings.HasPrefix(strings.ToLower(schema[1]), strings.ToLower(sep[1][0:i])) {
-			tbMatch = true
-		}
-	}
-	if schema[1] == sep[1] {
-		tbMatch = true
+	// lua Filter(event) after built-in filters
+	if !h.r.LuaFilter(event) {
+		return false
 	}
-	match = dbMatch && tbMatch
-	return match
+	return true
 }
 
 // InGTIDSet ...
@@ -15,24 +15,88 @@ package event
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
 )
 
-func TestTableFilterMatch(t *testing.T) {
-	tables := []string{
-		"`db`.`tb`",
-		"db.tb",
+func queryEvent(schema, sql string) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+		Event:  &replication.QueryEvent{Schema: []byte(schema), Query: []byte(sql)},
 	}
+}
 
-	filters := []string{
-		"db.%",
-		"db.tb%",
-		"db%.tb%",
-		"db%.%",
+func TestFilterTablesQueryEvent(t *testing.T) {
+	tablesOrg := common.Config.Filters.Tables
+	ignoreOrg := common.Config.Filters.IgnoreTables
+	defer func() {
+		common.Config.Filters.Tables = tablesOrg
+		common.Config.Filters.IgnoreTables = ignoreOrg
+	}()
+
+	h := newHandler()
+	common.Config.Filters.Tables = []string{"test.tb"}
+	common.Config.Filters.IgnoreTables = []string{"test.tb_ignore"}
+	cases := []struct {
+		event *replication.BinlogEvent
+		do    bool
+	}{
+		{queryEvent("test", "BEGIN"), true},
+		{queryEvent("test", "ALTER TABLE tb ADD COLUMN c int"), true},
+		{queryEvent("other", "ALTER TABLE test.tb ADD COLUMN c int"), true},
+		{queryEvent("other", "ALTER TABLE tb ADD COLUMN c int"), false},
+		{queryEvent("test", "UPDATE tb SET b = 'a' WHERE a = 1"), true},
+		{queryEvent("test", "DROP TABLE tb2"), false},
+		{queryEvent("test", "RENAME TABLE tb TO tb_ignore"), false},
+		{queryEvent("test", "CREATE DATABASE db"), false},
 	}
-	for _, table := range tables {
-		for _, filter := range filters {
-			fmt.Println(table, filter, tableFilterMatch(table, filter))
+	for _, c := range cases {
+		sql := string(c.event.Event.(*replication.QueryEvent).Query)
+		if do := h.FilterTables(c.event) && h.FilterIgnoreTables(c.event); do != c.do {
+			t.Errorf("filter query %q want %v, got %v", sql, c.do, do)
 		}
 	}
 }
+
+func TestFilterTablesTransactionHooks(t *testing.T) {
+	filtersOrg := common.Config.Filters
+	rebuildOrg := common.Config.Rebuild
+	defer func() {
+		common.Config.Filters = filtersOrg
+		common.Config.Rebuild = rebuildOrg
+	}()
+
+	script := filepath.Join(t.TempDir(), "hooks.lua")
+	err := os.WriteFile(script, []byte(`
+Begins, Commits, Gtids = 0, 0, 0
+function TransactionBegin(event) Begins = Begins + 1 end
+function TransactionCommit(xid, gtid) Commits = Commits + 1 end
+function Gtid(gtid, event) Gtids = Gtids + 1 end
+function Finalizer() print(Begins, Commits, Gtids) end
+`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	common.Config.Rebuild.Plugin = "lua"
+	common.Config.Rebuild.LuaScript = script
+	common.Config.Rebuild.LuaScripts = nil
+	common.Config.Filters.Tables = []string{"test.%"}
+	common.Config.Filters.EventType = []string{"insert", "update", "delete"}
+	h := newHandler()
+	h.r.LoadLuaScript()
+
+	if err = h.BinlogFileParser([]string{common.DevPath + "/test/binlog.000002"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	var begins, commits, gtids int
+	fmt.Sscan(common.CaptureOutput(h.r.LastStatus), &begins, &commits, &gtids)
+	// GTID, XID have no table, table and event type filters should not drop them
+	if begins == 0 || begins != commits || gtids < commits {
+		t.Errorf("begin: %d, commit: %d, gtid: %d", begins, commits, gtids)
+	}
+}
@@ -14,9 +14,7 @@
 package event
 
 import (
-	"bytes"
 	"context"
-	"crypto/cipher"
 	"database/sql"
 	"fmt"
 	"io"
@@ -24,39 +22,53 @@ import (
 	"sort"
 	"time"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 	"github.com/LianjiaTech/lightning/rebuild"
 
 	// database/sql
-	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/juju/errors"
 )
 
-// https://dev.mysql.com/doc/internals/en/binary-log-structure-and-contents.html
+// Handler run lightning filters and sql, flashback, stat, lua, wasm plugins for each event of binlog.Parser.
+// Filter state belongs to the Handler, plugin state to its Rebuilder, handlers are independent with each other.
+type Handler struct {
+	binlog.NopHandler
+	cfg    *common.Configuration
+	master *common.ChangeMaster
+	r      *rebuild.Rebuilder
+	stream bool // update master.info for replication stream
+	parser *binlog.Parser
+
+	followGTID     bool
+	followThreadID bool
+	ending         bool // stop position, time, GTID or UNTIL reached
+	starting       bool // start position reached
+}
 
-const (
-	FileHeaderLength  = 4  // binlog file magic header 0XFE bin
-	EventHeaderLength = 19 // event header length
-)
+// NewHandler create Handler with config, master info of replication stream and plugins to call
+func NewHandler(cfg *common.Configuration, master *common.ChangeMaster, r *rebuild.Rebuilder) *Handler {
+	return &Handler{cfg: cfg, master: master, r: r}
+}
 
 // BinlogParser ...
-func BinlogParser() {
-	if len(common.Config.MySQL.BinlogFile) > 0 {
+func (h *Handler) BinlogParser() {
+	if len(h.cfg.MySQL.BinlogFile) > 0 {
 		// check each binlog file start time for event time filter
-		err := CheckBinlogFileTime(common.Config.MySQL.BinlogFile)
+		files, err := h.CheckBinlogFileTime(h.cfg.MySQL.BinlogFile)
 		if err != nil {
 			println(err.Error())
 			return
 		}
-		switch common.Config.Rebuild.Plugin {
+		switch h.cfg.Rebuild.Plugin {
 		case "find":
-			fmt.Println(common.Config.MySQL.BinlogFile)
+			fmt.Fprintln(h.r.Output(), files)
 			return
 		case "decrypt":
-			for _, binlog := range common.Config.MySQL.BinlogFile {
-				err = DecryptBinlog(binlog, common.Config.MySQL.Keyring)
+			for _, file := range files {
+				err = binlog.Decrypt(h.r.Output(), file, h.cfg.MySQL.Keyring)
 				if err != nil {
 					println(err.Error())
 				}
@@ -65,14 +77,14 @@ func BinlogParser() {
 		}
 
 		// parse each binlog file
-		err = BinlogFileParser(common.Config.MySQL.BinlogFile)
+		err = h.BinlogFileParser(files)
 		if err != nil {
-			fmt.Println(err.Error())
+			fmt.Fprintln(h.r.Output(), err.Error())
 		}
 		return
 	}
-	if common.Config.MySQL.MasterInfo != "" {
-		err := BinlogStreamParser()
+	if h.cfg.MySQL.MasterInfo != "" {
+		err := h.BinlogStreamParser()
 		if err != nil {
 			println(err.Error())
 		}
@@ -81,14 +93,17 @@ func BinlogParser() {
 
 // CheckBinlogFileHeader check file is binary log
 func CheckBinlogFileHeader(buf []byte) bool {
-	// 0xFE62696E not encrypted
-	// 0xFD62696E encrypted
-	return bytes.Equal(buf, []byte{0xfe, 'b', 'i', 'n'}) || bytes.Equal(buf, []byte{0xfd, 'b', 'i', 'n'})
+	return binlog.CheckFileHeader(buf)
 }
 
 // CheckBinlogFileEncrypt check file is encrypted
 func CheckBinlogFileEncrypt(buf []byte) bool {
-	return bytes.Equal(buf, []byte{0xfd, 'b', 'i', 'n'})
+	return binlog.CheckFileEncrypt(buf)
+}
+
+// DecryptBinlog decrypt binlog file with keyring into stdout
+func DecryptBinlog(file, keyring string) error {
+	return binlog.Decrypt(os.Stdout, file, keyring)
 }
 
 // CheckBinlogFormat check binlog format
@@ -111,71 +126,52 @@ func CheckBinlogFormat(dsn string) string {
 	return format
 }
 
-// CheckBinlogFileTime ...
-func CheckBinlogFileTime(files []string) error {
-	var err error
+// CheckBinlogFileTime files sorted by index, out of event time filter ones removed
+func (h *Handler) CheckBinlogFileTime(files []string) ([]string, error) {
 	var filteredBinlogs []string
 
 	// no binlog, or only one, by pass check
 	if len(files) < 2 {
-		return err
+		return files, nil
 	}
 
 	// if no time filter, no need to check binlog files time
-	if common.Config.Filters.StartDatetime == "" &&
-		common.Config.Filters.StopDatetime == "" {
-		return err
+	if h.cfg.Filters.StartDatetime == "" &&
+		h.cfg.Filters.StopDatetime == "" {
+		return files, nil
 	}
 
 	// file sort by index
-	sort.Strings(common.Config.MySQL.BinlogFile)
+	files = append([]string(nil), files...)
+	sort.Strings(files)
+	// stop time reached by first event of a file is not the end of parsing
+	check := &Handler{cfg: h.cfg}
 
 	// each file only check first event
 	for idx, filename := range files {
 		do := true
-		fd, err := os.Open(filename)
+		f, err := binlog.OpenFile(filename, h.cfg.MySQL.Keyring)
 		if err != nil {
-			return err
-		}
-
-		bufFileHeader := make([]byte, FileHeaderLength)
-		if _, err := io.ReadFull(fd, bufFileHeader); err != nil {
-			return errors.Trace(err)
+			return nil, err
 		}
-		if !CheckBinlogFileHeader(bufFileHeader) {
-			err = errors.Errorf("invalid file type, not binlog")
-			return err
-		}
-		var stream cipher.Stream
-		if CheckBinlogFileEncrypt(bufFileHeader) {
-			stream, err = initAESCTRStream(filename, common.Config.MySQL.Keyring)
-			if err != nil {
-				return err
-			}
-			fd.Seek(EncryptFileHeaderOffset+FileHeaderLength, 0)
-		} else {
-			stream = nil
-		}
-
-		p := replication.NewBinlogParser()
-		event, err := FileNextEvent(p, fd, stream)
+		event, err := f.Next()
+		f.Close()
 		if err == io.EOF {
 			continue
 		}
 		if err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
 
-		if !FilterStartDatetime(event) {
+		if !check.FilterStartDatetime(event) {
 			do = false
 		}
-		if !FilterStopDatetime(event) {
+		if !check.FilterStopDatetime(event) {
 			if len(filteredBinlogs) == 0 && idx > 0 {
 				filteredBinlogs = append(filteredBinlogs, files[idx-1])
 			}
 			do = false
 		}
-		fd.Close()
 		if do {
 			if len(filteredBinlogs) == 0 && idx > 0 {
 				filteredBinlogs = append(filteredBinlogs, files[idx-1])
@@ -183,264 +179,142 @@ func CheckBinlogFileTime(files []string) error {
 			filteredBinlogs = append(filteredBinlogs, filename)
 		}
 	}
-	common.Config.MySQL.BinlogFile = filteredBinlogs
-	return err
+	return filteredBinlogs, nil
 }
 
-// BinlogFileParser parser binary log file
-func BinlogFileParser(files []string) error {
-	for _, filename := range files {
-		var fd *os.File
-		var err error
-		switch filename {
-		case "-":
-			fd = os.Stdin
-		default:
-			fd, err = os.Open(filename)
-		}
-		if err != nil {
-			return err
-		}
-		bufFileHeader := make([]byte, FileHeaderLength)
-		if _, err := io.ReadFull(fd, bufFileHeader); err != nil {
-			return errors.Trace(err)
-		}
-		if !CheckBinlogFileHeader(bufFileHeader) {
-			err = errors.Errorf("invalid file type, not binlog")
-			return err
-		}
-		var stream cipher.Stream
-		if CheckBinlogFileEncrypt(bufFileHeader) {
-			stream, err = initAESCTRStream(filename, common.Config.MySQL.Keyring)
-			if err != nil {
-				return err
-			}
-			fd.Seek(EncryptFileHeaderOffset, 0)
-			if _, err := io.ReadFull(fd, bufFileHeader); err != nil {
-				return errors.Trace(err)
-			}
-			if !CheckBinlogFileHeader(decryptAESCTR(stream, bufFileHeader)) {
-				err = errors.Errorf("invalid file type, not binlog")
-				return err
-			}
-		} else {
-			stream = nil
-		}
-
-		p := replication.NewBinlogParser()
-		p.SetUseDecimal(true) // support Decimal type
-		for {
-			event, err := FileNextEvent(p, fd, stream)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return errors.Trace(err)
-			}
-			if BinlogFilter(event) {
-				TypeSwitcher(event)
-			} else {
-				common.VerboseVerbose("-- [DEBUG] BinlogFilter ignore, EventType: %s, Position: %d, ServerID: %d, TimeStamp: %d",
-					event.Header.EventType.String(),
-					event.Header.LogPos,
-					event.Header.ServerID,
-					event.Header.Timestamp,
-				)
-			}
-			if Ending {
-				break
-			}
-		}
-		fd.Close()
+// OnEvent implements binlog.EventHandler, ErrStop when ending or plugin can't go on, see Rebuilder.Err
+func (h *Handler) OnEvent(_ context.Context, event *replication.BinlogEvent) error {
+	h.r.LuaReload(event)
+	// before filters, TABLE_MAP_EVENT not pass table and event type filters
+	h.r.TableMapSchema(event)
+	file, _ := h.parser.Position()
+	h.r.TableMapDrift(event, file)
+	// INTVAR_EVENT, RAND_EVENT, USER_VAR_EVENT belong to the next QUERY_EVENT
+	h.r.StatementContext(event)
+	if h.BinlogFilter(event) {
+		h.TypeSwitcher(event)
+	} else {
+		h.verboseVerbose("-- [DEBUG] BinlogFilter ignore, EventType: %s, Position: %d, ServerID: %d, TimeStamp: %d",
+			event.Header.EventType.String(),
+			event.Header.LogPos,
+			event.Header.ServerID,
+			event.Header.Timestamp,
+		)
+	}
+	if h.stream {
+		h.UpdateMasterInfo(event)
+	}
+	if h.ending || h.r.Err() != nil {
+		return binlog.ErrStop
 	}
 	return nil
 }
 
-// FileNextEvent ...
-func FileNextEvent(p *replication.BinlogParser, r io.Reader, stream cipher.Stream) (*replication.BinlogEvent, error) {
-	var err error
-	var head *replication.EventHeader
-	var event *replication.BinlogEvent
-
-	bufHead := make([]byte, EventHeaderLength)
-	if _, err = io.ReadFull(r, bufHead); err != nil {
-		return event, err
-	}
-	if stream != nil {
-		bufHead = decryptAESCTR(stream, bufHead)
-	}
+func (h *Handler) verboseVerbose(format string, a ...interface{}) {
+	h.cfg.VerboseVerbose(h.r.Output(), format, a...)
+}
 
-	head, err = ParseEventHeader(bufHead)
+// BinlogFileParser parser binary log file
+func (h *Handler) BinlogFileParser(files []string) error {
+	p, err := binlog.New(binlog.Options{
+		Files:    files,
+		Keyring:  h.cfg.MySQL.Keyring,
+		Charset:  h.cfg.Global.Charset,
+		Location: h.cfg.Global.Location,
+	})
 	if err != nil {
-		return event, errors.Trace(err)
-	}
-
-	eventLength := head.EventSize - replication.EventHeaderSize
-	bufBody := make([]byte, eventLength)
-	if n, err := io.ReadFull(r, bufBody); err != nil {
-		err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, head.EventSize, replication.EventHeaderSize, n)
-		return event, err
-	}
-	if stream != nil {
-		bufBody = decryptAESCTR(stream, bufBody)
+		return err
 	}
-
-	var rawData []byte
-	rawData = append(rawData, bufHead...)
-	rawData = append(rawData, bufBody...)
-	return p.Parse(rawData)
+	h.stream, h.parser = false, p
+	return p.Run(context.Background(), h)
 }
 
 // BinlogStreamParser parser mysql connection replication event
-func BinlogStreamParser() error {
-	readTimeout, err := time.ParseDuration(common.Config.MySQL.ReadTimeout)
+func (h *Handler) BinlogStreamParser() error {
+	readTimeout, err := time.ParseDuration(h.cfg.MySQL.ReadTimeout)
 	if err != nil {
 		common.Log.Error("BinlogStreamParser Error: %s", err.Error())
 		return err
 	}
 
-	changeMaster := replication.BinlogSyncerConfig{
-		ServerID:             common.MasterInfo.ServerID,
-		Flavor:               common.MasterInfo.ServerType,
-		Host:                 common.MasterInfo.MasterHost,
-		Port:                 uint16(common.MasterInfo.MasterPort),
-		User:                 common.MasterInfo.MasterUser,
-		Password:             common.MasterInfo.MasterPassword,
-		Charset:              common.Config.Global.Charset,
-		ReadTimeout:          readTimeout,
-		MaxReconnectAttempts: common.Config.MySQL.RetryCount,
-		SemiSyncEnabled:      false,
-
-		ParseTime:               false,                         // parse mysql datetime/time as string
-		TimestampStringLocation: common.Config.Global.Location, // If ParseTime is false, convert TIMESTAMP into this specified timezone.
-		UseDecimal:              true,                          // support Decimal type
-	}
-	syncer := replication.NewBinlogSyncer(changeMaster)
-	defer syncer.Close()
-	var streamer *replication.BinlogStreamer
-	if common.MasterInfo.AutoPosition {
-		streamer, err = binlogDumpGTIDSyncer(syncer)
-	} else {
-		streamer, err = binlogDumpSyncer(syncer)
+	if !h.master.AutoPosition && h.master.MasterLogFile == "" && h.cfg.MySQL.ReplicateFromCurrentPosition {
+		masterInfo := common.ShowMasterStatus(*h.master)
+		h.master.MasterLogFile = masterInfo.MasterLogFile
+		h.master.MasterLogPos = masterInfo.MasterLogPos
 	}
+	p, err := binlog.New(binlog.Options{
+		Master: binlog.Master{
+			Host:         h.master.MasterHost,
+			Port:         h.master.MasterPort,
+			User:         h.master.MasterUser,
+			Password:     h.master.MasterPassword,
+			Flavor:       h.master.ServerType,
+			ServerID:     h.master.ServerID,
+			File:         h.master.MasterLogFile,
+			Position:     uint32(h.master.MasterLogPos),
+			AutoPosition: h.master.AutoPosition,
+			GTIDSet:      h.master.ExecutedGTIDSet,
+			ReadTimeout:  readTimeout,
+			RetryCount:   h.cfg.MySQL.RetryCount,
+			Follow:       h.cfg.Global.Daemon,
+		},
+		Charset:  h.cfg.Global.Charset,
+		Location: h.cfg.Global.Location,
+	})
 	if err != nil {
 		return err
 	}
-
-	for {
-		event, err := getEvent(streamer, readTimeout)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		if BinlogFilter(event) {
-			TypeSwitcher(event)
-		} else {
-			common.VerboseVerbose("-- [DEBUG] BinlogFilter ignore, EventType: %s, Position: %d, ServerID: %d, TimeStamp: %d",
-				event.Header.EventType.String(),
-				event.Header.LogPos,
-				event.Header.ServerID,
-				event.Header.Timestamp,
-			)
-		}
-		UpdateMasterInfo(event)
-		if Ending {
-			break
-		}
-	}
-	return nil
-}
-
-func getEvent(streamer *replication.BinlogStreamer, readTimeout time.Duration) (*replication.BinlogEvent, error) {
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if common.Config.Global.Daemon {
-		ctx = context.Background()
-	} else {
-		ctx, cancel = context.WithTimeout(context.Background(), readTimeout)
-		defer cancel()
-	}
-	return streamer.GetEvent(ctx)
+	h.stream, h.parser = true, p
+	return p.Run(context.Background(), h)
 }
 
 // TypeSwitcher event router by type
-func TypeSwitcher(event *replication.BinlogEvent) {
-	rebuild.EventHeaderRebuild(event)
+func (h *Handler) TypeSwitcher(event *replication.BinlogEvent) {
+	h.r.EventHeaderRebuild(event)
 	switch event.Header.EventType {
 	case replication.GTID_EVENT:
-		rebuild.GTIDRebuild(event.Event.(*replication.GTIDEvent))
+		h.r.GTIDRebuild(event)
 	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
-		rebuild.InsertRebuild(event)
-	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
-		rebuild.UpdateRebuild(event)
+		h.r.InsertRebuild(event)
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		h.r.UpdateRebuild(event)
 	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
-		rebuild.DeleteRebuild(event)
+		h.r.DeleteRebuild(event)
 	case replication.QUERY_EVENT:
-		rebuild.QueryRebuild(event)
+		h.r.QueryRebuild(event)
 	case replication.ROWS_QUERY_EVENT:
-		rebuild.RowsQueryRebuild(event)
+		h.r.RowsQueryRebuild(event)
 	case replication.XID_EVENT:
-		rebuild.XidRebuild(event)
+		h.r.XidRebuild(event)
 	case replication.ROTATE_EVENT:
-		common.VerboseVerbose("-- [DEBUG] EventType: %s, NextLogName: %s", event.Header.EventType.String(), string(event.Event.(*replication.RotateEvent).NextLogName))
+		h.r.RotateRebuild(event)
 	// case replication.ANONYMOUS_GTID_EVENT, replication.PREVIOUS_GTIDS_EVENT, replication.TABLE_MAP_EVENT:
 	default:
-		common.VerboseVerbose("-- [DEBUG] TypeSwitcher EventType: %s bypass", event.Header.EventType.String())
-	}
-	sleepInterval(event)
-}
-
-func binlogDumpSyncer(syncer *replication.BinlogSyncer) (*replication.BinlogStreamer, error) {
-	if common.MasterInfo.MasterLogFile == "" && common.Config.MySQL.ReplicateFromCurrentPosition {
-		masterInfo := common.ShowMasterStatus(common.MasterInfo)
-		common.MasterInfo.MasterLogFile = masterInfo.MasterLogFile
-		common.MasterInfo.MasterLogPos = masterInfo.MasterLogPos
-	}
-	position := mysql.Position{Name: common.MasterInfo.MasterLogFile, Pos: uint32(common.MasterInfo.MasterLogPos)}
-	return syncer.StartSync(position)
-}
-
-func binlogDumpGTIDSyncer(syncer *replication.BinlogSyncer) (*replication.BinlogStreamer, error) {
-	gtid, err := mysql.ParseGTIDSet(common.MasterInfo.ServerType, common.MasterInfo.ExecutedGTIDSet)
-	if err != nil {
-		return nil, err
-	}
-	return syncer.StartSyncGTID(gtid)
-}
-
-// ParseEventHeader parser event header, in go-mysql it's internal func, make it public
-func ParseEventHeader(buf []byte) (*replication.EventHeader, error) {
-	head := new(replication.EventHeader)
-	err := head.Decode(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	if head.EventSize <= uint32(replication.EventHeaderSize) {
-		err = errors.Errorf("invalid event header, event size is %d, too small", head.EventSize)
-		return nil, err
+		h.verboseVerbose("-- [DEBUG] TypeSwitcher EventType: %s bypass", event.Header.EventType.String())
 	}
-	return head, nil
+	h.sleepInterval(event)
 }
 
 // sleepInterval ...
-func sleepInterval(event *replication.BinlogEvent) {
-	switch common.Config.Rebuild.Plugin {
+func (h *Handler) sleepInterval(event *replication.BinlogEvent) {
+	switch h.cfg.Rebuild.Plugin {
 	case "sql", "flashback":
 	default:
 		return
 	}
-	interval := common.Config.Rebuild.SleepDuration.Seconds()
+	interval := h.cfg.Rebuild.SleepDuration.Seconds()
 	if interval > 0 {
 		switch event.Header.EventType {
 		case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2,
-			replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+			replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2, replication.PARTIAL_UPDATE_ROWS_EVENT,
 			replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
-			fmt.Printf("SELECT sleep(%f);\n", interval)
+			fmt.Fprintf(h.r.Output(), "SELECT sleep(%f);\n", interval)
 		case replication.QUERY_EVENT:
 			switch string(event.Event.(*replication.QueryEvent).Query) {
 			case "BEGIN", "COMMIT":
 			default:
-				fmt.Printf("SELECT sleep(%f);\n", interval)
+				fmt.Fprintf(h.r.Output(), "SELECT sleep(%f);\n", interval)
 			}
 		}
 	}
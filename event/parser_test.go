@@ -14,7 +14,9 @@
 package event
 
 import (
+	"bytes"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/LianjiaTech/lightning/common"
@@ -23,7 +25,13 @@ import (
 
 func init() {
 	common.Config.MySQL.SchemaFile = common.DevPath + "/test/schema.sql"
-	rebuild.LoadSchemaInfo()
+}
+
+// newHandler handler with rebuilder of test schema, output into stdout
+func newHandler() *Handler {
+	r := rebuild.New(&common.Config, &common.MasterInfo, nil)
+	r.LoadSchemaInfo()
+	return NewHandler(&common.Config, &common.MasterInfo, r)
 }
 
 func ExampleCheckBinlogFileHeader() {
@@ -46,12 +54,37 @@ func ExampleCheckBinlogFileHeader() {
 }
 
 func TestBinlogFileParser(t *testing.T) {
-	err := BinlogFileParser([]string{common.DevPath + "/test/binlog.000002"})
+	err := newHandler().BinlogFileParser([]string{common.DevPath + "/test/binlog.000002"})
 	if err != nil {
 		t.Error(err.Error())
 	}
 }
 
+// TestHandlerConcurrent handlers in one process keep their own state and output
+func TestHandlerConcurrent(t *testing.T) {
+	var outs [2]bytes.Buffer
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rebuild.New(&common.Config, &common.MasterInfo, &outs[i])
+			r.LoadSchemaInfo()
+			errs[i] = NewHandler(&common.Config, &common.MasterInfo, r).BinlogFileParser([]string{common.DevPath + "/test/binlog.000002"})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if outs[0].Len() == 0 || outs[0].String() != outs[1].String() {
+		t.Errorf("outputs of handlers differ, %d bytes and %d bytes", outs[0].Len(), outs[1].Len())
+	}
+}
+
 func TestBinlogStreamParser(t *testing.T) {
 	masterInfoOrg := common.Config.MySQL.MasterInfo
 	stopPositionOrg := common.Config.Filters.StopPosition
@@ -63,7 +96,7 @@ func TestBinlogStreamParser(t *testing.T) {
 	common.LoadMasterInfo()
 	// 清空 binlog 文件名，强制从当前位点开始
 	common.MasterInfo.MasterLogFile = ""
-	err := BinlogStreamParser()
+	err := newHandler().BinlogStreamParser()
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -0,0 +1,46 @@
+-- Filter(event) 在内置过滤器之后调用，返回 true 保留，返回 false 或 nil 丢弃
+-- event.type: insert, update, delete, query, gtid, xid ...
+-- event.table, event.timestamp, event.server_id, event.log_pos, event.gtid, event.thread_id
+-- insert, update, delete: event.columns, event.primary_keys, event.before, event.after, event.values, event.types
+-- query: event.query, event.schema, event.tables
+
+function Init()
+end
+
+-- Filter only keep rows which first column greater than 100
+function Filter(event)
+    if event.values == nil then
+        return true
+    end
+    local v = event.values[event.columns[1]]
+    return type(v) == "number" and v > 100
+end
+
+-- InsertRewrite insert rewrite logic
+function InsertRewrite (tab, row)
+    local values = {}
+    for _, col in ipairs(row.columns) do
+        table.insert(values, tostring(row.values[col]))
+    end
+    print("-- INSERT INTO " .. tab .. " VALUES (" .. table.concat(values, ", ") .. ");")
+end
+
+-- DeleteRewrite delete rewrite logic
+function DeleteRewrite (tab)
+
+end
+
+-- UpdateRewrite update rewrite logic
+function UpdateRewrite (tab)
+
+end
+
+-- QueryRewrite query rewrite logic
+function QueryRewrite (sql)
+
+end
+
+-- Finalizer final destructor function
+function Finalizer ()
+
+end
@@ -0,0 +1,97 @@
+//go:build wasip1
+
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// demo wasm plugin, output one JSON line for each row change
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o demo.wasm ./plugin/wasm/demo
+//	lightning -plugin wasm -wasm-module demo.wasm -binlog-file test/binlog.000002 -schema-file test/schema.sql
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// event passed in by lightning
+type event struct {
+	Type   string                 `json:"type"`
+	Table  string                 `json:"table"`
+	GTID   string                 `json:"gtid"`
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Query  string                 `json:"query"`
+	Xid    uint64                 `json:"xid"`
+}
+
+//go:wasmimport lightning emit
+func emit(ptr unsafe.Pointer, size uint32)
+
+// buffers keep allocated memory alive until free
+var buffers = make(map[uint32][]byte)
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	buf := make([]byte, size+1)
+	ptr := uint32(uintptr(unsafe.Pointer(&buf[0])))
+	buffers[ptr] = buf
+	return ptr
+}
+
+//go:wasmexport free
+func free(ptr uint32) {
+	delete(buffers, ptr)
+}
+
+func read(ptr, size uint32) event {
+	var e event
+	if err := json.Unmarshal(buffers[ptr][:size], &e); err != nil {
+		output(map[string]string{"error": err.Error()})
+	}
+	return e
+}
+
+func output(v interface{}) {
+	buf, _ := json.Marshal(v)
+	emit(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+}
+
+var rows int
+
+//go:wasmexport on_row
+func onRow(ptr, size uint32) {
+	e := read(ptr, size)
+	rows++
+	output(map[string]interface{}{"op": e.Type, "table": e.Table, "before": e.Before, "after": e.After})
+}
+
+//go:wasmexport on_query
+func onQuery(ptr, size uint32) {
+	e := read(ptr, size)
+	output(map[string]interface{}{"op": "query", "query": e.Query})
+}
+
+//go:wasmexport on_commit
+func onCommit(ptr, size uint32) {
+	e := read(ptr, size)
+	output(map[string]interface{}{"op": "commit", "xid": e.Xid})
+}
+
+//go:wasmexport finalize
+func finalize() {
+	fmt.Printf("-- %d rows\n", rows)
+}
+
+func main() {}
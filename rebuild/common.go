@@ -14,65 +14,33 @@
 package rebuild
 
 import (
-	"encoding/hex"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 	"github.com/pingcap/parser/ast"
 
 	"github.com/BixData/gluabit32"
 	"github.com/BixData/gluasocket"
-	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
 	"github.com/montanaflynn/stats"
 
 	uuid "github.com/satori/go.uuid"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 	lua "github.com/yuin/gopher-lua"
 	"github.com/zhu327/gluadb"
 	lfs "layeh.com/gopher-lfs"
 )
 
-// for -plugin stat
-// TableStats
-var TableStats map[string]map[string]int64
-
-// RowsStats
-var RowsStats map[string]map[string]int64
-
-// QueryStats ...
-var QueryStats map[string]int64
-
-// TransactionStartPos ...
-var TransactionStartPos float64
-
-// TransactionStartTimeStamp ...
-var TransactionStartTimeStamp float64
-
-// MaxTransactionTime ...
-var MaxTransactionTime float64
-
-// MaxTransactionSize ...
-var MaxTransactionSize float64
-
-// MaxTransactionSizeStartPos ..
-var MaxTransactionSizeStartPos float64
-
-// MaxTransactionSizeStopPos = MaxTransactionSizeStartPos + Max(TransactionSizeStats)
-
-// MaxTransactionTimeStartPos ...
-var MaxTransactionTimeStartPos float64
-
-// MaxTransactionTimeStopPos ...
-var MaxTransactionTimeStopPos float64
-
-// TransactionSizeStats ...
-var TransactionSizeStats []float64
-
-// TransactionTimeStats ...
-var TransactionTimeStats []float64
-
+// Stats -plugin stat result
 type Stats struct {
 	Table           map[string]map[string]int64  `json:"TableStats"`
 	Rows            map[string]map[string]int64  `json:"RowsStats"`
@@ -82,19 +50,140 @@ type Stats struct {
 	TransactionTime []float64                    `json:"-"` // take from timestamp between begin and commit
 }
 
-// BinlogStats ...
-var BinlogStats Stats
+// transactionStats -plugin stat transaction size and time, positions of the largest transactions
+type transactionStats struct {
+	startPos       float64
+	startTimestamp float64
+	maxTime        float64
+	maxSize        float64
+	maxSizeStart   float64 // stop position = maxSizeStart + maxSize
+	maxTimeStart   float64
+	maxTimeStop    float64
+	sizes          []float64
+	times          []float64
+}
+
+// schemaInfo where schemas loaded from, written into header of -save-schema output
+type schemaInfo struct {
+	Source        string // host:port of MySQL or schema file
+	ServerVersion string
+	GTIDExecuted  string
+	Time          time.Time
+}
+
+// Rebuilder sql, flashback, stat, lua, wasm plugins of one binlog parsing.
+// All state belongs to the Rebuilder, rebuilders are independent with each other,
+// but one Rebuilder should handle events of one parser at a time.
+type Rebuilder struct {
+	cfg    *common.Configuration
+	master *common.ChangeMaster
+	out    io.Writer
+	err    error // plugin can't go on, eg. -lua-violation abort
+
+	// table schemas, keyed by `db`.`tb`
+	schemas        map[string]*ast.CreateTableStmt
+	columns        map[string][]string
+	primaryKeys    map[string][]string
+	schemaSource   schemaInfo
+	fallbackTables []string // tables which SHOW CREATE TABLE can't parse, schema built from information_schema
+	tableInfos     map[*ast.CreateTableStmt]*binlog.Table
+	schemaDB       *sql.DB
+	schemaTried    map[string]bool
+	schemaRetry    map[string]*schemaBackoff
+	schemaMutex    sync.Mutex
+
+	// schema drifts in order of first seen, tableDrifts keyed by table id and name
+	schemaDrifts []*SchemaDrift
+	tableDrifts  map[string]*SchemaDrift
+
+	// statement format context
+	pendingContext []string
+	queryContext   []string
+	sessionVars    map[string]string
+
+	// -plugin sql, flashback
+	insertValuesMerge []string
+	eventTime         string // -foreach-time
+
+	// -plugin stat
+	tableStats  map[string]map[string]int64
+	rowsStats   map[string]map[string]int64
+	queryStats  map[string]int64
+	transaction transactionStats
+
+	// -plugin lua, luaState is the state of the script being called
+	luaState         *lua.LState
+	luaScripts       []*luaScript
+	luaSingle        *luaScript
+	luaFiles         map[*lua.LState][]*luaRotateFile
+	luaRunning       luaRunning
+	luaReloadPending atomic.Bool
+	luaInTransaction bool
+	luaInBegin       bool
+	luaTestCalls     []string
+	currentGTID      string
+	currentThreadID  uint32
+	luaWatchOnce     sync.Once
+	luaReloadOnce    sync.Once
+	done             chan struct{} // closed by LastStatus, stop lua watchers
+
+	// -plugin wasm
+	wasm struct {
+		runtime wazero.Runtime
+		module  api.Module
+	}
+}
+
+// New create Rebuilder with config and master info, output into out, nil out for os.Stdout.
+// Master info is read for schema loading and logs, config must not change while rebuilding.
+func New(cfg *common.Configuration, master *common.ChangeMaster, out io.Writer) *Rebuilder {
+	return &Rebuilder{
+		cfg:         cfg,
+		master:      master,
+		out:         out,
+		schemas:     make(map[string]*ast.CreateTableStmt),
+		columns:     make(map[string][]string),
+		primaryKeys: make(map[string][]string),
+		tableInfos:  make(map[*ast.CreateTableStmt]*binlog.Table),
+		schemaTried: make(map[string]bool),
+		schemaRetry: make(map[string]*schemaBackoff),
+		tableDrifts: make(map[string]*SchemaDrift),
+		sessionVars: make(map[string]string),
+		tableStats:  make(map[string]map[string]int64),
+		rowsStats:   make(map[string]map[string]int64),
+		luaFiles:    make(map[*lua.LState][]*luaRotateFile),
+		done:        make(chan struct{}),
+	}
+}
+
+// Output writer of rebuilt SQL, stat and debug info
+func (r *Rebuilder) Output() io.Writer {
+	if r.out == nil {
+		// resolve at write time, stdout may be redirected
+		return os.Stdout
+	}
+	return r.out
+}
+
+// Err error which plugin can't go on, parsing should stop
+func (r *Rebuilder) Err() error {
+	return r.err
+}
+
+func (r *Rebuilder) printf(format string, a ...interface{}) {
+	fmt.Fprintf(r.Output(), format, a...)
+}
 
-// Lua ...
-var Lua *lua.LState
+func (r *Rebuilder) println(a ...interface{}) {
+	fmt.Fprintln(r.Output(), a...)
+}
 
-// InsertValuesMerge INSERT values merge
-var InsertValuesMerge []string
+func (r *Rebuilder) verbose(format string, a ...interface{}) {
+	r.cfg.Verbose(r.Output(), format, a...)
+}
 
-func init() {
-	TableStats = make(map[string]map[string]int64)
-	RowsStats = make(map[string]map[string]int64)
-	Schemas = make(map[string]*ast.CreateTableStmt)
+func (r *Rebuilder) verboseVerbose(format string, a ...interface{}) {
+	r.cfg.VerboseVerbose(r.Output(), format, a...)
 }
 
 // RowEventTable ...
@@ -104,7 +193,7 @@ func RowEventTable(event *replication.BinlogEvent) string {
 	}
 	switch event.Header.EventType {
 	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2,
-		replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+		replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2, replication.PARTIAL_UPDATE_ROWS_EVENT,
 		replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
 		return fmt.Sprintf("`%s`.`%s`",
 			string(event.Event.(*replication.RowsEvent).Table.Schema),
@@ -113,220 +202,116 @@ func RowEventTable(event *replication.BinlogEvent) string {
 	return ""
 }
 
-// BuildValues build values list
-func BuildValues(event *replication.RowsEvent) [][]string {
-	table := fmt.Sprintf("`%s`.`%s`", string(event.Table.Schema), event.Table.Table)
+// TableInfo column metadata of table in schemas, nil if not found
+func (r *Rebuilder) TableInfo(table string) *binlog.Table {
+	stmt := r.schemas[r.SchemaTable(table)]
+	if stmt == nil {
+		return nil
+	}
+	info, ok := r.tableInfos[stmt]
+	if !ok {
+		info = binlog.NewTable(stmt)
+		r.tableInfos[stmt] = info
+	}
+	return info
+}
+
+// RowsValues typed values of each row image of rows event
+func (r *Rebuilder) RowsValues(event *replication.RowsEvent) [][]binlog.Value {
+	return binlog.EventValues(r.TableInfo(fmt.Sprintf("`%s`.`%s`", event.Table.Schema, event.Table.Table)), event)
+}
+
+// sqlValue MySQL literal of value, -hex-string for strings
+func (r *Rebuilder) sqlValue(v binlog.Value) string {
+	return v.SQL(r.cfg.Global.HexString)
+}
+
+// sqlValues MySQL literals of one row image
+func (r *Rebuilder) sqlValues(row []binlog.Value) []string {
+	literals := make([]string, len(row))
+	for i, v := range row {
+		literals[i] = r.sqlValue(v)
+	}
+	return literals
+}
+
+// BuildValues build values list as MySQL literals
+func (r *Rebuilder) BuildValues(event *replication.RowsEvent) [][]string {
 	var values [][]string
-	for _, row := range event.Rows {
-		var columns []string
-		for i, t := range event.Table.ColumnType {
-			if row[i] == nil {
-				columns = append(columns, "NULL")
-				continue
-			}
-			var unsigned bool
-			if ok := Schemas[table]; ok != nil {
-				if (Schemas[table].Cols[i].Tp.Flag & mysql.UNSIGNED_FLAG) > 0 {
-					unsigned = true
-				}
-			}
-			switch t {
-			case mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_NULL,
-				mysql.MYSQL_TYPE_TIMESTAMP:
-				columns = append(columns, fmt.Sprint(row[i]))
-			// binlog use -1 for unsigned int max value
-			case mysql.MYSQL_TYPE_TINY:
-				if unsigned && fmt.Sprint(row[i]) == "-1" {
-					columns = append(columns, "255")
-				} else {
-					columns = append(columns, fmt.Sprint(row[i]))
-				}
-			case mysql.MYSQL_TYPE_SHORT:
-				if unsigned && fmt.Sprint(row[i]) == "-1" {
-					columns = append(columns, "65535")
-				} else {
-					columns = append(columns, fmt.Sprint(row[i]))
-				}
-			case mysql.MYSQL_TYPE_INT24:
-				if unsigned && fmt.Sprint(row[i]) == "-1" {
-					columns = append(columns, "16777215")
-				} else {
-					columns = append(columns, fmt.Sprint(row[i]))
-				}
-			case mysql.MYSQL_TYPE_LONG:
-				if unsigned && fmt.Sprint(row[i]) == "-1" {
-					columns = append(columns, "4294967295")
-				} else {
-					columns = append(columns, fmt.Sprint(row[i]))
-				}
-			case mysql.MYSQL_TYPE_LONGLONG:
-				if unsigned && fmt.Sprint(row[i]) == "-1" {
-					columns = append(columns, "18446744073709551615")
-				} else {
-					columns = append(columns, fmt.Sprint(row[i]))
-				}
-			case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_YEAR,
-				mysql.MYSQL_TYPE_NEWDATE, mysql.MYSQL_TYPE_TIMESTAMP2, mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_TIME2:
-				columns = append(columns, fmt.Sprint("'", row[i], "'"))
-			case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING:
-				switch v := row[i].(type) {
-				case string:
-					if common.Config.Global.HexString {
-						columns = append(columns, fmt.Sprintf(`X'%s'`, hex.EncodeToString([]byte(v))))
-					} else {
-						// strconv.Quote will escape unicode \u0100
-						// escape function maybe not correct with multi byte charset
-						// columns = append(columns, strconv.Quote(v))
-						columns = append(columns, fmt.Sprintf(`"%s"`, escape(v)))
-					}
-				case []byte:
-					if common.Config.Global.HexString {
-						columns = append(columns, fmt.Sprintf(`X'%s'`, hex.EncodeToString(v)))
-					} else {
-						columns = append(columns, fmt.Sprintf(`"%s"`, escape(string(v))))
-					}
-				case int, int64, int32, int16, int8, uint64, uint32, uint16, uint8:
-					// SET ENUM
-					columns = append(columns, fmt.Sprint(v))
-				default:
-					columns = append(columns, fmt.Sprintf(`'%s'`, fmt.Sprint(v)))
-				}
-
-			// MySQL 8.0/8.4: ENUM and SET types - stored as integers in binlog
-			case mysql.MYSQL_TYPE_ENUM:
-				columns = append(columns, fmt.Sprint(row[i]))
-			case mysql.MYSQL_TYPE_SET:
-				columns = append(columns, fmt.Sprint(row[i]))
-
-			case mysql.MYSQL_TYPE_JSON:
-				// Safe type assertion with fallback
-				switch v := row[i].(type) {
-				case []byte:
-					columns = append(columns, fmt.Sprintf(`'%s'`, v))
-				case string:
-					columns = append(columns, fmt.Sprintf(`'%s'`, v))
-				default:
-					columns = append(columns, fmt.Sprintf(`'%s'`, fmt.Sprint(v)))
-				}
-			case mysql.MYSQL_TYPE_BIT:
-				// Safe type assertion with fallback
-				switch v := row[i].(type) {
-				case int64:
-					columns = append(columns, fmt.Sprintf(`%d`, v))
-				case int:
-					columns = append(columns, fmt.Sprintf(`%d`, v))
-				case uint64:
-					columns = append(columns, fmt.Sprintf(`%d`, v))
-				default:
-					columns = append(columns, fmt.Sprintf(`'%s'`, fmt.Sprint(v)))
-				}
-
-			// MySQL 8.0/8.4: GEOMETRY and Spatial types - stored as binary WKB format
-			// Supports: GEOMETRY, POINT, LINESTRING, POLYGON, MULTIPOINT,
-			//           MULTILINESTRING, MULTIPOLYGON, GEOMETRYCOLLECTION
-			case mysql.MYSQL_TYPE_GEOMETRY:
-				// Safe type assertion with fallback
-				switch v := row[i].(type) {
-				case []byte:
-					columns = append(columns, fmt.Sprintf(`ST_GeomFromWKB(X'%s')`, hex.EncodeToString(v)))
-				default:
-					columns = append(columns, fmt.Sprintf(`ST_GeomFromWKB(X'%s')`, hex.EncodeToString([]byte(fmt.Sprint(v)))))
-				}
-
-			// MySQL 9.0: VECTOR type - stored as binary format
-			// Supports: VECTOR data type for AI/ML applications
-			case mysql.MYSQL_TYPE_VECTOR:
-				// Safe type assertion with fallback
-				switch v := row[i].(type) {
-				case []byte:
-					columns = append(columns, fmt.Sprintf(`STRING_TO_VECTOR(X'%s')`, hex.EncodeToString(v)))
-				default:
-					columns = append(columns, fmt.Sprintf(`STRING_TO_VECTOR(X'%s')`, hex.EncodeToString([]byte(fmt.Sprint(v)))))
-				}
-
-			// MySQL 8.0/8.4: BLOB types - stored as binary data
-			case mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
-				// Safe type assertion with fallback
-				switch v := row[i].(type) {
-				case []byte:
-					columns = append(columns, fmt.Sprintf(`X'%s'`, hex.EncodeToString(v)))
-				default:
-					columns = append(columns, fmt.Sprintf(`X'%s'`, hex.EncodeToString([]byte(fmt.Sprint(v)))))
-				}
-
-			default:
-				// Safe type assertion with fallback for unknown types
-				switch v := row[i].(type) {
-				case []byte:
-					columns = append(columns, fmt.Sprintf(`X'%s'`, hex.EncodeToString(v)))
-				default:
-					columns = append(columns, fmt.Sprintf(`'%s'`, fmt.Sprint(v)))
-				}
-			}
-		}
-		values = append(values, columns)
+	for _, row := range r.RowsValues(event) {
+		values = append(values, r.sqlValues(row))
 	}
 	return values
 }
 
 // GTIDRebuild ...
-func GTIDRebuild(event *replication.GTIDEvent) {
+func (r *Rebuilder) GTIDRebuild(gtidEvent *replication.BinlogEvent) {
+	event := gtidEvent.Event.(*replication.GTIDEvent)
 	serverID, _ := uuid.FromBytes(event.SID)
-	common.Verbose("-- [DEBUG] GTID_NEXT: %s:%d, LastCommitted: %d, SequenceNumber: %d, CommitFlag: %d\n", serverID, event.GNO, event.LastCommitted, event.SequenceNumber, event.CommitFlag)
+	r.verbose("-- [DEBUG] GTID_NEXT: %s:%d, LastCommitted: %d, SequenceNumber: %d, CommitFlag: %d\n", serverID, event.GNO, event.LastCommitted, event.SequenceNumber, event.CommitFlag)
+	r.trackTransaction(gtidEvent)
+
+	switch r.cfg.Rebuild.Plugin {
+	case "lua":
+		r.GTIDLua(gtidEvent)
+	}
 }
 
 // EventHeaderRebuild ...
-func EventHeaderRebuild(event *replication.BinlogEvent) {
+func (r *Rebuilder) EventHeaderRebuild(event *replication.BinlogEvent) {
 	header := event.Header
-	common.Verbose("-- [DEBUG] EventType: %s, ServerID: %d, Timestamp: %d, LogPos: %d, EventSize: %d, Flags: %d\n",
+	r.verbose("-- [DEBUG] EventType: %s, ServerID: %d, Timestamp: %d, LogPos: %d, EventSize: %d, Flags: %d\n",
 		header.EventType.String(), header.ServerID, header.Timestamp, header.LogPos, header.EventSize, header.Flags)
 
-	if common.Config.Rebuild.ForeachTime {
-		common.Config.Rebuild.CurrentEventTime = fmt.Sprint(time.Unix(int64(header.Timestamp), 0).Format("2006-01-02 15:04:05"))
+	if r.cfg.Rebuild.ForeachTime {
+		r.eventTime = fmt.Sprint(time.Unix(int64(header.Timestamp), 0).Format("2006-01-02 15:04:05"))
 	}
 }
 
 // LastStatus ...
-func LastStatus() {
-	switch common.Config.Rebuild.Plugin {
+func (r *Rebuilder) LastStatus() {
+	r.printDriftReport()
+	switch r.cfg.Rebuild.Plugin {
 	case "stat":
-		printBinlogStat()
+		r.printBinlogStat()
+	case "wasm":
+		r.closeWasmModule()
 	}
-	if Lua != nil {
-		if err := Lua.CallByParam(lua.P{
-			Fn:      Lua.GetGlobal("Finalizer"),
-			NRet:    1,
-			Protect: true,
-		}); err != nil {
-			common.Log.Error(err.Error())
-			return
-		}
-		defer Lua.Close()
+	r.luaEachScript(func(s *luaScript) {
+		r.luaLifecycleHook("Finalizer")
+		r.luaState.Close()
+		r.closeLuaFiles(r.luaState)
+	})
+	// stop lua memory and reload watchers
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
 	}
 }
 
 // printBinlogStat ...
-func printBinlogStat() {
+func (r *Rebuilder) printBinlogStat() {
 	// TransactionTimeStats
-	medianTime, _ := stats.Median(TransactionTimeStats)
-	maxTime, _ := stats.Max(TransactionTimeStats)
-	meanTime, _ := stats.Mean(TransactionTimeStats)
-	p99Time, _ := stats.Percentile(TransactionTimeStats, 99)
-	p95Time, _ := stats.Percentile(TransactionTimeStats, 95)
+	medianTime, _ := stats.Median(r.transaction.times)
+	maxTime, _ := stats.Max(r.transaction.times)
+	meanTime, _ := stats.Mean(r.transaction.times)
+	p99Time, _ := stats.Percentile(r.transaction.times, 99)
+	p95Time, _ := stats.Percentile(r.transaction.times, 95)
 	// TransactionSizeStats
-	medianSize, _ := stats.Median(TransactionSizeStats)
-	maxSize, _ := stats.Max(TransactionSizeStats)
-	meanSize, _ := stats.Mean(TransactionSizeStats)
-	p99Size, _ := stats.Percentile(TransactionSizeStats, 99)
-	p95Size, _ := stats.Percentile(TransactionSizeStats, 95)
-
-	BinlogStats = Stats{
-		Table: TableStats,
-		Rows:  RowsStats,
-		Query: QueryStats,
+	medianSize, _ := stats.Median(r.transaction.sizes)
+	maxSize, _ := stats.Max(r.transaction.sizes)
+	meanSize, _ := stats.Mean(r.transaction.sizes)
+	p99Size, _ := stats.Percentile(r.transaction.sizes, 99)
+	p95Size, _ := stats.Percentile(r.transaction.sizes, 95)
+
+	binlogStats := Stats{
+		Table: r.tableStats,
+		Rows:  r.rowsStats,
+		Query: r.queryStats,
 		Transaction: map[string]map[string]string{
 			"TimeSeconds": {
-				"MaxTransactionPos": fmt.Sprintf("-start-position %d -stop-position %d", int64(MaxTransactionTimeStartPos), int64(MaxTransactionTimeStopPos)),
+				"MaxTransactionPos": fmt.Sprintf("-start-position %d -stop-position %d", int64(r.transaction.maxTimeStart), int64(r.transaction.maxTimeStop)),
 				"Median":            fmt.Sprintf("%0.2f", medianTime),
 				"Max":               fmt.Sprintf("%0.2f", maxTime),
 				"Mean":              fmt.Sprintf("%0.2f", meanTime),
@@ -334,7 +319,7 @@ func printBinlogStat() {
 				"P95":               fmt.Sprintf("%0.2f", p95Time),
 			},
 			"SizeBytes": {
-				"MaxTransactionPos": fmt.Sprintf("-start-position %d -stop-position %d", int64(MaxTransactionSizeStartPos), int64(MaxTransactionSizeStartPos+MaxTransactionSize)),
+				"MaxTransactionPos": fmt.Sprintf("-start-position %d -stop-position %d", int64(r.transaction.maxSizeStart), int64(r.transaction.maxSizeStart+r.transaction.maxSize)),
 				"Median":            fmt.Sprintf("%0.1f", medianSize),
 				"Max":               fmt.Sprintf("%0.1f", maxSize),
 				"Mean":              fmt.Sprintf("%0.1f", meanSize),
@@ -344,101 +329,104 @@ func printBinlogStat() {
 		},
 	}
 
-	buf, err := json.MarshalIndent(BinlogStats, "", "  ")
+	buf, err := json.MarshalIndent(binlogStats, "", "  ")
 	if err != nil {
-		fmt.Println(err)
+		r.println(err)
 	}
-	fmt.Println(string(buf))
+	r.println(string(buf))
 }
 
 // LuaStringList ...
-func LuaStringList(name string, values []string) {
-	t := Lua.NewTable()
+func (r *Rebuilder) LuaStringList(name string, values []string) {
+	t := r.luaState.NewTable()
 	for k, v := range values {
-		Lua.SetTable(t, lua.LNumber(k+1), lua.LString(v))
+		r.luaState.SetTable(t, lua.LNumber(k+1), lua.LString(v))
 	}
-	Lua.SetGlobal(name, t)
+	r.luaState.SetGlobal(name, t)
 }
 
 // LuaMapStringList ...
-func LuaMapStringList(name string, values map[string][]string) {
-	t := Lua.NewTable()
+func (r *Rebuilder) LuaMapStringList(name string, values map[string][]string) {
+	t := r.luaState.NewTable()
 	for k, cols := range values {
-		l := Lua.NewTable()
+		l := r.luaState.NewTable()
 		for i, col := range cols {
-			Lua.SetTable(l, lua.LNumber(i+1), lua.LString(col))
+			r.luaState.SetTable(l, lua.LNumber(i+1), lua.LString(col))
 		}
-		Lua.SetTable(t, lua.LString(k), l)
+		r.luaState.SetTable(t, lua.LString(k), l)
 	}
-	Lua.SetGlobal(name, t)
+	r.luaState.SetGlobal(name, t)
 }
 
-// LoadLuaScript ...
-func LoadLuaScript() {
-	if common.Config.Rebuild.LuaScript == "" || common.Config.Rebuild.Plugin != "lua" {
-		return
-	}
-	Lua = lua.NewState()
-	gluasocket.Preload(Lua)
-	gluabit32.Preload(Lua)
-	gluadb.Preload(Lua) // lua package require "mysql", "redis"
-	lfs.Preload(Lua)    // lfs.currentdir() for package loading
-
-	if err := Lua.DoFile(common.Config.Rebuild.LuaScript); err != nil {
-		common.Log.Error(err.Error())
+// luaTableSchema add table loaded after lua Init into GoColumns, GoPrimaryKeys of each lua script
+func (r *Rebuilder) luaTableSchema(table string) {
+	if r.cfg.Rebuild.Plugin != "lua" {
 		return
 	}
+	r.luaEachScript(func(*luaScript) {
+		for name, cols := range map[string][]string{"GoColumns": r.columns[table], "GoPrimaryKeys": r.primaryKeys[table]} {
+			t, ok := r.luaState.GetGlobal(name).(*lua.LTable)
+			if !ok {
+				continue
+			}
+			l := r.luaState.NewTable()
+			for i, col := range cols {
+				r.luaState.SetTable(l, lua.LNumber(i+1), lua.LString(col))
+			}
+			r.luaState.SetTable(t, lua.LString(r.OutputTable(table)), l)
+		}
+	})
+}
 
-	LuaMapStringList("GoPrimaryKeys", PrimaryKeys)
-	LuaMapStringList("GoColumns", Columns)
+// luaPreload preload lua modules
+func (r *Rebuilder) luaPreload(L *lua.LState) {
+	gluasocket.Preload(L)
+	gluabit32.Preload(L)
+	gluadb.Preload(L)                               // lua package require "mysql", "redis"
+	lfs.Preload(L)                                  // lfs.currentdir() for package loading
+	L.PreloadModule("lightning", r.lightningLoader) // json, escape, time, schema, file, log helpers
+}
 
-	if err := Lua.CallByParam(lua.P{
-		Fn:      Lua.GetGlobal("Init"),
-		NRet:    1,
-		Protect: true,
-	}); err != nil {
-		common.Log.Error(err.Error())
+// LoadLuaScript ...
+func (r *Rebuilder) LoadLuaScript() {
+	configs := r.luaScriptConfigs()
+	if len(configs) == 0 || r.cfg.Rebuild.Plugin != "lua" {
 		return
 	}
-}
-
-func escape(sql string) string {
-	dest := make([]byte, 0, 2*len(sql))
-	var escape byte
-	for i := 0; i < len(sql); i++ {
-		c := sql[i]
-
-		escape = 0
-
-		switch c {
-		case 0: /* Must be escaped for 'mysql' */
-			escape = '0'
-			break
-		case '\n': /* Must be escaped for logs */
-			escape = 'n'
-			break
-		case '\r':
-			escape = 'r'
-			break
-		case '\\':
-			escape = '\\'
-			break
-		case '\'':
-			escape = '\''
-			break
-		case '"': /* Better safe than sorry */
-			escape = '"'
-			break
-		case '\032': /* This gives problems on Win32 */
-			escape = 'Z'
+	r.luaMemoryWatch()
+	r.luaReloadWatch()
+
+	// script load failed will be skipped, not affect others
+	r.luaScripts = nil
+	for _, c := range configs {
+		L, err := r.loadLuaState(c.Script)
+		if err != nil {
+			common.Log.Error(err.Error())
+			continue
 		}
+		r.luaScripts = append(r.luaScripts, &luaScript{path: c.Script, tables: c.Tables, state: L})
+	}
+	if len(r.luaScripts) == 0 {
+		return
+	}
+	r.luaState = r.luaScripts[0].state
+	r.luaEachScript(func(*luaScript) { r.luaInit() })
+}
 
-		if escape != 0 {
-			dest = append(dest, '\\', escape)
-		} else {
-			dest = append(dest, c)
-		}
+// loadLuaState create lua state and run script
+func (r *Rebuilder) loadLuaState(script string) (*lua.LState, error) {
+	L := r.newLuaState()
+	if err := L.DoFile(script); err != nil {
+		L.Close()
+		return nil, err
 	}
+	return L, nil
+}
+
+// luaInit set table metadata globals and call Init
+func (r *Rebuilder) luaInit() {
+	r.LuaMapStringList("GoPrimaryKeys", r.rewriteTableKeys(r.primaryKeys))
+	r.LuaMapStringList("GoColumns", r.rewriteTableKeys(r.columns))
 
-	return string(dest)
+	r.luaLifecycleHook("Init")
 }
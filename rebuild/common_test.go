@@ -14,33 +14,46 @@
 package rebuild
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
 	"strconv"
 	"testing"
+	"time"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/replication"
 )
 
 func TestLastStatus(t *testing.T) {
-	LastStatus()
+	r := New(&common.Config, &common.MasterInfo, nil)
+	r.LastStatus()
 }
 
 func TestPrintBinlogStat(t *testing.T) {
-	printBinlogStat()
+	r := New(&common.Config, &common.MasterInfo, nil)
+	r.printBinlogStat()
 }
 
 func TestLoadLuaScript(t *testing.T) {
-	LoadLuaScript()
+	r := New(&common.Config, &common.MasterInfo, nil)
+	r.LoadLuaScript()
 }
 
 func TestStrconvQuote(t *testing.T) {
 	fmt.Println(strconv.Quote(`'"space `))
-	fmt.Printf(`"%s"`, escape(`'"space `))
+	fmt.Printf(`"%s"`, binlog.Escape(`'"space `))
 }
 
 // TestBuildValuesDataTypes tests MySQL 8.0/8.4 data types support
 func TestBuildValuesDataTypes(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
 	testCases := []struct {
 		name        string
 		event       *replication.RowsEvent
@@ -155,8 +168,8 @@ func TestBuildValuesDataTypes(t *testing.T) {
 				},
 			},
 			expectedSQL: []string{
-				"'{\"key\": \"value\"}'",
-				"255",
+				`CAST('{\"key\": \"value\"}' AS JSON)`,
+				"b'11111111'",
 				"ST_GeomFromWKB(X'0101000000')",
 			},
 		},
@@ -182,7 +195,7 @@ func TestBuildValuesDataTypes(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			values := BuildValues(tc.event)
+			values := r.BuildValues(tc.event)
 
 			for rowIdx, row := range values {
 				for colIdx, col := range row {
@@ -202,6 +215,7 @@ func TestBuildValuesDataTypes(t *testing.T) {
 
 // TestBuildValuesUnsignedInts tests unsigned integer max values
 func TestBuildValuesUnsignedInts(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
 	// Note: This test requires schema to be set up with unsigned flags
 	// For now, we test without schema (no unsigned flag)
 	event := &replication.RowsEvent{
@@ -221,7 +235,7 @@ func TestBuildValuesUnsignedInts(t *testing.T) {
 		},
 	}
 
-	values := BuildValues(event)
+	values := r.BuildValues(event)
 
 	// Without schema (unsigned flag), -1 should remain as -1
 	expected := []string{"-1", "-1", "-1", "-1", "-1"}
@@ -232,3 +246,212 @@ func TestBuildValuesUnsignedInts(t *testing.T) {
 		}
 	}
 }
+
+// TestTypeValues golden SQL of column types in test/types.sql
+func TestTypeValues(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	buf, err := os.ReadFile(common.DevPath + "/test/types.sql")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = r.schemaAppend("test", string(buf)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		table string
+		types []byte
+		meta  []uint16
+		rows  [][]interface{}
+	}{
+		// ENUM, SET are logged as STRING with real type in meta
+		{"enum_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_STRING}, []uint16{0, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1},
+			[][]interface{}{{int32(1), int64(1)}, {int32(2), int64(3)}, {int32(3), int64(0)}, {int32(4), int64(9)}, {int32(5), nil}}},
+		{"set_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_STRING}, []uint16{0, uint16(mysql.MYSQL_TYPE_SET)<<8 | 1},
+			[][]interface{}{{int32(1), int64(1)}, {int32(2), int64(5)}, {int32(3), int64(0)}, {int32(4), int64(8)}}},
+		{"bit_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_BIT}, nil,
+			[][]interface{}{{int32(1), int64(124)}, {int32(2), int64(0)}}},
+		{"year_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_YEAR}, nil,
+			[][]interface{}{{int32(1), 2016}, {int32(2), 0}}},
+	}
+	golden := func(ev *replication.RowsEvent) {
+		err := common.GoldenDiff(func() {
+			r.insertQuery(RowEventTable(&replication.BinlogEvent{
+				Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2},
+				Event:  ev,
+			}), r.RowsValues(ev))
+		}, t.Name()+"_"+string(ev.Table.Table), update)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, c := range cases {
+		golden(&replication.RowsEvent{
+			Table: &replication.TableMapEvent{
+				Schema:     []byte("test"),
+				Table:      []byte(c.table),
+				ColumnType: c.types,
+				ColumnMeta: c.meta,
+			},
+			Rows: c.rows,
+		})
+	}
+
+	// temporal values decoded by go-mysql from binary rows, precision from column meta, TIMESTAMP in Location
+	locOrg := r.cfg.Global.Location
+	r.cfg.Global.Location = time.FixedZone("UTC+8", 8*3600)
+	defer func() { r.cfg.Global.Location = locOrg }()
+	ts := time.Date(2016, 6, 1, 15, 55, 29, 0, time.UTC).Unix() // 2016-06-01 23:55:29 +08:00
+	decoded := []struct {
+		table string
+		types []byte
+		meta  []uint16 // fractional seconds precision
+		rows  [][][]byte
+	}{
+		{"time_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_TIME2, mysql.MYSQL_TYPE_TIME2}, []uint16{0, 0, 3},
+			[][][]byte{
+				{int32Bytes(1), time2Bytes(false, 838, 59, 59, 0, 0), time2Bytes(true, 0, 0, 1, 500000, 3)},
+				{int32Bytes(2), time2Bytes(true, 12, 0, 0, 0, 0), time2Bytes(false, 0, 0, 0, 0, 3)},
+			}},
+		{"datetime_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_DATETIME2}, []uint16{0, 0, 6},
+			[][][]byte{
+				{int32Bytes(1), datetime2Bytes(2016, 6, 1, 23, 55, 29, 0, 0), datetime2Bytes(2016, 6, 1, 23, 55, 29, 123456, 6)},
+				{int32Bytes(2), datetime2Bytes(0, 0, 0, 0, 0, 0, 0, 0), datetime2Bytes(0, 0, 0, 0, 0, 0, 0, 6)},
+			}},
+		{"timestamp_type", []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIMESTAMP2}, []uint16{0, 0, 3},
+			[][][]byte{
+				{int32Bytes(1), binary.LittleEndian.AppendUint32(nil, uint32(ts)), timestamp2Bytes(ts, 120000, 3)},
+				{int32Bytes(2), binary.LittleEndian.AppendUint32(nil, 0), timestamp2Bytes(0, 0, 3)},
+			}},
+	}
+	for _, c := range decoded {
+		ev, err := decodeWriteRows("test", c.table, c.types, c.meta, c.rows)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		golden(ev)
+	}
+}
+
+// decodeWriteRows decode WRITE_ROWS_EVENTv2 of binary rows by go-mysql as lightning parses binlog
+func decodeWriteRows(schema, table string, types []byte, meta []uint16, rows [][][]byte) (*replication.RowsEvent, error) {
+	fd, err := os.Open(common.DevPath + "/test/binlog.000002")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	// FORMAT_DESCRIPTION_EVENT after binlog magic number
+	head := make([]byte, 4+replication.EventHeaderSize)
+	if _, err = io.ReadFull(fd, head); err != nil {
+		return nil, err
+	}
+	fde := make([]byte, binary.LittleEndian.Uint32(head[4+9:]))
+	copy(fde, head[4:])
+	if _, err = io.ReadFull(fd, fde[replication.EventHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	p := replication.NewBinlogParser()
+	p.SetUseDecimal(true)
+	p.SetTimestampStringLocation(common.Config.Global.Location)
+	if _, err = p.Parse(fde); err != nil {
+		return nil, err
+	}
+
+	bitmap := bytes.Repeat([]byte{0xff}, (len(types)+7)/8)
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 0, 0} // table id, flags
+	tableMap = append(append(append(tableMap, byte(len(schema))), schema...), 0)
+	tableMap = append(append(append(tableMap, byte(len(table))), table...), 0)
+	tableMap = append(append(tableMap, byte(len(types))), types...)
+	var metaBytes []byte
+	for i, tp := range types {
+		switch tp {
+		case mysql.MYSQL_TYPE_TIME2, mysql.MYSQL_TYPE_DATETIME2, mysql.MYSQL_TYPE_TIMESTAMP2:
+			metaBytes = append(metaBytes, byte(meta[i]))
+		}
+	}
+	tableMap = append(append(append(tableMap, byte(len(metaBytes))), metaBytes...), make([]byte, len(bitmap))...)
+
+	writeRows := []byte{1, 0, 0, 0, 0, 0, 1, 0, 2, 0} // table id, flags STMT_END, extra data length
+	writeRows = append(append(writeRows, byte(len(types))), bitmap...)
+	for _, row := range rows {
+		writeRows = append(writeRows, make([]byte, len(bitmap))...) // null bitmap
+		for _, col := range row {
+			writeRows = append(writeRows, col...)
+		}
+	}
+
+	if _, err = p.Parse(eventBytes(replication.TABLE_MAP_EVENT, tableMap)); err != nil {
+		return nil, err
+	}
+	e, err := p.Parse(eventBytes(replication.WRITE_ROWS_EVENTv2, writeRows))
+	if err != nil {
+		return nil, err
+	}
+	return e.Event.(*replication.RowsEvent), nil
+}
+
+// eventBytes event with header and CRC32 checksum
+func eventBytes(tp replication.EventType, body []byte) []byte {
+	size := replication.EventHeaderSize + len(body) + replication.BinlogChecksumLength
+	b := binary.LittleEndian.AppendUint32(nil, 0) // timestamp
+	b = append(b, byte(tp))
+	b = binary.LittleEndian.AppendUint32(b, 1) // server id
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = binary.LittleEndian.AppendUint32(b, 0) // log pos
+	b = binary.LittleEndian.AppendUint16(b, 0) // flags
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+func int32Bytes(i int32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(i))
+}
+
+// fracBytes fractional seconds storage of TIME2, DATETIME2, TIMESTAMP2 in precision fsp
+func fracBytes(usec int64, fsp int) []byte {
+	switch fsp {
+	case 1, 2:
+		return []byte{byte(usec / 10000)}
+	case 3, 4:
+		return binary.BigEndian.AppendUint16(nil, uint16(usec/100))
+	case 5, 6:
+		return binary.BigEndian.AppendUint32(nil, uint32(usec))[1:]
+	}
+	return nil
+}
+
+// time2Bytes TIME2 storage, negative value keeps fractional part in reverse order
+func time2Bytes(neg bool, h, m, s, usec int64, fsp int) []byte {
+	hms := h<<12 | m<<6 | s
+	if fsp >= 5 {
+		v := hms<<24 + usec
+		if neg {
+			v = -v
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(v+replication.TIMEF_OFS))[2:]
+	}
+	frac := fracBytes(usec, fsp)
+	if neg {
+		hms = -hms
+		if usec != 0 {
+			// 0x100 - frac, 0x10000 - frac
+			hms--
+			scale := int64(10000)
+			if fsp >= 3 {
+				scale = 100
+			}
+			frac = fracBytes((int64(1)<<(8*len(frac))-usec/scale)*scale, fsp)
+		}
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(hms+replication.TIMEF_INT_OFS))[1:], frac...)
+}
+
+func datetime2Bytes(year, month, day, h, m, s, usec int64, fsp int) []byte {
+	v := (year*13+month)<<22 | day<<17 | h<<12 | m<<6 | s + replication.DATETIMEF_INT_OFS
+	return append(binary.BigEndian.AppendUint64(nil, uint64(v))[3:], fracBytes(usec, fsp)...)
+}
+
+func timestamp2Bytes(sec, usec int64, fsp int) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(sec)), fracBytes(usec, fsp)...)
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 
 	"github.com/go-mysql-org/go-mysql/replication"
@@ -24,143 +25,155 @@ import (
 )
 
 // DeleteRebuild ...
-func DeleteRebuild(event *replication.BinlogEvent) string {
-	switch common.Config.Rebuild.Plugin {
+func (r *Rebuilder) DeleteRebuild(event *replication.BinlogEvent) string {
+	switch r.cfg.Rebuild.Plugin {
 	case "sql":
-		DeleteQuery(event)
+		r.DeleteQuery(event)
 	case "flashback":
-		DeleteRollbackQuery(event)
+		r.DeleteRollbackQuery(event)
 	case "stat":
-		DeleteStat(event)
+		r.DeleteStat(event)
 	case "lua":
-		DeleteLua(event)
+		r.DeleteLua(event)
+	case "wasm":
+		r.RowsWasm(event)
 	default:
 	}
 	return ""
 }
 
 // DeleteQuery build original delete SQL
-func DeleteQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) DeleteQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	values := r.RowsValues(ev)
 
-	common.Verbose("-- [DEBUG] event: delete, table: %s, rows: %d\n", table, len(values))
+	r.verbose("-- [DEBUG] event: delete, table: %s, rows: %d\n", table, len(values))
 
-	deleteQuery(table, values)
+	r.deleteQuery(table, values)
 }
 
-func deleteQuery(table string, values [][]string) {
-	// for common.Config.Rebuild.WithoutDBName
-	shortTableName := onlyTable(table)
-
+func (r *Rebuilder) deleteQuery(table string, values [][]binlog.Value) {
 	var deletePrefix = "DELETE FROM"
-	if common.Config.Rebuild.ForeachTime && common.Config.Rebuild.CurrentEventTime != "" {
-		deletePrefix = fmt.Sprintf(`/* %s */%s`, common.Config.Rebuild.CurrentEventTime, deletePrefix)
+	if r.cfg.Rebuild.ForeachTime && r.eventTime != "" {
+		deletePrefix = fmt.Sprintf(`/* %s */%s`, r.eventTime, deletePrefix)
 	}
 
-	if ok := PrimaryKeys[table]; ok != nil {
-		for _, value := range values {
+	// -logical-table, -rewrite-db, -rewrite-tables, -without-db-name
+	name := r.OutputTable(table)
+	deletePrefix = r.originComment(table) + deletePrefix
+	table = r.SchemaTable(table)
+
+	if ok := r.primaryKeys[table]; ok != nil {
+		for _, row := range values {
 			var where []string
-			for _, col := range PrimaryKeys[table] {
-				for i, c := range Columns[table] {
+			for _, col := range r.primaryKeys[table] {
+				for i, c := range r.columns[table] {
 					if c == col {
-						if value[i] == "NULL" {
+						if row[i].IsNull() {
 							where = append(where, fmt.Sprintf("%s IS NULL", col))
 						} else {
-							where = append(where, fmt.Sprintf("%s = %s", col, value[i]))
+							where = append(where, fmt.Sprintf("%s = %s", col, r.sqlValue(row[i])))
 						}
 					}
 				}
 			}
 
-			if common.Config.Rebuild.WithoutDBName {
-				fmt.Printf("%s %s WHERE %s LIMIT 1;\n", deletePrefix, shortTableName, strings.Join(where, " AND "))
-			} else {
-				fmt.Printf("%s %s WHERE %s LIMIT 1;\n", deletePrefix, table, strings.Join(where, " AND "))
-			}
+			r.printf("%s %s WHERE %s LIMIT 1;\n", deletePrefix, name, strings.Join(where, " AND "))
 		}
 	} else {
-		for _, value := range values {
+		for _, row := range values {
 			var where []string
-			for i, v := range value {
+			for i, v := range row {
 				col := fmt.Sprintf("@%d", i)
-				if v == "NULL" {
+				if v.IsNull() {
 					where = append(where, fmt.Sprintf("%s IS NULL", col))
 				} else {
-					where = append(where, fmt.Sprintf("%s = %s", col, v))
+					where = append(where, fmt.Sprintf("%s = %s", col, r.sqlValue(v)))
 				}
 			}
-			if common.Config.Rebuild.WithoutDBName {
-				fmt.Printf("-- %s %s WHERE %s LIMIT 1;\n", deletePrefix, shortTableName, strings.Join(where, " AND "))
-			} else {
-				fmt.Printf("-- %s %s WHERE %s LIMIT 1;\n", deletePrefix, table, strings.Join(where, " AND "))
-			}
+			r.printf("-- %s %s WHERE %s LIMIT 1;\n", deletePrefix, name, strings.Join(where, " AND "))
 		}
 	}
 }
 
 // DeleteRollbackQuery build rollback insert SQL
-func DeleteRollbackQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) DeleteRollbackQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	if r.flashbackRefused(table, ev) {
+		return
+	}
+	values := r.RowsValues(ev)
 
-	insertQuery(table, values)
+	r.insertQuery(table, values)
 }
 
 // DeleteStat ...
-func DeleteStat(event *replication.BinlogEvent) {
-	table := RowEventTable(event)
-	if TableStats[table] != nil {
-		TableStats[table]["delete"]++
+func (r *Rebuilder) DeleteStat(event *replication.BinlogEvent) {
+	table := r.RewriteTable(r.LogicalTable(RowEventTable(event)))
+	if r.tableStats[table] != nil {
+		r.tableStats[table]["delete"]++
 	} else {
-		TableStats[table] = map[string]int64{"delete": 1}
+		r.tableStats[table] = map[string]int64{"delete": 1}
 	}
 
-	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
-	if RowsStats[table] != nil {
-		RowsStats[table]["delete"] += int64(len(values))
+	rows := int64(len(event.Event.(*replication.RowsEvent).Rows))
+	if r.rowsStats[table] != nil {
+		r.rowsStats[table]["delete"] += rows
 	} else {
-		RowsStats[table] = map[string]int64{"delete": int64(len(values))}
+		r.rowsStats[table] = map[string]int64{"delete": rows}
 	}
 }
 
 // DeleteLua ...
-func DeleteLua(event *replication.BinlogEvent) {
-	if common.Config.Rebuild.LuaScript == "" || event == nil {
-		return
-	}
+func (r *Rebuilder) DeleteLua(event *replication.BinlogEvent) {
+	r.luaEach(event, func() { r.deleteLua(event) })
+}
+
+func (r *Rebuilder) deleteLua(event *replication.BinlogEvent) {
 
 	table := RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	var values [][]string
+	if r.luaCompatGlobals() {
+		values = r.BuildValues(ev)
+	}
 
 	// lua function
+	fn, ok := r.luaFunction("DeleteRewrite")
+	if !ok {
+		return
+	}
 	f := lua.P{
-		Fn:      Lua.GetGlobal("DeleteRewrite"),
+		Fn:      fn,
 		NRet:    0,
 		Protect: true,
 	}
-	// lua value
-	v := lua.LString(table)
-	for _, value := range values {
-		LuaStringList("GoValues", value)
-		if err := Lua.CallByParam(f, v); err != nil {
+	// lua value: table name, row table
+	v := lua.LString(r.OutputTable(table))
+	for i := range ev.Rows {
+		if r.luaCompatGlobals() {
+			r.LuaStringList("GoValues", values[i])
+		}
+		if err := r.luaCall(f, v, r.luaRowTable(event, ev.Rows[i:i+1])); err != nil {
 			common.Log.Error(err.Error())
+			// -lua-violation skip the row
+			if _, ok := err.(*luaBudgetError); ok {
+				continue
+			}
 			return
 		}
 	}
@@ -0,0 +1,103 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// SchemaDrift table schema not match TABLE_MAP_EVENT, with position where drift first seen
+type SchemaDrift struct {
+	binlog.Drift
+	LogFile   string `json:"log_file,omitempty"`
+	LogPos    uint32 `json:"log_pos"`
+	Timestamp uint32 `json:"timestamp"`
+	Refused   int64  `json:"refused_events,omitempty"` // rows events flashback refused
+}
+
+func driftKey(tableID uint64, table string) string {
+	return fmt.Sprintf("%d:%s", tableID, table)
+}
+
+// TableMapDrift compare TABLE_MAP_EVENT with schema once per table id, file is the current binlog file
+func (r *Rebuilder) TableMapDrift(event *replication.BinlogEvent, file string) {
+	ev, ok := event.Event.(*replication.TableMapEvent)
+	if !ok {
+		return
+	}
+	table := fmt.Sprintf("`%s`.`%s`", ev.Schema, ev.Table)
+	key := driftKey(ev.TableID, table)
+	if _, ok := r.tableDrifts[key]; ok {
+		return
+	}
+	r.tableDrifts[key] = nil
+	if !r.schemaTableSelected(string(ev.Schema), string(ev.Table)) {
+		return
+	}
+	d := binlog.CheckTableMap(r.TableInfo(table), ev)
+	if d == nil {
+		return
+	}
+	// schema may come from route table or `%` database
+	d.Table = table
+	drift := &SchemaDrift{
+		Drift:     *d,
+		LogFile:   file,
+		LogPos:    event.Header.LogPos,
+		Timestamp: event.Header.Timestamp,
+	}
+	r.tableDrifts[key] = drift
+	r.schemaDrifts = append(r.schemaDrifts, drift)
+	common.Log.Warn("schema drift, table: %s, table id: %d, binlog columns: %d, schema columns: %d, mismatched columns: %d, position: %s:%d",
+		table, ev.TableID, d.BinlogColumns, d.SchemaColumns, len(d.Columns), file, event.Header.LogPos)
+}
+
+// flashbackRefused rows of drifted table may be mislabeled, flashback SQL is not generated unless -force-flashback
+func (r *Rebuilder) flashbackRefused(table string, ev *replication.RowsEvent) bool {
+	drift := r.tableDrifts[driftKey(ev.TableID, table)]
+	if drift == nil || r.cfg.Rebuild.ForceFlashback {
+		return false
+	}
+	drift.Refused++
+	r.printf("-- Table: %s, Error: schema not match binlog since %s:%d, flashback refused, use -force-flashback to generate anyway\n",
+		table, drift.LogFile, drift.LogPos)
+	return true
+}
+
+// printDriftReport write drift report into -drift-report file or stderr, nothing if no drift
+func (r *Rebuilder) printDriftReport() {
+	if len(r.schemaDrifts) == 0 {
+		return
+	}
+	buf, err := json.MarshalIndent(map[string]interface{}{"schema_drifts": r.schemaDrifts}, "", "  ")
+	if err != nil {
+		common.Log.Error("printDriftReport Error: %s", err.Error())
+		return
+	}
+	buf = append(buf, '\n')
+	if r.cfg.MySQL.DriftReport == "" {
+		os.Stderr.Write(buf)
+		return
+	}
+	if err = os.WriteFile(r.cfg.MySQL.DriftReport, buf, 0644); err != nil {
+		common.Log.Error("printDriftReport Error: %s", err.Error())
+	}
+}
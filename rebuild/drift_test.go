@@ -0,0 +1,65 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestTableMapDrift(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	forceOrg := r.cfg.Rebuild.ForceFlashback
+	driftsOrg := r.schemaDrifts
+	defer func() {
+		r.cfg.Rebuild.ForceFlashback = forceOrg
+		r.schemaDrifts = driftsOrg
+	}()
+
+	if err := r.schemaAppend("test", "CREATE TABLE `drift` (`id` int, `a` int)"); err != nil {
+		t.Fatal(err.Error())
+	}
+	tableMap := func(id uint64, types ...byte) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.TABLE_MAP_EVENT, LogPos: 100 + uint32(id)},
+			Event: &replication.TableMapEvent{TableID: id, Schema: []byte("test"), Table: []byte("drift"),
+				ColumnCount: uint64(len(types)), ColumnType: types, ColumnMeta: make([]uint16, len(types))},
+		}
+	}
+
+	// table id 1 matches schema, table id 2 has a new column, each table id checked once
+	r.TableMapDrift(tableMap(1, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG), "binlog.000001")
+	r.TableMapDrift(tableMap(2, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG), "binlog.000001")
+	r.TableMapDrift(tableMap(2, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG), "binlog.000001")
+	drifts := r.schemaDrifts[len(driftsOrg):]
+	if len(drifts) != 1 || drifts[0].TableID != 2 || drifts[0].LogFile != "binlog.000001" || drifts[0].LogPos != 102 {
+		t.Fatalf("drifts: %+v", drifts)
+	}
+
+	r.cfg.Rebuild.ForceFlashback = false
+	if r.flashbackRefused("`test`.`drift`", &replication.RowsEvent{TableID: 1}) {
+		t.Error("table id 1 refused")
+	}
+	if !r.flashbackRefused("`test`.`drift`", &replication.RowsEvent{TableID: 2}) || drifts[0].Refused != 1 {
+		t.Error("table id 2 not refused")
+	}
+	r.cfg.Rebuild.ForceFlashback = true
+	if r.flashbackRefused("`test`.`drift`", &replication.RowsEvent{TableID: 2}) {
+		t.Error("table id 2 refused with -force-flashback")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 
 	"github.com/go-mysql-org/go-mysql/replication"
@@ -24,169 +25,214 @@ import (
 )
 
 // InsertRebuild ...
-func InsertRebuild(event *replication.BinlogEvent) string {
-	switch common.Config.Rebuild.Plugin {
+func (r *Rebuilder) InsertRebuild(event *replication.BinlogEvent) string {
+	switch r.cfg.Rebuild.Plugin {
 	case "sql":
-		InsertQuery(event)
+		r.InsertQuery(event)
 	case "flashback":
-		InsertRollbackQuery(event)
+		r.InsertRollbackQuery(event)
 	case "stat":
-		InsertStat(event)
+		r.InsertStat(event)
 	case "lua":
-		InsertLua(event)
+		r.InsertLua(event)
+	case "wasm":
+		r.RowsWasm(event)
 	default:
 	}
 	return ""
 }
 
 // InsertQuery ...
-func InsertQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) InsertQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
-	insertQuery(table, values)
+	values := r.RowsValues(ev)
+	r.insertQuery(table, values)
 }
 
-func insertQuery(table string, values [][]string) {
+func (r *Rebuilder) insertQuery(table string, values [][]binlog.Value) {
 	var insertPrefix string
-	if common.Config.Rebuild.Replace {
+	if r.cfg.Rebuild.Replace {
 		insertPrefix = "REPLACE INTO"
 	} else {
 		insertPrefix = "INSERT INTO"
 	}
-	if common.Config.Rebuild.ForeachTime && common.Config.Rebuild.CurrentEventTime != "" {
-		insertPrefix = fmt.Sprintf(`/* %s */%s`, common.Config.Rebuild.CurrentEventTime, insertPrefix)
+	if r.cfg.Rebuild.ForeachTime && r.eventTime != "" {
+		insertPrefix = fmt.Sprintf(`/* %s */%s`, r.eventTime, insertPrefix)
 	}
 
-	// for common.Config.Rebuild.WithoutDBName
-	shortTableName := onlyTable(table)
+	// -logical-table, -rewrite-db, -rewrite-tables, -without-db-name
+	name := r.OutputTable(table)
+	insertPrefix = r.originComment(table) + insertPrefix
+	table = r.SchemaTable(table)
 
+	info := r.TableInfo(table)
+	// invisible primary key is used by UPDATE, DELETE WHERE, keep it in INSERT with column list
+	keys := r.invisibleKeys(info, table)
 	colStr := ""
-	for row, v := range values {
+	for row, image := range values {
+		v := r.sqlValues(image)
 		valStr := ""
-		if common.Config.Rebuild.CompleteInsert {
-			if ok := Columns[table]; ok != nil {
-				if len(common.Config.Rebuild.IgnoreColumns) > 0 {
-					var truncValues, truncColumns []string
-					for i, col := range Columns[table] {
-						ignore := false
-						for _, c := range common.Config.Rebuild.IgnoreColumns {
-							if c == strings.Trim(col, "`") {
-								ignore = true
-							}
-						}
-						if !ignore {
-							truncColumns = append(truncColumns, col)
-							truncValues = append(truncValues, v[i])
+		if r.cfg.Rebuild.CompleteInsert || len(keys) > 0 {
+			if ok := r.columns[table]; ok != nil {
+				var truncValues, truncColumns []string
+				for i, col := range r.columns[table] {
+					// generated and invisible columns are not written, except invisible primary key
+					ignore := !info.Writable(i) && !keys[col]
+					for _, c := range r.cfg.Rebuild.IgnoreColumns {
+						if c == strings.Trim(col, "`") {
+							ignore = true
 						}
 					}
-					colStr = fmt.Sprintf("(%s)", strings.Join(truncColumns, ", "))
-					valStr = strings.Join(truncValues, ", ")
-				} else {
-					colStr = fmt.Sprintf("(%s)", strings.Join(Columns[table], ", "))
-					valStr = strings.Join(v, ", ")
+					if !ignore {
+						truncColumns = append(truncColumns, col)
+						truncValues = append(truncValues, v[i])
+					}
 				}
+				colStr = fmt.Sprintf("(%s)", strings.Join(truncColumns, ", "))
+				valStr = strings.Join(truncValues, ", ")
 			} else {
 				valStr = strings.Join(v, ", ")
 			}
 		} else {
-			valStr = strings.Join(v, ", ")
+			valStr = strings.Join(positionalValues(info, v), ", ")
 		}
 
-		if common.Config.Rebuild.ExtendedInsertCount > 1 {
-			InsertValuesMerge = append(InsertValuesMerge, fmt.Sprintf("(%s)", valStr))
+		if r.cfg.Rebuild.ExtendedInsertCount > 1 {
+			r.insertValuesMerge = append(r.insertValuesMerge, fmt.Sprintf("(%s)", valStr))
 		} else {
-			if common.Config.Rebuild.WithoutDBName {
-				fmt.Printf("%s %s %s VALUES (%s);\n", insertPrefix, shortTableName, colStr, valStr)
-			} else {
-				fmt.Printf("%s %s %s VALUES (%s);\n", insertPrefix, table, colStr, valStr)
-			}
+			r.printf("%s %s %s VALUES (%s);\n", insertPrefix, name, colStr, valStr)
 		}
 
 		// INSERT VALUES merge
-		if row != 0 && common.Config.Rebuild.ExtendedInsertCount > 1 &&
-			(row+1)%common.Config.Rebuild.ExtendedInsertCount == 0 {
-			if common.Config.Rebuild.WithoutDBName {
-				fmt.Printf("%s %s %s VALUES %s;\n", insertPrefix, shortTableName, colStr, strings.Join(InsertValuesMerge, ", "))
-			} else {
-				fmt.Printf("%s %s %s VALUES %s;\n", insertPrefix, table, colStr, strings.Join(InsertValuesMerge, ", "))
+		if row != 0 && r.cfg.Rebuild.ExtendedInsertCount > 1 &&
+			(row+1)%r.cfg.Rebuild.ExtendedInsertCount == 0 {
+			r.printf("%s %s %s VALUES %s;\n", insertPrefix, name, colStr, strings.Join(r.insertValuesMerge, ", "))
+			r.insertValuesMerge = []string{}
+		}
+	}
+	if len(r.insertValuesMerge) > 0 {
+		r.printf("%s %s %s VALUES %s;\n", insertPrefix, name, colStr, strings.Join(r.insertValuesMerge, ", "))
+		r.insertValuesMerge = []string{}
+	}
+}
+
+// positionalValues values of INSERT without column list, which excludes invisible columns,
+// and only DEFAULT is permitted for generated columns
+func positionalValues(info *binlog.Table, v []string) []string {
+	if info == nil {
+		return v
+	}
+	var values []string
+	for i, val := range v {
+		if i < len(info.Columns) {
+			if info.Columns[i].Invisible {
+				continue
+			}
+			if info.Columns[i].Generated {
+				val = "DEFAULT"
 			}
-			InsertValuesMerge = []string{}
 		}
+		values = append(values, val)
 	}
-	if len(InsertValuesMerge) > 0 {
-		if common.Config.Rebuild.WithoutDBName {
-			fmt.Printf("%s %s %s VALUES %s;\n", insertPrefix, shortTableName, colStr, strings.Join(InsertValuesMerge, ", "))
-		} else {
-			fmt.Printf("%s %s %s VALUES %s;\n", insertPrefix, table, colStr, strings.Join(InsertValuesMerge, ", "))
+	return values
+}
+
+// invisibleKeys invisible columns of primary key, eg. my_row_id of generated invisible primary key
+func (r *Rebuilder) invisibleKeys(info *binlog.Table, table string) map[string]bool {
+	keys := make(map[string]bool)
+	if info == nil {
+		return keys
+	}
+	for _, key := range r.primaryKeys[table] {
+		for _, c := range info.Columns {
+			if key == fmt.Sprintf("`%s`", c.Name) && c.Invisible && !c.Generated {
+				keys[key] = true
+			}
 		}
-		InsertValuesMerge = []string{}
 	}
+	return keys
 }
 
 // InsertRollbackQuery ...
-func InsertRollbackQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) InsertRollbackQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	if r.flashbackRefused(table, ev) {
+		return
+	}
+	values := r.RowsValues(ev)
 
-	common.Verbose("-- [DEBUG] event: insert, table: %s, rows: %d\n", table, len(values))
+	r.verbose("-- [DEBUG] event: insert, table: %s, rows: %d\n", table, len(values))
 
-	deleteQuery(table, values)
+	r.deleteQuery(table, values)
 }
 
 // InsertStat ...
-func InsertStat(event *replication.BinlogEvent) {
-	table := RowEventTable(event)
-	if TableStats[table] != nil {
-		TableStats[table]["insert"]++
+func (r *Rebuilder) InsertStat(event *replication.BinlogEvent) {
+	table := r.RewriteTable(r.LogicalTable(RowEventTable(event)))
+	if r.tableStats[table] != nil {
+		r.tableStats[table]["insert"]++
 	} else {
-		TableStats[table] = map[string]int64{"insert": 1}
+		r.tableStats[table] = map[string]int64{"insert": 1}
 	}
 
-	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
-	if RowsStats[table] != nil {
-		RowsStats[table]["insert"] += int64(len(values))
+	rows := int64(len(event.Event.(*replication.RowsEvent).Rows))
+	if r.rowsStats[table] != nil {
+		r.rowsStats[table]["insert"] += rows
 	} else {
-		RowsStats[table] = map[string]int64{"insert": int64(len(values))}
+		r.rowsStats[table] = map[string]int64{"insert": rows}
 	}
 }
 
 // InsertLua ...
-func InsertLua(event *replication.BinlogEvent) {
-	if common.Config.Rebuild.LuaScript == "" || event == nil {
-		return
-	}
+func (r *Rebuilder) InsertLua(event *replication.BinlogEvent) {
+	r.luaEach(event, func() { r.insertLua(event) })
+}
+
+func (r *Rebuilder) insertLua(event *replication.BinlogEvent) {
 
 	table := RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	var values [][]string
+	if r.luaCompatGlobals() {
+		values = r.BuildValues(ev)
+	}
 
 	// lua function
+	fn, ok := r.luaFunction("InsertRewrite")
+	if !ok {
+		return
+	}
 	f := lua.P{
-		Fn:      Lua.GetGlobal("InsertRewrite"),
+		Fn:      fn,
 		NRet:    0,
 		Protect: true,
 	}
-	// lua value
-	v := lua.LString(table)
-	for _, value := range values {
-		LuaStringList("GoValues", value)
-		if err := Lua.CallByParam(f, v); err != nil {
+	// lua value: table name, row table
+	v := lua.LString(r.OutputTable(table))
+	for i := range ev.Rows {
+		if r.luaCompatGlobals() {
+			r.LuaStringList("GoValues", values[i])
+		}
+		if err := r.luaCall(f, v, r.luaRowTable(event, ev.Rows[i:i+1])); err != nil {
 			common.Log.Error(err.Error())
+			// -lua-violation skip the row
+			if _, ok := err.(*luaBudgetError); ok {
+				continue
+			}
 			return
 		}
 	}
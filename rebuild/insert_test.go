@@ -12,3 +12,67 @@
  */
 
 package rebuild
+
+import (
+	"testing"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// TestGeneratedColumns generated and invisible columns not in INSERT VALUES, UPDATE SET, GIPK in INSERT and WHERE
+func TestGeneratedColumns(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	completeOrg := r.cfg.Rebuild.CompleteInsert
+	defer func() {
+		r.cfg.Rebuild.CompleteInsert = completeOrg
+	}()
+
+	err := r.schemaAppend("test", "CREATE TABLE `gipk` (\n"+
+		"  `my_row_id` bigint unsigned NOT NULL AUTO_INCREMENT /*!80023 INVISIBLE */,\n"+
+		"  `a` int DEFAULT NULL,\n"+
+		"  `b` int GENERATED ALWAYS AS ((`a` + 1)) VIRTUAL,\n"+
+		"  `c` int GENERATED ALWAYS AS ((`a` * 2)) STORED,\n"+
+		"  PRIMARY KEY (`my_row_id`)\n"+
+		") ENGINE=InnoDB")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = r.schemaAppend("test", "CREATE TABLE `gen` (\n"+
+		"  `id` int NOT NULL,\n"+
+		"  `a` int DEFAULT NULL,\n"+
+		"  `b` int GENERATED ALWAYS AS ((`a` + 1)) VIRTUAL,\n"+
+		"  PRIMARY KEY (`id`)\n"+
+		") ENGINE=InnoDB")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	err = common.GoldenDiff(func() {
+		row := func(id uint64, a int32) []binlog.Value {
+			return binlog.RowValues(r.TableInfo("`test`.`gipk`"),
+				[]byte{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG},
+				[]interface{}{int64(id), a, a + 1, a * 2})
+		}
+		values := [][]binlog.Value{row(1, 1), row(1, 2)}
+		r.cfg.Rebuild.CompleteInsert = false
+		r.insertQuery("`test`.`gipk`", values[:1])
+		r.cfg.Rebuild.CompleteInsert = true
+		r.insertQuery("`test`.`gipk`", values[:1])
+		r.updateQuery("`test`.`gipk`", values)
+		r.updateRollbackQuery("`test`.`gipk`", values)
+		r.deleteQuery("`test`.`gipk`", values[:1])
+
+		r.cfg.Rebuild.CompleteInsert = false
+		r.insertQuery("`test`.`gen`", [][]binlog.Value{binlog.RowValues(r.TableInfo("`test`.`gen`"),
+			[]byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG},
+			[]interface{}{int32(1), int32(1), int32(2)})})
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,411 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	uuid "github.com/satori/go.uuid"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// trackTransaction keep GTID and thread id of current transaction
+func (r *Rebuilder) trackTransaction(event *replication.BinlogEvent) {
+	switch event.Header.EventType {
+	case replication.GTID_EVENT:
+		ev := event.Event.(*replication.GTIDEvent)
+		serverID, _ := uuid.FromBytes(ev.SID)
+		r.currentGTID = fmt.Sprintf("%s:%d", serverID, ev.GNO)
+	case replication.QUERY_EVENT:
+		r.currentThreadID = event.Event.(*replication.QueryEvent).SlaveProxyID
+	}
+}
+
+// luaEventType insert, update, delete, query or binlog event type name
+func luaEventType(event *replication.BinlogEvent) string {
+	switch event.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return "insert"
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		return "update"
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		return "delete"
+	case replication.QUERY_EVENT:
+		return "query"
+	}
+	return strings.ToLower(event.Header.EventType.String())
+}
+
+// luaEventTable event header, table, GTID info for lua
+func (r *Rebuilder) luaEventTable(event *replication.BinlogEvent) *lua.LTable {
+	t := r.luaState.NewTable()
+	header := event.Header
+	t.RawSetString("type", lua.LString(luaEventType(event)))
+	t.RawSetString("event_type", lua.LString(header.EventType.String()))
+	t.RawSetString("timestamp", lua.LNumber(header.Timestamp))
+	t.RawSetString("server_id", lua.LNumber(header.ServerID))
+	t.RawSetString("log_pos", lua.LNumber(header.LogPos))
+	t.RawSetString("event_size", lua.LNumber(header.EventSize))
+	t.RawSetString("flags", lua.LNumber(header.Flags))
+	t.RawSetString("gtid", lua.LString(r.currentGTID))
+	t.RawSetString("thread_id", lua.LNumber(r.currentThreadID))
+
+	switch event.Header.EventType {
+	case replication.QUERY_EVENT:
+		ev := event.Event.(*replication.QueryEvent)
+		t.RawSetString("schema", lua.LString(ev.Schema))
+		t.RawSetString("query", lua.LString(ev.Query))
+		tables := r.QueryEventTables(event)
+		if len(tables) > 0 {
+			t.RawSetString("table", lua.LString(tables[0]))
+		}
+		l := r.luaState.NewTable()
+		for _, table := range tables {
+			l.Append(lua.LString(table))
+		}
+		t.RawSetString("tables", l)
+	default:
+		if table := RowEventTable(event); table != "" {
+			t.RawSetString("table", lua.LString(table))
+		}
+	}
+	return t
+}
+
+// luaList convert string list into lua table
+func (r *Rebuilder) luaList(values []string) *lua.LTable {
+	l := r.luaState.NewTable()
+	for _, v := range values {
+		l.Append(lua.LString(v))
+	}
+	return l
+}
+
+// rowColumnNames column names without quote, @N if table schema not found
+func (r *Rebuilder) rowColumnNames(table string, count int) []string {
+	cols := r.columns[r.SchemaTable(table)]
+	names := make([]string, count)
+	for i := range names {
+		if i < len(cols) {
+			names[i] = strings.Trim(cols[i], "`")
+		} else {
+			names[i] = fmt.Sprintf("@%d", i)
+		}
+	}
+	return names
+}
+
+// luaMaxInteger integers larger than 2^53 lose precision as lua number, pass them as string
+const luaMaxInteger = 1 << 53
+
+// luaValue typed lua value of binlog column, integers beyond 2^53 as string
+func luaValue(v binlog.Value) (lua.LValue, string) {
+	value, kind := v.Native()
+	switch val := value.(type) {
+	case int64:
+		if val > luaMaxInteger || val < -luaMaxInteger {
+			return lua.LString(fmt.Sprint(val)), kind
+		}
+		return lua.LNumber(val), kind
+	case uint64:
+		if val > luaMaxInteger {
+			return lua.LString(fmt.Sprint(val)), kind
+		}
+		return lua.LNumber(val), kind
+	case float64:
+		return lua.LNumber(val), kind
+	case string:
+		return lua.LString(val), kind
+	case []byte:
+		return lua.LString(val), kind
+	}
+	return lua.LNil, kind
+}
+
+// luaRowImage one row image as column name keyed table, with value kinds keyed by column name
+func (r *Rebuilder) luaRowImage(names []string, row []binlog.Value) (*lua.LTable, *lua.LTable) {
+	values := r.luaState.NewTable()
+	kinds := r.luaState.NewTable()
+	for i, v := range row {
+		value, kind := luaValue(v)
+		values.RawSetString(names[i], value)
+		kinds.RawSetString(names[i], lua.LString(kind))
+	}
+	return values, kinds
+}
+
+// luaRowTable event table with one row of rows event, update rows as before, after pair.
+// fields besides luaEventTable: schema, name, columns, primary_keys, before, after, values, types
+func (r *Rebuilder) luaRowTable(event *replication.BinlogEvent, rows [][]interface{}) *lua.LTable {
+	t := r.luaEventTable(event)
+	ev := event.Event.(*replication.RowsEvent)
+	table := RowEventTable(event)
+	t.RawSetString("schema", lua.LString(ev.Table.Schema))
+	t.RawSetString("name", lua.LString(ev.Table.Table))
+
+	names := r.rowColumnNames(table, int(ev.ColumnCount))
+	for _, row := range rows {
+		for len(names) < len(row) {
+			names = append(names, fmt.Sprintf("@%d", len(names)))
+		}
+	}
+	t.RawSetString("columns", r.luaList(names))
+	var keys []string
+	for _, key := range r.primaryKeys[r.SchemaTable(table)] {
+		keys = append(keys, strings.Trim(key, "`"))
+	}
+	t.RawSetString("primary_keys", r.luaList(keys))
+
+	info := r.TableInfo(table)
+	image := func(row []interface{}) []binlog.Value {
+		return binlog.TableMapValues(info, ev.Table, row)
+	}
+	switch luaEventType(event) {
+	case "insert":
+		after, types := r.luaRowImage(names, image(rows[0]))
+		t.RawSetString("after", after)
+		t.RawSetString("values", after)
+		t.RawSetString("types", types)
+	case "delete":
+		before, types := r.luaRowImage(names, image(rows[0]))
+		t.RawSetString("before", before)
+		t.RawSetString("values", before)
+		t.RawSetString("types", types)
+	case "update":
+		before, _ := r.luaRowImage(names, image(rows[0]))
+		after, types := r.luaRowImage(names, image(rows[1]))
+		t.RawSetString("before", before)
+		t.RawSetString("after", after)
+		t.RawSetString("values", after)
+		t.RawSetString("types", types)
+	}
+	return t
+}
+
+// luaCompatGlobals keep GoValues, GoValuesWhere, GoValuesSet globals for -lua-mode compat
+func (r *Rebuilder) luaCompatGlobals() bool {
+	return r.cfg.Rebuild.LuaMode != "typed"
+}
+
+// LuaFilter call lua Filter(event) after built-in filters, return false to drop the event.
+// Row events call Filter for each row, update rows as before, after pairs.
+// Only row events and table query events are filtered, transaction control events, eg. GTID, XID, BEGIN, COMMIT always pass.
+// With chained scripts, each script filters for itself, the event is dropped only when all scripts drop it.
+func (r *Rebuilder) LuaFilter(event *replication.BinlogEvent) bool {
+	if r.luaState == nil || event == nil {
+		return true
+	}
+	r.trackTransaction(event)
+	if !luaTableEvent(event) {
+		return true
+	}
+
+	scripts := r.luaEventScripts(event)
+	if len(scripts) == 0 {
+		return true
+	}
+	var do bool
+	current := r.luaState
+	for _, s := range scripts {
+		r.luaState = s.state
+		s.filtered, s.drop, s.rows = event, false, nil
+		if ev, ok := event.Event.(*replication.RowsEvent); ok {
+			s.rows = ev.Rows
+		}
+		if !r.luaFilterScript(s, event) {
+			s.drop = true
+		}
+		do = do || !s.drop
+	}
+	r.luaState = current
+
+	// only one script, filter rows in place
+	if ev, ok := event.Event.(*replication.RowsEvent); ok && len(scripts) == 1 {
+		ev.Rows = scripts[0].rows
+	}
+	return do
+}
+
+// luaTableEvent row event or query event other than BEGIN, COMMIT, ROLLBACK
+func luaTableEvent(event *replication.BinlogEvent) bool {
+	if event.Header.EventType == replication.QUERY_EVENT {
+		return !IsTransactionQuery(string(event.Event.(*replication.QueryEvent).Query))
+	}
+	return RowEventTable(event) != ""
+}
+
+// luaFilterScript call Filter of one script, kept rows of row events save in s.rows
+func (r *Rebuilder) luaFilterScript(s *luaScript, event *replication.BinlogEvent) (do bool) {
+	fn := r.luaState.GetGlobal("Filter")
+	if fn.Type() != lua.LTFunction {
+		return true
+	}
+
+	// keep event if values can't build, error will print in rebuild
+	defer func() {
+		if err := recover(); err != nil {
+			common.Log.Error("LuaFilter Table: %s, Error: %s", RowEventTable(event), strings.Split(fmt.Sprint(err), "\n")[0])
+			do = true
+		}
+	}()
+
+	var step int
+	switch luaEventType(event) {
+	case "insert", "delete":
+		step = 1
+	case "update":
+		step = 2
+	default:
+		return r.luaFilterCall(fn, r.luaEventTable(event))
+	}
+
+	ev := event.Event.(*replication.RowsEvent)
+	var rows [][]interface{}
+	for i := 0; i+step <= len(ev.Rows); i += step {
+		if r.luaFilterCall(fn, r.luaRowTable(event, ev.Rows[i:i+step])) {
+			rows = append(rows, ev.Rows[i:i+step]...)
+		}
+	}
+	s.rows = rows
+	return len(rows) > 0
+}
+
+// luaFilterCall call lua Filter, keep the event when lua error
+func (r *Rebuilder) luaFilterCall(fn lua.LValue, t *lua.LTable) bool {
+	if err := r.luaCall(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, t); err != nil {
+		common.Log.Error(err.Error())
+		return true
+	}
+	ret := r.luaState.Get(-1)
+	r.luaState.Pop(1)
+	return lua.LVAsBool(ret)
+}
+
+// luaFunction get lua global function, optional hooks not defined in script will be skipped
+func (r *Rebuilder) luaFunction(name string) (lua.LValue, bool) {
+	if r.luaState == nil {
+		return lua.LNil, false
+	}
+	fn := r.luaState.GetGlobal(name)
+	return fn, fn.Type() == lua.LTFunction
+}
+
+// luaHook call optional lua hook, log error and go on if hook failed
+func (r *Rebuilder) luaHook(name string, args ...lua.LValue) {
+	fn, ok := r.luaFunction(name)
+	if !ok {
+		return
+	}
+	if err := r.luaCall(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	}, args...); err != nil {
+		common.Log.Error(err.Error())
+	}
+}
+
+// luaLifecycleHook call Init, Finalizer without -lua-timeout budget
+func (r *Rebuilder) luaLifecycleHook(name string) {
+	fn, ok := r.luaFunction(name)
+	if !ok {
+		return
+	}
+	if err := r.luaState.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	}); err != nil {
+		common.Log.Error(err.Error())
+	}
+}
+
+// GTIDLua call lua Gtid(gtid, event), event with last_committed, sequence_number, commit_flag
+func (r *Rebuilder) GTIDLua(event *replication.BinlogEvent) {
+	r.luaEach(event, func() { r.gtidLua(event) })
+}
+
+func (r *Rebuilder) gtidLua(event *replication.BinlogEvent) {
+	if _, ok := r.luaFunction("Gtid"); !ok {
+		return
+	}
+	ev := event.Event.(*replication.GTIDEvent)
+	t := r.luaEventTable(event)
+	t.RawSetString("last_committed", lua.LNumber(ev.LastCommitted))
+	t.RawSetString("sequence_number", lua.LNumber(ev.SequenceNumber))
+	t.RawSetString("commit_flag", lua.LNumber(ev.CommitFlag))
+	r.luaHook("Gtid", lua.LString(r.currentGTID), t)
+}
+
+// XidLua call lua TransactionCommit(xid, gtid)
+func (r *Rebuilder) XidLua(event *replication.BinlogEvent) {
+	r.luaEach(event, func() {
+		r.luaHook("TransactionCommit", lua.LNumber(event.Event.(*replication.XIDEvent).XID), lua.LString(r.currentGTID))
+	})
+}
+
+// RotateLua call lua Rotate(file, position)
+func (r *Rebuilder) RotateLua(event *replication.BinlogEvent) {
+	ev := event.Event.(*replication.RotateEvent)
+	r.luaEach(event, func() {
+		r.luaHook("Rotate", lua.LString(ev.NextLogName), lua.LNumber(ev.Position))
+	})
+}
+
+// queryHooksLua call lua TransactionBegin, TransactionCommit, TransactionRollback or Ddl for QUERY_EVENT
+func (r *Rebuilder) queryHooksLua(queryEvent *replication.BinlogEvent, sql string) {
+	switch strings.ToUpper(sql) {
+	case "BEGIN":
+		if _, ok := r.luaFunction("TransactionBegin"); ok {
+			r.luaHook("TransactionBegin", r.luaEventTable(queryEvent))
+		}
+		return
+	case "COMMIT":
+		// non-transactional engine or statement format commit without XID_EVENT
+		r.luaHook("TransactionCommit", lua.LNumber(0), lua.LString(r.currentGTID))
+		return
+	case "ROLLBACK":
+		// transaction modified non-transactional tables rolled back
+		r.luaHook("TransactionRollback", lua.LString(r.currentGTID))
+		return
+	}
+	if IsTransactionQuery(sql) {
+		// XA COMMIT, XA ROLLBACK of prepared XA transaction
+		if fields := strings.Fields(strings.ToUpper(sql)); len(fields) > 1 && fields[0] == "XA" {
+			switch fields[1] {
+			case "COMMIT":
+				r.luaHook("TransactionCommit", lua.LNumber(0), lua.LString(r.currentGTID))
+			case "ROLLBACK":
+				r.luaHook("TransactionRollback", lua.LString(r.currentGTID))
+			}
+		}
+		return
+	}
+	if _, ok := r.luaFunction("Ddl"); !ok {
+		return
+	}
+	if parsedType := r.ddlType(sql); parsedType != "" {
+		r.luaHook("Ddl", lua.LString(queryEvent.Event.(*replication.QueryEvent).Schema), lua.LString(sql), lua.LString(parsedType))
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// withLua run f with lua state load from script
+func withLua(t *testing.T, r *Rebuilder, script string, f func()) {
+	luaOrg := r.luaState
+	r.luaState = lua.NewState()
+	r.luaPreload(r.luaState)
+	defer func() {
+		r.luaState.Close()
+		r.luaState = luaOrg
+	}()
+	if err := r.luaState.DoString(script); err != nil {
+		t.Fatal(err.Error())
+	}
+	f()
+}
+
+func TestLuaFilter(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	script := `
+Calls = 0
+function Filter(event)
+    Calls = Calls + 1
+    if event.type == "query" then
+        return event.table ~= "` + "`test`.`tb`" + `"
+    end
+    if event.type == "update" then
+        return event.after["@1"] ~= "skip"
+    end
+    return event.values == nil or event.values["@0"] ~= 2
+end
+`
+	rowsEvent := func(eventType replication.EventType, rows [][]interface{}) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: eventType},
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{
+					Schema:     []byte("test"),
+					Table:      []byte("filter"),
+					ColumnType: []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR},
+				},
+				Rows: rows,
+			},
+		}
+	}
+
+	withLua(t, r, script, func() {
+		insert := rowsEvent(replication.WRITE_ROWS_EVENTv2, [][]interface{}{{1, "a"}, {2, "b"}, {3, "c"}})
+		if !r.LuaFilter(insert) {
+			t.Error("insert event should keep")
+		}
+		if rows := insert.Event.(*replication.RowsEvent).Rows; len(rows) != 2 || rows[1][0] != 3 {
+			t.Errorf("insert rows filter error: %v", rows)
+		}
+
+		update := rowsEvent(replication.UPDATE_ROWS_EVENTv2, [][]interface{}{{1, "a"}, {1, "skip"}, {3, "c"}, {3, "d"}})
+		r.LuaFilter(update)
+		if rows := update.Event.(*replication.RowsEvent).Rows; len(rows) != 2 || rows[1][1] != "d" {
+			t.Errorf("update rows filter error: %v", rows)
+		}
+
+		remove := rowsEvent(replication.DELETE_ROWS_EVENTv2, [][]interface{}{{2, "b"}})
+		if r.LuaFilter(remove) {
+			t.Error("delete event should drop")
+		}
+
+		query := &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+			Event:  &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE tb ADD c int")},
+		}
+		if r.LuaFilter(query) {
+			t.Error("query event should drop")
+		}
+
+		// transaction control events not passed to Filter
+		begin := &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+			Event:  &replication.QueryEvent{Schema: []byte("test"), Query: []byte("BEGIN")},
+		}
+		gtid := &replication.BinlogEvent{Header: &replication.EventHeader{EventType: replication.GTID_EVENT}, Event: &replication.GTIDEvent{}}
+		xid := &replication.BinlogEvent{Header: &replication.EventHeader{EventType: replication.XID_EVENT}, Event: &replication.XIDEvent{}}
+		for _, e := range []*replication.BinlogEvent{gtid, begin, xid} {
+			if !r.LuaFilter(e) {
+				t.Errorf("%s should pass", e.Header.EventType)
+			}
+		}
+		if calls := lua.LVAsNumber(r.luaState.GetGlobal("Calls")); calls != 7 {
+			t.Errorf("Filter want 7 calls, got %v", calls)
+		}
+	})
+}
+
+func TestLuaRowTable(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	err := r.schemaAppend("test", "CREATE TABLE `row` (`id` int unsigned, `name` varchar(10), `data` blob, `price` decimal(10,2), `memo` text, PRIMARY KEY (`id`))")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	script := `
+function UpdateRewrite(tab, row)
+    assert(tab == "` + "`test`.`row`" + `", tab)
+    assert(row.type == "update" and row.schema == "test" and row.name == "row")
+    assert(row.timestamp == 1700000000 and row.server_id == 1 and row.log_pos == 1024)
+    assert(table.concat(row.columns, ",") == "id,name,data,price,memo")
+    assert(table.concat(row.primary_keys, ",") == "id")
+    assert(row.before.id == 4294967295 and row.after.id == 1)
+    assert(row.before.name == "a" and row.after.name == "b")
+    assert(row.after.data == "\0\1" and row.types.data == "binary")
+    assert(row.after.price == "1.50" and row.types.price == "decimal")
+    assert(row.after.memo == nil and row.types.memo == "null")
+    assert(GoValuesSet[1] == "1")
+    Checked = true
+end
+`
+	withLua(t, r, script, func() {
+		event := &replication.BinlogEvent{
+			Header: &replication.EventHeader{
+				EventType: replication.UPDATE_ROWS_EVENTv2,
+				Timestamp: 1700000000,
+				ServerID:  1,
+				LogPos:    1024,
+			},
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{
+					Schema: []byte("test"),
+					Table:  []byte("row"),
+					ColumnType: []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB,
+						mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_BLOB},
+				},
+				ColumnCount: 5,
+				Rows: [][]interface{}{
+					{int32(-1), "a", []byte{0}, testDecimal("1.00"), []byte("memo")},
+					{int32(1), "b", []byte{0, 1}, testDecimal("1.50"), nil},
+				},
+			},
+		}
+		scriptOrg := r.cfg.Rebuild.LuaScript
+		r.cfg.Rebuild.LuaScript = "test.lua"
+		defer func() { r.cfg.Rebuild.LuaScript = scriptOrg }()
+		r.UpdateLua(event)
+		if r.luaState.GetGlobal("Checked") != lua.LTrue {
+			t.Error("UpdateRewrite row table check failed")
+		}
+	})
+}
+
+// testDecimal decimal.Decimal like value
+type testDecimal string
+
+func (d testDecimal) String() string {
+	return string(d)
+}
+
+func TestLuaHooks(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	pluginOrg := r.cfg.Rebuild.Plugin
+	scriptOrg := r.cfg.Rebuild.LuaScript
+	r.cfg.Rebuild.Plugin = "lua"
+	r.cfg.Rebuild.LuaScript = "test.lua"
+	defer func() {
+		r.cfg.Rebuild.Plugin = pluginOrg
+		r.cfg.Rebuild.LuaScript = scriptOrg
+	}()
+
+	// InsertRewrite, QueryRewrite ... not defined, should skip silently
+	script := `
+Calls = {}
+function Gtid(gtid, event)
+    table.insert(Calls, "gtid " .. gtid .. " " .. event.last_committed)
+end
+function TransactionBegin(event)
+    table.insert(Calls, "begin " .. event.gtid)
+end
+function Ddl(schema, sql, parsedType)
+    table.insert(Calls, "ddl " .. schema .. " " .. parsedType)
+end
+function TransactionCommit(xid, gtid)
+    table.insert(Calls, "commit " .. xid .. " " .. gtid)
+end
+function TransactionRollback(gtid)
+    table.insert(Calls, "rollback " .. gtid)
+end
+function Rotate(file, pos)
+    table.insert(Calls, "rotate " .. file .. " " .. pos)
+end
+`
+	header := func(eventType replication.EventType) *replication.EventHeader {
+		return &replication.EventHeader{EventType: eventType}
+	}
+	query := func(sql string) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: header(replication.QUERY_EVENT),
+			Event:  &replication.QueryEvent{Schema: []byte("test"), Query: []byte(sql)},
+		}
+	}
+	withLua(t, r, script, func() {
+		r.GTIDRebuild(&replication.BinlogEvent{
+			Header: header(replication.GTID_EVENT),
+			Event: &replication.GTIDEvent{
+				SID:           []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62},
+				GNO:           5,
+				LastCommitted: 4,
+			},
+		})
+		r.QueryRebuild(query("BEGIN"))
+		r.InsertLua(&replication.BinlogEvent{
+			Header: header(replication.WRITE_ROWS_EVENTv2),
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("tb"), ColumnType: []byte{mysql.MYSQL_TYPE_LONG}},
+				Rows:  [][]interface{}{{1}},
+			},
+		})
+		r.XidRebuild(&replication.BinlogEvent{
+			Header: header(replication.XID_EVENT),
+			Event:  &replication.XIDEvent{XID: 10},
+		})
+		r.QueryRebuild(query("ALTER TABLE tb ADD c int"))
+		r.QueryRebuild(query("INSERT INTO tb VALUES (1)"))
+		r.QueryRebuild(query("BEGIN"))
+		r.QueryRebuild(query("ROLLBACK"))
+		r.QueryRebuild(query("XA COMMIT X'01',X'',1"))
+		r.QueryRebuild(query("XA ROLLBACK X'02',X'',1"))
+		r.RotateRebuild(&replication.BinlogEvent{
+			Header: header(replication.ROTATE_EVENT),
+			Event:  &replication.RotateEvent{NextLogName: []byte("binlog.000003"), Position: 4},
+		})
+
+		var calls []string
+		r.luaState.GetGlobal("Calls").(*lua.LTable).ForEach(func(_, v lua.LValue) {
+			calls = append(calls, v.String())
+		})
+		gtid := "3e11fa47-71ca-11e1-9e33-c80aa9429562:5"
+		expect := []string{
+			"gtid " + gtid + " 4",
+			"begin " + gtid,
+			"commit 10 " + gtid,
+			"ddl test AlterTable",
+			"begin " + gtid,
+			"rollback " + gtid,
+			"commit 0 " + gtid,
+			"rollback " + gtid,
+			"rotate binlog.000003 4",
+		}
+		if strings.Join(calls, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("lua hooks want:\n%s\ngot:\n%s", strings.Join(expect, "\n"), strings.Join(calls, "\n"))
+		}
+	})
+}
@@ -0,0 +1,404 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v2"
+)
+
+// luaFixture -lua-test fixture, YAML or JSON format
+type luaFixture struct {
+	Script string            `yaml:"script"` // lua script, default -lua-script
+	Schema string            `yaml:"schema"` // CREATE TABLE statements
+	Events []luaFixtureEvent `yaml:"events"`
+	Expect struct {
+		Stdout *string   `yaml:"stdout"` // nil for not check
+		Calls  *[]string `yaml:"calls"`  // mysql, redis calls, nil for not check
+	} `yaml:"expect"`
+}
+
+// luaFixtureEvent synthetic binlog event
+type luaFixtureEvent struct {
+	Op        string        `yaml:"op"`    // insert, update, delete, query, begin, commit
+	Table     string        `yaml:"table"` // db.tb
+	Rows      []interface{} `yaml:"rows"`  // insert, delete: column map or value list, update: {before: row, after: row}
+	Schema    string        `yaml:"schema"`
+	SQL       string        `yaml:"sql"`
+	GTID      string        `yaml:"gtid"`
+	Xid       uint64        `yaml:"xid"`
+	Timestamp uint32        `yaml:"timestamp"`
+	ServerID  uint32        `yaml:"server_id"`
+	LogPos    uint32        `yaml:"log_pos"`
+	ThreadID  uint32        `yaml:"thread_id"`
+}
+
+// LuaTest run -lua-test fixtures, return false if any fixture mismatch
+func (r *Rebuilder) LuaTest() bool {
+	pass := true
+	for _, file := range r.cfg.Rebuild.LuaTest {
+		// each fixture runs in a fresh Rebuilder, stdout of the script is captured
+		if err := New(r.cfg, r.master, nil).luaTestFixture(file); err != nil {
+			r.printf("FAIL %s\n%s\n", file, err.Error())
+			pass = false
+			continue
+		}
+		r.printf("PASS %s\n", file)
+	}
+	return pass
+}
+
+// luaTestFixture run one fixture and compare with expect
+func (r *Rebuilder) luaTestFixture(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var fixture luaFixture
+	if err = yaml.Unmarshal(buf, &fixture); err != nil {
+		return err
+	}
+	script := fixture.Script
+	if script == "" {
+		script = r.cfg.Rebuild.LuaScript
+	}
+	if script == "" {
+		return fmt.Errorf("no lua script, use script in fixture or -lua-script")
+	}
+	// script path relative to fixture file if not found in current directory
+	if _, err = os.Stat(script); err != nil && !filepath.IsAbs(script) {
+		script = filepath.Join(filepath.Dir(file), script)
+	}
+
+	if err = r.schemaAppend("", fixture.Schema); err != nil {
+		return fmt.Errorf("schema error: %s", err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	var events []*replication.BinlogEvent
+	for i, e := range fixture.Events {
+		event, err := r.luaFixtureBinlogEvent(e)
+		if err != nil {
+			return fmt.Errorf("events[%d] %s", i, err.Error())
+		}
+		events = append(events, event)
+	}
+
+	// script of the fixture, config shared with others is not changed
+	cfg := *r.cfg
+	cfg.Rebuild.LuaScript = script
+	r.cfg = &cfg
+	r.luaTestCalls = []string{}
+
+	var loadErr error
+	stdout := common.CaptureOutput(func() {
+		L := r.newLuaState()
+		L.PreloadModule("mysql", r.luaStubLoader("mysql"))
+		L.PreloadModule("redis", r.luaStubLoader("redis"))
+		if loadErr = L.DoFile(script); loadErr != nil {
+			L.Close()
+			return
+		}
+		r.luaState = L
+		r.luaInit()
+		for i, event := range events {
+			if fixture.Events[i].GTID != "" {
+				r.currentGTID = fixture.Events[i].GTID
+			}
+			r.luaTestDispatch(event)
+		}
+		r.luaLifecycleHook("Finalizer")
+		r.luaState.Close()
+		r.closeLuaFiles(r.luaState)
+		r.luaState = nil
+	})
+	if loadErr != nil {
+		return loadErr
+	}
+
+	var diff []string
+	if fixture.Expect.Stdout != nil && *fixture.Expect.Stdout != stdout {
+		diff = append(diff, fmt.Sprintf("stdout mismatch\n--- expect\n%s\n+++ actual\n%s", *fixture.Expect.Stdout, stdout))
+	}
+	if fixture.Expect.Calls != nil && strings.Join(*fixture.Expect.Calls, "\n") != strings.Join(r.luaTestCalls, "\n") {
+		diff = append(diff, fmt.Sprintf("calls mismatch\n--- expect\n%s\n+++ actual\n%s",
+			strings.Join(*fixture.Expect.Calls, "\n"), strings.Join(r.luaTestCalls, "\n")))
+	}
+	if len(diff) > 0 {
+		return fmt.Errorf("%s", strings.Join(diff, "\n"))
+	}
+	return nil
+}
+
+// luaTestDispatch route event as lua plugin does, Filter first then rewrite hooks
+func (r *Rebuilder) luaTestDispatch(event *replication.BinlogEvent) {
+	if !r.LuaFilter(event) {
+		return
+	}
+	switch event.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv2:
+		r.InsertLua(event)
+	case replication.UPDATE_ROWS_EVENTv2:
+		r.UpdateLua(event)
+	case replication.DELETE_ROWS_EVENTv2:
+		r.DeleteLua(event)
+	case replication.QUERY_EVENT:
+		r.QueryLua(event, string(event.Event.(*replication.QueryEvent).Query))
+	case replication.XID_EVENT:
+		r.XidLua(event)
+	}
+}
+
+// luaFixtureBinlogEvent build binlog event from fixture event
+func (r *Rebuilder) luaFixtureBinlogEvent(e luaFixtureEvent) (*replication.BinlogEvent, error) {
+	header := &replication.EventHeader{
+		Timestamp: e.Timestamp,
+		ServerID:  e.ServerID,
+		LogPos:    e.LogPos,
+	}
+	event := &replication.BinlogEvent{Header: header}
+	switch strings.ToLower(e.Op) {
+	case "begin":
+		header.EventType = replication.QUERY_EVENT
+		event.Event = &replication.QueryEvent{SlaveProxyID: e.ThreadID, Schema: []byte(e.Schema), Query: []byte("BEGIN")}
+		return event, nil
+	case "query":
+		header.EventType = replication.QUERY_EVENT
+		event.Event = &replication.QueryEvent{SlaveProxyID: e.ThreadID, Schema: []byte(e.Schema), Query: []byte(e.SQL)}
+		return event, nil
+	case "commit":
+		header.EventType = replication.XID_EVENT
+		event.Event = &replication.XIDEvent{XID: e.Xid}
+		return event, nil
+	case "insert":
+		header.EventType = replication.WRITE_ROWS_EVENTv2
+	case "update":
+		header.EventType = replication.UPDATE_ROWS_EVENTv2
+	case "delete":
+		header.EventType = replication.DELETE_ROWS_EVENTv2
+	default:
+		return nil, fmt.Errorf("op '%s' not support, use insert, update, delete, query, begin, commit", e.Op)
+	}
+
+	database, name := common.SplitTableName(e.Table)
+	if database == "" || name == "" {
+		return nil, fmt.Errorf("table '%s' format should be db.tb", e.Table)
+	}
+	table := fmt.Sprintf("`%s`.`%s`", database, name)
+	var images []interface{}
+	var labels []string // rows[i] or rows[i].before, rows[i].after for errors
+	for i, row := range e.Rows {
+		if header.EventType != replication.UPDATE_ROWS_EVENTv2 {
+			images = append(images, row)
+			labels = append(labels, fmt.Sprintf("rows[%d]", i))
+			continue
+		}
+		pair := luaFixtureMap(row)
+		if pair == nil || pair["before"] == nil || pair["after"] == nil {
+			return nil, fmt.Errorf("update rows should be {before: row, after: row}")
+		}
+		images = append(images, pair["before"], pair["after"])
+		labels = append(labels, fmt.Sprintf("rows[%d].before", i), fmt.Sprintf("rows[%d].after", i))
+	}
+
+	rows := &replication.RowsEvent{
+		Table: &replication.TableMapEvent{
+			Schema: []byte(database),
+			Table:  []byte(name),
+		},
+	}
+	cols := r.columns[r.SchemaTable(table)]
+	for _, image := range images {
+		row, err := luaFixtureRow(cols, image)
+		if err != nil {
+			return nil, err
+		}
+		rows.Rows = append(rows.Rows, row)
+	}
+	rows.Table.ColumnType = r.luaFixtureColumnTypes(table, rows.Rows)
+	rows.ColumnCount = uint64(len(rows.Table.ColumnType))
+	for j, row := range rows.Rows {
+		if len(row) > len(rows.Table.ColumnType) {
+			return nil, fmt.Errorf("%s has %d values, table %s has %d columns", labels[j], len(row), table, len(rows.Table.ColumnType))
+		}
+		for i, v := range row {
+			row[i] = luaFixtureValue(rows.Table.ColumnType[i], v)
+		}
+	}
+	event.Event = rows
+	return event, nil
+}
+
+// luaFixtureMap yaml map into string keys map, nil if not map
+func luaFixtureMap(v interface{}) map[string]interface{} {
+	switch m := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			res[fmt.Sprint(k)] = v
+		}
+		return res
+	case map[string]interface{}:
+		return m
+	}
+	return nil
+}
+
+// luaFixtureRow row values in column order, row is value list or column map
+func luaFixtureRow(cols []string, image interface{}) ([]interface{}, error) {
+	if list, ok := image.([]interface{}); ok {
+		return list, nil
+	}
+	values := luaFixtureMap(image)
+	if values == nil {
+		return nil, fmt.Errorf("row should be value list or column map, got %v", image)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("column map row need table schema")
+	}
+	row := make([]interface{}, len(cols))
+	for k, v := range values {
+		found := false
+		for i, col := range cols {
+			if strings.Trim(col, "`") == k {
+				row[i], found = v, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column '%s' not found", k)
+		}
+	}
+	return row, nil
+}
+
+// luaFixtureColumnTypes column types from schema, or guess from values
+func (r *Rebuilder) luaFixtureColumnTypes(table string, rows [][]interface{}) []byte {
+	var types []byte
+	if schema, ok := r.schemas[r.SchemaTable(table)]; ok {
+		for _, col := range schema.Cols {
+			types = append(types, col.Tp.Tp)
+		}
+		return types
+	}
+	for _, row := range rows {
+		for i, v := range row {
+			if i < len(types) && types[i] != mysql.MYSQL_TYPE_NULL {
+				continue
+			}
+			var tp byte
+			switch v.(type) {
+			case nil:
+				tp = mysql.MYSQL_TYPE_NULL
+			case int, int64, uint64:
+				tp = mysql.MYSQL_TYPE_LONGLONG
+			case float64:
+				tp = mysql.MYSQL_TYPE_DOUBLE
+			default:
+				tp = mysql.MYSQL_TYPE_VARCHAR
+			}
+			if i < len(types) {
+				types[i] = tp
+			} else {
+				types = append(types, tp)
+			}
+		}
+	}
+	return types
+}
+
+// luaFixtureValue convert yaml value into value type go-mysql decode from binlog
+func luaFixtureValue(tp byte, v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case int:
+		return int64(val)
+	case string:
+		switch tp {
+		case mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB,
+			mysql.MYSQL_TYPE_JSON, mysql.MYSQL_TYPE_GEOMETRY:
+			return []byte(val)
+		}
+	}
+	return v
+}
+
+// luaStubLoader stub mysql, redis module record calls instead of connect
+func (r *Rebuilder) luaStubLoader(module string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(r.luaStubObject(L, module))
+		return 1
+	}
+}
+
+// luaStubObject any method call on object is recorded as module.method(args), new() return new object
+func (r *Rebuilder) luaStubObject(L *lua.LState, module string) *lua.LTable {
+	obj := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		method := L.CheckString(2)
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if method == "new" {
+				L.Push(r.luaStubObject(L, module))
+				return 1
+			}
+			start := 1
+			// object:method(...) call
+			if L.GetTop() > 0 && L.Get(1) == obj {
+				start = 2
+			}
+			var args []string
+			for i := start; i <= L.GetTop(); i++ {
+				args = append(args, luaStubArg(L.Get(i)))
+			}
+			r.luaTestCalls = append(r.luaTestCalls, fmt.Sprintf("%s.%s(%s)", module, method, strings.Join(args, ", ")))
+			switch method {
+			case "query":
+				// mysql query result rows
+				L.Push(L.NewTable())
+			default:
+				L.Push(lua.LTrue)
+			}
+			return 1
+		}))
+		return 1
+	}))
+	L.SetMetatable(obj, mt)
+	return obj
+}
+
+// luaStubArg JSON format of lua value
+func luaStubArg(v lua.LValue) string {
+	value, err := luaToGo(v, 0)
+	if err != nil {
+		return v.String()
+	}
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return v.String()
+	}
+	return string(buf)
+}
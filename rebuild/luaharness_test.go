@@ -0,0 +1,120 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+)
+
+func TestLuaTest(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	rebuildOrg := r.cfg.Rebuild
+	schemasOrg, columnsOrg, primaryKeysOrg := r.schemas, r.columns, r.primaryKeys
+	defer func() {
+		r.cfg.Rebuild = rebuildOrg
+		r.schemas, r.columns, r.primaryKeys = schemasOrg, columnsOrg, primaryKeysOrg
+	}()
+
+	dir := t.TempDir()
+	script := `
+local mysql = require "mysql"
+local db = mysql:new()
+
+function Init()
+    db:connect({host = "127.0.0.1", port = 3306})
+end
+
+function InsertRewrite(tab, row)
+    db:query(string.format("INSERT INTO copy VALUES (%d, '%s')", row.after.id, row.after.name))
+end
+
+function UpdateRewrite(tab, row)
+    print(row.before.name .. " -> " .. row.after.name)
+end
+
+function QueryRewrite(sql, event)
+    print(event.schema, sql)
+end
+
+function Finalizer()
+    db:close()
+end
+`
+	if err := os.WriteFile(filepath.Join(dir, "copy.lua"), []byte(script), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	fixture := func(stdout string) string {
+		return `
+script: copy.lua
+schema: |
+  CREATE TABLE test.t1 (id int NOT NULL, name varchar(10), PRIMARY KEY (id));
+events:
+  - {op: insert, table: test.t1, rows: [{id: 1, name: a}, [2, b]]}
+  - {op: update, table: test.t1, rows: [{before: {id: 1, name: a}, after: {id: 1, name: c}}]}
+  - {op: query, schema: test, sql: "TRUNCATE TABLE t1"}
+expect:
+  stdout: "` + stdout + `"
+  calls:
+    - mysql.connect({"host":"127.0.0.1","port":3306})
+    - mysql.query("INSERT INTO copy VALUES (1, 'a')")
+    - mysql.query("INSERT INTO copy VALUES (2, 'b')")
+    - mysql.close()
+`
+	}
+	pass := filepath.Join(dir, "pass.yaml")
+	fail := filepath.Join(dir, "fail.yaml")
+	if err := os.WriteFile(pass, []byte(fixture(`a -> c\ntest\tTRUNCATE TABLE t1\n`)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(fail, []byte(fixture(`a -> b\n`)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r.cfg.Rebuild.LuaMode = "typed"
+	if err := r.luaTestFixture(pass); err != nil {
+		t.Error(err.Error())
+	}
+	if err := r.luaTestFixture(fail); err == nil {
+		t.Error("fail.yaml should mismatch")
+	}
+
+	// more values than table columns
+	long := filepath.Join(dir, "long.yaml")
+	if err := os.WriteFile(long, []byte(strings.Replace(fixture(""), "[2, b]", "[2, b, extra]", 1)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := r.luaTestFixture(long); err == nil || !strings.Contains(err.Error(), "events[0] rows[1] has 3 values") {
+		t.Errorf("long.yaml want rows[1] error, got %v", err)
+	}
+
+	// fixtures shipped with plugin demos
+	r.cfg.Rebuild.LuaMode = "compat"
+	r.cfg.Rebuild.LuaTest = []string{"test/lua/demo.sql.yaml", "test/lua/demo.redis.yaml"}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(common.DevPath); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !r.LuaTest() {
+		t.Error("demo fixtures should pass")
+	}
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/mysql"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaMaxDepth max nested table depth for json_encode, avoid endless loop on cycle reference
+const luaMaxDepth = 64
+
+// luaFileType metatable name of lightning.open file writer
+const luaFileType = "lightning.file"
+
+// lightningLoader lua module `local lightning = require("lightning")`
+func (r *Rebuilder) lightningLoader(L *lua.LState) int {
+	mt := L.NewTypeMetatable(luaFileType)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"write": luaFileWrite,
+		"close": luaFileClose,
+	}))
+
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"json_encode": luaJSONEncode,
+		"json_decode": luaJSONDecode,
+		"escape":      luaEscape,
+		"time_format": r.luaTimeFormat,
+		"tables":      r.luaTables,
+		"schema":      r.luaSchema,
+		"open":        r.luaOpenFile,
+		"log":         luaLog,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// luaToGo convert lua value into go value for json encoding
+func luaToGo(v lua.LValue, depth int) (interface{}, error) {
+	if depth > luaMaxDepth {
+		return nil, fmt.Errorf("nested table too deep or cycle reference")
+	}
+	switch val := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(val), nil
+	case lua.LNumber:
+		return float64(val), nil
+	case lua.LString:
+		return string(val), nil
+	case *lua.LTable:
+		// table with continuous integer keys from 1 as array, others as object
+		var keys int
+		val.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if n := val.MaxN(); n > 0 && n == keys {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := luaToGo(val.RawGetInt(i), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, nil
+		}
+		obj := make(map[string]interface{}, keys)
+		var err error
+		val.ForEach(func(k, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			obj[k.String()], err = luaToGo(item, depth+1)
+		})
+		return obj, err
+	}
+	return nil, fmt.Errorf("unsupported lua type: %s", v.Type().String())
+}
+
+// goToLua convert json decoded go value into lua value
+func goToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch val := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(val)
+	case float64:
+		return lua.LNumber(val)
+	case string:
+		return lua.LString(val)
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range val {
+			t.Append(goToLua(L, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, item := range val {
+			t.RawSetString(k, goToLua(L, item))
+		}
+		return t
+	}
+	return lua.LString(fmt.Sprint(v))
+}
+
+// luaJSONEncode lightning.json_encode(value) return string, err
+func luaJSONEncode(L *lua.LState) int {
+	v, err := luaToGo(L.CheckAny(1), 0)
+	if err == nil {
+		var buf []byte
+		buf, err = json.Marshal(v)
+		if err == nil {
+			L.Push(lua.LString(buf))
+			return 1
+		}
+	}
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// luaJSONDecode lightning.json_decode(string) return value, err
+func luaJSONDecode(L *lua.LState) int {
+	var v interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(goToLua(L, v))
+	return 1
+}
+
+// luaEscape lightning.escape(string) escape string as rebuild does, without quote
+func luaEscape(L *lua.LState) int {
+	L.Push(lua.LString(binlog.Escape(L.CheckString(1))))
+	return 1
+}
+
+// luaTimeFormat lightning.time_format(timestamp [, layout]) format unix timestamp in -time-zone,
+// layout use go time format, default 2006-01-02 15:04:05
+func (r *Rebuilder) luaTimeFormat(L *lua.LState) int {
+	layout := L.OptString(2, "2006-01-02 15:04:05")
+	loc := r.cfg.Global.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	L.Push(lua.LString(time.Unix(int64(L.CheckNumber(1)), 0).In(loc).Format(layout)))
+	return 1
+}
+
+// luaTables lightning.tables() sorted table names of loaded schemas
+func (r *Rebuilder) luaTables(L *lua.LState) int {
+	var tables []string
+	for table := range r.schemas {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	L.Push(luaListState(L, tables))
+	return 1
+}
+
+// luaSchema lightning.schema(table) table metadata, table format `db`.`tb` or db.tb, nil if not found
+func (r *Rebuilder) luaSchema(L *lua.LState) int {
+	database, name := common.SplitTableName(L.CheckString(1))
+	table := r.SchemaTable(fmt.Sprintf("`%s`.`%s`", database, name))
+	schema, ok := r.schemas[table]
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	t := L.NewTable()
+	t.RawSetString("table", lua.LString(table))
+	t.RawSetString("database", lua.LString(schema.Table.Schema.String()))
+	t.RawSetString("name", lua.LString(schema.Table.Name.String()))
+	cols := L.NewTable()
+	for _, col := range schema.Cols {
+		c := L.NewTable()
+		c.RawSetString("name", lua.LString(col.Name.Name.String()))
+		c.RawSetString("type", lua.LString(col.Tp.InfoSchemaStr()))
+		c.RawSetString("unsigned", lua.LBool(col.Tp.Flag&mysql.UnsignedFlag > 0))
+		nullable := true
+		for _, option := range col.Options {
+			switch option.Tp {
+			case ast.ColumnOptionNotNull, ast.ColumnOptionPrimaryKey:
+				nullable = false
+			}
+		}
+		c.RawSetString("nullable", lua.LBool(nullable))
+		cols.Append(c)
+	}
+	t.RawSetString("columns", cols)
+	var keys []string
+	for _, key := range r.primaryKeys[table] {
+		keys = append(keys, strings.Trim(key, "`"))
+	}
+	t.RawSetString("primary_keys", luaListState(L, keys))
+	L.Push(t)
+	return 1
+}
+
+// luaListState convert string list into lua table of L
+func luaListState(L *lua.LState, values []string) *lua.LTable {
+	l := L.NewTable()
+	for _, v := range values {
+		l.Append(lua.LString(v))
+	}
+	return l
+}
+
+// luaLog lightning.log(level, message) write log into lightning log, level: debug, info, warn, error
+func luaLog(L *lua.LState) int {
+	level, msg := L.CheckString(1), L.CheckString(2)
+	switch strings.ToLower(level) {
+	case "debug":
+		common.Log.Debug("[lua] %s", msg)
+	case "info":
+		common.Log.Info("[lua] %s", msg)
+	case "warn", "warning":
+		common.Log.Warn("[lua] %s", msg)
+	case "error":
+		common.Log.Error("[lua] %s", msg)
+	default:
+		L.ArgError(1, "level should be debug, info, warn or error")
+	}
+	return 0
+}
+
+// luaRotateFile file writer rotate by size, keep max backup files as path.1, path.2 ...
+type luaRotateFile struct {
+	path     string
+	maxSize  int64 // bytes, 0 for no rotate
+	maxFiles int   // backup files
+	size     int64
+	file     *os.File
+}
+
+func (f *luaRotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *luaRotateFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for i := f.maxFiles - 1; i > 0; i-- {
+		backup := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(backup); err == nil {
+			if err := os.Rename(backup, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *luaRotateFile) write(s string) error {
+	if f.file == nil {
+		return fmt.Errorf("file %s already closed", f.path)
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(s)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.WriteString(s)
+	f.size += int64(n)
+	return err
+}
+
+func (f *luaRotateFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// luaOpenFile lightning.open(path [, {max_size = bytes, max_files = n}]) return file writer, err
+func (r *Rebuilder) luaOpenFile(L *lua.LState) int {
+	f := &luaRotateFile{path: L.CheckString(1)}
+	if opts := L.OptTable(2, nil); opts != nil {
+		f.maxSize = int64(lua.LVAsNumber(opts.RawGetString("max_size")))
+		f.maxFiles = int(lua.LVAsNumber(opts.RawGetString("max_files")))
+	}
+	// rotate keep at least one backup file, never remove written data
+	if f.maxSize > 0 && f.maxFiles <= 0 {
+		f.maxFiles = 1
+	}
+	if err := f.open(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	// coroutine has its own thread, key by main thread
+	main := L.G.MainThread
+	r.luaFiles[main] = append(r.luaFiles[main], f)
+
+	ud := L.NewUserData()
+	ud.Value = f
+	L.SetMetatable(ud, L.GetTypeMetatable(luaFileType))
+	L.Push(ud)
+	return 1
+}
+
+func checkLuaFile(L *lua.LState) *luaRotateFile {
+	if f, ok := L.CheckUserData(1).Value.(*luaRotateFile); ok {
+		return f
+	}
+	L.ArgError(1, "lightning file expected")
+	return nil
+}
+
+// luaFileWrite file:write(...) write strings as one record, return true or nil, err
+func luaFileWrite(L *lua.LState) int {
+	f := checkLuaFile(L)
+	var record strings.Builder
+	for i := 2; i <= L.GetTop(); i++ {
+		record.WriteString(L.CheckString(i))
+	}
+	// rotate before the whole record, never split it into two files
+	if err := f.write(record.String()); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// luaFileClose file:close()
+func luaFileClose(L *lua.LState) int {
+	if err := checkLuaFile(L).close(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// closeLuaFiles close file writers which lua script forgot to close
+func (r *Rebuilder) closeLuaFiles(L *lua.LState) {
+	for _, f := range r.luaFiles[L] {
+		common.LogIfError(f.close(), "")
+	}
+	delete(r.luaFiles, L)
+}
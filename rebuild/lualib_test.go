@@ -0,0 +1,113 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LianjiaTech/lightning/common"
+)
+
+func TestLightningLuaModule(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	err := r.schemaAppend("test", "CREATE TABLE `lualib` (`id` int(10) unsigned NOT NULL, `name` varchar(10), PRIMARY KEY (`id`))")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	locOrg := r.cfg.Global.Location
+	r.cfg.Global.Location = time.UTC
+	defer func() { r.cfg.Global.Location = locOrg }()
+
+	script := `
+local lightning = require("lightning")
+
+local s = lightning.json_encode({id = 1, tags = {"a", "b"}, ok = true})
+assert(s == '{"id":1,"ok":true,"tags":["a","b"]}', s)
+local v = lightning.json_decode('{"id": 2, "list": [1, "x"], "n": null}')
+assert(v.id == 2 and v.list[2] == "x" and v.n == nil)
+local _, err = lightning.json_decode("{")
+assert(err ~= nil)
+local cycle = {}
+cycle.self = cycle
+_, err = lightning.json_encode(cycle)
+assert(err ~= nil)
+
+assert(lightning.escape("it's\n") == "it\\'s\\n", lightning.escape("it's\n"))
+assert(lightning.time_format(0) == "1970-01-01 00:00:00")
+assert(lightning.time_format(86400, "2006/01/02") == "1970/01/02")
+
+local schema = lightning.schema("test.lualib")
+assert(schema.database == "test" and schema.name == "lualib")
+assert(schema.columns[1].name == "id" and schema.columns[1].type == "int(10) unsigned", schema.columns[1].type)
+assert(schema.columns[1].unsigned and not schema.columns[1].nullable)
+assert(schema.columns[2].type == "varchar(10)" and schema.columns[2].nullable)
+assert(schema.primary_keys[1] == "id")
+assert(lightning.schema("test.not_exist") == nil)
+
+local found = false
+for _, tb in ipairs(lightning.tables()) do
+    found = found or tb == "` + "`test`.`lualib`" + `"
+end
+assert(found)
+
+lightning.log("info", "lightning lua module test")
+
+local f = assert(lightning.open(LogFile, {max_size = 16, max_files = 2}))
+for i = 1, 4 do
+    assert(f:write("12345", "678\n"))
+end
+assert(f:close())
+
+local g = assert(lightning.open(LogFile .. ".default", {max_size = 16}))
+for i = 1, 3 do
+    assert(g:write("12345678\n"))
+end
+assert(g:close())
+`
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "lua.log")
+	withLua(t, r, `LogFile = "`+logFile+`"`, func() {
+		if err := r.luaState.DoString(script); err != nil {
+			t.Fatal(err.Error())
+		}
+	})
+
+	// 4 writes, each rotate the previous file as a whole record, keep 2 backup files
+	for _, file := range []string{logFile, logFile + ".1", logFile + ".2"} {
+		buf, err := os.ReadFile(file)
+		if err != nil || string(buf) != "12345678\n" {
+			t.Errorf("%s want 12345678, got %q, %v", file, string(buf), err)
+		}
+	}
+	if _, err := os.Stat(logFile + ".3"); err == nil {
+		t.Errorf("%s.3 should not exist", logFile)
+	}
+
+	// max_files not set, keep one backup file
+	for _, file := range []string{logFile + ".default", logFile + ".default.1"} {
+		buf, err := os.ReadFile(file)
+		if err != nil || string(buf) != "12345678\n" {
+			t.Errorf("%s want 12345678, got %q, %v", file, string(buf), err)
+		}
+	}
+	if _, err := os.Stat(logFile + ".default.2"); err == nil {
+		t.Errorf("%s.default.2 should not exist", logFile)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	errLuaTimeout = errors.New("lua-timeout exceeded")
+	errLuaMemory  = errors.New("lua-memory-limit exceeded")
+)
+
+// luaBudgetError lua call cancelled by -lua-timeout or -lua-memory-limit
+type luaBudgetError struct {
+	cause error
+	err   error
+}
+
+func (e *luaBudgetError) Error() string {
+	return fmt.Sprintf("%s: %s", e.cause.Error(), e.err.Error())
+}
+
+// luaRunning cancel function of running lua call and heap size when it starts, for memory watcher
+type luaRunning struct {
+	sync.Mutex
+	cancel   context.CancelCauseFunc
+	baseline uint64
+}
+
+// luaLimited -lua-timeout or -lua-memory-limit specified
+func (r *Rebuilder) luaLimited() bool {
+	return r.cfg.Rebuild.LuaTimeoutDuration > 0 || r.cfg.Rebuild.LuaMemoryLimit > 0
+}
+
+// luaCall call lua function with -lua-timeout, -lua-memory-limit budget and -lua-violation policy
+func (r *Rebuilder) luaCall(p lua.P, args ...lua.LValue) error {
+	if r.err != nil {
+		// aborted, skip the rest calls of the event
+		return r.err
+	}
+	if !r.luaLimited() {
+		return r.luaState.CallByParam(p, args...)
+	}
+	for retry := 0; ; retry++ {
+		err := r.luaCallBudget(p, args...)
+		budget, ok := err.(*luaBudgetError)
+		if !ok {
+			return err
+		}
+		switch r.cfg.Rebuild.LuaViolation {
+		case "abort":
+			r.err = fmt.Errorf("lua abort, master.info position %s:%d, %s", r.master.MasterLogFile, r.master.MasterLogPos, budget.Error())
+			return r.err
+		case "retry":
+			if retry < r.cfg.Rebuild.LuaRetry {
+				common.Log.Warn("lua retry %d, %s", retry+1, budget.Error())
+				continue
+			}
+		}
+		return budget
+	}
+}
+
+// luaCallBudget call lua function with context, context cancel cause tells budget violation
+func (r *Rebuilder) luaCallBudget(p lua.P, args ...lua.LValue) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if d := r.cfg.Rebuild.LuaTimeoutDuration; d > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeoutCause(ctx, d, errLuaTimeout)
+		defer timeoutCancel()
+	}
+
+	r.luaRunning.Lock()
+	r.luaRunning.cancel = cancel
+	r.luaRunning.baseline = luaHeap()
+	r.luaRunning.Unlock()
+	defer func() {
+		r.luaRunning.Lock()
+		r.luaRunning.cancel = nil
+		r.luaRunning.Unlock()
+	}()
+
+	r.luaState.SetContext(ctx)
+	err := r.luaState.CallByParam(p, args...)
+	r.luaState.RemoveContext()
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return &luaBudgetError{cause: cause, err: err}
+		}
+	}
+	return err
+}
+
+// luaHeap heap size of the process in bytes
+func luaHeap() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// luaMemoryWatch cancel running lua call when heap grows more than -lua-memory-limit since the call starts.
+// Go runtime not count memory per LState, heap growth of the process is an approximation,
+// allocations of other goroutines during the call are counted too.
+func (r *Rebuilder) luaMemoryWatch() {
+	if r.cfg.Rebuild.LuaMemoryLimit <= 0 {
+		return
+	}
+	r.luaWatchOnce.Do(func() {
+		go func() {
+			exceeded := func() bool {
+				limit := uint64(r.cfg.Rebuild.LuaMemoryLimit) * 1024 * 1024
+				r.luaRunning.Lock()
+				defer r.luaRunning.Unlock()
+				return r.luaRunning.cancel != nil && limit > 0 && luaHeap() > r.luaRunning.baseline+limit
+			}
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-r.done:
+					return
+				}
+				if !exceeded() {
+					continue
+				}
+				// garbage not collected yet is not counted
+				runtime.GC()
+				if !exceeded() {
+					continue
+				}
+				r.luaRunning.Lock()
+				if r.luaRunning.cancel != nil {
+					r.luaRunning.cancel(errLuaMemory)
+				}
+				r.luaRunning.Unlock()
+			}
+		}()
+	})
+}
+
+// newLuaState create lua state, -lua-sandbox only open safe libs
+func (r *Rebuilder) newLuaState() *lua.LState {
+	if !r.cfg.Rebuild.LuaSandbox {
+		L := lua.NewState()
+		r.luaPreload(L)
+		return L
+	}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	r.luaPreload(L)
+
+	// package.preload and package.loaders load modules without require, only keep modules in -lua-modules.
+	// require still finds loaders in registry.
+	pkg := L.GetGlobal("package")
+	if preload, ok := L.GetField(pkg, "preload").(*lua.LTable); ok {
+		var denied []lua.LValue
+		preload.ForEach(func(k, _ lua.LValue) {
+			if !r.luaModuleAllowed(k.String()) {
+				denied = append(denied, k)
+			}
+		})
+		for _, k := range denied {
+			preload.RawSet(k, lua.LNil)
+		}
+	}
+	L.SetField(pkg, "loaders", lua.LNil)
+
+	// require only modules in -lua-modules and opened libs, eg. string, table
+	require := L.GetGlobal("require")
+	L.SetGlobal("require", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		loaded := L.GetField(L.Get(lua.RegistryIndex), "_LOADED")
+		if !r.luaModuleAllowed(name) && L.GetField(loaded, name) == lua.LNil {
+			L.RaiseError("module '%s' not allowed in lua-sandbox, check lua-modules", name)
+		}
+		L.Push(require)
+		L.Push(lua.LString(name))
+		L.Call(1, 1)
+		return 1
+	}))
+	return L
+}
+
+// luaModuleAllowed module or its parent module in -lua-modules, eg. socket allow socket.http
+func (r *Rebuilder) luaModuleAllowed(name string) bool {
+	for _, module := range r.cfg.Rebuild.LuaModules {
+		module = strings.TrimSpace(module)
+		if name == module || strings.HasPrefix(name, module+".") {
+			return true
+		}
+	}
+	return false
+}
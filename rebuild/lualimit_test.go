@@ -0,0 +1,165 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaBudget(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	rebuildOrg := r.cfg.Rebuild
+	defer func() { r.cfg.Rebuild = rebuildOrg }()
+	r.cfg.Rebuild.LuaScript = "test.lua"
+	r.cfg.Rebuild.LuaMode = "typed"
+
+	script := `
+Calls = 0
+Done = {}
+function InsertRewrite(tab, row)
+    Calls = Calls + 1
+    if row.values["@0"] == 2 then
+        while true do end
+    end
+    if row.values["@0"] == 5 then
+        local start = os.clock()
+        while os.clock() - start < 0.5 do end
+    end
+    if row.values["@0"] == 3 then
+        local t = {}
+        while true do
+            t[#t + 1] = string.rep("x", 1024) .. #t
+        end
+    end
+    table.insert(Done, row.values["@0"])
+end
+`
+	insert := func(ids ...int) *replication.BinlogEvent {
+		var rows [][]interface{}
+		for _, id := range ids {
+			rows = append(rows, []interface{}{id})
+		}
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2},
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("budget"), ColumnType: []byte{mysql.MYSQL_TYPE_LONG}},
+				Rows:  rows,
+			},
+		}
+	}
+	result := func() (int, int) {
+		return int(lua.LVAsNumber(r.luaState.GetGlobal("Calls"))), r.luaState.GetGlobal("Done").(*lua.LTable).Len()
+	}
+
+	// skip the endless loop row, go on with next row
+	r.cfg.Rebuild.LuaTimeoutDuration = 50 * time.Millisecond
+	r.cfg.Rebuild.LuaViolation = "skip"
+	withLua(t, r, script, func() {
+		r.InsertLua(insert(1, 2, 4))
+		if calls, done := result(); calls != 3 || done != 2 {
+			t.Errorf("skip want 3 calls 2 done, got %d calls %d done", calls, done)
+		}
+	})
+
+	r.cfg.Rebuild.LuaViolation = "retry"
+	r.cfg.Rebuild.LuaRetry = 2
+	withLua(t, r, script, func() {
+		r.InsertLua(insert(2))
+		if calls, done := result(); calls != 3 || done != 0 {
+			t.Errorf("retry want 3 calls 0 done, got %d calls %d done", calls, done)
+		}
+	})
+
+	// abort stops the rest rows, error tells parser to stop
+	r.cfg.Rebuild.LuaViolation = "abort"
+	withLua(t, r, script, func() {
+		r.InsertLua(insert(2, 1))
+		if calls, done := result(); calls != 1 || done != 0 {
+			t.Errorf("abort want 1 calls 0 done, got %d calls %d done", calls, done)
+		}
+		if r.Err() == nil {
+			t.Error("abort should set Err")
+		}
+	})
+	r.err = nil
+
+	// memory limit without timeout
+	r.cfg.Rebuild.LuaTimeoutDuration = 0
+	r.cfg.Rebuild.LuaViolation = "skip"
+	r.cfg.Rebuild.LuaMemoryLimit = 16
+	r.luaMemoryWatch()
+	// heap allocated before the call is not counted
+	ballast := make([]byte, 64*1024*1024)
+	runtime.GC()
+	withLua(t, r, script, func() {
+		r.InsertLua(insert(5))
+		if _, done := result(); done != 1 {
+			t.Errorf("heap before lua call should not exceed lua-memory-limit")
+		}
+	})
+	runtime.KeepAlive(ballast)
+
+	r.cfg.Rebuild.LuaMemoryLimit = 256
+	withLua(t, r, script, func() {
+		err := r.luaCall(lua.P{Fn: r.luaState.GetGlobal("InsertRewrite"), Protect: true}, lua.LString(""), r.luaRowTable(insert(3), [][]interface{}{{3}}))
+		if budget, ok := err.(*luaBudgetError); !ok || budget.cause != errLuaMemory {
+			t.Errorf("want lua-memory-limit exceeded, got %v", err)
+		}
+		// state still usable after cancel
+		r.InsertLua(insert(1))
+		if _, done := result(); done != 1 {
+			t.Errorf("lua state should be usable after cancel")
+		}
+	})
+}
+
+func TestLuaSandbox(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	rebuildOrg := r.cfg.Rebuild
+	defer func() { r.cfg.Rebuild = rebuildOrg }()
+	r.cfg.Rebuild.LuaSandbox = true
+	r.cfg.Rebuild.LuaModules = []string{"lightning", "socket"}
+
+	L := r.newLuaState()
+	defer L.Close()
+	err := L.DoString(`
+assert(os == nil and io == nil and debug == nil)
+assert(dofile == nil and loadfile == nil)
+assert(string.format("%d", 1) == "1" and math.floor(1.5) == 1 and table.concat({"a"}) == "a")
+local lightning = require("lightning")
+assert(lightning.escape("'") == "\\'")
+assert(require("socket.url") ~= nil)
+local ok, err = pcall(require, "mysql")
+assert(not ok and string.find(err, "not allowed"), err)
+ok = pcall(require, "os")
+assert(not ok)
+-- modules not in lua-modules are unreachable without require
+assert(package.preload["lfs"] == nil and package.preload["mysql"] == nil and package.preload["bit32"] == nil)
+assert(package.preload["lightning"] ~= nil and package.preload["socket.url"] ~= nil)
+assert(package.loaders == nil)
+ok, err = pcall(require, "lfs")
+assert(not ok and string.find(err, "not allowed"), err)
+`)
+	if err != nil {
+		t.Error(err.Error())
+	}
+}
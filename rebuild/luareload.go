@@ -0,0 +1,150 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// luaReloadWatch watch SIGHUP and -lua-reload-interval file change
+func (r *Rebuilder) luaReloadWatch() {
+	r.luaReloadOnce.Do(func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(sig)
+			for {
+				select {
+				case <-sig:
+					common.Log.Info("lua script reload on SIGHUP, wait for transaction boundary")
+					r.luaReloadPending.Store(true)
+				case <-r.done:
+					return
+				}
+			}
+		}()
+
+		interval := r.cfg.Rebuild.LuaReloadDuration
+		if interval <= 0 {
+			return
+		}
+		modTime := func(script string) time.Time {
+			info, err := os.Stat(script)
+			if err != nil {
+				return time.Time{}
+			}
+			return info.ModTime()
+		}
+		last := make(map[string]time.Time)
+		for _, c := range r.luaScriptConfigs() {
+			last[c.Script] = modTime(c.Script)
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-r.done:
+					return
+				}
+				for script, t := range last {
+					// file being written or removed, check next time
+					if current := modTime(script); !current.IsZero() && !current.Equal(t) {
+						last[script] = current
+						common.Log.Info("lua script %s changed, wait for transaction boundary", script)
+						r.luaReloadPending.Store(true)
+					}
+				}
+			}
+		}()
+	})
+}
+
+// LuaReload track transaction boundary, reload lua script before the event if reload pending and not in transaction
+func (r *Rebuilder) LuaReload(event *replication.BinlogEvent) {
+	if r.cfg.Rebuild.Plugin != "lua" || len(r.luaScripts) == 0 {
+		return
+	}
+	if !r.luaInTransaction && r.luaReloadPending.Load() {
+		r.luaReloadScript(event)
+	}
+
+	switch event.Header.EventType {
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT, replication.MARIADB_GTID_EVENT:
+		r.luaInTransaction = true
+		r.luaInBegin = false
+	case replication.QUERY_EVENT:
+		switch strings.ToUpper(string(event.Event.(*replication.QueryEvent).Query)) {
+		case "BEGIN":
+			r.luaInTransaction = true
+			r.luaInBegin = true
+		case "COMMIT", "ROLLBACK":
+			r.luaInTransaction = false
+			r.luaInBegin = false
+		default:
+			// DDL, statement without BEGIN is a transaction itself
+			if !r.luaInBegin {
+				r.luaInTransaction = false
+			}
+		}
+	case replication.XID_EVENT:
+		r.luaInTransaction = false
+		r.luaInBegin = false
+	}
+}
+
+// luaReloadScript replace lua state of each script with new one, keep the old one if new script load failed
+func (r *Rebuilder) luaReloadScript(event *replication.BinlogEvent) {
+	r.luaReloadPending.Store(false)
+	current := r.luaState
+	for _, s := range r.luaScripts {
+		L, err := r.loadLuaState(s.path)
+		if err != nil {
+			common.Log.Error("lua script %s reload failed, keep the old one: %s", s.path, err.Error())
+			continue
+		}
+
+		if s.state != nil {
+			r.luaState = s.state
+			r.luaLifecycleHook("Finalizer")
+			r.luaState.Close()
+			r.closeLuaFiles(r.luaState)
+		}
+		if current == s.state {
+			current = L
+		}
+		s.state = L
+		r.luaState = L
+		r.luaInit()
+
+		// fake ROTATE_EVENT has no position
+		var pos uint32
+		if event.Header.LogPos > event.Header.EventSize {
+			pos = event.Header.LogPos - event.Header.EventSize
+		}
+		common.Log.Info("lua script %s reloaded before %s at position %d, master.info %s:%d, executed gtid set: %s", s.path,
+			event.Header.EventType.String(), pos,
+			r.master.MasterLogFile, r.master.MasterLogPos, r.master.ExecutedGTIDSet)
+	}
+	r.luaState = current
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaReload(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "reload.lua")
+	finalized := filepath.Join(dir, "finalized")
+	version := func(v string) string {
+		return `
+function Init()
+    Version = "` + v + `"
+end
+function Finalizer()
+    local f = io.open("` + finalized + `", "a")
+    f:write("` + v + `")
+    f:close()
+end
+`
+	}
+
+	rebuildOrg := r.cfg.Rebuild
+	luaOrg, scriptsOrg := r.luaState, r.luaScripts
+	defer func() {
+		r.cfg.Rebuild = rebuildOrg
+		r.luaState, r.luaScripts = luaOrg, scriptsOrg
+	}()
+	r.cfg.Rebuild.Plugin = "lua"
+	r.cfg.Rebuild.LuaScript = script
+
+	if err := os.WriteFile(script, []byte(version("1")), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	L, err := r.loadLuaState(script)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.luaState = L
+	r.luaScripts = []*luaScript{{path: script, state: L}}
+	r.luaInit()
+
+	event := func(eventType replication.EventType, e replication.Event) *replication.BinlogEvent {
+		return &replication.BinlogEvent{Header: &replication.EventHeader{EventType: eventType}, Event: e}
+	}
+	gtid := event(replication.GTID_EVENT, &replication.GTIDEvent{})
+	begin := event(replication.QUERY_EVENT, &replication.QueryEvent{Query: []byte("BEGIN")})
+	rows := event(replication.WRITE_ROWS_EVENTv2, &replication.RowsEvent{})
+	xid := event(replication.XID_EVENT, &replication.XIDEvent{})
+	ddl := event(replication.QUERY_EVENT, &replication.QueryEvent{Query: []byte("ALTER TABLE tb ADD c int")})
+	check := func(step, want string) {
+		if v := r.luaState.GetGlobal("Version"); v.String() != want {
+			t.Errorf("%s: want version %s, got %s", step, want, v.String())
+		}
+	}
+
+	r.LuaReload(gtid)
+	r.LuaReload(begin)
+	if err := os.WriteFile(script, []byte(version("2")), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r.luaReloadPending.Store(true)
+	r.LuaReload(rows)
+	r.LuaReload(xid)
+	check("in transaction", "1")
+	r.LuaReload(gtid)
+	check("transaction boundary", "2")
+	if buf, _ := os.ReadFile(finalized); string(buf) != "1" {
+		t.Errorf("old script Finalizer should be called, got %q", string(buf))
+	}
+
+	// DDL transaction without BEGIN
+	if err := os.WriteFile(script, []byte(version("3")), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r.luaReloadPending.Store(true)
+	r.LuaReload(ddl)
+	check("DDL", "2")
+	r.LuaReload(gtid)
+	check("after DDL", "3")
+
+	// keep old script if new script broken
+	if err := os.WriteFile(script, []byte("function Init("), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	r.luaReloadPending.Store(true)
+	r.LuaReload(xid)
+	r.LuaReload(event(replication.ROTATE_EVENT, &replication.RotateEvent{}))
+	check("broken script", "3")
+	if r.luaReloadPending.Load() {
+		t.Error("reload pending should be cleared")
+	}
+	if r.luaState.GetGlobal("Init").Type() != lua.LTFunction {
+		t.Error("old lua state should be kept")
+	}
+	r.luaState.Close()
+}
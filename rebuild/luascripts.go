@@ -0,0 +1,153 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaScript one of chained lua scripts, each has its own lua state
+type luaScript struct {
+	path   string
+	tables []string // table filters, empty match all events
+	state  *lua.LState
+
+	// Filter result of the latest filtered event
+	filtered *replication.BinlogEvent
+	drop     bool
+	rows     [][]interface{}
+}
+
+// luaScriptList scripts loaded, or luaState itself if no script loaded
+func (r *Rebuilder) luaScriptList() []*luaScript {
+	if len(r.luaScripts) > 0 {
+		return r.luaScripts
+	}
+	if r.luaState == nil {
+		return nil
+	}
+	if r.luaSingle == nil || r.luaSingle.state != r.luaState {
+		r.luaSingle = &luaScript{state: r.luaState}
+	}
+	return []*luaScript{r.luaSingle}
+}
+
+// luaScriptConfigs -lua-script first, then -lua-scripts
+func (r *Rebuilder) luaScriptConfigs() []common.LuaScript {
+	var scripts []common.LuaScript
+	if r.cfg.Rebuild.LuaScript != "" {
+		scripts = append(scripts, common.LuaScript{Script: r.cfg.Rebuild.LuaScript})
+	}
+	return append(scripts, r.cfg.Rebuild.LuaScripts...)
+}
+
+// luaEventScripts scripts whose table filters match the event.
+// Events not belong to any table, eg. GTID, XID, BEGIN, COMMIT go to all scripts,
+// query events without table only go to scripts without table filters.
+func (r *Rebuilder) luaEventScripts(event *replication.BinlogEvent) []*luaScript {
+	scripts := r.luaScriptList()
+	var tables []string
+	switch event.Header.EventType {
+	case replication.QUERY_EVENT:
+		if IsTransactionQuery(string(event.Event.(*replication.QueryEvent).Query)) {
+			return scripts
+		}
+		tables = r.QueryEventTables(event)
+	default:
+		if table := RowEventTable(event); table != "" {
+			tables = []string{table}
+		} else {
+			return scripts
+		}
+	}
+
+	var matched []*luaScript
+	for _, s := range scripts {
+		if len(s.tables) == 0 {
+			matched = append(matched, s)
+			continue
+		}
+		for _, table := range tables {
+			if r.cfg.TableFiltersMatch(table, s.tables) {
+				matched = append(matched, s)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// luaEach call f with luaState switched to each script matching the event in declared order.
+// Rows dropped by a script's Filter are only invisible to that script, panic in one script not affect others.
+func (r *Rebuilder) luaEach(event *replication.BinlogEvent, f func()) {
+	if event == nil {
+		return
+	}
+	current := r.luaState
+	defer func() { r.luaState = current }()
+
+	ev, isRows := event.Event.(*replication.RowsEvent)
+	var rows [][]interface{}
+	if isRows {
+		rows = ev.Rows
+		defer func() { ev.Rows = rows }()
+	}
+
+	for _, s := range r.luaEventScripts(event) {
+		if s.state == nil {
+			continue
+		}
+		if s.filtered == event {
+			if s.drop {
+				continue
+			}
+			if isRows {
+				ev.Rows = s.rows
+			}
+		} else if isRows {
+			ev.Rows = rows
+		}
+		r.luaState = s.state
+		luaEachCall(s, f)
+	}
+}
+
+// luaEachCall isolate panic of one script
+func luaEachCall(s *luaScript, f func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			common.Log.Error("lua script %s Error: %s", s.path, strings.Split(fmt.Sprint(err), "\n")[0])
+		}
+	}()
+	f()
+}
+
+// luaEachScript call f with luaState switched to every script, for Init, Finalizer
+func (r *Rebuilder) luaEachScript(f func(s *luaScript)) {
+	current := r.luaState
+	defer func() { r.luaState = current }()
+	for _, s := range r.luaScriptList() {
+		if s.state == nil {
+			continue
+		}
+		r.luaState = s.state
+		f(s)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaScripts(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	dir := t.TempDir()
+	write := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		return path
+	}
+	cache := write("cache.lua", `
+Seen = {}
+Inited = false
+function Init()
+    Inited = true
+end
+function InsertRewrite(tab, row)
+    if row.values["@0"] == 3 then
+        error("cache down")
+    end
+    table.insert(Seen, tab .. ":" .. row.values["@0"])
+end
+`)
+	audit := write("audit.lua", `
+Seen = {}
+function Filter(event)
+    return event.values == nil or event.values["@0"] ~= 1
+end
+function InsertRewrite(tab, row)
+    table.insert(Seen, tab .. ":" .. row.values["@0"])
+end
+function TransactionCommit(xid, gtid)
+    table.insert(Seen, "commit")
+end
+`)
+	broken := write("broken.lua", "function Init(")
+
+	rebuildOrg := r.cfg.Rebuild
+	luaOrg, scriptsOrg := r.luaState, r.luaScripts
+	defer func() {
+		r.luaEachScript(func(*luaScript) { r.luaState.Close() })
+		r.cfg.Rebuild = rebuildOrg
+		r.luaState, r.luaScripts = luaOrg, scriptsOrg
+	}()
+	r.cfg.Rebuild.Plugin = "lua"
+	r.cfg.Rebuild.LuaMode = "typed"
+	r.cfg.Rebuild.LuaScript = ""
+	r.cfg.Rebuild.LuaScripts = []common.LuaScript{
+		{Script: cache, Tables: []string{"test.cache\\_%"}},
+		{Script: broken},
+		{Script: audit},
+	}
+	r.LoadLuaScript()
+	if len(r.luaScripts) != 2 {
+		t.Fatalf("broken script should be skipped, got %d scripts", len(r.luaScripts))
+	}
+	if !lua.LVAsBool(r.luaScripts[0].state.GetGlobal("Inited")) {
+		t.Error("Init of cache.lua should be called")
+	}
+
+	insert := func(table string, ids ...int) *replication.BinlogEvent {
+		var rows [][]interface{}
+		for _, id := range ids {
+			rows = append(rows, []interface{}{id})
+		}
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2},
+			Event: &replication.RowsEvent{
+				Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte(table), ColumnType: []byte{mysql.MYSQL_TYPE_LONG}},
+				Rows:  rows,
+			},
+		}
+	}
+	for _, event := range []*replication.BinlogEvent{
+		insert("cache_1", 1, 2, 3, 4),
+		insert("user", 1, 5),
+		{Header: &replication.EventHeader{EventType: replication.XID_EVENT}, Event: &replication.XIDEvent{XID: 1}},
+	} {
+		if !r.LuaFilter(event) {
+			continue
+		}
+		switch event.Header.EventType {
+		case replication.WRITE_ROWS_EVENTv2:
+			r.InsertLua(event)
+		case replication.XID_EVENT:
+			r.XidLua(event)
+		}
+	}
+
+	seen := func(L *lua.LState) []string {
+		var values []string
+		L.GetGlobal("Seen").(*lua.LTable).ForEach(func(_, v lua.LValue) { values = append(values, v.String()) })
+		return values
+	}
+	cases := []struct {
+		script string
+		want   []string
+	}{
+		// error on row 3 stops the rest rows in cache.lua only, audit.lua not affected
+		{cache, []string{"`test`.`cache_1`:1", "`test`.`cache_1`:2"}},
+		// row 1 filtered by audit.lua still go to cache.lua
+		{audit, []string{"`test`.`cache_1`:2", "`test`.`cache_1`:3", "`test`.`cache_1`:4", "`test`.`user`:5", "commit"}},
+	}
+	for i, c := range cases {
+		got := seen(r.luaScripts[i].state)
+		if len(got) != len(c.want) {
+			t.Errorf("%s want %v, got %v", c.script, c.want, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != c.want[j] {
+				t.Errorf("%s want %v, got %v", c.script, c.want, got)
+				break
+			}
+		}
+	}
+}
@@ -30,7 +30,7 @@ import (
 )
 
 // QueryRebuild rebuild sql, need pingcap/parser
-func QueryRebuild(queryEvent *replication.BinlogEvent) string {
+func (r *Rebuilder) QueryRebuild(queryEvent *replication.BinlogEvent) string {
 	switch queryEvent.Header.EventType {
 	case replication.QUERY_EVENT:
 	default:
@@ -39,42 +39,52 @@ func QueryRebuild(queryEvent *replication.BinlogEvent) string {
 	}
 
 	event := queryEvent.Event.(*replication.QueryEvent)
+	r.trackTransaction(queryEvent)
 
-	common.Verbose("-- [DEBUG] ThreadID: %d, Schema: %s, ErrorCode: %d, ExecutionTime: %d, GSet: %v\n",
+	r.verbose("-- [DEBUG] ThreadID: %d, Schema: %s, ErrorCode: %d, ExecutionTime: %d, GSet: %v\n",
 		event.SlaveProxyID, event.Schema, event.ErrorCode, event.ExecutionTime, event.GSet)
 
-	sql := string(event.Query)
-	switch common.Config.Rebuild.Plugin {
+	// -rewrite-db, -rewrite-tables, -without-db-name
+	sql := r.RewriteQuery(string(event.Query), string(event.Schema))
+	switch r.cfg.Rebuild.Plugin {
 	case "sql":
-		// fmt.Printf("SET TIMESTAMP=%d;\n", queryEvent.Header.Timestamp)
-		QueryFormat(sql)
+		// session context of statement format DML and DDL
+		if !IsTransactionQuery(sql) {
+			for _, stmt := range r.sessionContext(queryEvent) {
+				r.println(stmt)
+			}
+		}
+		r.QueryFormat(sql)
 	case "flashback":
-		QueryRollback(sql)
+		r.QueryRollback(sql)
 	case "stat":
 		if sql == "BEGIN" {
-			TransactionStartPos = float64(queryEvent.Header.LogPos)
-			TransactionStartTimeStamp = float64(queryEvent.Header.Timestamp)
+			r.transaction.startPos = float64(queryEvent.Header.LogPos)
+			r.transaction.startTimestamp = float64(queryEvent.Header.Timestamp)
 		}
-		QueryStat(sql)
+		r.QueryStat(sql)
+		r.queryTableStat(string(event.Query), string(event.Schema))
 	case "lua":
-		QueryLua(sql)
+		r.QueryLua(queryEvent, sql)
+	case "wasm":
+		r.QueryWasm(queryEvent, sql)
 	default:
 	}
 
 	// stat transaction time, exec_time on slave it's replication lag time.
 	// https://dev.mysql.com/doc/refman/5.6/en/mysqlbinlog.html
 	transactionTime := float64(event.ExecutionTime)
-	if transactionTime > MaxTransactionTime {
-		MaxTransactionTime = transactionTime
-		MaxTransactionTimeStartPos = TransactionStartPos
+	if transactionTime > r.transaction.maxTime {
+		r.transaction.maxTime = transactionTime
+		r.transaction.maxTimeStart = r.transaction.startPos
 	}
-	TransactionTimeStats = append(TransactionTimeStats, transactionTime)
+	r.transaction.times = append(r.transaction.times, transactionTime)
 
 	return ""
 }
 
 // RowsQueryRebuild ...
-func RowsQueryRebuild(rowsQueryEvent *replication.BinlogEvent) string {
+func (r *Rebuilder) RowsQueryRebuild(rowsQueryEvent *replication.BinlogEvent) string {
 	switch rowsQueryEvent.Header.EventType {
 	case replication.ROWS_QUERY_EVENT:
 	default:
@@ -83,29 +93,46 @@ func RowsQueryRebuild(rowsQueryEvent *replication.BinlogEvent) string {
 	}
 
 	event := rowsQueryEvent.Event.(*replication.RowsQueryEvent)
-	common.VerboseVerbose("-- [DEBUG] RowsQuery Event, Query: %s\n", string(event.Query))
+	r.verboseVerbose("-- [DEBUG] RowsQuery Event, Query: %s\n", string(event.Query))
 	return ""
 }
 
 // XidRebuild ...
-func XidRebuild(event *replication.BinlogEvent) string {
+func (r *Rebuilder) XidRebuild(event *replication.BinlogEvent) string {
 	// stat transaction size
-	transactionSize := float64(event.Header.LogPos) - TransactionStartPos
-	if transactionSize > MaxTransactionSize {
-		MaxTransactionSizeStartPos = TransactionStartPos
-		MaxTransactionSize = transactionSize
+	transactionSize := float64(event.Header.LogPos) - r.transaction.startPos
+	if transactionSize > r.transaction.maxSize {
+		r.transaction.maxSizeStart = r.transaction.startPos
+		r.transaction.maxSize = transactionSize
 	}
-	TransactionSizeStats = append(TransactionSizeStats, transactionSize)
+	r.transaction.sizes = append(r.transaction.sizes, transactionSize)
 
-	if MaxTransactionTimeStartPos == TransactionStartPos {
-		MaxTransactionTimeStopPos = float64(event.Header.LogPos)
+	if r.transaction.maxTimeStart == r.transaction.startPos {
+		r.transaction.maxTimeStop = float64(event.Header.LogPos)
 	}
 
-	common.Verbose("-- [DEBUG] XID_EVENT TransactionSizeBytes: %s, Xid: %d, GSet: %v\n",
+	r.verbose("-- [DEBUG] XID_EVENT TransactionSizeBytes: %s, Xid: %d, GSet: %v\n",
 		fmt.Sprintf("%0.0f", transactionSize), event.Event.(*replication.XIDEvent).XID, event.Event.(*replication.XIDEvent).GSet)
+
+	switch r.cfg.Rebuild.Plugin {
+	case "lua":
+		r.XidLua(event)
+	case "wasm":
+		r.XidWasm(event)
+	}
 	return ""
 }
 
+// RotateRebuild ...
+func (r *Rebuilder) RotateRebuild(event *replication.BinlogEvent) {
+	r.verboseVerbose("-- [DEBUG] EventType: %s, NextLogName: %s", event.Header.EventType.String(), string(event.Event.(*replication.RotateEvent).NextLogName))
+
+	switch r.cfg.Rebuild.Plugin {
+	case "lua":
+		r.RotateLua(event)
+	}
+}
+
 // TiParse TiDB 语法解析
 func TiParse(sql, charset, collation string) ([]ast.StmtNode, error) {
 	p := parser.New()
@@ -113,39 +140,188 @@ func TiParse(sql, charset, collation string) ([]ast.StmtNode, error) {
 	return stmt, err
 }
 
+// targetTables tables which statement writes: DDL object, INSERT table, UPDATE and DELETE targets.
+// Read-only sources of INSERT ... SELECT, joins and subqueries are not included, database is the default database
+func targetTables(stmt ast.StmtNode, database string) []string {
+	var names []*ast.TableName
+	switch s := stmt.(type) {
+	case *ast.AlterTableStmt:
+		names = append(names, s.Table)
+	case *ast.CreateTableStmt:
+		names = append(names, s.Table)
+	case *ast.DropTableStmt:
+		names = append(names, s.Tables...)
+	case *ast.RenameTableStmt:
+		for _, t := range s.TableToTables {
+			names = append(names, t.OldTable, t.NewTable)
+		}
+	case *ast.TruncateTableStmt:
+		names = append(names, s.Table)
+	case *ast.CreateIndexStmt:
+		names = append(names, s.Table)
+	case *ast.DropIndexStmt:
+		names = append(names, s.Table)
+	case *ast.InsertStmt:
+		names = joinTables(s.Table.TableRefs, nil)
+	case *ast.UpdateStmt:
+		// multiple-table UPDATE writes tables in SET list, all joined tables if any column is not qualified
+		var targets map[string]bool
+		if len(joinTables(s.TableRefs.TableRefs, nil)) > 1 {
+			targets = make(map[string]bool)
+			for _, a := range s.List {
+				if a.Column.Table.L == "" {
+					targets = nil
+					break
+				}
+				targets[a.Column.Table.L] = true
+			}
+		}
+		names = joinTables(s.TableRefs.TableRefs, targets)
+	case *ast.DeleteStmt:
+		// DELETE t1 FROM t1 JOIN t2 only deletes from t1
+		var targets map[string]bool
+		if s.IsMultiTable && s.Tables != nil {
+			targets = make(map[string]bool)
+			for _, t := range s.Tables.Tables {
+				targets[t.Name.L] = true
+			}
+		}
+		names = joinTables(s.TableRefs.TableRefs, targets)
+	}
+
+	var tables []string
+	for _, name := range names {
+		db := name.Schema.String()
+		if db == "" {
+			db = database
+		}
+		tables = appendTable(tables, fmt.Sprintf("`%s`.`%s`", db, name.Name.String()))
+	}
+	return tables
+}
+
+// appendTable append table if not exists
+func appendTable(tables []string, table string) []string {
+	for _, t := range tables {
+		if t == table {
+			return tables
+		}
+	}
+	return append(tables, table)
+}
+
+// joinTables tables in FROM clause whose alias or name in targets, all if targets is nil. Derived tables are skipped
+func joinTables(node ast.ResultSetNode, targets map[string]bool) []*ast.TableName {
+	switch n := node.(type) {
+	case *ast.Join:
+		return append(joinTables(n.Left, targets), joinTables(n.Right, targets)...)
+	case *ast.TableSource:
+		name, ok := n.Source.(*ast.TableName)
+		if !ok {
+			return nil
+		}
+		alias := n.AsName.L
+		if alias == "" {
+			alias = name.Name.L
+		}
+		if targets == nil || targets[alias] {
+			return []*ast.TableName{name}
+		}
+	case *ast.TableName:
+		return []*ast.TableName{n}
+	}
+	return nil
+}
+
+// QueryTables get table names which DDL or DML statement writes, database is the default database
+func (r *Rebuilder) QueryTables(sql, database string) []string {
+	stmts, err := TiParse(sql, r.cfg.Global.Charset, mysql.Charsets[r.cfg.Global.Charset])
+	if err != nil {
+		r.verboseVerbose("-- [DEBUG] QueryTables parse error: %s", err.Error())
+		return nil
+	}
+	var tables []string
+	for _, stmt := range stmts {
+		for _, table := range targetTables(stmt, database) {
+			tables = appendTable(tables, table)
+		}
+	}
+	return tables
+}
+
+// QueryEventTables get table names from QUERY_EVENT, event Schema as default database
+func (r *Rebuilder) QueryEventTables(event *replication.BinlogEvent) []string {
+	if event == nil || event.Header.EventType != replication.QUERY_EVENT {
+		return nil
+	}
+	ev := event.Event.(*replication.QueryEvent)
+	if IsTransactionQuery(string(ev.Query)) {
+		return nil
+	}
+	return r.QueryTables(string(ev.Query), string(ev.Schema))
+}
+
+// ddlType statement type of DDL, eg. CreateTable, AlterTable. empty for non-DDL, unknown if parse failed
+func (r *Rebuilder) ddlType(sql string) string {
+	stmts, err := TiParse(sql, r.cfg.Global.Charset, mysql.Charsets[r.cfg.Global.Charset])
+	if err != nil {
+		common.Log.Warn("ddlType parse error: %s, sql: %s", err.Error(), sql)
+		return "unknown"
+	}
+	for _, stmt := range stmts {
+		if _, ok := stmt.(ast.DDLNode); ok {
+			return strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%T", stmt), "*ast."), "Stmt")
+		}
+	}
+	return ""
+}
+
+// IsTransactionQuery BEGIN, COMMIT, ROLLBACK, XA in QUERY_EVENT
+func IsTransactionQuery(sql string) bool {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(strings.TrimSuffix(fields[0], ";")) {
+	case "BEGIN", "COMMIT", "ROLLBACK", "XA":
+		return true
+	}
+	return false
+}
+
 // QueryFormat ...
-func QueryFormat(sql string) {
+func (r *Rebuilder) QueryFormat(sql string) {
 	if strings.HasPrefix(sql, "BEGIN") {
-		common.Verbose("-- [DEBUG] BEGIN;")
+		r.verbose("-- [DEBUG] BEGIN;")
 		return
 	}
 
 	if strings.HasSuffix(sql, ";") {
-		fmt.Println(sql)
+		r.println(sql)
 	} else {
-		fmt.Println(sql, ";")
+		r.println(sql, ";")
 	}
 }
 
-func QueryRollback(sql string) {
-	stmts, err := TiParse(sql, common.Config.Global.Charset, mysql.Charsets[common.Config.Global.Charset])
+func (r *Rebuilder) QueryRollback(sql string) {
+	stmts, err := TiParse(sql, r.cfg.Global.Charset, mysql.Charsets[r.cfg.Global.Charset])
 	if err == nil {
 		for _, stmt := range stmts {
 			switch node := stmt.(type) {
 			case *ast.CreateTableStmt:
-				CreateTableRollback(node)
+				r.CreateTableRollback(node)
 			case *ast.CreateDatabaseStmt:
-				CreateDatabaseRollback(node)
+				r.CreateDatabaseRollback(node)
 			case *ast.CreateIndexStmt:
-				CreateIndexRollback(node)
+				r.CreateIndexRollback(node)
 			case *ast.CreateViewStmt:
-				CreateViewRollback(node)
+				r.CreateViewRollback(node)
 			// case *ast.AlterTableStmt:
 			// TODO: ALTER TABLE tb ADD col int;
 			case *ast.BeginStmt:
-				common.Verbose("-- [DEBUG] BEGIN;")
+				r.verbose("-- [DEBUG] BEGIN;")
 			default:
-				common.VerboseVerbose("-- [DEBUG] can't rollback: %s;", sql)
+				r.verboseVerbose("-- [DEBUG] can't rollback: %s;", sql)
 			}
 		}
 	} else {
@@ -154,39 +330,39 @@ func QueryRollback(sql string) {
 }
 
 // CreateTableRollback ...
-func CreateTableRollback(stmt *ast.CreateTableStmt) {
+func (r *Rebuilder) CreateTableRollback(stmt *ast.CreateTableStmt) {
 	if stmt.Table.Schema.String() == "" {
-		fmt.Printf("DROP TABLE IF EXISTS `%s`;\n", stmt.Table.Name)
+		r.printf("DROP TABLE IF EXISTS `%s`;\n", stmt.Table.Name)
 	} else {
-		fmt.Printf("DROP TABLE IF EXISTS `%s`.`%s`;\n", stmt.Table.Schema, stmt.Table.Name)
+		r.printf("DROP TABLE IF EXISTS `%s`.`%s`;\n", stmt.Table.Schema, stmt.Table.Name)
 	}
 }
 
 // CreateDatabaseRollback ...
-func CreateDatabaseRollback(stmt *ast.CreateDatabaseStmt) {
-	fmt.Printf("DROP DATABASE IF EXISTS `%s`;\n", stmt.Name)
+func (r *Rebuilder) CreateDatabaseRollback(stmt *ast.CreateDatabaseStmt) {
+	r.printf("DROP DATABASE IF EXISTS `%s`;\n", stmt.Name)
 }
 
 // CreateIndexRollback ...
-func CreateIndexRollback(stmt *ast.CreateIndexStmt) {
+func (r *Rebuilder) CreateIndexRollback(stmt *ast.CreateIndexStmt) {
 	if stmt.Table.Schema.String() == "" {
-		fmt.Printf("DROP INDEX `%s` ON `%s`;\n", stmt.IndexName, stmt.Table.Name)
+		r.printf("DROP INDEX `%s` ON `%s`;\n", stmt.IndexName, stmt.Table.Name)
 	} else {
-		fmt.Printf("DROP INDEX `%s` ON `%s`.`%s`;\n", stmt.IndexName, stmt.Table.Schema, stmt.Table.Name)
+		r.printf("DROP INDEX `%s` ON `%s`.`%s`;\n", stmt.IndexName, stmt.Table.Schema, stmt.Table.Name)
 	}
 }
 
 // CreateViewRollback ...
-func CreateViewRollback(stmt *ast.CreateViewStmt) {
+func (r *Rebuilder) CreateViewRollback(stmt *ast.CreateViewStmt) {
 	if stmt.ViewName.Schema.String() == "" {
-		fmt.Printf("DROP VIEW IF EXISTS `%s`;\n", stmt.ViewName.Name)
+		r.printf("DROP VIEW IF EXISTS `%s`;\n", stmt.ViewName.Name)
 	} else {
-		fmt.Printf("DROP VIEW IF EXISTS `%s`.`%s`;\n", stmt.ViewName.Schema, stmt.ViewName.Name)
+		r.printf("DROP VIEW IF EXISTS `%s`.`%s`;\n", stmt.ViewName.Schema, stmt.ViewName.Name)
 	}
 }
 
 // QueryStat ...
-func QueryStat(sql string) {
+func (r *Rebuilder) QueryStat(sql string) {
 	// TODO: statement base table stat
 	// stmt, err := TiParse(sql, common.Config.Global.Charset, mysql.Charsets[common.Config.Global.Charset])
 	t := strings.ToLower(strings.Fields(sql)[0])
@@ -196,25 +372,24 @@ func QueryStat(sql string) {
 		return
 	}
 
-	if QueryStats != nil {
-		QueryStats[t]++
+	if r.queryStats != nil {
+		r.queryStats[t]++
 	} else {
-		QueryStats = map[string]int64{t: 1}
+		r.queryStats = map[string]int64{t: 1}
 	}
 }
 
-// QueryLua ...
-func QueryLua(sql string) {
-	if common.Config.Rebuild.LuaScript == "" || sql == "" {
+// QueryLua call lua QueryRewrite(sql, event)
+func (r *Rebuilder) QueryLua(queryEvent *replication.BinlogEvent, sql string) {
+	if sql == "" {
 		return
 	}
+	r.luaEach(queryEvent, func() { r.queryLua(queryEvent, sql) })
+}
 
-	if err := Lua.CallByParam(lua.P{
-		Fn:      Lua.GetGlobal("QueryRewrite"),
-		NRet:    1,
-		Protect: true,
-	}, lua.LString(sql)); err != nil {
-		common.Log.Error(err.Error())
-		return
+func (r *Rebuilder) queryLua(queryEvent *replication.BinlogEvent, sql string) {
+	if _, ok := r.luaFunction("QueryRewrite"); ok {
+		r.luaHook("QueryRewrite", lua.LString(sql), r.luaEventTable(queryEvent))
 	}
+	r.queryHooksLua(queryEvent, sql)
 }
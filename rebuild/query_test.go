@@ -15,6 +15,7 @@ package rebuild
 
 import (
 	"flag"
+	"fmt"
 	"testing"
 
 	"github.com/LianjiaTech/lightning/common"
@@ -23,6 +24,7 @@ import (
 var update = flag.Bool("update", false, "update .golden files")
 
 func TestQueryRollback(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
 	sqls := []string{
 		`CREATE TABLE tb (a int)`,
 		`create database db`,
@@ -31,7 +33,7 @@ func TestQueryRollback(t *testing.T) {
 
 	err := common.GoldenDiff(func() {
 		for _, sql := range sqls {
-			QueryRollback(sql)
+			r.QueryRollback(sql)
 		}
 	}, t.Name(), update)
 	if nil != err {
@@ -39,3 +41,38 @@ func TestQueryRollback(t *testing.T) {
 	}
 
 }
+
+func TestQueryTables(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	cases := []struct {
+		sql    string
+		tables []string
+	}{
+		{"ALTER TABLE tb ADD COLUMN c int", []string{"`test`.`tb`"}},
+		{"CREATE TABLE db.tb (a int)", []string{"`db`.`tb`"}},
+		{"DROP TABLE IF EXISTS tb1, db.tb2", []string{"`test`.`tb1`", "`db`.`tb2`"}},
+		{"RENAME TABLE tb TO db.tb_bak", []string{"`test`.`tb`", "`db`.`tb_bak`"}},
+		{"TRUNCATE TABLE tb", []string{"`test`.`tb`"}},
+		{"CREATE INDEX idx_b ON tb (b)", []string{"`test`.`tb`"}},
+		{"INSERT INTO tb VALUES (1, 'abc')", []string{"`test`.`tb`"}},
+		{"UPDATE tb SET b = 'a' WHERE a = 1", []string{"`test`.`tb`"}},
+		{"DELETE FROM db.tb WHERE a = 1", []string{"`db`.`tb`"}},
+		// read-only sources are not targets
+		{"INSERT INTO tb SELECT * FROM db.ignored", []string{"`test`.`tb`"}},
+		{"UPDATE tb SET b = (SELECT MAX(b) FROM tb2) WHERE a IN (SELECT a FROM tb3)", []string{"`test`.`tb`"}},
+		{"UPDATE tb t1 JOIN tb2 t2 ON t1.a = t2.a SET t1.b = t2.b", []string{"`test`.`tb`"}},
+		{"UPDATE tb, tb2 SET b = 1 WHERE tb.a = tb2.a", []string{"`test`.`tb`", "`test`.`tb2`"}},
+		{"DELETE t1 FROM tb t1 JOIN db.tb2 t2 ON t1.a = t2.a", []string{"`test`.`tb`"}},
+		{"DELETE FROM tb WHERE a IN (SELECT a FROM tb2)", []string{"`test`.`tb`"}},
+		{"CREATE TABLE tb_copy LIKE tb", []string{"`test`.`tb_copy`"}},
+		{"ALTER TABLE tb ADD FOREIGN KEY (a) REFERENCES tb2 (a)", []string{"`test`.`tb`"}},
+		{"CREATE DATABASE db", nil},
+		{"BEGIN", nil},
+	}
+	for _, c := range cases {
+		tables := r.QueryTables(c.sql, "test")
+		if fmt.Sprint(tables) != fmt.Sprint(c.tables) {
+			t.Errorf("QueryTables(%q) want %v, got %v", c.sql, c.tables, tables)
+		}
+	}
+}
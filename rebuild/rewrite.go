@@ -0,0 +1,176 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+)
+
+// rewriteEnabled any of -rewrite-db, -rewrite-tables, -without-db-name specified
+func (r *Rebuilder) rewriteEnabled() bool {
+	return len(r.cfg.Rebuild.RewriteRules) > 0 || r.cfg.Rebuild.WithoutDBName
+}
+
+// RewriteTable rewrite `db`.`tb` into output table name, -without-db-name only keep table name
+func (r *Rebuilder) RewriteTable(table string) string {
+	if !r.rewriteEnabled() || table == "" {
+		return table
+	}
+	database, name := common.SplitTableName(table)
+	database, name = r.cfg.RewriteTableName(database, name)
+	table = fmt.Sprintf("`%s`.`%s`", database, name)
+	if r.cfg.Rebuild.WithoutDBName {
+		return onlyTable(table)
+	}
+	return table
+}
+
+// LogicalTable get logical table name of -route-tables, or physical table itself if no route match
+func (r *Rebuilder) LogicalTable(table string) string {
+	if logical := r.cfg.RouteTable(table); logical != "" {
+		return logical
+	}
+	return table
+}
+
+// OutputTable table name in generated query and lua, -logical-table then rewrite
+func (r *Rebuilder) OutputTable(table string) string {
+	if r.cfg.Rebuild.LogicalTable {
+		table = r.LogicalTable(table)
+	}
+	return r.RewriteTable(table)
+}
+
+// originComment physical table comment for -logical-table output
+func (r *Rebuilder) originComment(table string) string {
+	if !r.cfg.Rebuild.LogicalTable || r.cfg.RouteTable(table) == "" {
+		return ""
+	}
+	return fmt.Sprintf("/* origin: %s */", table)
+}
+
+// rewriteTableKeys rewrite map keys for lua GoColumns, GoPrimaryKeys
+func (r *Rebuilder) rewriteTableKeys(values map[string][]string) map[string][]string {
+	if !r.rewriteEnabled() && !r.cfg.Rebuild.LogicalTable {
+		return values
+	}
+	rewrite := make(map[string][]string)
+	for table, cols := range values {
+		rewrite[r.OutputTable(table)] = cols
+	}
+	return rewrite
+}
+
+// rewriteVisitor rewrite table and database names in statement
+type rewriteVisitor struct {
+	cfg      *common.Configuration
+	database string // default database
+	changed  bool
+}
+
+// Enter implements ast.Visitor interface
+func (v *rewriteVisitor) Enter(in ast.Node) (ast.Node, bool) {
+	switch node := in.(type) {
+	case *ast.TableName:
+		node.Schema, node.Name = v.rewriteTable(node.Schema, node.Name)
+		return in, true
+	case *ast.ColumnName:
+		// qualified column, eg. db.tb.col, tb.col
+		if node.Table.String() != "" {
+			node.Schema, node.Table = v.rewriteTable(node.Schema, node.Table)
+		}
+		return in, true
+	case *ast.UseStmt:
+		node.DBName = v.rewriteDatabase(node.DBName)
+	case *ast.CreateDatabaseStmt:
+		node.Name = v.rewriteDatabase(node.Name)
+	case *ast.AlterDatabaseStmt:
+		node.Name = v.rewriteDatabase(node.Name)
+	case *ast.DropDatabaseStmt:
+		node.Name = v.rewriteDatabase(node.Name)
+	}
+	return in, false
+}
+
+// Leave implements ast.Visitor interface
+func (v *rewriteVisitor) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+func (v *rewriteVisitor) rewriteTable(schema, name model.CIStr) (model.CIStr, model.CIStr) {
+	database := schema.String()
+	if database == "" {
+		database = v.database
+	}
+	db, tb := v.cfg.RewriteTableName(database, name.String())
+	if v.cfg.Rebuild.WithoutDBName {
+		db = ""
+	} else if db == database && schema.String() == "" {
+		// keep table name without database as it was
+		db = ""
+	}
+	if db == schema.String() && tb == name.String() {
+		return schema, name
+	}
+	v.changed = true
+	return model.NewCIStr(db), model.NewCIStr(tb)
+}
+
+func (v *rewriteVisitor) rewriteDatabase(database string) string {
+	if database == "" {
+		return database
+	}
+	db := v.cfg.RewriteDatabaseName(database)
+	if db != database {
+		v.changed = true
+	}
+	return db
+}
+
+// RewriteQuery rewrite database and table names in QUERY_EVENT, database is the default database
+func (r *Rebuilder) RewriteQuery(sql, database string) string {
+	if !r.rewriteEnabled() || sql == "" || IsTransactionQuery(sql) {
+		return sql
+	}
+	stmts, err := TiParse(sql, r.cfg.Global.Charset, mysql.Charsets[r.cfg.Global.Charset])
+	if err != nil {
+		common.Log.Warn("RewriteQuery parse error: %s, sql: %s", err.Error(), sql)
+		return sql
+	}
+
+	v := &rewriteVisitor{cfg: r.cfg, database: database}
+	var queries []string
+	for _, stmt := range stmts {
+		stmt.Accept(v)
+		var buf strings.Builder
+		if err := stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &buf)); err != nil {
+			common.Log.Warn("RewriteQuery restore error: %s, sql: %s", err.Error(), sql)
+			return sql
+		}
+		queries = append(queries, buf.String())
+	}
+	// keep original format if nothing changed
+	if !v.changed {
+		return sql
+	}
+	return strings.Join(queries, "; ")
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"testing"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+func TestRewriteQuery(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	rulesOrg := r.cfg.Rebuild.RewriteRules
+	withoutDBNameOrg := r.cfg.Rebuild.WithoutDBName
+	defer func() {
+		r.cfg.Rebuild.RewriteRules = rulesOrg
+		r.cfg.Rebuild.WithoutDBName = withoutDBNameOrg
+	}()
+
+	var err error
+	r.cfg.Rebuild.RewriteRules, err = common.ParseRewriteRules(
+		[]string{"db1->db2"},
+		[]string{"test.tb->test.tb_recover"},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tables := [][2]string{
+		{"`test`.`tb`", "`test`.`tb_recover`"},
+		{"`db1`.`tb`", "`db2`.`tb`"},
+		{"`test`.`other`", "`test`.`other`"},
+	}
+	for _, c := range tables {
+		if table := r.RewriteTable(c[0]); table != c[1] {
+			t.Errorf("RewriteTable(%s) want %s, got %s", c[0], c[1], table)
+		}
+	}
+
+	queries := [][3]string{
+		// default database, sql, expect
+		{"test", "ALTER TABLE tb ADD COLUMN c int", "ALTER TABLE `tb_recover` ADD COLUMN `c` INT"},
+		{"db1", "TRUNCATE TABLE tb", "TRUNCATE TABLE `db2`.`tb`"},
+		{"test", "DROP TABLE other", "DROP TABLE other"},
+		{"test", "CREATE DATABASE db1", "CREATE DATABASE `db2`"},
+		{"test", "BEGIN", "BEGIN"},
+		{"test", "UPDATE test.tb SET test.tb.c = 1 WHERE tb.id = 1", "UPDATE `test`.`tb_recover` SET `test`.`tb_recover`.`c`=1 WHERE `tb_recover`.`id`=1"},
+		{"test", "DELETE FROM db1.tb WHERE db1.tb.id = 1", "DELETE FROM `db2`.`tb` WHERE `db2`.`tb`.`id`=1"},
+		{"test", "UPDATE tb AS t SET t.c = 1", "UPDATE `tb_recover` AS `t` SET `t`.`c`=1"},
+		{"test", "USE db1", "USE `db2`"},
+		{"test", "USE test", "USE test"},
+	}
+	for _, c := range queries {
+		if sql := r.RewriteQuery(c[1], c[0]); sql != c[2] {
+			t.Errorf("RewriteQuery(%s) want %s, got %s", c[1], c[2], sql)
+		}
+	}
+
+	r.cfg.Rebuild.WithoutDBName = true
+	if table := r.RewriteTable("`db1`.`tb`"); table != "`tb`" {
+		t.Errorf("RewriteTable without-db-name want `tb`, got %s", table)
+	}
+	if sql := r.RewriteQuery("DROP TABLE db1.tb", "test"); sql != "DROP TABLE `tb`" {
+		t.Errorf("RewriteQuery without-db-name want DROP TABLE `tb`, got %s", sql)
+	}
+	if sql := r.RewriteQuery("DELETE FROM db1.tb WHERE db1.tb.id = 1", "test"); sql != "DELETE FROM `tb` WHERE `tb`.`id`=1" {
+		t.Errorf("RewriteQuery without-db-name want DELETE FROM `tb` WHERE `tb`.`id`=1, got %s", sql)
+	}
+}
+
+func TestLogicalTable(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	rulesOrg := r.cfg.Rebuild.RouteRules
+	logicalOrg := r.cfg.Rebuild.LogicalTable
+	defer func() {
+		r.cfg.Rebuild.RouteRules = rulesOrg
+		r.cfg.Rebuild.LogicalTable = logicalOrg
+	}()
+
+	var err error
+	r.cfg.Rebuild.RouteRules, err = common.ParseRouteRules([]string{`shard\_%.order\_%->shard.order`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// one schema serve all sharding tables
+	err = r.schemaAppend("shard", "CREATE TABLE `order` (`id` int, `v` varchar(10), PRIMARY KEY (`id`))")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	if table := r.SchemaTable("`shard_01`.`order_0001`"); table != "`shard`.`order`" {
+		t.Errorf("SchemaTable want `shard`.`order`, got %s", table)
+	}
+
+	err = common.GoldenDiff(func() {
+		row := func(id int32, v string) []binlog.Value {
+			return binlog.RowValues(r.TableInfo("`shard`.`order`"), []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR}, []interface{}{id, v})
+		}
+		values := [][]binlog.Value{row(1, "a"), row(1, "b")}
+		r.updateQuery("`shard_01`.`order_0001`", values)
+		r.cfg.Rebuild.LogicalTable = true
+		r.updateQuery("`shard_01`.`order_0001`", values)
+		r.deleteQuery("`shard_01`.`order_0001`", values[:1])
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
@@ -15,85 +15,207 @@ package rebuild
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-mysql-org/go-mysql/replication"
 	"github.com/juju/errors"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 
 	// database/sql
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/pingcap/parser/ast"
-	"github.com/pingcap/parser/model"
-	"github.com/pingcap/parser/mysql"
 )
 
-// Schemas ...
-var Schemas map[string]*ast.CreateTableStmt
-
-// Columns ...
-var Columns map[string][]string
-
-// PrimaryKeys ...
-var PrimaryKeys map[string][]string
-
 // LoadSchemaInfo load schema info from file or mysql
-func LoadSchemaInfo() {
-	if common.Config.MySQL.SchemaFile != "" {
+func (r *Rebuilder) LoadSchemaInfo() {
+	if r.cfg.MySQL.SchemaFile != "" {
 		// load from file
-		err := loadSchemaFromFile()
+		err := r.loadSchemaFromFile()
 		if err != nil {
 			common.Log.Error(errors.Trace(err).Error())
 		}
 		return
 	} else {
 		// load from mysql server
-		err := loadSchemaFromMySQL()
+		err := r.loadSchemaFromMySQL()
 		if err != nil {
 			common.Log.Error(errors.Trace(err).Error())
 		}
 	}
 }
 
-func loadSchemaFromFile() error {
-	common.Log.Debug("loadSchemaFromFile %s", common.Config.MySQL.SchemaFile)
-	if _, err := os.Stat(common.Config.MySQL.SchemaFile); err != nil {
+func (r *Rebuilder) loadSchemaFromFile() error {
+	file := r.cfg.MySQL.SchemaFile
+	common.Log.Debug("loadSchemaFromFile %s", file)
+	r.schemaSource.Source = file
+	r.schemaSource.Time = time.Now()
+	info, err := os.Stat(file)
+	if err != nil {
 		return err
 	}
-	buf, err := ioutil.ReadFile(common.Config.MySQL.SchemaFile)
+	if info.IsDir() {
+		err = r.loadSchemaDir(file)
+	} else {
+		err = r.loadSchemaFile(file, "")
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+	return err
+}
+
+var (
+	// mydumper db.tb-schema.sql
+	mydumperSchemaFile = regexp.MustCompile(`^([^.]+)\.[^.]+-schema\.sql$`)
+	// mydumper data, view, trigger files, eg. db.tb.00000.sql, db.tb-schema-view.sql
+	mydumperOtherFile = regexp.MustCompile(`(\.[0-9]+|-schema-view|-schema-triggers|-schema-post)\.sql$`)
+)
+
+// loadSchemaDir load .sql and .json schema files in directory, eg. one file for each table or mydumper output.
+// Files in sub directory use the directory name as default database, mydumper db.tb-schema.sql use db.
+func (r *Rebuilder) loadSchemaDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || mydumperOtherFile.MatchString(name) ||
+			(filepath.Ext(name) != ".sql" && filepath.Ext(name) != ".json") {
+			return nil
+		}
+		var database string
+		if sub := filepath.Dir(path); sub != filepath.Clean(dir) {
+			database = filepath.Base(sub)
+		} else if m := mydumperSchemaFile.FindStringSubmatch(name); m != nil {
+			database = m[1]
+		}
+		if err = r.loadSchemaFile(path, database); err != nil {
+			common.Log.Error("schema file: %s, error: %s", path, err.Error())
+		}
+		return nil
+	})
+}
+
+// loadSchemaFile load SQL or JSON snapshot schema file, tables can't parse are logged and skipped
+func (r *Rebuilder) loadSchemaFile(file, database string) error {
+	buf, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	err = schemaAppend("", string(buf))
-	buildColumns()
-	buildPrimaryKeys()
-	return err
+	var stmts []*ast.CreateTableStmt
+	var errs []*binlog.SchemaError
+	if binlog.IsSnapshot(string(buf)) {
+		snapshot, err := binlog.ParseSnapshot(buf)
+		if err != nil {
+			return err
+		}
+		stmts, errs = snapshot.Parse(r.cfg.Global.Charset)
+	} else {
+		stmts, errs = binlog.ParseSchema(database, string(buf), r.cfg.Global.Charset)
+	}
+	r.schemaAdd(stmts)
+	for _, e := range errs {
+		common.Log.Error("schema file: %s, %s", file, e.Error())
+	}
+	return nil
 }
 
-func loadSchemaFromMySQL() error {
-	var databases []string
+// schemaRetryMax max wait before loading a failed table again
+const schemaRetryMax = time.Minute
+
+// schemaBackoff retry of table failed to load on TABLE_MAP_EVENT, wait doubles after each failure
+type schemaBackoff struct {
+	next time.Time
+	wait time.Duration
+}
+
+// schemaRetryDue table never failed or its backoff passed
+func (r *Rebuilder) schemaRetryDue(key string, now time.Time) bool {
+	retry, ok := r.schemaRetry[key]
+	return !ok || !now.Before(retry.next)
+}
+
+// schemaRetryFailed record failure of table, return wait before next retry
+func (r *Rebuilder) schemaRetryFailed(key string, now time.Time) time.Duration {
+	retry, ok := r.schemaRetry[key]
+	if !ok {
+		retry = &schemaBackoff{wait: time.Second}
+		r.schemaRetry[key] = retry
+	} else if retry.wait *= 2; retry.wait > schemaRetryMax {
+		retry.wait = schemaRetryMax
+	}
+	retry.next = now.Add(retry.wait)
+	return retry.wait
+}
+
+// loadSchemaFromMySQL prefetch selected tables with -schema-prefetch parallel connections,
+// or only connect and load each table on its first TABLE_MAP_EVENT if -schema-prefetch is 0
+func (r *Rebuilder) loadSchemaFromMySQL() error {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/?charset=%s&timeout=5s",
-		common.MasterInfo.MasterUser,
-		common.MasterInfo.MasterPassword,
-		common.MasterInfo.MasterHost,
-		common.MasterInfo.MasterPort,
-		common.Config.Global.Charset,
+		r.master.MasterUser,
+		r.master.MasterPassword,
+		r.master.MasterHost,
+		r.master.MasterPort,
+		r.cfg.Global.Charset,
 	)
 	common.Log.Debug("loadSchemaFromMySQL %s", dsn)
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	// lazy loading connect on first TABLE_MAP_EVENT, check connection before parsing
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
 
-	res, err := db.Query("SHOW DATABASES;")
+	// server info for -save-schema header, gtid_executed not exists in MariaDB
+	r.schemaSource.Source = fmt.Sprintf("%s:%d", r.master.MasterHost, r.master.MasterPort)
+	r.schemaSource.Time = time.Now()
+	db.QueryRow("SELECT @@version").Scan(&r.schemaSource.ServerVersion)
+	db.QueryRow("SELECT @@global.gtid_executed").Scan(&r.schemaSource.GTIDExecuted)
+
+	r.schemaDB = db
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	// -save-schema need all tables
+	parallel := r.cfg.MySQL.SchemaPrefetch
+	if parallel <= 0 && r.cfg.MySQL.SaveSchema != "" {
+		parallel = 1
+	}
+	if parallel <= 0 {
+		db.SetMaxOpenConns(1)
+		return nil
+	}
+	db.SetMaxOpenConns(parallel)
+	tables, err := r.schemaTables(db)
 	if err != nil {
 		return err
 	}
+	r.prefetchSchema(db, tables, parallel)
+	r.buildColumns()
+	r.buildPrimaryKeys()
+	return nil
+}
+
+// schemaTables database, table pairs selected by -tables, -ignore-tables, system databases are skipped
+func (r *Rebuilder) schemaTables(db *sql.DB) ([][2]string, error) {
+	var databases []string
+	res, err := db.Query("SHOW DATABASES;")
+	if err != nil {
+		return nil, err
+	}
 	for res.Next() {
 		var database string
 		res.Scan(&database)
@@ -105,15 +227,13 @@ func loadSchemaFromMySQL() error {
 	}
 	res.Close()
 
+	var tables [][2]string
 	for _, database := range databases {
 		res, err := db.Query(fmt.Sprintf("SHOW TABLES FROM `%s`", database))
 		if err != nil {
 			common.Log.Error(errors.Trace(err).Error())
 			continue
 		}
-
-		// SHOW TABLES
-		var tables []string
 		for res.Next() {
 			var table string
 			err = res.Scan(&table)
@@ -121,176 +241,419 @@ func loadSchemaFromMySQL() error {
 				common.Log.Error(errors.Trace(err).Error())
 				continue
 			}
-			tables = append(tables, table)
+			// 对于表较多的情况，只加载需要的表将极大加速表结构加载速度
+			if r.schemaTableSelected(database, table) {
+				tables = append(tables, [2]string{database, table})
+			}
 		}
+		res.Close()
+	}
+	return tables, nil
+}
 
-		// SHOW CREATE TABLE
-		for _, table := range tables {
-			var ignore bool
-			if len(common.Config.Filters.Tables) > 0 {
-				ignore = true
-			}
-			for _, tb := range common.Config.Filters.Tables {
-				// TODO: % 匹配有点复杂，这里暂且加载所有表结构
-				if strings.Contains(tb, "%") && strings.HasPrefix(strings.Replace(tb, "`", "", -1), database+".") {
-					ignore = false
-					break
-				}
-				// 对于表较多的情况，只加载需要的表将极大加速表结构加载速度
-				if strings.Replace(tb, "`", "", -1) == fmt.Sprintf("%s.%s", database, table) {
-					ignore = false
-					break
-				}
-			}
-			if ignore {
-				continue
+// prefetchSchema load tables with parallel connections, a table failed to load don't block others
+func (r *Rebuilder) prefetchSchema(db *sql.DB, tables [][2]string, parallel int) {
+	jobs := make(chan [2]string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				r.loadTableSchema(db, t[0], t[1])
 			}
+		}()
+	}
+	for _, t := range tables {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+}
 
-			tableRes, err := db.Query(fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`;", database, table))
-			if err != nil {
-				common.Log.Error(errors.Trace(err).Error())
-				continue
-			}
+// loadTableSchema load table into schemas by SHOW CREATE TABLE, build from information_schema if it can't parse.
+// false if table is view or failed to load.
+func (r *Rebuilder) loadTableSchema(db *sql.DB, database, table string) bool {
+	tableRes, err := db.Query(fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`;", database, table))
+	if err != nil {
+		common.Log.Error(errors.Trace(err).Error())
+		return false
+	}
+	defer tableRes.Close()
 
-			cols, err := tableRes.Columns()
-			if err != nil {
-				common.Log.Error(errors.Trace(err).Error())
-				continue
-			}
-			// SHOW CREATE VIEW WILL GET 4 COLUMNS
-			if len(cols) != 2 {
-				common.Log.Info("by pass host: %s, port: %d, database: %s, table: %s",
-					common.MasterInfo.MasterHost,
-					common.MasterInfo.MasterPort,
-					database, table)
-				continue
-			}
+	cols, err := tableRes.Columns()
+	if err != nil {
+		common.Log.Error(errors.Trace(err).Error())
+		return false
+	}
+	// SHOW CREATE VIEW WILL GET 4 COLUMNS
+	if len(cols) != 2 {
+		common.Log.Info("by pass host: %s, port: %d, database: %s, table: %s",
+			r.master.MasterHost,
+			r.master.MasterPort,
+			database, table)
+		return false
+	}
 
-			for tableRes.Next() {
-				var name, schema string
-				err = tableRes.Scan(&name, &schema)
-				if err != nil {
-					common.Log.Error("host: %s, port: %d, database: %s, table: %s, error: %s",
-						common.MasterInfo.MasterHost,
-						common.MasterInfo.MasterPort,
-						database, table, errors.Trace(err).Error())
-					continue
-				}
-				err = schemaAppend(database, schema)
-				if err != nil {
-					common.Log.Error("host: %s, port: %d, database: %s, table: %s, sql: %s, error: %s",
-						common.MasterInfo.MasterHost,
-						common.MasterInfo.MasterPort,
-						database, table,
-						schema,
-						errors.Trace(err).Error())
-					schemaAppend(database, buildFakeTable(db, fmt.Sprintf("`%s`.`%s`", database, table)))
-				}
-			}
-			tableRes.Close()
+	var name, schema string
+	if tableRes.Next() {
+		err = tableRes.Scan(&name, &schema)
+	}
+	if err != nil || schema == "" {
+		if err == nil {
+			err = tableRes.Err()
 		}
-		res.Close()
+		common.Log.Error("host: %s, port: %d, database: %s, table: %s, error: %v",
+			r.master.MasterHost,
+			r.master.MasterPort,
+			database, table, err)
+		return false
 	}
-	buildColumns()
-	buildPrimaryKeys()
-	return nil
+
+	fallback := false
+	stmts, errs := binlog.ParseSchema(database, schema, r.cfg.Global.Charset)
+	if len(errs) > 0 {
+		common.Log.Error("host: %s, port: %d, database: %s, table: %s, sql: %s, error: %s",
+			r.master.MasterHost,
+			r.master.MasterPort,
+			database, table,
+			schema,
+			errs[0].Err.Error())
+		stmts, errs = binlog.ParseSchema(database, r.buildFallbackTable(db, database, table), r.cfg.Global.Charset)
+		if len(errs) > 0 || len(stmts) == 0 {
+			common.Log.Error("database: %s, table: %s, fallback schema failed", database, table)
+			return false
+		}
+		fallback = true
+	}
+
+	r.schemaMutex.Lock()
+	defer r.schemaMutex.Unlock()
+	r.schemaAdd(stmts)
+	if fallback {
+		name := fmt.Sprintf("`%s`.`%s`", database, table)
+		r.fallbackTables = append(r.fallbackTables, name)
+		r.verbose("-- [DEBUG] schema of %s built from information_schema", name)
+	}
+	return len(stmts) > 0
 }
 
-func schemaAppend(database, sql string) error {
-	sql = removeIncompatibleWords(sql)
-	stmts, err := TiParse(sql, common.Config.Global.Charset, mysql.Charsets[common.Config.Global.Charset])
-	if err != nil {
-		return err
+// TableMapSchema load table schema from MySQL on its first TABLE_MAP_EVENT,
+// for tables not prefetched or created after lightning started
+func (r *Rebuilder) TableMapSchema(event *replication.BinlogEvent) {
+	ev, ok := event.Event.(*replication.TableMapEvent)
+	if !ok || r.schemaDB == nil {
+		return
 	}
-	if database == "" {
-		database = "%"
+	database, table := string(ev.Schema), string(ev.Table)
+	key := fmt.Sprintf("`%s`.`%s`", database, table)
+	if _, ok := r.schemas[key]; ok || r.schemaTried[key] {
+		return
 	}
-	for _, stmt := range stmts {
-		switch node := stmt.(type) {
-		case *ast.CreateTableStmt:
-			if node.Table.Schema.String() == "" {
-				node.Table.Schema = model.NewCIStr(database)
-			}
-			Schemas[fmt.Sprintf("`%s`.`%s`", database, node.Table.Name)] = node
-		case *ast.UseStmt:
-			database = node.DBName
+	if !r.schemaTableSelected(database, table) {
+		r.schemaTried[key] = true
+		return
+	}
+	now := time.Now()
+	if !r.schemaRetryDue(key, now) {
+		return
+	}
+	if !r.loadTableSchema(r.schemaDB, database, table) {
+		wait := r.schemaRetryFailed(key, now)
+		r.verbose("-- [DEBUG] schema of %s load failed, retry after %s", key, wait)
+		return
+	}
+	delete(r.schemaRetry, key)
+	r.verboseVerbose("-- [DEBUG] schema of %s loaded on TABLE_MAP_EVENT", key)
+	stmt := r.schemas[key]
+	r.appendColumns(stmt)
+	r.appendPrimaryKeys(stmt)
+	r.luaTableSchema(key)
+}
+
+// schemaTableSelected check table with -tables, -ignore-tables filters
+func (r *Rebuilder) schemaTableSelected(database, table string) bool {
+	name := fmt.Sprintf("`%s`.`%s`", database, table)
+	if len(r.cfg.Filters.Tables) > 0 &&
+		!r.cfg.TableFiltersMatch(name, r.cfg.Filters.Tables) {
+		return false
+	}
+	return !r.cfg.TableFiltersMatch(name, r.cfg.Filters.IgnoreTables)
+}
+
+// schemaAppend add tables of CREATE TABLE SQL into schemas, tables can't parse are skipped and returned as error
+func (r *Rebuilder) schemaAppend(database, sql string) error {
+	stmts, errs := binlog.ParseSchema(database, sql, r.cfg.Global.Charset)
+	r.schemaAdd(stmts)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
 		}
+		return errors.New(strings.Join(msgs, "; "))
 	}
 	return nil
 }
 
-// removeIncompatibleWords remove pingcap/parser not support words from schema
-// Note: only for MySQL `SHOW CREATE TABLE` hand-writing SQL not compatible
-func removeIncompatibleWords(sql string) string {
-	// CONSTRAINT col_fk FOREIGN KEY (col) REFERENCES tb (id) ON UPDATE CASCADE
-	re := regexp.MustCompile(` ON UPDATE CASCADE`)
-	sql = re.ReplaceAllString(sql, "")
+func (r *Rebuilder) schemaAdd(stmts []*ast.CreateTableStmt) {
+	for _, node := range stmts {
+		r.schemas[fmt.Sprintf("`%s`.`%s`", node.Table.Schema, node.Table.Name)] = node
+	}
+}
 
-	// FULLTEXT KEY col_fk (col) /*!50100 WITH PARSER `ngram` */
-	// /*!50100 PARTITION BY LIST (col)
-	re = regexp.MustCompile(`/\*!5`)
-	sql = re.ReplaceAllString(sql, "/* 5")
+// SaveSchema write loaded schema into file which can be used as -schema-file, format depends on path:
+// .json for JSON snapshot, existing directory or path ends with / for one .sql file of each table, others for one SQL file.
+func (r *Rebuilder) SaveSchema(path string) error {
+	snapshot := r.schemaSnapshot()
+	if strings.HasSuffix(path, ".json") {
+		buf, err := json.MarshalIndent(snapshot, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(buf, '\n'), 0644)
+	}
+	if info, err := os.Stat(path); (err == nil && info.IsDir()) || strings.HasSuffix(path, string(os.PathSeparator)) {
+		// tables without database at top level, others in database directory
+		for _, table := range snapshot.Tables {
+			dir := path
+			if table.Database != "%" {
+				dir = filepath.Join(path, table.Database)
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			file := filepath.Join(dir, table.Name+".sql")
+			if err := os.WriteFile(file, []byte(schemaSQL(snapshot, []binlog.SnapshotTable{table})), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(schemaSQL(snapshot, snapshot.Tables)), 0644)
+}
 
-	// col varchar(10) CHARACTER SET gbk DEFAULT NULL
-	re = regexp.MustCompile(`CHARACTER SET [a-z_0-9]* `)
-	sql = re.ReplaceAllString(sql, "")
+// schemaSnapshot snapshot of schemas, tables without database first, then sorted by database and name
+func (r *Rebuilder) schemaSnapshot() binlog.Snapshot {
+	snapshot := binlog.Snapshot{
+		Version:       binlog.SnapshotVersion,
+		Charset:       r.cfg.Global.Charset,
+		Source:        r.schemaSource.Source,
+		ServerVersion: r.schemaSource.ServerVersion,
+		GTIDExecuted:  strings.Replace(r.schemaSource.GTIDExecuted, "\n", "", -1),
+	}
+	if !r.schemaSource.Time.IsZero() {
+		snapshot.Time = r.schemaSource.Time.Format(time.RFC3339)
+	}
+	for _, stmt := range r.schemas {
+		snapshot.Tables = append(snapshot.Tables, binlog.SnapshotTable{
+			Database: stmt.Table.Schema.String(),
+			Name:     stmt.Table.Name.String(),
+			Create:   strings.TrimSpace(stmt.Text()),
+		})
+	}
+	sort.Slice(snapshot.Tables, func(i, j int) bool {
+		a, b := snapshot.Tables[i], snapshot.Tables[j]
+		if (a.Database == "%") != (b.Database == "%") {
+			return a.Database == "%"
+		}
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Name < b.Name
+	})
+	return snapshot
+}
 
-	// DEFAULT CHARSET=utf8mb3
-	re = regexp.MustCompile(`DEFAULT CHARSET=[a-z_0-9]*`)
-	sql = re.ReplaceAllString(sql, "")
+// schemaSQL header and CREATE TABLE statements with USE before each database
+func schemaSQL(snapshot binlog.Snapshot, tables []binlog.SnapshotTable) string {
+	var buf strings.Builder
+	buf.WriteString("-- lightning schema export\n")
+	for _, line := range [][2]string{
+		{"Source", snapshot.Source},
+		{"Server version", snapshot.ServerVersion},
+		{"GTID executed", snapshot.GTIDExecuted},
+		{"Time", snapshot.Time},
+	} {
+		if line[1] != "" {
+			fmt.Fprintf(&buf, "-- %s: %s\n", line[0], line[1])
+		}
+	}
+	database := "%"
+	for _, table := range tables {
+		if table.Database != database {
+			database = table.Database
+			fmt.Fprintf(&buf, "\nUSE `%s`;\n", database)
+		}
+		fmt.Fprintf(&buf, "\n%s;\n", table.Create)
+	}
+	return buf.String()
+}
 
-	return sql
+// SchemaTable get key of schemas, columns, primaryKeys for table.
+// Sharding tables without their own schema use the logical table schema of -route-tables.
+func (r *Rebuilder) SchemaTable(table string) string {
+	if _, ok := r.schemas[table]; ok {
+		return table
+	}
+	if logical := r.cfg.RouteTable(table); logical != "" {
+		if _, ok := r.schemas[logical]; ok {
+			return logical
+		}
+	}
+	// tables declared without database match any database
+	if wildcard := "`%`." + onlyTable(table); r.schemas[wildcard] != nil {
+		return wildcard
+	}
+	return table
 }
 
 // buildColumns build column name list
-func buildColumns() {
-	Columns = make(map[string][]string)
-	for _, schema := range Schemas {
-		table := fmt.Sprintf("`%s`.`%s`", schema.Table.Schema.String(), schema.Table.Name.String())
-		for _, col := range schema.Cols {
-			Columns[table] = append(Columns[table], fmt.Sprintf("`%s`", col.Name.String()))
-		}
+func (r *Rebuilder) buildColumns() {
+	r.columns = make(map[string][]string)
+	for _, schema := range r.schemas {
+		r.appendColumns(schema)
+	}
+}
+
+// appendColumns build column name list of one table
+func (r *Rebuilder) appendColumns(schema *ast.CreateTableStmt) {
+	table := fmt.Sprintf("`%s`.`%s`", schema.Table.Schema.String(), schema.Table.Name.String())
+	r.columns[table] = nil
+	for _, col := range schema.Cols {
+		r.columns[table] = append(r.columns[table], fmt.Sprintf("`%s`", col.Name.String()))
 	}
 }
 
 // buildPrimaryKeys build primary key list
-func buildPrimaryKeys() {
-	PrimaryKeys = make(map[string][]string)
-	for _, schema := range Schemas {
-		table := fmt.Sprintf("`%s`.`%s`", schema.Table.Schema.String(), schema.Table.Name.String())
-		for _, con := range schema.Constraints {
-			if con.Tp == ast.ConstraintPrimaryKey {
-				for _, col := range con.Keys {
-					PrimaryKeys[table] = append(PrimaryKeys[table], fmt.Sprintf("`%s`", col.Column.String()))
-				}
+func (r *Rebuilder) buildPrimaryKeys() {
+	r.primaryKeys = make(map[string][]string)
+	for _, schema := range r.schemas {
+		r.appendPrimaryKeys(schema)
+	}
+}
+
+// appendPrimaryKeys build primary key list of one table, columns must be built first
+func (r *Rebuilder) appendPrimaryKeys(schema *ast.CreateTableStmt) {
+	table := fmt.Sprintf("`%s`.`%s`", schema.Table.Schema.String(), schema.Table.Name.String())
+	r.primaryKeys[table] = nil
+	for _, con := range schema.Constraints {
+		if con.Tp == ast.ConstraintPrimaryKey {
+			for _, col := range con.Keys {
+				r.primaryKeys[table] = append(r.primaryKeys[table], fmt.Sprintf("`%s`", col.Column.String()))
 			}
 		}
-		// 如果表没有主键，把表的所有列合起来当主键
-		if len(PrimaryKeys[table]) == 0 {
-			PrimaryKeys[table] = Columns[table]
-		}
 	}
+	// 如果表没有主键，把表的所有列合起来当主键
+	if len(r.primaryKeys[table]) == 0 {
+		r.primaryKeys[table] = r.columns[table]
+	}
+}
+
+// fallbackColumn column of information_schema.COLUMNS
+type fallbackColumn struct {
+	Name    string
+	Type    string // COLUMN_TYPE, eg. int(10) unsigned, enum('a','b')
+	Charset string // CHARACTER_SET_NAME
+	Extra   string // EXTRA, eg. auto_increment, VIRTUAL GENERATED, INVISIBLE
+}
+
+// fallbackKey primary or unique key of information_schema.STATISTICS
+type fallbackKey struct {
+	Name    string
+	Columns []string
 }
 
-// buildFakeTable ...
-func buildFakeTable(db *sql.DB, table string) string {
-	var col, key string
-	var t []byte
-	var columns, primary []string
-	res, err := db.Query(fmt.Sprintf("SHOW COLUMNS FROM %s", table))
+// buildFallbackTable CREATE TABLE of table built from information_schema, used when SHOW CREATE TABLE can't parse
+func (r *Rebuilder) buildFallbackTable(db *sql.DB, database, table string) string {
+	var columns []fallbackColumn
+	res, err := db.Query(`SELECT COLUMN_NAME, COLUMN_TYPE, CHARACTER_SET_NAME, EXTRA
+FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, database, table)
 	if err != nil {
 		common.Log.Error(err.Error())
 		return ""
 	}
+	for res.Next() {
+		var col fallbackColumn
+		var charset sql.NullString
+		if err = res.Scan(&col.Name, &col.Type, &charset, &col.Extra); err != nil {
+			common.Log.Error(err.Error())
+			continue
+		}
+		col.Charset = charset.String
+		columns = append(columns, col)
+	}
+	res.Close()
+
+	// expression index parts have NULL COLUMN_NAME, skip these keys
+	var keys []fallbackKey
+	var skip = make(map[string]bool)
+	res, err = db.Query(`SELECT INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS
+WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 0 ORDER BY INDEX_NAME, SEQ_IN_INDEX`, database, table)
+	if err != nil {
+		common.Log.Error(err.Error())
+		return r.fallbackCreateTable(table, columns, keys)
+	}
 	defer res.Close()
 	for res.Next() {
-		res.Scan(&col, &t, &t, &key, &t, &t)
-		columns = append(columns, fmt.Sprintf("`%s` INT", col))
-		if key == "PRI" {
-			primary = append(primary, fmt.Sprintf("`%s`", col))
+		var name string
+		var col sql.NullString
+		if err = res.Scan(&name, &col); err != nil {
+			common.Log.Error(err.Error())
+			continue
+		}
+		if !col.Valid {
+			skip[name] = true
+			continue
+		}
+		if len(keys) == 0 || keys[len(keys)-1].Name != name {
+			keys = append(keys, fallbackKey{Name: name})
+		}
+		keys[len(keys)-1].Columns = append(keys[len(keys)-1].Columns, col.String)
+	}
+	var valid []fallbackKey
+	for _, key := range keys {
+		if !skip[key.Name] {
+			valid = append(valid, key)
+		}
+	}
+	return r.fallbackCreateTable(table, columns, valid)
+}
+
+// fallbackCreateTable CREATE TABLE in SHOW CREATE TABLE format, column types pingcap/parser can't parse use INT instead
+func (r *Rebuilder) fallbackCreateTable(table string, columns []fallbackColumn, keys []fallbackKey) string {
+	var defs []string
+	for _, col := range columns {
+		def := fmt.Sprintf("`%s` %s", col.Name, col.Type)
+		if col.Charset != "" {
+			def += " CHARACTER SET " + col.Charset
+		}
+		extra := strings.ToUpper(col.Extra)
+		// only generated flag is needed, expression may be the reason SHOW CREATE TABLE failed
+		if strings.Contains(extra, "VIRTUAL GENERATED") {
+			def += " GENERATED ALWAYS AS (NULL) VIRTUAL"
+		} else if strings.Contains(extra, "STORED GENERATED") {
+			def += " GENERATED ALWAYS AS (NULL) STORED"
+		}
+		if strings.Contains(extra, "INVISIBLE") {
+			def += " /*!80023 INVISIBLE */"
+		}
+		if _, err := binlog.ParseCreateTables("", fmt.Sprintf("CREATE TABLE `t` (\n  %s\n)", def), r.cfg.Global.Charset); err != nil {
+			def = fmt.Sprintf("`%s` INT", col.Name)
+		}
+		defs = append(defs, def)
+	}
+	for _, key := range keys {
+		cols := make([]string, len(key.Columns))
+		for i, c := range key.Columns {
+			cols[i] = fmt.Sprintf("`%s`", c)
+		}
+		if key.Name == "PRIMARY" {
+			defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(cols, ",")))
+		} else {
+			defs = append(defs, fmt.Sprintf("UNIQUE KEY `%s` (%s)", key.Name, strings.Join(cols, ",")))
 		}
 	}
-	return fmt.Sprintf("CREATE TABLE %s (%s %s);", table, strings.Join(columns, ","), fmt.Sprintf(", PRIMARY KEY (%s)", strings.Join(primary, ",")))
+	return fmt.Sprintf("CREATE TABLE `%s` (\n  %s\n)", table, strings.Join(defs, ",\n  "))
 }
 
 func onlyTable(table string) string {
@@ -15,10 +15,17 @@ package rebuild
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 	"github.com/kr/pretty"
+	"github.com/pingcap/parser/ast"
 )
 
 func TestLoadSchemaInfo(t *testing.T) {
@@ -28,27 +35,183 @@ func TestLoadSchemaInfo(t *testing.T) {
 }
 
 func TestLoadSchemaFromFile(t *testing.T) {
-	schemaFileOrg := common.Config.MySQL.SchemaFile
+	r := New(&common.Config, &common.MasterInfo, nil)
+	schemaFileOrg := r.cfg.MySQL.SchemaFile
 
-	common.Config.MySQL.SchemaFile = common.DevPath + "/test/schema.sql"
-	err := loadSchemaFromFile()
-	pretty.Println(err, Schemas)
+	r.cfg.MySQL.SchemaFile = common.DevPath + "/test/schema.sql"
+	err := r.loadSchemaFromFile()
+	pretty.Println(err, r.schemas)
 
-	common.Config.MySQL.SchemaFile = schemaFileOrg
+	r.cfg.MySQL.SchemaFile = schemaFileOrg
 }
 
 func TestLoadSchemaFromMySQL(t *testing.T) {
-	master := common.Config.MySQL.MasterInfo
+	r := New(&common.Config, &common.MasterInfo, nil)
+	master := r.cfg.MySQL.MasterInfo
 
-	common.Config.MySQL.MasterInfo = common.DevPath + "/etc/master.info"
+	r.cfg.MySQL.MasterInfo = common.DevPath + "/etc/master.info"
 	common.LoadMasterInfo()
-	err := loadSchemaFromMySQL()
-	pretty.Println(err, Schemas)
+	err := r.loadSchemaFromMySQL()
+	pretty.Println(err, r.schemas)
 
-	common.Config.MySQL.MasterInfo = master
+	r.cfg.MySQL.MasterInfo = master
+}
+
+func TestLoadSchemaDir(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	schemasOrg := r.schemas
+	schemaFileOrg := r.cfg.MySQL.SchemaFile
+	defer func() {
+		r.schemas = schemasOrg
+		r.cfg.MySQL.SchemaFile = schemaFileOrg
+		r.buildColumns()
+		r.buildPrimaryKeys()
+	}()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"shop/orders.sql":       "CREATE TABLE `orders` (`id` int, PRIMARY KEY (`id`));",
+		"shop/broken.sql":       "CREATE TABLE `broken` (`id` vector(3));",
+		"crm.user-schema.sql":   "CREATE TABLE `user` (`id` int, `name` varchar(10));",
+		"crm.user.00000.sql":    "INSERT INTO `user` VALUES (1, 'a');",
+		"any.sql":               "CREATE TABLE `anytb` (`id` int);",
+		"snapshot/tables.json":  `{"version": 1, "tables": [{"database": "log", "name": "access", "create": "CREATE TABLE access (id int)"}]}`,
+		"README.md":             "CREATE TABLE `ignored` (`id` int);",
+		"shop/use.sql":          "USE `other`; CREATE TABLE `v` (`id` int);",
+		"crm.v-schema-view.sql": "CREATE TABLE `v` (`id` int);",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	r.schemas = make(map[string]*ast.CreateTableStmt)
+	r.cfg.MySQL.SchemaFile = dir
+	if err := r.loadSchemaFromFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	var tables []string
+	for table := range r.schemas {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	want := "`%`.`anytb`,`crm`.`user`,`log`.`access`,`other`.`v`,`shop`.`orders`"
+	if got := strings.Join(tables, ","); got != want {
+		t.Errorf("tables want %s, got %s", want, got)
+	}
+	if table := r.SchemaTable("`db`.`anytb`"); table != "`%`.`anytb`" {
+		t.Errorf("table without database want `%%`.`anytb`, got %s", table)
+	}
+
+	// JSON snapshot load back the same tables
+	snapshot := filepath.Join(dir, "snapshot.json")
+	if err := r.SaveSchema(snapshot); err != nil {
+		t.Fatal(err.Error())
+	}
+	r.schemas = make(map[string]*ast.CreateTableStmt)
+	r.cfg.MySQL.SchemaFile = snapshot
+	if err := r.loadSchemaFromFile(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(r.schemas) != len(tables) || r.primaryKeys["`shop`.`orders`"][0] != "`id`" {
+		t.Errorf("snapshot want %d tables, got %d, %v", len(tables), len(r.schemas), r.primaryKeys)
+	}
+}
+
+func TestSaveSchema(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	schemasOrg := r.schemas
+	sourceOrg := r.schemaSource
+	schemaFileOrg := r.cfg.MySQL.SchemaFile
+	defer func() {
+		r.schemas = schemasOrg
+		r.schemaSource = sourceOrg
+		r.cfg.MySQL.SchemaFile = schemaFileOrg
+		r.buildColumns()
+		r.buildPrimaryKeys()
+	}()
+
+	r.schemas = make(map[string]*ast.CreateTableStmt)
+	if err := r.schemaAppend("", "CREATE TABLE `anytb` (`id` int);"); err != nil {
+		t.Fatal(err.Error())
+	}
+	r.cfg.MySQL.SchemaFile = common.DevPath + "/test/mysqldump.sql"
+	r.loadSchemaFromFile()
+	r.schemaSource.Source = "127.0.0.1:3306"
+	r.schemaSource.ServerVersion = "8.0.36"
+	r.schemaSource.GTIDExecuted = "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100,\n4e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"
+	r.schemaSource.Time = time.Date(2026, 10, 19, 10, 0, 0, 0, time.FixedZone("CST", 8*3600))
+
+	dir := t.TempDir()
+	err := common.GoldenDiff(func() {
+		if err := r.SaveSchema(filepath.Join(dir, "schema.sql")); err != nil {
+			t.Fatal(err.Error())
+		}
+		buf, _ := os.ReadFile(filepath.Join(dir, "schema.sql"))
+		fmt.Print(string(buf))
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// SQL file, directory and JSON snapshot load back the same tables
+	for _, path := range []string{filepath.Join(dir, "schema.sql"), filepath.Join(dir, "tables") + "/", filepath.Join(dir, "schema.json")} {
+		if err := r.SaveSchema(path); err != nil {
+			t.Fatal(err.Error())
+		}
+		r.schemas = make(map[string]*ast.CreateTableStmt)
+		r.cfg.MySQL.SchemaFile = path
+		if err := r.loadSchemaFromFile(); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(r.schemas) != 3 || r.schemas["`%`.`anytb`"] == nil || r.TableInfo("`shop`.`orders`").Columns[1].Charset != "gbk" {
+			t.Errorf("%s load back wrong tables: %v", path, r.schemas)
+		}
+	}
+}
+
+func TestFallbackCreateTable(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	columns := []fallbackColumn{
+		{Name: "my_row_id", Type: "bigint unsigned", Extra: "auto_increment INVISIBLE"},
+		{Name: "id", Type: "int(10) unsigned"},
+		{Name: "name", Type: "varchar(10)", Charset: "gbk"},
+		{Name: "status", Type: "enum('a','b')", Charset: "utf8mb4"},
+		{Name: "total", Type: "int", Extra: "STORED GENERATED"},
+		{Name: "v", Type: "vector(3)"},
+	}
+	keys := []fallbackKey{
+		{Name: "PRIMARY", Columns: []string{"my_row_id"}},
+		{Name: "uk_id", Columns: []string{"id", "name"}},
+	}
+	sql := r.fallbackCreateTable("tb", columns, keys)
+	stmts, err := binlog.ParseCreateTables("test", sql, "utf8mb4")
+	if err != nil {
+		t.Fatal(sql, err.Error())
+	}
+	table := binlog.NewTable(stmts[0])
+	if len(table.PrimaryKeys) != 1 || table.PrimaryKeys[0] != "my_row_id" {
+		t.Errorf("primary key want my_row_id, got %v", table.PrimaryKeys)
+	}
+	cols := table.Columns
+	if !cols[0].Invisible || !cols[0].Unsigned || !cols[1].Unsigned {
+		t.Errorf("my_row_id, id want unsigned, got %v, %v", cols[0], cols[1])
+	}
+	if cols[2].Charset != "gbk" || len(cols[3].Elems) != 2 || !cols[4].Generated {
+		t.Errorf("name, status, total columns wrong: %v, %v, %v", cols[2], cols[3], cols[4])
+	}
+	if cols[5].Name != "v" || cols[5].Type != "int(11)" {
+		t.Errorf("unknown type want int(11), got %s", cols[5].Type)
+	}
 }
 
 func TestOnlyTable(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
 	tables := []string{
 		"`db`.`tb`",
 		"tb",
@@ -56,10 +219,59 @@ func TestOnlyTable(t *testing.T) {
 
 	err := common.GoldenDiff(func() {
 		for _, table := range tables {
-			fmt.Println(onlyTable(table))
+			r.println(onlyTable(table))
 		}
 	}, t.Name(), update)
 	if nil != err {
 		t.Fatal(err)
 	}
 }
+
+func TestAppendColumns(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	columnsOrg, primaryKeysOrg := r.columns, r.primaryKeys
+	r.columns, r.primaryKeys = make(map[string][]string), make(map[string][]string)
+	defer func() { r.columns, r.primaryKeys = columnsOrg, primaryKeysOrg }()
+
+	stmts, errs := binlog.ParseSchema("db", "CREATE TABLE t1 (a int, b int, PRIMARY KEY (b)); CREATE TABLE t2 (c int)", "utf8mb4")
+	if len(errs) > 0 || len(stmts) != 2 {
+		t.Fatal(errs)
+	}
+	for _, stmt := range stmts {
+		r.appendColumns(stmt)
+		r.appendPrimaryKeys(stmt)
+	}
+	if strings.Join(r.columns["`db`.`t1`"], ",") != "`a`,`b`" || strings.Join(r.primaryKeys["`db`.`t1`"], ",") != "`b`" {
+		t.Errorf("t1 got %v, %v", r.columns["`db`.`t1`"], r.primaryKeys["`db`.`t1`"])
+	}
+	// no primary key, all columns as primary key
+	if strings.Join(r.primaryKeys["`db`.`t2`"], ",") != "`c`" {
+		t.Errorf("t2 got %v", r.primaryKeys["`db`.`t2`"])
+	}
+}
+
+func TestSchemaRetry(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	key := "`db`.`retry`"
+	defer delete(r.schemaRetry, key)
+
+	now := time.Now()
+	if !r.schemaRetryDue(key, now) {
+		t.Error("table never failed should load")
+	}
+	// wait doubles after each failure, at most schemaRetryMax
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if wait := r.schemaRetryFailed(key, now); wait != want {
+			t.Errorf("wait want %s, got %s", want, wait)
+		}
+	}
+	if r.schemaRetryDue(key, now.Add(3*time.Second)) || !r.schemaRetryDue(key, now.Add(4*time.Second)) {
+		t.Error("table should retry after 4s")
+	}
+	for i := 0; i < 10; i++ {
+		r.schemaRetryFailed(key, now)
+	}
+	if wait := r.schemaRetryFailed(key, now); wait != schemaRetryMax {
+		t.Errorf("wait want %s, got %s", schemaRetryMax, wait)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/charset"
+	"github.com/pingcap/parser/mysql"
+)
+
+// StatementContext collect INTVAR_EVENT, RAND_EVENT, USER_VAR_EVENT for the following QUERY_EVENT.
+// Called before filters, these events have no table or position of their own statement.
+func (r *Rebuilder) StatementContext(event *replication.BinlogEvent) {
+	switch event.Header.EventType {
+	case replication.INTVAR_EVENT:
+		ev := event.Event.(*replication.IntVarEvent)
+		switch ev.Type {
+		case replication.LAST_INSERT_ID:
+			r.pendingContext = append(r.pendingContext, fmt.Sprintf("SET LAST_INSERT_ID=%d;", ev.Value))
+		case replication.INSERT_ID:
+			r.pendingContext = append(r.pendingContext, fmt.Sprintf("SET INSERT_ID=%d;", ev.Value))
+		}
+	case replication.RAND_EVENT:
+		seed1, seed2, err := binlog.ParseRand(genericEventData(event))
+		if err != nil {
+			common.Log.Error("StatementContext Error: %s", err.Error())
+			return
+		}
+		r.pendingContext = append(r.pendingContext, fmt.Sprintf("SET @@RAND_SEED1=%d, @@RAND_SEED2=%d;", seed1, seed2))
+	case replication.USER_VAR_EVENT:
+		v, err := binlog.ParseUserVar(genericEventData(event))
+		if err != nil {
+			common.Log.Error("StatementContext Error: %s", err.Error())
+			return
+		}
+		r.pendingContext = append(r.pendingContext, fmt.Sprintf("SET @`%s`:=%s;", strings.ReplaceAll(v.Name, "`", "``"), v.SQL()))
+	case replication.QUERY_EVENT:
+		r.queryContext, r.pendingContext = r.pendingContext, nil
+	}
+}
+
+func genericEventData(event *replication.BinlogEvent) []byte {
+	if ev, ok := event.Event.(*replication.GenericEvent); ok {
+		return ev.Data
+	}
+	return nil
+}
+
+// sessionContext statements needed before QUERY_EVENT to replay it: USE, SET TIMESTAMP,
+// session variables from status vars which changed since last statement, then user variables, INSERT_ID, RAND seeds
+func (r *Rebuilder) sessionContext(event *replication.BinlogEvent) []string {
+	ev := event.Event.(*replication.QueryEvent)
+	var stmts []string
+	if db := string(ev.Schema); db != "" && !r.cfg.Rebuild.WithoutDBName {
+		db = r.cfg.RewriteDatabaseName(db)
+		if r.sessionVars["database"] != db {
+			r.sessionVars["database"] = db
+			stmts = append(stmts, fmt.Sprintf("USE `%s`;", strings.ReplaceAll(db, "`", "``")))
+		}
+	}
+
+	status, err := binlog.ParseQueryStatus(ev.StatusVars)
+	if err != nil {
+		common.Log.Warn("sessionContext status vars Error: %s", err.Error())
+	}
+	timestamp := fmt.Sprint(event.Header.Timestamp)
+	if status.HasMicroseconds {
+		timestamp = fmt.Sprintf("%d.%06d", event.Header.Timestamp, status.Microseconds)
+	}
+	if r.sessionVars["timestamp"] != timestamp {
+		r.sessionVars["timestamp"] = timestamp
+		stmts = append(stmts, fmt.Sprintf("SET TIMESTAMP=%s;", timestamp))
+	}
+
+	var vars []string
+	for _, v := range sessionStatusVars(ev.SlaveProxyID, status) {
+		if r.sessionVars[v[0]] != v[1] {
+			r.sessionVars[v[0]] = v[1]
+			vars = append(vars, fmt.Sprintf("@@session.%s=%s", v[0], v[1]))
+		}
+	}
+	if len(vars) > 0 {
+		stmts = append(stmts, fmt.Sprintf("SET %s;", strings.Join(vars, ", ")))
+	}
+	return append(stmts, r.queryContext...)
+}
+
+// sessionStatusVars session variable name, value pairs of status vars in order, variables not recorded are omitted
+func sessionStatusVars(threadID uint32, s *binlog.QueryStatus) [][2]string {
+	vars := [][2]string{{"pseudo_thread_id", fmt.Sprint(threadID)}}
+	if s.HasFlags2 {
+		flag := func(name string, on bool) {
+			value := "0"
+			if on {
+				value = "1"
+			}
+			vars = append(vars, [2]string{name, value})
+		}
+		flag("foreign_key_checks", s.Flags2&binlog.OptionNoForeignKeyChecks == 0)
+		flag("sql_auto_is_null", s.Flags2&binlog.OptionAutoIsNull > 0)
+		flag("unique_checks", s.Flags2&binlog.OptionRelaxedUniqueChecks == 0)
+		flag("autocommit", s.Flags2&binlog.OptionNotAutocommit == 0)
+	}
+	if s.HasSQLMode {
+		// numeric sql_mode like mysqlbinlog, names differ between versions
+		vars = append(vars, [2]string{"sql_mode", fmt.Sprint(s.SQLMode)})
+	}
+	vars = append(vars,
+		[2]string{"auto_increment_increment", fmt.Sprint(s.AutoIncrementIncrement)},
+		[2]string{"auto_increment_offset", fmt.Sprint(s.AutoIncrementOffset)},
+	)
+	if s.ClientCollation > 0 {
+		cs := fmt.Sprint(s.ClientCollation)
+		if name := binlog.CollationCharset(uint64(s.ClientCollation)); name != "" {
+			cs = name
+		}
+		vars = append(vars,
+			[2]string{"character_set_client", cs},
+			[2]string{"collation_connection", collationName(s.ConnectionCollation)},
+			[2]string{"collation_server", collationName(s.ServerCollation)},
+		)
+	}
+	if s.TimeZone != "" {
+		vars = append(vars, [2]string{"time_zone", fmt.Sprintf("'%s'", strings.ReplaceAll(s.TimeZone, "'", "''"))})
+	}
+	vars = append(vars, [2]string{"lc_time_names", fmt.Sprint(s.LcTimeNames)})
+	database := "DEFAULT"
+	if s.DatabaseCollation > 0 {
+		database = collationName(s.DatabaseCollation)
+	}
+	vars = append(vars, [2]string{"collation_database", database})
+	if s.HasExplicitDefaultsForTimestamp {
+		value := "0"
+		if s.ExplicitDefaultsForTimestamp {
+			value = "1"
+		}
+		vars = append(vars, [2]string{"explicit_defaults_for_timestamp", value})
+	}
+	if s.DefaultCollationForUTF8MB4 > 0 {
+		vars = append(vars, [2]string{"default_collation_for_utf8mb4", collationName(s.DefaultCollationForUTF8MB4)})
+	}
+	return vars
+}
+
+// collationName collation name of id, id itself if unknown which MySQL accepts as well
+func collationName(id uint16) string {
+	if _, name, err := charset.GetCharsetInfoByID(int(id)); err == nil {
+		return name
+	}
+	return fmt.Sprint(id)
+}
+
+// queryTableStat count statement DML into tableStats by type and table, rows are unknown in statement format
+func (r *Rebuilder) queryTableStat(sql, database string) {
+	if IsTransactionQuery(sql) {
+		return
+	}
+	stmts, err := TiParse(sql, r.cfg.Global.Charset, mysql.Charsets[r.cfg.Global.Charset])
+	if err != nil {
+		r.verboseVerbose("-- [DEBUG] queryTableStat parse error: %s", err.Error())
+		return
+	}
+	for _, stmt := range stmts {
+		var t string
+		switch s := stmt.(type) {
+		case *ast.InsertStmt:
+			t = "insert"
+			if s.IsReplace {
+				t = "replace"
+			}
+		case *ast.UpdateStmt:
+			t = "update"
+		case *ast.DeleteStmt:
+			t = "delete"
+		default:
+			continue
+		}
+		for _, table := range targetTables(stmt, database) {
+			table = r.RewriteTable(r.LogicalTable(table))
+			if r.tableStats[table] == nil {
+				r.tableStats[table] = make(map[string]int64)
+			}
+			r.tableStats[table][t]++
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestStatementContext(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	pluginOrg := r.cfg.Rebuild.Plugin
+	sessionVarsOrg := r.sessionVars
+	defer func() {
+		r.cfg.Rebuild.Plugin = pluginOrg
+		r.sessionVars = sessionVarsOrg
+	}()
+	r.cfg.Rebuild.Plugin = "sql"
+	r.sessionVars = make(map[string]string)
+
+	query := func(timestamp uint32, schema, sql string, vars []byte) *replication.BinlogEvent {
+		return &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT, Timestamp: timestamp},
+			Event:  &replication.QueryEvent{SlaveProxyID: 10, Schema: []byte(schema), Query: []byte(sql), StatusVars: vars},
+		}
+	}
+	// flags2, sql_mode, charset utf8mb4_general_ci
+	vars := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0x20, 0x4e, 0, 0, 0, 0, 4, 45, 0, 45, 0, 45, 0}
+	userVar := binary.LittleEndian.AppendUint32(nil, 1)
+	userVar = append(userVar, 'v', 0, 2, 63, 0, 0, 0, 8, 0, 0, 0)
+	userVar = binary.LittleEndian.AppendUint64(userVar, 7)
+	events := []*replication.BinlogEvent{
+		query(1640612573, "test", "BEGIN", vars),
+		{
+			Header: &replication.EventHeader{EventType: replication.INTVAR_EVENT},
+			Event:  &replication.IntVarEvent{Type: replication.INSERT_ID, Value: 100},
+		},
+		{
+			Header: &replication.EventHeader{EventType: replication.USER_VAR_EVENT},
+			Event:  &replication.GenericEvent{Data: userVar},
+		},
+		query(1640612573, "test", "INSERT INTO tb (b) VALUES (@v)", vars),
+		// only changed context is output
+		query(1640612573, "test", "UPDATE tb SET b = 1 WHERE a = 1", vars),
+		query(1640612574, "db", "DELETE FROM tb WHERE a = 1", vars[:14]),
+		query(1640612574, "db", "COMMIT", vars),
+	}
+	err := common.GoldenDiff(func() {
+		for _, event := range events {
+			r.StatementContext(event)
+			if event.Header.EventType == replication.QUERY_EVENT {
+				r.QueryRebuild(event)
+			}
+		}
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryTableStat(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	tableStatsOrg := r.tableStats
+	defer func() { r.tableStats = tableStatsOrg }()
+	r.tableStats = make(map[string]map[string]int64)
+
+	for _, sql := range []string{
+		"INSERT INTO tb VALUES (1)",
+		"REPLACE INTO db.tb SELECT * FROM tb2",
+		"UPDATE tb JOIN tb2 ON tb.a = tb2.a SET tb.b = 1",
+		"DELETE tb FROM tb JOIN tb2 ON tb.a = tb2.a",
+		"DELETE FROM tb WHERE a IN (SELECT a FROM tb3)",
+		"CREATE TABLE tb4 (a int)",
+		"BEGIN",
+	} {
+		r.queryTableStat(sql, "test")
+	}
+	want := map[string]map[string]int64{
+		"`test`.`tb`": {"insert": 1, "update": 1, "delete": 2},
+		"`db`.`tb`":   {"replace": 1},
+	}
+	if len(r.tableStats) != len(want) {
+		t.Fatalf("want %v, got %v", want, r.tableStats)
+	}
+	for table, stats := range want {
+		for k, v := range stats {
+			if r.tableStats[table][k] != v {
+				t.Errorf("%s %s want %d, got %d", table, k, v, r.tableStats[table][k])
+			}
+		}
+	}
+}
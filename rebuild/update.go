@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/LianjiaTech/lightning/binlog"
 	"github.com/LianjiaTech/lightning/common"
 
 	"github.com/go-mysql-org/go-mysql/replication"
@@ -24,273 +25,330 @@ import (
 )
 
 // UpdateRebuild ...
-func UpdateRebuild(event *replication.BinlogEvent) string {
-	switch common.Config.Rebuild.Plugin {
+func (r *Rebuilder) UpdateRebuild(event *replication.BinlogEvent) string {
+	switch r.cfg.Rebuild.Plugin {
 	case "sql":
-		UpdateQuery(event)
+		r.UpdateQuery(event)
 	case "flashback":
-		UpdateRollbackQuery(event)
+		r.UpdateRollbackQuery(event)
 	case "stat":
-		UpdateStat(event)
+		r.UpdateStat(event)
 	case "lua":
-		UpdateLua(event)
+		r.UpdateLua(event)
+	case "wasm":
+		r.RowsWasm(event)
 	default:
 	}
 	return ""
 }
 
 // UpdateQuery ...
-func UpdateQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) UpdateQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	values := r.RowsValues(ev)
 
-	common.Verbose("-- [DEBUG] event: update, table: %s, rows: %d\n", table, len(values))
+	r.verbose("-- [DEBUG] event: update, table: %s, rows: %d\n", table, len(values))
 
-	if common.Config.Rebuild.Replace {
-		var insertValues [][]string
-		for odd, value := range values {
-			if odd%2 == 1 {
-				insertValues = append(insertValues, value)
+	if r.cfg.Rebuild.Replace {
+		r.replaceQuery(table, values, 1, r.updateQuery)
+	} else {
+		r.updateQuery(table, values)
+	}
+}
+
+// replaceQuery REPLACE INTO with after image (1) or before image (0) of each update row.
+// REPLACE writes the whole row, rows with columns not logged or partial JSON fall back to update, order is kept.
+func (r *Rebuilder) replaceQuery(table string, values [][]binlog.Value, image int, update func(string, [][]binlog.Value)) {
+	var rows, pairs [][]binlog.Value
+	flush := func() {
+		if len(rows) > 0 {
+			r.insertQuery(table, rows)
+			rows = nil
+		}
+		if len(pairs) > 0 {
+			update(table, pairs)
+			pairs = nil
+		}
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		if completeImage(values[i+image]) {
+			if len(pairs) > 0 {
+				flush()
+			}
+			rows = append(rows, values[i+image])
+		} else {
+			if len(rows) > 0 {
+				flush()
 			}
+			pairs = append(pairs, values[i], values[i+1])
+		}
+	}
+	flush()
+}
+
+// completeImage every column is logged with its full value
+func completeImage(row []binlog.Value) bool {
+	for _, v := range row {
+		if v.Missing || v.IsPartial() {
+			return false
 		}
-		insertQuery(table, insertValues)
-	} else {
-		updateQuery(table, values)
 	}
+	return true
 }
 
-func updateQuery(table string, values [][]string) {
+func (r *Rebuilder) updateQuery(table string, values [][]binlog.Value) {
 	var where []string
 	var set []string
 
 	var updatePrefix = "UPDATE"
-	if common.Config.Rebuild.ForeachTime && common.Config.Rebuild.CurrentEventTime != "" {
-		updatePrefix = fmt.Sprintf(`/* %s */%s`, common.Config.Rebuild.CurrentEventTime, updatePrefix)
+	if r.cfg.Rebuild.ForeachTime && r.eventTime != "" {
+		updatePrefix = fmt.Sprintf(`/* %s */%s`, r.eventTime, updatePrefix)
 	}
 
-	// for common.Config.Rebuild.WithoutDBName
-	shortTableName := onlyTable(table)
+	// -logical-table, -rewrite-db, -rewrite-tables, -without-db-name
+	name := r.OutputTable(table)
+	updatePrefix = r.originComment(table) + updatePrefix
+	table = r.SchemaTable(table)
+	info := r.TableInfo(table)
 
-	if ok := PrimaryKeys[table]; ok != nil {
+	if ok := r.primaryKeys[table]; ok != nil {
 		// 0 是 where 条件， 1 是 set 值
-		for odd, value := range values {
+		for odd, row := range values {
 			if odd%2 == 0 {
 				where = []string{}
 				set = []string{}
-				for _, col := range PrimaryKeys[table] {
-					for i, c := range Columns[table] {
+				for _, col := range r.primaryKeys[table] {
+					for i, c := range r.columns[table] {
 						if c == col {
-							if value[i] == "NULL" {
+							if row[i].IsNull() {
 								where = append(where, fmt.Sprintf("%s IS NULL", col))
 							} else {
-								where = append(where, fmt.Sprintf("%s = %s", col, value[i]))
+								where = append(where, fmt.Sprintf("%s = %s", col, r.sqlValue(row[i])))
 							}
 						}
 					}
 				}
 			} else {
-				if len(common.Config.Rebuild.IgnoreColumns) > 0 {
-					for i, col := range Columns[table] {
+				if len(r.cfg.Rebuild.IgnoreColumns) > 0 {
+					for i, col := range r.columns[table] {
 						ignore := false
-						for _, c := range common.Config.Rebuild.IgnoreColumns {
+						for _, c := range r.cfg.Rebuild.IgnoreColumns {
 							if c == strings.Trim(col, "`") {
 								ignore = true
 							}
 						}
-						if !ignore {
-							set = append(set, fmt.Sprintf("%s = %s", col, value[i]))
+						if !ignore && !row[i].Missing && info.Writable(i) {
+							set = append(set, fmt.Sprintf("%s = %s", col, r.sqlValue(row[i])))
 						}
 					}
 				} else {
-					for i, c := range Columns[table] {
-						set = append(set, fmt.Sprintf("%s = %s", c, value[i]))
+					for i, c := range r.columns[table] {
+						// binlog_row_image MINIMAL only log changed columns, generated and invisible columns are not written
+						if !row[i].Missing && info.Writable(i) {
+							set = append(set, fmt.Sprintf("%s = %s", c, r.sqlValue(row[i])))
+						}
 					}
 				}
 
-				if common.Config.Rebuild.WithoutDBName {
-					fmt.Printf("%s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, shortTableName, strings.Join(set, ", "), strings.Join(where, " AND "))
-				} else {
-					fmt.Printf("%s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, table, strings.Join(set, ", "), strings.Join(where, " AND "))
-				}
+				r.printf("%s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, name, strings.Join(set, ", "), strings.Join(where, " AND "))
 			}
 		}
 	} else {
-		for odd, value := range values {
+		for odd, row := range values {
 			if odd%2 == 0 {
 				where = []string{}
 				set = []string{}
-				for i, v := range value {
-					if v == "NULL" {
+				for i, v := range row {
+					// partial JSON is not the column value
+					if v.Missing || v.IsPartial() {
+						continue
+					}
+					if v.IsNull() {
 						where = append(where, fmt.Sprintf("@%d IS NULL", i))
 					} else {
-						where = append(where, fmt.Sprintf("@%d = %s", i, v))
+						where = append(where, fmt.Sprintf("@%d = %s", i, r.sqlValue(v)))
 					}
 				}
 			} else {
-				for i, v := range value {
-					set = append(set, fmt.Sprintf("@%d = %s", i, v))
-				}
-				if common.Config.Rebuild.WithoutDBName {
-					fmt.Printf("-- %s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, shortTableName, strings.Join(set, ", "), strings.Join(where, " AND "))
-				} else {
-					fmt.Printf("-- %s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, table, strings.Join(set, ", "), strings.Join(where, " AND "))
+				for i, v := range row {
+					if !v.Missing {
+						set = append(set, fmt.Sprintf("@%d = %s", i, r.sqlValue(v)))
+					}
 				}
+				r.printf("-- %s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, name, strings.Join(set, ", "), strings.Join(where, " AND "))
 			}
 		}
 	}
 }
 
 // UpdateRollbackQuery ...
-func UpdateRollbackQuery(event *replication.BinlogEvent) {
+func (r *Rebuilder) UpdateRollbackQuery(event *replication.BinlogEvent) {
 	var table string
 	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(r), "\n")[0])
+		if err := recover(); err != nil {
+			r.printf("-- Table: %s, Error: %s\n", table, strings.Split(fmt.Sprint(err), "\n")[0])
 		}
 	}()
 	table = RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	if r.flashbackRefused(table, ev) {
+		return
+	}
+	values := r.RowsValues(ev)
 
-	if common.Config.Rebuild.Replace {
-		var insertValues [][]string
-		for odd, value := range values {
-			if odd%2 == 0 {
-				insertValues = append(insertValues, value)
-			}
-		}
-		insertQuery(table, insertValues)
+	if r.cfg.Rebuild.Replace {
+		r.replaceQuery(table, values, 0, r.updateRollbackQuery)
 	} else {
-		updateRollbackQuery(table, values)
+		r.updateRollbackQuery(table, values)
 	}
 }
 
-func updateRollbackQuery(table string, values [][]string) {
+func (r *Rebuilder) updateRollbackQuery(table string, values [][]binlog.Value) {
 	var where []string
 	var set []string
 
-	if ok := PrimaryKeys[table]; ok != nil {
-		for odd, value := range values {
+	var updatePrefix = "UPDATE"
+	// -logical-table, -rewrite-db, -rewrite-tables, -without-db-name
+	name := r.OutputTable(table)
+	updatePrefix = r.originComment(table) + updatePrefix
+	table = r.SchemaTable(table)
+	info := r.TableInfo(table)
+
+	if ok := r.primaryKeys[table]; ok != nil {
+		for odd, row := range values {
 			if odd%2 == 0 {
 				where = []string{}
 				set = []string{}
-				if len(common.Config.Rebuild.IgnoreColumns) > 0 {
-					for i, col := range Columns[table] {
+				if len(r.cfg.Rebuild.IgnoreColumns) > 0 {
+					for i, col := range r.columns[table] {
 						ignore := false
-						for _, c := range common.Config.Rebuild.IgnoreColumns {
+						for _, c := range r.cfg.Rebuild.IgnoreColumns {
 							if c == strings.Trim(col, "`") {
 								ignore = true
 							}
 						}
-						if !ignore {
-							set = append(set, fmt.Sprintf("%s = %s", col, value[i]))
+						if !ignore && !row[i].Missing && info.Writable(i) {
+							set = append(set, fmt.Sprintf("%s = %s", col, r.sqlValue(row[i])))
 						}
 					}
 				} else {
-					for i, c := range Columns[table] {
-						set = append(set, fmt.Sprintf("%s = %s", c, value[i]))
+					for i, c := range r.columns[table] {
+						// binlog_row_image MINIMAL only log changed columns, generated and invisible columns are not written
+						if !row[i].Missing && info.Writable(i) {
+							set = append(set, fmt.Sprintf("%s = %s", c, r.sqlValue(row[i])))
+						}
 					}
 				}
 			} else {
-				for _, col := range PrimaryKeys[table] {
-					for i, c := range Columns[table] {
+				for _, col := range r.primaryKeys[table] {
+					for i, c := range r.columns[table] {
 						if c == col {
-							if value[i] == "NULL" {
+							// binlog_row_image MINIMAL may not log unchanged key in after image, take it from before image
+							v := row[i]
+							if v.Missing {
+								v = values[odd-1][i]
+							}
+							if v.IsNull() {
 								where = append(where, fmt.Sprintf("%s IS NULL", col))
 							} else {
-								where = append(where, fmt.Sprintf("%s = %s", col, value[i]))
+								where = append(where, fmt.Sprintf("%s = %s", col, r.sqlValue(v)))
 							}
 						}
 					}
 				}
-				fmt.Printf("UPDATE %s SET %s WHERE %s LIMIT 1;\n", table, strings.Join(set, ", "), strings.Join(where, " AND "))
+				r.printf("%s %s SET %s WHERE %s LIMIT 1;\n", updatePrefix, name, strings.Join(set, ", "), strings.Join(where, " AND "))
 			}
 		}
 	} else {
-		for odd, value := range values {
+		for odd, row := range values {
 			if odd%2 == 0 {
 				where = []string{}
 				set = []string{}
-				for i, v := range value {
-					set = append(set, fmt.Sprintf("@%d = %s", i, v))
+				for i, v := range row {
+					if !v.Missing {
+						set = append(set, fmt.Sprintf("@%d = %s", i, r.sqlValue(v)))
+					}
 				}
 			} else {
-				for i, v := range value {
-					if v == "NULL" {
+				for i, v := range row {
+					// partial JSON is not the column value
+					if v.Missing || v.IsPartial() {
+						continue
+					}
+					if v.IsNull() {
 						where = append(where, fmt.Sprintf("@%d IS NULL", i))
 					} else {
-						where = append(where, fmt.Sprintf("@%d = %s", i, v))
+						where = append(where, fmt.Sprintf("@%d = %s", i, r.sqlValue(v)))
 					}
 				}
-				fmt.Printf("-- UPDATE %s SET %s WHERE %s  LIMIT 1;\n", table, strings.Join(set, ", "), strings.Join(where, " AND "))
+				r.printf("-- %s %s SET %s WHERE %s  LIMIT 1;\n", updatePrefix, name, strings.Join(set, ", "), strings.Join(where, " AND "))
 			}
 		}
 	}
 }
 
 // UpdateStat ...
-func UpdateStat(event *replication.BinlogEvent) {
-	table := RowEventTable(event)
-	if TableStats[table] != nil {
-		TableStats[table]["update"]++
+func (r *Rebuilder) UpdateStat(event *replication.BinlogEvent) {
+	table := r.RewriteTable(r.LogicalTable(RowEventTable(event)))
+	if r.tableStats[table] != nil {
+		r.tableStats[table]["update"]++
 	} else {
-		TableStats[table] = map[string]int64{"update": 1}
+		r.tableStats[table] = map[string]int64{"update": 1}
 	}
 
-	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
-	if RowsStats[table] != nil {
-		RowsStats[table]["update"] += int64(len(values))
+	rows := int64(len(event.Event.(*replication.RowsEvent).Rows))
+	if r.rowsStats[table] != nil {
+		r.rowsStats[table]["update"] += rows
 	} else {
-		RowsStats[table] = map[string]int64{"update": int64(len(values))}
+		r.rowsStats[table] = map[string]int64{"update": rows}
 	}
 }
 
 // UpdateLua ...
-func UpdateLua(event *replication.BinlogEvent) {
-	if common.Config.Rebuild.LuaScript == "" || event == nil {
-		return
-	}
+func (r *Rebuilder) UpdateLua(event *replication.BinlogEvent) {
+	r.luaEach(event, func() { r.updateLua(event) })
+}
+
+func (r *Rebuilder) updateLua(event *replication.BinlogEvent) {
 
 	table := RowEventTable(event)
 	ev := event.Event.(*replication.RowsEvent)
-	values := BuildValues(ev)
+	var values [][]string
+	if r.luaCompatGlobals() {
+		values = r.BuildValues(ev)
+	}
 
 	// lua function
+	fn, ok := r.luaFunction("UpdateRewrite")
+	if !ok {
+		return
+	}
 	f := lua.P{
-		Fn:      Lua.GetGlobal("UpdateRewrite"),
+		Fn:      fn,
 		NRet:    0,
 		Protect: true,
 	}
-	// lua value
-	v := lua.LString(table)
-	var where, set []string
-	for odd, value := range values {
-		if odd%2 == 0 {
-			where = []string{}
-			set = []string{}
-			for _, v := range value {
-				where = append(where, v)
-			}
-		} else {
-			for _, v := range value {
-				set = append(set, v)
-			}
-
-			LuaStringList("GoValuesWhere", where)
-			LuaStringList("GoValuesSet", set)
-
-			if err := Lua.CallByParam(f, v); err != nil {
-				common.Log.Error(err.Error())
-				return
+	// lua value: table name, row table with before, after image
+	v := lua.LString(r.OutputTable(table))
+	for i := 0; i+1 < len(ev.Rows); i += 2 {
+		if r.luaCompatGlobals() {
+			r.LuaStringList("GoValuesWhere", values[i])
+			r.LuaStringList("GoValuesSet", values[i+1])
+		}
+		if err := r.luaCall(f, v, r.luaRowTable(event, ev.Rows[i:i+2])); err != nil {
+			common.Log.Error(err.Error())
+			// -lua-violation skip the row
+			if _, ok := err.(*luaBudgetError); ok {
+				continue
 			}
+			return
 		}
 	}
 }
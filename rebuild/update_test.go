@@ -12,3 +12,52 @@
  */
 
 package rebuild
+
+import (
+	"testing"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// TestUpdateMinimalImage binlog_row_image MINIMAL: flashback WHERE takes key from before image,
+// -replace falls back to UPDATE for rows not logged completely
+func TestUpdateMinimalImage(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	replaceOrg := r.cfg.Rebuild.Replace
+	defer func() {
+		r.cfg.Rebuild.Replace = replaceOrg
+	}()
+
+	err := r.schemaAppend("test", "CREATE TABLE `minimal` (`id` int NOT NULL, `a` int, `b` int, PRIMARY KEY (`id`))")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r.buildColumns()
+	r.buildPrimaryKeys()
+
+	// missing columns are nil in row
+	row := func(id, a, b interface{}, missing ...int) []binlog.Value {
+		v := binlog.RowValues(r.TableInfo("`test`.`minimal`"),
+			[]byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONG},
+			[]interface{}{id, a, b})
+		for _, i := range missing {
+			v[i].Missing = true
+		}
+		return v
+	}
+	minimal := [][]binlog.Value{row(int32(1), nil, nil, 1, 2), row(nil, int32(2), nil, 0, 2)}
+	full := [][]binlog.Value{row(int32(2), int32(1), int32(1)), row(int32(2), int32(3), int32(1))}
+
+	err = common.GoldenDiff(func() {
+		r.cfg.Rebuild.Replace = false
+		r.updateRollbackQuery("`test`.`minimal`", minimal)
+		r.cfg.Rebuild.Replace = true
+		r.replaceQuery("`test`.`minimal`", append(append([][]binlog.Value{}, full...), minimal...), 1, r.updateQuery)
+	}, t.Name(), update)
+	if nil != err {
+		t.Fatal(err)
+	}
+}
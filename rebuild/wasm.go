@@ -0,0 +1,316 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/LianjiaTech/lightning/binlog"
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmEvent event passed into wasm module as JSON, binary values encoded as base64
+type wasmEvent struct {
+	Type        string                 `json:"type"`
+	EventType   string                 `json:"event_type"`
+	Timestamp   uint32                 `json:"timestamp"`
+	ServerID    uint32                 `json:"server_id"`
+	LogPos      uint32                 `json:"log_pos"`
+	GTID        string                 `json:"gtid"`
+	ThreadID    uint32                 `json:"thread_id"`
+	Table       string                 `json:"table,omitempty"`
+	Schema      string                 `json:"schema,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Columns     []string               `json:"columns,omitempty"`
+	PrimaryKeys []string               `json:"primary_keys,omitempty"`
+	Before      map[string]interface{} `json:"before,omitempty"`
+	After       map[string]interface{} `json:"after,omitempty"`
+	Types       map[string]string      `json:"types,omitempty"`
+	Query       string                 `json:"query,omitempty"`
+	Tables      []string               `json:"tables,omitempty"`
+	Xid         uint64                 `json:"xid,omitempty"`
+}
+
+// LoadWasmModule instantiate -wasm-module without file system, network, environment access
+func (r *Rebuilder) LoadWasmModule() error {
+	if r.cfg.Rebuild.Plugin != "wasm" {
+		return nil
+	}
+	if err := r.loadWasmModule(r.cfg.Rebuild.WasmModule); err != nil {
+		return fmt.Errorf("wasm module %s load failed: %s", r.cfg.Rebuild.WasmModule, err.Error())
+	}
+	r.wasmCall("init", nil)
+	return r.err
+}
+
+func (r *Rebuilder) loadWasmModule(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if limit := r.cfg.Rebuild.WasmMemoryLimit; limit > 0 {
+		// 64KiB per page
+		config = config.WithMemoryLimitPages(uint32(limit) * 16)
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, config)
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	_, err = rt.NewHostModuleBuilder("lightning").
+		NewFunctionBuilder().WithFunc(r.wasmEmit).Export("emit").
+		NewFunctionBuilder().WithFunc(wasmLog).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		rt.Close(ctx)
+		return err
+	}
+
+	compiled, err := rt.CompileModule(ctx, buf)
+	if err != nil {
+		rt.Close(ctx)
+		return err
+	}
+	// reactor module initialize only, no main function
+	module, err := rt.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().
+		WithName("plugin").
+		WithStartFunctions("_initialize").
+		WithStdout(r.Output()).
+		WithStderr(os.Stderr))
+	if err != nil {
+		rt.Close(ctx)
+		return err
+	}
+	if module.ExportedFunction("alloc") == nil || module.Memory() == nil {
+		rt.Close(ctx)
+		return fmt.Errorf("wasm module should export memory and alloc(size i32) i32")
+	}
+	r.wasm.runtime, r.wasm.module = rt, module
+	return nil
+}
+
+// wasmRead read bytes from module memory
+func wasmRead(m api.Module, ptr, size uint32) []byte {
+	buf, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		common.Log.Error("wasm memory read out of range, ptr: %d, size: %d", ptr, size)
+		return nil
+	}
+	return buf
+}
+
+// wasmEmit lightning.emit(ptr, len) output one record
+func (r *Rebuilder) wasmEmit(_ context.Context, m api.Module, ptr, size uint32) {
+	r.println(string(wasmRead(m, ptr, size)))
+}
+
+// wasmLog lightning.log(level, ptr, len) write lightning log, level: 0 debug, 1 info, 2 warn, 3 error
+func wasmLog(_ context.Context, m api.Module, level, ptr, size uint32) {
+	msg := string(wasmRead(m, ptr, size))
+	switch level {
+	case 0:
+		common.Log.Debug("[wasm] %s", msg)
+	case 1:
+		common.Log.Info("[wasm] %s", msg)
+	case 2:
+		common.Log.Warn("[wasm] %s", msg)
+	default:
+		common.Log.Error("[wasm] %s", msg)
+	}
+}
+
+// wasmCall call exported function with payload written into module memory, function not exported will be skipped.
+// Module closed by -wasm-timeout can't go on, exit with master.info position.
+func (r *Rebuilder) wasmCall(name string, payload []byte) {
+	module := r.wasm.module
+	if module == nil || r.err != nil {
+		return
+	}
+	fn := module.ExportedFunction(name)
+	if fn == nil {
+		return
+	}
+
+	ctx := context.Background()
+	if d := r.cfg.Rebuild.WasmTimeoutDuration; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	var err error
+	if payload == nil {
+		_, err = fn.Call(ctx)
+	} else {
+		err = wasmCallPayload(ctx, module, fn, payload)
+	}
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		r.err = fmt.Errorf("wasm %s timeout, master.info position %s:%d, %s", name, r.master.MasterLogFile, r.master.MasterLogPos, err.Error())
+		return
+	}
+	common.Log.Error("wasm %s Error: %s", name, err.Error())
+}
+
+func wasmCallPayload(ctx context.Context, module api.Module, fn api.Function, payload []byte) error {
+	res, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(payload)))
+	if err != nil {
+		return err
+	}
+	ptr := uint32(res[0])
+	if !module.Memory().Write(ptr, payload) {
+		return fmt.Errorf("alloc return out of range memory %d", ptr)
+	}
+	_, err = fn.Call(ctx, uint64(ptr), uint64(len(payload)))
+	// module keep allocated buffer until free
+	if free := module.ExportedFunction("free"); free != nil && err == nil {
+		_, err = free.Call(ctx, uint64(ptr))
+	}
+	return err
+}
+
+// wasmCallEvent serialize event and call exported function
+func (r *Rebuilder) wasmCallEvent(name string, e *wasmEvent) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		common.Log.Error("wasm %s Error: %s", name, err.Error())
+		return
+	}
+	r.wasmCall(name, buf)
+}
+
+// newWasmEvent event header, GTID info
+func (r *Rebuilder) newWasmEvent(event *replication.BinlogEvent) *wasmEvent {
+	header := event.Header
+	return &wasmEvent{
+		Type:      luaEventType(event),
+		EventType: header.EventType.String(),
+		Timestamp: header.Timestamp,
+		ServerID:  header.ServerID,
+		LogPos:    header.LogPos,
+		GTID:      r.currentGTID,
+		ThreadID:  r.currentThreadID,
+	}
+}
+
+// wasmRowImage one row image keyed by column name, with value kinds
+func wasmRowImage(names []string, row []binlog.Value) (map[string]interface{}, map[string]string) {
+	values := make(map[string]interface{}, len(row))
+	kinds := make(map[string]string, len(row))
+	for i, v := range row {
+		values[names[i]] = v
+		_, kinds[names[i]] = v.Native()
+	}
+	return values, kinds
+}
+
+// RowsWasm call wasm on_row(ptr, len) for each row of rows event
+func (r *Rebuilder) RowsWasm(event *replication.BinlogEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			common.Log.Error("RowsWasm Table: %s, Error: %s", RowEventTable(event), strings.Split(fmt.Sprint(err), "\n")[0])
+		}
+	}()
+	if r.wasm.module == nil || r.wasm.module.ExportedFunction("on_row") == nil {
+		return
+	}
+
+	ev := event.Event.(*replication.RowsEvent)
+	table := RowEventTable(event)
+	names := r.rowColumnNames(table, int(ev.ColumnCount))
+	for _, row := range ev.Rows {
+		for len(names) < len(row) {
+			names = append(names, fmt.Sprintf("@%d", len(names)))
+		}
+	}
+	var keys []string
+	for _, key := range r.primaryKeys[r.SchemaTable(table)] {
+		keys = append(keys, strings.Trim(key, "`"))
+	}
+
+	values := r.RowsValues(ev)
+	step := 1
+	if luaEventType(event) == "update" {
+		step = 2
+	}
+	for i := 0; i+step <= len(ev.Rows); i += step {
+		e := r.newWasmEvent(event)
+		e.Table = r.OutputTable(table)
+		e.Schema, e.Name = string(ev.Table.Schema), string(ev.Table.Table)
+		e.Columns, e.PrimaryKeys = names, keys
+		switch e.Type {
+		case "insert":
+			e.After, e.Types = wasmRowImage(names, values[i])
+		case "delete":
+			e.Before, e.Types = wasmRowImage(names, values[i])
+		case "update":
+			e.Before, _ = wasmRowImage(names, values[i])
+			e.After, e.Types = wasmRowImage(names, values[i+1])
+		}
+		r.wasmCallEvent("on_row", e)
+	}
+}
+
+// QueryWasm call wasm on_begin, on_commit or on_query for QUERY_EVENT
+func (r *Rebuilder) QueryWasm(queryEvent *replication.BinlogEvent, sql string) {
+	if sql == "" {
+		return
+	}
+	e := r.newWasmEvent(queryEvent)
+	ev := queryEvent.Event.(*replication.QueryEvent)
+	e.Schema = string(ev.Schema)
+	switch strings.ToUpper(sql) {
+	case "BEGIN":
+		r.wasmCallEvent("on_begin", e)
+		return
+	case "COMMIT":
+		// non-transactional engine or statement format commit without XID_EVENT
+		r.wasmCallEvent("on_commit", e)
+		return
+	}
+	e.Query = sql
+	e.Tables = r.QueryEventTables(queryEvent)
+	if len(e.Tables) > 0 {
+		e.Table = e.Tables[0]
+	}
+	r.wasmCallEvent("on_query", e)
+}
+
+// XidWasm call wasm on_commit(ptr, len)
+func (r *Rebuilder) XidWasm(event *replication.BinlogEvent) {
+	e := r.newWasmEvent(event)
+	e.Xid = event.Event.(*replication.XIDEvent).XID
+	r.wasmCallEvent("on_commit", e)
+}
+
+// closeWasmModule call wasm finalize and close runtime
+func (r *Rebuilder) closeWasmModule() {
+	if r.wasm.runtime == nil {
+		return
+	}
+	r.wasmCall("finalize", nil)
+	common.LogIfError(r.wasm.runtime.Close(context.Background()), "")
+	r.wasm.runtime, r.wasm.module = nil, nil
+}
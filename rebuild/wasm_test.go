@@ -0,0 +1,100 @@
+/*
+ * Copyright(c)  2019 Lianjia, Inc.  All Rights Reserved
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LianjiaTech/lightning/common"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// wasmEcho module emit the payload of on_row, on_commit as it is, alloc always return 1024
+var wasmEcho = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic, version
+	// type: (i32, i32) -> (), (i32) -> i32
+	0x01, 0x0b, 0x02, 0x60, 0x02, 0x7f, 0x7f, 0x00, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	// import: lightning.emit
+	0x02, 0x12, 0x01, 0x09, 'l', 'i', 'g', 'h', 't', 'n', 'i', 'n', 'g', 0x04, 'e', 'm', 'i', 't', 0x00, 0x00,
+	// function: alloc, echo
+	0x03, 0x03, 0x02, 0x01, 0x00,
+	// memory: 1 page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export: memory, alloc, on_row, on_commit
+	0x07, 0x27, 0x04,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x01,
+	0x06, 'o', 'n', '_', 'r', 'o', 'w', 0x00, 0x02,
+	0x09, 'o', 'n', '_', 'c', 'o', 'm', 'm', 'i', 't', 0x00, 0x02,
+	// code: alloc { i32.const 1024 }, echo { emit(local 0, local 1) }
+	0x0a, 0x10, 0x02,
+	0x05, 0x00, 0x41, 0x80, 0x08, 0x0b,
+	0x08, 0x00, 0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x0b,
+}
+
+func TestWasmPlugin(t *testing.T) {
+	r := New(&common.Config, &common.MasterInfo, nil)
+	path := filepath.Join(t.TempDir(), "echo.wasm")
+	if err := os.WriteFile(path, wasmEcho, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := r.loadWasmModule(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer r.closeWasmModule()
+
+	event := &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.UPDATE_ROWS_EVENTv2, Timestamp: 1, LogPos: 100},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{
+				Schema:     []byte("test"),
+				Table:      []byte("wasm"),
+				ColumnType: []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_BLOB},
+			},
+			Rows: [][]interface{}{{int32(1), []byte("a")}, {int32(-1), nil}},
+		},
+	}
+	xid := &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.XID_EVENT},
+		Event:  &replication.XIDEvent{XID: 7},
+	}
+	gtidOrg, threadOrg := r.currentGTID, r.currentThreadID
+	defer func() { r.currentGTID, r.currentThreadID = gtidOrg, threadOrg }()
+	r.currentGTID, r.currentThreadID = "", 0
+
+	out := common.CaptureOutput(func() {
+		r.RowsWasm(event)
+		r.XidWasm(xid)
+		// not exported, skip
+		r.QueryWasm(&replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+			Event:  &replication.QueryEvent{Query: []byte("TRUNCATE TABLE t")},
+		}, "TRUNCATE TABLE t")
+	})
+	expect := []string{
+		`{"type":"update","event_type":"UpdateRowsEventV2","timestamp":1,"server_id":0,"log_pos":100,"gtid":"","thread_id":0,` +
+			"\"table\":\"`test`.`wasm`\"," + `"schema":"test","name":"wasm","columns":["@0","@1"],` +
+			`"before":{"@0":1,"@1":"YQ=="},"after":{"@0":-1,"@1":null},"types":{"@0":"number","@1":"null"}}`,
+		`{"type":"xidevent","event_type":"XIDEvent","timestamp":0,"server_id":0,"log_pos":0,"gtid":"","thread_id":0,"xid":7}`,
+		``,
+	}
+	if out != strings.Join(expect, "\n") {
+		t.Errorf("want:\n%s\ngot:\n%s", strings.Join(expect, "\n"), out)
+	}
+}
@@ -0,0 +1,86 @@
+-- MySQL dump 10.13  Distrib 8.0.36, for Linux (x86_64)
+--
+-- Host: 127.0.0.1    Database: shop
+-- ------------------------------------------------------
+-- Server version	8.0.36
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8mb4 */;
+/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+
+--
+-- Current Database: `shop`
+--
+
+CREATE DATABASE /*!32312 IF NOT EXISTS*/ `shop` /*!40100 DEFAULT CHARACTER SET utf8mb4 */ /*!80016 DEFAULT ENCRYPTION='N' */;
+
+USE `shop`;
+
+--
+-- Table structure for table `orders`
+--
+
+DROP TABLE IF EXISTS `orders`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `orders` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `memo` varchar(64) CHARACTER SET gbk COLLATE gbk_chinese_ci DEFAULT 'a;b -- c',
+  `status` enum('new','paid') NOT NULL DEFAULT 'new',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB AUTO_INCREMENT=3 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci
+/*!50100 PARTITION BY HASH (`id`)
+PARTITIONS 4 */;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `embedding`
+--
+
+DROP TABLE IF EXISTS `embedding`;
+CREATE TABLE `embedding` (
+  `id` int NOT NULL,
+  `v` vector(3) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+/*!50003 SET @saved_cs_client      = @@character_set_client */ ;
+DELIMITER ;;
+/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `orders_bi` BEFORE INSERT ON `orders` FOR EACH ROW BEGIN
+  SET NEW.memo = 'x;y';
+END */;;
+DELIMITER ;
+/*!50003 SET character_set_client  = @saved_cs_client */ ;
+
+--
+-- Temporary view structure for view `paid`
+--
+
+DROP TABLE IF EXISTS `paid`;
+/*!50001 DROP VIEW IF EXISTS `paid`*/;
+/*!50001 CREATE VIEW `paid` AS SELECT 1 AS `id`*/;
+
+--
+-- Current Database: `crm`
+--
+
+USE `crm`;
+
+CREATE TABLE `user` (
+  `id` int NOT NULL,
+  `name` varchar(10) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+DELIMITER ;;
+CREATE DEFINER=`root`@`%` PROCEDURE `p`()
+BEGIN
+  CREATE TABLE tmp (id int);
+  SELECT 1;
+END ;;
+DELIMITER ;
+/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
+
+-- Dump completed on 2026-10-19 10:00:00
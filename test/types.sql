@@ -0,0 +1,47 @@
+-- column types rendering, rebuild TestTypeValues
+USE test;
+
+CREATE TABLE `enum_type` (
+  `id` int NOT NULL,
+  `v` enum('red','green','it''s') DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `set_type` (
+  `id` int NOT NULL,
+  `v` set('bold','italic','underline') DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `bit_type` (
+  `id` int NOT NULL,
+  `v` bit(7) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB;
+
+CREATE TABLE `year_type` (
+  `id` int NOT NULL,
+  `v` year DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB;
+
+CREATE TABLE `time_type` (
+  `id` int NOT NULL,
+  `a` time DEFAULT NULL,
+  `b` time(3) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB;
+
+CREATE TABLE `datetime_type` (
+  `id` int NOT NULL,
+  `a` datetime DEFAULT NULL,
+  `b` datetime(6) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB;
+
+CREATE TABLE `timestamp_type` (
+  `id` int NOT NULL,
+  `a` timestamp NULL DEFAULT NULL,
+  `b` timestamp(3) NULL DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB;